@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -16,55 +19,60 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-const (
-	DbUser     = "myuser"
-	DbPassword = "mypassword"
-	DbName     = "mydatabase"
-	DbHost     = "postgres"
-	DbPort     = "5432"
-)
-
 type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Tenant   string `json:"tenant,omitempty"`
 }
 
 type ShiftReceive struct {
-	Datum  string                   `json:"datum"`
-	Day    string                   `json:"day"`
-	Time   string                   `json:"time"`
-	Trade  bool                     `json:"trade"`
-	Uid    string                   `json:"uid"`
-	Search []map[string]interface{} `json:"search"`
+	Datum    string                   `json:"datum"`
+	Day      string                   `json:"day"`
+	Time     string                   `json:"time"`
+	Trade    bool                     `json:"trade"`
+	Uid      string                   `json:"uid"`
+	Team     string                   `json:"team,omitempty"`
+	Skills   []string                 `json:"skills,omitempty"`
+	Search   []map[string]interface{} `json:"search"`
+	Targets  []TradeTarget            `json:"targets"`
+	Released bool                     `json:"released,omitempty"`
+	Excluded []TradeExclusion         `json:"excluded,omitempty"`
 }
 
 type App struct {
-	DB *sql.DB
+	Store  Store
+	Config *Config
+	Events *eventHub
 }
 
 // Auth middleware
 func (app *App) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("sessionID")
-		if err != nil || !app.isValidSession(cookie.Value) {
-			w.WriteHeader(http.StatusUnauthorized)
-			_, err := w.Write([]byte("{\"message\": \"Unauthorized"))
-			if err != nil {
-				return
-			}
+		principal, err := app.resolvePrincipal(r)
+		if err != nil {
+			writeMessage(w, http.StatusUnauthorized, "Unauthorized")
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
 	})
 }
 
 func (app *App) isValidSession(sessionID string) bool {
-	var username string
-	err := app.DB.QueryRow("SELECT username FROM sessions WHERE sessionID=$1 AND timeout > NOW()", sessionID).Scan(&username)
+	_, err := app.Store.GetSession(sessionID)
 	return err == nil
 }
 
+// writeMessage writes a JSON message response with the given status code
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(map[string]string{"message": message})
+	if err != nil {
+		return
+	}
+}
+
 // Login handler
 func (app *App) loginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -83,34 +91,30 @@ func (app *App) handleLoginPost(w http.ResponseWriter, r *http.Request) {
 	var user User
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("{\"message\": \"Invalid request payload\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// The session is bound to the tenant of the account, a tenant given
+	// with the credentials has to match it
+	tenantID, err := app.Store.UserTenant(user.Username)
+	if err != nil || (user.Tenant != "" && user.Tenant != tenantID) {
+		writeMessage(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
+	store := app.Store.ForTenant(tenantID)
 
 	// Check user credentials against the database
-	var storedPassword string
-	err = app.DB.QueryRow("SELECT password FROM user_base WHERE username=$1", user.Username).Scan(&storedPassword)
+	storedPassword, err := store.PasswordHash(user.Username)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Invalid credentials\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
 	// Compare the stored hashed password with the provided password
 	err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(user.Password))
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Invalid credentials\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
@@ -118,60 +122,49 @@ func (app *App) handleLoginPost(w http.ResponseWriter, r *http.Request) {
 	sessionID := generateSessionID()
 
 	// Store the session in the database
-	timeout := time.Now().Add(24 * time.Hour) // 24 hour session timeout
-	_, err = app.DB.Exec("INSERT INTO sessions (sessionID, username, timeout) VALUES ($1, $2, $3)", sessionID, user.Username, timeout)
+	timeout := time.Now().Add(app.Config.Session.TTL)
+	err = store.CreateSession(Session{ID: sessionID, Tenant: tenantID, Username: user.Username, Expires: timeout})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to create session\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to create session")
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sessionID",
-		Value:    sessionID,
-		HttpOnly: true,
-		Path:     "/",
-	})
-	_, err = w.Write([]byte("{\"message\": \"Login successful\"}"))
-	if err != nil {
-		return
-	}
+	http.SetCookie(w, app.sessionCookie(sessionID, timeout))
+	writeMessage(w, http.StatusOK, "Login successful")
 }
 
 func (app *App) handleLoginPut(w http.ResponseWriter, r *http.Request) {
 	var user User
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("{\"message\": \"Invalid request payload\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	// Anyone may join the default tenant, the admins of other tenants add
+	// their users themselves
+	if user.Tenant != "" && user.Tenant != defaultTenant {
+		writeMessage(w, http.StatusForbidden, "Accounts of this tenant are created by its admins")
 		return
 	}
+	tenantID := defaultTenant
+	store := app.Store.ForTenant(tenantID)
 
 	// Hash the user's password before storing it
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to hash password\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to hash password")
 		return
 	}
 
 	// Store user credentials in the database
-	_, err = app.DB.Exec("INSERT INTO user_base (username, password) VALUES ($1, $2)", user.Username, string(hashedPassword))
+	err = store.CreateUser(user.Username, string(hashedPassword))
+	if errors.Is(err, errUserExists) {
+		writeMessage(w, http.StatusConflict, "User already exists")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to create user\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to create user")
 		return
 	}
 
@@ -179,27 +172,15 @@ func (app *App) handleLoginPut(w http.ResponseWriter, r *http.Request) {
 	sessionID := generateSessionID()
 
 	// Store the session in the database
-	timeout := time.Now().Add(24 * time.Hour) // 24 hour session timeout
-	_, err = app.DB.Exec("INSERT INTO sessions (sessionID, username, timeout) VALUES ($1, $2, $3)", sessionID, user.Username, timeout)
+	timeout := time.Now().Add(app.Config.Session.TTL)
+	err = store.CreateSession(Session{ID: sessionID, Tenant: tenantID, Username: user.Username, Expires: timeout})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to create session\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to create session")
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sessionID",
-		Value:    sessionID,
-		HttpOnly: true,
-		Path:     "/",
-	})
-	_, err = w.Write([]byte("{\"message\": \"User created and login successful\"}"))
-	if err != nil {
-		return
-	}
+	http.SetCookie(w, app.sessionCookie(sessionID, timeout))
+	writeMessage(w, http.StatusOK, "User created and login successful")
 }
 
 func (app *App) handleLoginGet(w http.ResponseWriter, r *http.Request) {
@@ -244,133 +225,89 @@ func (app *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
 func (app *App) handleLogoutPost(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("sessionID")
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Unauthorized\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	_, err = app.DB.Exec("DELETE FROM sessions WHERE sessionID=$1", cookie.Value)
+	err = app.Store.DeleteSession(cookie.Value)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to logout\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to logout")
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sessionID",
-		Value:    "",
-		HttpOnly: true,
-		Path:     "/",
-		MaxAge:   -1, // Delete cookie
-	})
-	_, err = w.Write([]byte("{\"message\": \"Logout successful\"}"))
-	if err != nil {
-		return
-	}
+	cookie = app.sessionCookie("", time.Time{})
+	cookie.MaxAge = -1 // Delete cookie
+	http.SetCookie(w, cookie)
+	writeMessage(w, http.StatusOK, "Logout successful")
 }
 
 // Private handler
 func (app *App) shiftHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		app.shiftHandlerGet(w, r)
+		principal, ok := requirePermission(w, r, permShiftsRead)
+		if !ok {
+			return
+		}
+		app.shiftHandlerGet(w, r, principal)
 	case http.MethodPost:
-		app.shiftHandlerPost(w, r)
+		principal, ok := requirePermission(w, r, permShiftsWrite)
+		if !ok {
+			return
+		}
+		app.shiftHandlerPost(w, r, principal)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func (app *App) shiftHandlerGet(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("sessionID")
-	if err != nil || !app.isValidSession(cookie.Value) {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Unauthorized"))
-		if err != nil {
-			return
-		}
-		return
-	}
+func (app *App) shiftHandlerGet(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	username := principal.Username
 
-	var username string
-	err = app.DB.QueryRow("SELECT username FROM sessions WHERE sessionID=$1", cookie.Value).Scan(&username)
+	types, err := app.Store.ShiftTypes()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to get username from session\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch shift types")
 		return
 	}
 
-	rows, err := app.DB.Query("SELECT shiftID, date, time, day, TRADE, search_early, search_evening, search_night FROM shifts WHERE username=$1", username)
+	stored, err := app.store(r).ListShifts(username)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to fetch shifts\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch shifts")
 		return
 	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-
-		}
-	}(rows)
 
 	var shifts []map[string]interface{}
-	for rows.Next() {
-		var shiftID, date, timeV, day string
-		var trade, searchEarly, searchEvening, searchNight bool
-		err := rows.Scan(&shiftID, &date, &timeV, &day, &trade, &searchEarly, &searchEvening, &searchNight)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err := w.Write([]byte("{\"message\": \"Failed to scan shift\"}"))
+	offersByDate := make(map[string]map[string]int)
+	for _, s := range stored {
+		// Offers only count within the shift's team
+		date := formatDate(s.Date)
+		offers, ok := offersByDate[s.Team+"/"+date]
+		if !ok {
+			offers, err = app.store(r).CountOffers(date, s.Team)
 			if err != nil {
+				writeMessage(w, http.StatusInternalServerError, "Failed to count offers")
 				return
 			}
-			return
+			offersByDate[s.Team+"/"+date] = offers
 		}
 
-		var earlyCount string
-		var lateCount string
-		var nightCount string
-
-		err = app.DB.QueryRow("SELECT count(*) FROM shifts WHERE date=$1 AND trade=true AND time='früh'", date).Scan(&earlyCount)
-		err = app.DB.QueryRow("SELECT count(*) FROM shifts WHERE date=$1 AND trade=true AND time='spät'", date).Scan(&lateCount)
-		err = app.DB.QueryRow("SELECT count(*) FROM shifts WHERE date=$1 AND trade=true AND time='nacht'", date).Scan(&nightCount)
-
 		shift := map[string]interface{}{
-			"uid":   shiftID,
-			"datum": date,
-			"time":  timeV,
-			"day":   day,
-			"trade": trade,
-			"search": []map[string]interface{}{
-				{"selected": searchEarly, "name": "früh", "offers": earlyCount},
-				{"selected": searchEvening, "name": "spät", "offers": lateCount},
-				{"selected": searchNight, "name": "nacht", "offers": nightCount},
-			},
+			"uid":     s.ID,
+			"datum":   date,
+			"time":    s.Time,
+			"team":    s.Team,
+			"skills":  s.Skills,
+			"day":     weekdayName(s.Date),
+			"trade":   s.Trade,
+			"search":  searchList(types, s.Search, offers),
+			"targets": s.Targets,
+		}
+		if s.Released {
+			shift["released"] = true
 		}
 		shifts = append(shifts, shift)
 	}
 
-	if err = rows.Err(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to iterate over shifts\"}"))
-		if err != nil {
-			return
-		}
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(shifts)
 	if err != nil {
@@ -378,54 +315,95 @@ func (app *App) shiftHandlerGet(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (app *App) shiftHandlerPost(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("sessionID")
-	if err != nil || !app.isValidSession(cookie.Value) {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Unauthorized"))
-		if err != nil {
-			return
-		}
+func (app *App) shiftHandlerPost(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	username := principal.Username
+
+	var shift ShiftReceive
+	err := json.NewDecoder(r.Body).Decode(&shift)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	var username string
-	err = app.DB.QueryRow("SELECT username FROM sessions WHERE sessionID=$1", cookie.Value).Scan(&username)
+	types, err := app.Store.ShiftTypes()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to get username from session\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
 		return
 	}
 
-	var shift ShiftReceive
-	err = json.NewDecoder(r.Body).Decode(&shift)
+	// New shifts start without trade offers, only date and slot are taken over
+	shift.Trade, shift.Search, shift.Targets = false, nil, nil
+	input, errs := parseShift(shift, types, time.Now(), isPastAllowed(principal))
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	input.Team, errs, err = app.resolveShiftTeam(r, principal, shift.Team, true)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("{\"message\": \"Invalid request payload\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to get team")
+		return
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
 		return
 	}
 
 	shiftID := generateSessionID() // Use generateSessionID to create a unique ID for the shift
 
-	_, err = app.DB.Exec("INSERT INTO shifts (shiftID, username, date, time, day, TRADE, search_early, search_evening, search_night) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
-		shiftID, username, shift.Datum, shift.Time, shift.Day, false, false, false, false)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to add shift\"}"))
+	// A slot is worked once per date, the working time rules of the tenant
+	// are checked against the user's schedule
+	var conflict *Shift
+	var violations []RuleViolation
+	var events []Event
+	message := "Failed to get rules"
+	err = app.store(r).Atomic(func(tx Store) error {
+		rules, err := app.rules(tx)
 		if err != nil {
-			return
+			return err
 		}
+		message = "Failed to fetch shifts"
+		schedule, err := tx.ListShifts(username)
+		if err != nil {
+			return err
+		}
+		newShift := input.shift(shiftID, username)
+		conflict = slotConflict(newShift, schedule)
+		if conflict != nil {
+			return nil
+		}
+		violations = rules.check(newShift, schedule)
+		if violations != nil {
+			return nil
+		}
+
+		message = "Failed to add shift"
+		if err := tx.CreateShift(newShift); err != nil {
+			return err
+		}
+		events = append(events, shiftEvent(requestTenant(r), "created", newShift))
+		return nil
+	})
+	if errors.Is(err, errShiftConflict) {
+		writeMessage(w, http.StatusConflict, "User already works the slot on that date")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, message)
+		return
+	}
+	if conflict != nil {
+		writeShiftConflict(w, conflict)
+		return
+	}
+	if violations != nil {
+		writeRuleViolations(w, violations)
 		return
 	}
+	app.publish(events...)
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	_, err = w.Write([]byte("{\"message\": \"{\"message\": \"Shift added successfully\"}"))
+	err = json.NewEncoder(w).Encode(map[string]string{"message": "Shift added successfully", "uid": shiftID})
 	if err != nil {
 		return
 	}
@@ -435,59 +413,71 @@ func (app *App) shiftHandlerPost(w http.ResponseWriter, r *http.Request) {
 func (app *App) shiftByIDHandler(w http.ResponseWriter, r *http.Request) {
 	pathSegments := strings.Split(r.URL.Path, "/")
 	if len(pathSegments) < 3 {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("{\"message\": \"Invalid shift ID\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusBadRequest, "Invalid shift ID")
 		return
 	}
 	shiftID := pathSegments[2]
 
 	switch r.Method {
 	case http.MethodGet:
-		app.shiftByIDGet(w, r, shiftID)
+		principal, ok := requirePermission(w, r, permShiftsRead)
+		if !ok {
+			return
+		}
+		app.shiftByIDGet(w, r, principal, shiftID)
 	case http.MethodPut:
-		app.shiftByIDPut(w, r, shiftID)
+		principal, ok := requirePermission(w, r, permShiftsWrite)
+		if !ok {
+			return
+		}
+		app.shiftByIDPut(w, r, principal, shiftID)
 	case http.MethodDelete:
-		app.shiftByIDDelete(w, r, shiftID)
+		principal, ok := requirePermission(w, r, permShiftsWrite)
+		if !ok {
+			return
+		}
+		app.shiftByIDDelete(w, r, principal, shiftID)
 	case http.MethodPatch:
-		app.shiftByIDPatch(w, r, shiftID)
+		principal, ok := requirePermission(w, r, permShiftsTrade)
+		if !ok {
+			return
+		}
+		app.shiftByIDPatch(w, r, principal, shiftID)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func (app *App) shiftByIDGet(w http.ResponseWriter, r *http.Request, shiftID string) {
-	cookie, err := r.Cookie("sessionID")
-	if err != nil || !app.isValidSession(cookie.Value) {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Unauthorized"))
-		if err != nil {
-			return
+func (app *App) shiftByIDGet(w http.ResponseWriter, r *http.Request, principal *Principal, shiftID string) {
+	stored, err := app.store(r).GetShift(principal.shiftScope(), shiftID)
+	if err != nil {
+		if errors.Is(err, errShiftNotFound) {
+			writeMessage(w, http.StatusNotFound, "Shift not found")
+		} else {
+			writeMessage(w, http.StatusInternalServerError, "Failed to get shift")
 		}
 		return
 	}
 
-	var shift ShiftReceive
-	err = app.DB.QueryRow("SELECT date, time, day, TRADE, search_early, search_evening, search_night FROM shifts WHERE shiftID=$1", shiftID).Scan(&shift.Datum, &shift.Time, &shift.Day, &shift.Trade, &shift.Search[0], &shift.Search[1], &shift.Search[2])
+	types, err := app.Store.ShiftTypes()
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
-			_, err := w.Write([]byte("{\"message\": \"Shift not found\"}"))
-			if err != nil {
-				return
-			}
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err := w.Write([]byte("{\"message\": \"Failed to get shift\"}"))
-			if err != nil {
-				return
-			}
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
 		return
 	}
 
+	shift := ShiftReceive{
+		Datum:    formatDate(stored.Date),
+		Day:      weekdayName(stored.Date),
+		Time:     stored.Time,
+		Trade:    stored.Trade,
+		Uid:      stored.ID,
+		Team:     stored.Team,
+		Skills:   stored.Skills,
+		Search:   searchList(types, stored.Search, nil),
+		Targets:  stored.Targets,
+		Released: stored.Released,
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(shift)
 	if err != nil {
@@ -495,279 +485,307 @@ func (app *App) shiftByIDGet(w http.ResponseWriter, r *http.Request, shiftID str
 	}
 }
 
-func (app *App) shiftByIDPut(w http.ResponseWriter, r *http.Request, shiftID string) {
-	cookie, err := r.Cookie("sessionID")
-	if err != nil || !app.isValidSession(cookie.Value) {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Unauthorized"))
-		if err != nil {
-			return
-		}
-		return
-	}
-
+func (app *App) shiftByIDPut(w http.ResponseWriter, r *http.Request, principal *Principal, shiftID string) {
 	var shift ShiftReceive
-	err = json.NewDecoder(r.Body).Decode(&shift)
+	err := json.NewDecoder(r.Body).Decode(&shift)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("{\"message\": \"Invalid request payload\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	_, err = app.DB.Exec("UPDATE shifts SET date=$1, time=$2, day=$3, TRADE=$4, search_early=$5, search_evening=$6, search_night=$7 WHERE shiftID=$8",
-		shift.Datum, shift.Time, shift.Day, shift.Trade,
-		getSearchValue(shift.Search, "früh"), getSearchValue(shift.Search, "spät"), getSearchValue(shift.Search, "nacht"),
-		shiftID)
+	types, err := app.Store.ShiftTypes()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to update shift\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("{\"message\": \"Shift updated successfully\"}"))
+	input, errs := parseShift(shift, types, time.Now(), isPastAllowed(principal))
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	keepSkills(principal, input)
+	input.Team, errs, err = app.resolveShiftTeam(r, principal, shift.Team, false)
 	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get team")
+		return
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
 		return
 	}
-}
 
-func (app *App) shiftByIDDelete(w http.ResponseWriter, r *http.Request, shiftID string) {
-	cookie, err := r.Cookie("sessionID")
-	if err != nil || !app.isValidSession(cookie.Value) {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Unauthorized"))
+	var conflict *Shift
+	var violations []RuleViolation
+	var events []Event
+	err = app.store(r).Atomic(func(tx Store) error {
+		stored, err := tx.GetShift(principal.shiftScope(), shiftID)
 		if err != nil {
-			return
+			return err
 		}
+		updated := input.shift(shiftID, stored.Username)
+		conflict, violations, err = app.checkMove(tx, *stored, updated)
+		if err != nil || conflict != nil || violations != nil {
+			return err
+		}
+		if err := tx.UpdateShift(principal.shiftScope(), updated); err != nil {
+			return err
+		}
+		events = shiftChanged(requestTenant(r), *stored, updated)
+		return nil
+	})
+	if conflict != nil {
+		writeShiftConflict(w, conflict)
+		return
+	}
+	if violations != nil {
+		writeRuleViolations(w, violations)
 		return
 	}
-
-	_, err = app.DB.Exec("DELETE FROM shifts WHERE shiftID=$1", shiftID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to delete shift\"}"))
-		if err != nil {
+		if errors.Is(err, errShiftConflict) {
+			writeMessage(w, http.StatusConflict, "User already works the slot on that date")
 			return
 		}
+		if errors.Is(err, errShiftNotFound) {
+			writeMessage(w, http.StatusNotFound, "Shift not found")
+		} else {
+			writeMessage(w, http.StatusInternalServerError, "Failed to update shift")
+		}
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("{\"message\": \"Shift deleted successfully\"}"))
-	if err != nil {
-		return
-	}
+	app.publish(events...)
+
+	writeMessage(w, http.StatusOK, "Shift updated successfully")
 }
 
-func (app *App) shiftByIDPatch(w http.ResponseWriter, r *http.Request, shiftID string) {
-	cookie, err := r.Cookie("sessionID")
-	if err != nil || !app.isValidSession(cookie.Value) {
-		w.WriteHeader(http.StatusUnauthorized)
-		_, err := w.Write([]byte("{\"message\": \"Unauthorized"))
+func (app *App) shiftByIDDelete(w http.ResponseWriter, r *http.Request, principal *Principal, shiftID string) {
+	var events []Event
+	err := app.store(r).Atomic(func(tx Store) error {
+		stored, err := tx.GetShift(principal.shiftScope(), shiftID)
 		if err != nil {
-			return
+			return err
 		}
+		if err := tx.DeleteShift(principal.shiftScope(), shiftID); err != nil {
+			return err
+		}
+		events = append(events, shiftEvent(requestTenant(r), "deleted", *stored))
+		if stored.Trade {
+			events = append(events, offersEvent(requestTenant(r), *stored))
+		}
+		return nil
+	})
+	if errors.Is(err, errShiftNotFound) {
+		writeMessage(w, http.StatusNotFound, "Shift not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to delete shift")
 		return
 	}
 
+	app.publish(events...)
+
+	writeMessage(w, http.StatusOK, "Shift deleted successfully")
+}
+
+func (app *App) shiftByIDPatch(w http.ResponseWriter, r *http.Request, principal *Principal, shiftID string) {
 	var shift ShiftReceive
-	err = json.NewDecoder(r.Body).Decode(&shift)
+	err := json.NewDecoder(r.Body).Decode(&shift)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("{\"message\": \"Invalid request payload\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 
-	tx, err := app.DB.Begin()
+	types, err := app.Store.ShiftTypes()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to begin transaction\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
 		return
 	}
 
-	// Update the current shift
-	query := "UPDATE shifts SET date=$1, time=$2, day=$3, TRADE=$4, search_early=$5, search_evening=$6, search_night=$7 WHERE shiftID=$8"
-	_, err = tx.Exec(query, shift.Datum, shift.Time, shift.Day, shift.Trade,
-		getSearchValue(shift.Search, "früh"), getSearchValue(shift.Search, "spät"), getSearchValue(shift.Search, "nacht"),
-		shiftID)
+	input, errs := parseShift(shift, types, time.Now(), isPastAllowed(principal))
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	keepSkills(principal, input)
+	input.Team, errs, err = app.resolveShiftTeam(r, principal, shift.Team, false)
 	if err != nil {
-		err := tx.Rollback()
-		if err != nil {
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err = w.Write([]byte("{\"message\": \"Failed to update shift\"}"))
-		if err != nil {
-			return
-		}
+		writeMessage(w, http.StatusInternalServerError, "Failed to get team")
 		return
 	}
-
-	if shift.Trade {
-		// Check for a matching shift to trade with
-		var matchingShiftID, matchingUsername string
-		err = tx.QueryRow(`
-			SELECT shiftID, username FROM shifts
-			WHERE date=$1 AND TRADE=true
-			AND ((search_early=true AND $2='früh') OR (search_evening=true AND $2='spät') OR (search_night=true AND $2='nacht'))
-			AND shiftID <> $3
-		`, shift.Datum, shift.Time, shiftID).Scan(&matchingShiftID, &matchingUsername)
-		if errors.Is(err, sql.ErrNoRows) {
-			err = nil // No matching shift found, not an error
-		} else if err != nil {
-			err := tx.Rollback()
-			if err != nil {
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err = w.Write([]byte("{\"message\": \"Failed to find matching shift\"}"))
-			if err != nil {
-				return
-			}
-			return
-		} else {
-			// Swap usernames
-			var currentUsername string
-			err = tx.QueryRow("SELECT username FROM shifts WHERE shiftID=$1", shiftID).Scan(&currentUsername)
-			if err != nil {
-				err := tx.Rollback()
-				if err != nil {
-					return
-				}
-				w.WriteHeader(http.StatusInternalServerError)
-				_, err = w.Write([]byte("{\"message\": \"Failed to get current username\"}"))
-				if err != nil {
-					return
-				}
-				return
-			}
-
-			_, err = tx.Exec("UPDATE shifts SET username=$1, trade=false, search_early=false, search_evening=false, search_night=false WHERE shiftID=$2", matchingUsername, shiftID)
-			if err != nil {
-				err := tx.Rollback()
-				if err != nil {
-					return
-				}
-				w.WriteHeader(http.StatusInternalServerError)
-				_, err = w.Write([]byte("{\"message\": \"Failed to update shift with new username\"}"))
-				if err != nil {
-					return
-				}
-				return
-			}
-
-			_, err = tx.Exec("UPDATE shifts SET username=$1, trade=false, search_early=false, search_evening=false, search_night=false WHERE shiftID=$2", currentUsername, matchingShiftID)
-			if err != nil {
-				err := tx.Rollback()
-				if err != nil {
-					return
-				}
-				w.WriteHeader(http.StatusInternalServerError)
-				_, err = w.Write([]byte("{\"message\": \"Failed to update matching shift with new username\"}"))
-				if err != nil {
-					return
-				}
-				return
-			}
-		}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
 	}
 
-	if err := tx.Commit(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte("{\"message\": \"Failed to commit transaction\"}"))
-		if err != nil {
-			return
-		}
+	patch, err := app.patchShift(r, principal, shiftID, input)
+	if patch.conflict != nil {
+		writeShiftConflict(w, patch.conflict)
 		return
 	}
-
-	// Return the updated shift to the frontend
-	updatedShift := ShiftReceive{
-		Datum: shift.Datum,
-		Day:   shift.Day,
-		Time:  shift.Time,
-		Trade: false, // trade is set to false after swap
-		Uid:   shiftID,
-		Search: []map[string]interface{}{
-			{"name": "früh", "selected": getSearchValue(shift.Search, "früh")},
-			{"name": "spät", "selected": getSearchValue(shift.Search, "spät")},
-			{"name": "nacht", "selected": getSearchValue(shift.Search, "nacht")},
-		},
+	if patch.violations != nil {
+		writeRuleViolations(w, patch.violations)
+		return
+	}
+	if err != nil {
+		status, message := patchFailure(patch, err)
+		writeMessage(w, status, message)
+		return
 	}
 
+	// Return the updated shift to the frontend
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(updatedShift)
+	err = json.NewEncoder(w).Encode(patch.shift(shiftID, input, types))
 	if err != nil {
 		return
 	}
 }
 
-// Helper function to get search value
-func getSearchValue(search []map[string]interface{}, name string) bool {
-	for _, item := range search {
-		if item["name"] == name {
-			return item["selected"].(bool)
+// shiftPatch is the outcome of updating a shift through PATCH or a trade
+// intent
+type shiftPatch struct {
+	conflict   *Shift // the shift already taking the slot
+	violations []RuleViolation
+	excluded   []TradeExclusion
+	events     []Event
+	message    string // describes the step that failed
+}
+
+// patchShift updates a shift and, if it is offered, proposes the shortest
+// trade that leads back to it; the events are published once committed
+func (app *App) patchShift(r *http.Request, principal *Principal, shiftID string, input *ShiftInput) (*shiftPatch, error) {
+	patch := &shiftPatch{message: "Failed to update shift"}
+	err := app.store(r).Atomic(func(tx Store) error {
+		stored, err := tx.GetShift(principal.shiftScope(), shiftID)
+		if err != nil {
+			return err
+		}
+
+		// Update the current shift unless it moves onto a slot its owner
+		// already works or breaks the working time rules
+		if input.Skills == nil {
+			input.Skills = stored.Skills
+		}
+		updated := input.shift(shiftID, stored.Username)
+		patch.conflict, patch.violations, err = app.checkMove(tx, *stored, updated)
+		if err != nil || patch.conflict != nil || patch.violations != nil {
+			return err
+		}
+		// Released shifts are claimed rather than swapped, shifts picked up
+		// without giveback stay with their owner
+		if input.Trade && stored.Released {
+			return errShiftReleased
 		}
+		if input.Trade && stored.NoGiveback && !principal.can(permShiftsManage) {
+			return errNoGiveback
+		}
+		err = tx.UpdateShift(principal.shiftScope(), updated)
+		if err != nil {
+			return err
+		}
+		patch.events = shiftChanged(requestTenant(r), *stored, updated)
+		if !input.Trade {
+			return nil
+		}
+
+		patch.message = "Failed to expire trades"
+		err = tx.ExpireTrades()
+		if err != nil {
+			return err
+		}
+
+		// Look for the shortest chain of trade-enabled shifts that leads back to this one
+		patch.message = "Failed to find matching shift"
+		nodes, err := tx.TradeGraph()
+		if err != nil {
+			return err
+		}
+		rules, err := app.rules(tx)
+		if err != nil {
+			return err
+		}
+
+		// Swaps that need a skill the receiver lacks or break the working time
+		// rules are skipped, the response explains why shifts were left out
+		check := newSwapCheck(tx, rules)
+		patch.excluded = tradeExclusions(nodes, shiftID, check.violations)
+		cycle := findShortestCycle(nodes, shiftID, check.allows)
+		if check.err != nil {
+			return check.err
+		}
+
+		// A match only proposes the trade, the swap runs once every owner accepted
+		if cycle == nil {
+			return nil
+		}
+		patch.message = "Failed to propose trade"
+		tradeID, err := tx.CreateTrade(cycle, app.Config.Trade.ProposalTTL)
+		if err != nil {
+			return err
+		}
+		trade, err := tx.GetTrade(tradeID)
+		if err != nil {
+			return err
+		}
+		patch.events = append(patch.events, tradeEvent(requestTenant(r), trade))
+		return nil
+	})
+	if err != nil || patch.conflict != nil || patch.violations != nil {
+		return patch, err
 	}
-	return false
+	app.publish(patch.events...)
+	return patch, nil
 }
 
-// Initialize the database
-func initDB() *sql.DB {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", DbHost, DbPort, DbUser, DbPassword, DbName)
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		log.Fatal(err)
+// shift returns the patched shift as sent to the frontend
+func (patch *shiftPatch) shift(shiftID string, input *ShiftInput, types []ShiftType) ShiftReceive {
+	return ShiftReceive{
+		Datum:    input.Datum(),
+		Day:      weekdayName(input.Date),
+		Time:     input.Type.Name,
+		Trade:    input.Trade, // trade stays enabled until a proposal is accepted
+		Uid:      shiftID,
+		Team:     input.Team,
+		Skills:   input.Skills,
+		Search:   searchList(types, searchedSet(input.Searched), nil),
+		Targets:  input.Targets,
+		Excluded: patch.excluded,
 	}
+}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS user_base (
-			username TEXT PRIMARY KEY,
-			password TEXT NOT NULL
-		)
-	`)
-	if err != nil {
-		log.Fatal(err)
+// patchFailure returns the status and message of a failed shift patch
+func patchFailure(patch *shiftPatch, err error) (int, string) {
+	switch {
+	case errors.Is(err, errShiftConflict):
+		return http.StatusConflict, "User already works the slot on that date"
+	case errors.Is(err, errShiftReleased):
+		return http.StatusConflict, "Shift is released to the open shifts, withdraw it to trade it"
+	case errors.Is(err, errNoGiveback):
+		return http.StatusConflict, "Shift was picked up without giveback"
+	case errors.Is(err, errShiftNotFound):
+		return http.StatusNotFound, "Shift not found"
+	default:
+		return http.StatusInternalServerError, patch.message
 	}
+}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS sessions (
-			sessionID TEXT PRIMARY KEY,
-			username TEXT NOT NULL,
-			timeout TIMESTAMP NOT NULL,
-			FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE 
-		)
-	`)
+// Initialize the database
+func initDB(config DatabaseConfig) *sql.DB {
+	db, err := sql.Open(config.Driver, config.connectionString())
 	if err != nil {
 		log.Fatal(err)
 	}
+	// SQLite allows a single writer, transactions queue up on the one connection
+	if config.Driver == driverSQLite {
+		config.MaxOpenConns, config.MaxIdleConns = 1, 1
+	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS shifts (
-			shiftID TEXT PRIMARY KEY,
-			username TEXT,
-			date TEXT NOT NULL,
-			time TEXT NOT NULL,
-			day TEXT NOT NULL,
-			TRADE BOOLEAN default false,
-			search_early BOOLEAN default false,
-			search_evening BOOLEAN default false,
-			search_night BOOLEAN default false,
-			FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE 				  
-		)
-	`)
+	err = db.Ping()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -775,6 +793,20 @@ func initDB() *sql.DB {
 	return db
 }
 
+// sessionCookie builds the session cookie with the configured flags
+func (app *App) sessionCookie(sessionID string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     "sessionID",
+		Value:    sessionID,
+		HttpOnly: true,
+		Path:     "/",
+		Domain:   app.Config.Session.CookieDomain,
+		Expires:  expires,
+		Secure:   app.Config.Session.CookieSecure,
+		SameSite: app.Config.Session.sameSite(),
+	}
+}
+
 // Generate a new session ID
 func generateSessionID() string {
 	b := make([]byte, 16)
@@ -785,9 +817,50 @@ func generateSessionID() string {
 	return hex.EncodeToString(b)
 }
 
+// routes registers the handlers of all endpoints
+func (app *App) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", app.loginHandler)
+	mux.HandleFunc("/logout", app.logoutHandler)
+	mux.Handle("/shifts", app.authMiddleware(http.HandlerFunc(app.shiftHandler)))
+	mux.Handle("/shifts/", app.authMiddleware(http.HandlerFunc(app.shiftByIDHandler))) // Note the trailing slash
+	mux.Handle("/shifts/ws", app.authMiddleware(http.HandlerFunc(app.socketHandler)))
+	mux.Handle("/shifts/bulk", app.authMiddleware(http.HandlerFunc(app.shiftBulkHandler)))
+	mux.Handle("/trades", app.authMiddleware(http.HandlerFunc(app.tradeHandler)))
+	mux.Handle("/trades/", app.authMiddleware(http.HandlerFunc(app.tradeByIDHandler)))
+	mux.Handle("/open-shifts", app.authMiddleware(http.HandlerFunc(app.openShiftHandler)))
+	mux.Handle("/open-shifts/", app.authMiddleware(http.HandlerFunc(app.openShiftByIDHandler)))
+	mux.Handle("/events", app.authMiddleware(http.HandlerFunc(app.eventHandler)))
+	mux.Handle("/calendar", app.authMiddleware(http.HandlerFunc(app.calendarHandler)))
+	mux.HandleFunc("/calendar/", app.calendarFeedHandler)
+	mux.Handle("/roster/import", app.authMiddleware(http.HandlerFunc(app.rosterImportHandler)))
+	mux.Handle("/shift-types", app.authMiddleware(http.HandlerFunc(app.shiftTypeHandler)))
+	mux.Handle("/shift-types/", app.authMiddleware(http.HandlerFunc(app.shiftTypeByNameHandler)))
+	mux.Handle("/admin/users", app.authMiddleware(http.HandlerFunc(app.adminUserHandler)))
+	mux.Handle("/admin/users/", app.authMiddleware(http.HandlerFunc(app.adminUserByNameHandler)))
+	mux.Handle("/teams", app.authMiddleware(http.HandlerFunc(app.teamHandler)))
+	mux.Handle("/teams/", app.authMiddleware(http.HandlerFunc(app.teamByNameHandler)))
+	mux.Handle("/rotations", app.authMiddleware(http.HandlerFunc(app.rotationHandler)))
+	mux.Handle("/rotations/", app.authMiddleware(http.HandlerFunc(app.rotationByNameHandler)))
+	mux.Handle("/admin/teams", app.authMiddleware(http.HandlerFunc(app.adminTeamHandler)))
+	mux.Handle("/admin/teams/", app.authMiddleware(http.HandlerFunc(app.adminTeamByNameHandler)))
+	mux.Handle("/admin/tenants", app.authMiddleware(http.HandlerFunc(app.adminTenantHandler)))
+	mux.Handle("/admin/rules", app.authMiddleware(http.HandlerFunc(app.adminRulesHandler)))
+	return mux
+}
+
 // Main function
 func main() {
-	db := initDB()
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file")
+	flag.Parse()
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+	log.Printf("effective configuration:\n%s", config.redacted())
+
+	db := initDB(config.Database)
 	defer func(db *sql.DB) {
 		err := db.Close()
 		if err != nil {
@@ -795,13 +868,48 @@ func main() {
 		}
 	}(db)
 
-	app := &App{DB: db}
+	// `main migrate up|down|status [steps]` only manages the schema
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		err := runMigrateCommand(db, config.Database.Driver, args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = migrateUp(context.Background(), db, config.Database.Driver, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := &App{Store: newSQLStore(db, config.Database.Driver), Config: config, Events: newEventHub()}
+
+	// `main import [flags] file` applies a roster file without serving
+	if args := flag.Args(); len(args) > 0 && args[0] == "import" {
+		err := runImportCommand(app, args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if config.Events.PostgresNotify {
+		err := app.Events.bridgePostgres(db, config.Database.connectionString())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	http.HandleFunc("/login", app.loginHandler)
-	http.HandleFunc("/logout", app.logoutHandler)
-	http.Handle("/shifts", app.authMiddleware(http.HandlerFunc(app.shiftHandler)))
-	http.Handle("/shifts/", app.authMiddleware(http.HandlerFunc(app.shiftByIDHandler))) // Note the trailing slash
+	// Grant the admin and operator roles to the configured user so roles
+	// and tenants can be managed
+	if config.AdminUser != "" {
+		for _, role := range []string{roleAdmin, roleOperator} {
+			err := app.Store.GrantRole(config.AdminUser, role)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
-	fmt.Println("Server is running on port 4010")
-	log.Fatal(http.ListenAndServe(":4010", nil))
+	fmt.Println("Server is running on", config.Server.ListenAddress)
+	log.Fatal(http.ListenAndServe(config.Server.ListenAddress, app.routes()))
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type UserRoles struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+// Admin handler for /admin/users
+func (app *App) adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permUsersManage); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.adminUserGet(w, r)
+	case http.MethodPost:
+		app.adminUserPost(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) adminUserGet(w http.ResponseWriter, r *http.Request) {
+	usernames, err := app.store(r).Usernames()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch users")
+		return
+	}
+
+	users := []UserRoles{}
+	for _, username := range usernames {
+		roles, err := app.store(r).UserRoles(username)
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to get user roles")
+			return
+		}
+		users = append(users, UserRoles{Username: username, Roles: roles})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(users)
+	if err != nil {
+		return
+	}
+}
+
+// adminUserPost creates an account in the admin's tenant, the only way into
+// a tenant other than the default one
+func (app *App) adminUserPost(w http.ResponseWriter, r *http.Request) {
+	var user User
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if user.Username == "" || user.Password == "" {
+		writeMessage(w, http.StatusBadRequest, "Invalid user: username and password are required")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to hash password")
+		return
+	}
+	err = app.store(r).CreateUser(user.Username, string(hashedPassword))
+	if errors.Is(err, errUserExists) {
+		writeMessage(w, http.StatusConflict, "User already exists")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to create user")
+		return
+	}
+
+	roles, err := app.store(r).UserRoles(user.Username)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get user roles")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(UserRoles{Username: user.Username, Roles: roles})
+	if err != nil {
+		return
+	}
+}
+
+// Admin handler for /admin/users/{username}/roles and /admin/users/{username}/skills
+func (app *App) adminUserByNameHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permUsersManage); !ok {
+		return
+	}
+
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) != 4 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	username := pathSegments[2]
+
+	switch {
+	case pathSegments[3] == "roles" && r.Method == http.MethodGet:
+		app.adminUserRolesGet(w, r, username)
+	case pathSegments[3] == "roles" && r.Method == http.MethodPut:
+		app.adminUserRolesPut(w, r, username)
+	case pathSegments[3] == "skills" && r.Method == http.MethodGet:
+		app.adminUserSkillsGet(w, r, username)
+	case pathSegments[3] == "skills" && r.Method == http.MethodPut:
+		app.adminUserSkillsPut(w, r, username)
+	case pathSegments[3] == "roles" || pathSegments[3] == "skills":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (app *App) adminUserRolesGet(w http.ResponseWriter, r *http.Request, username string) {
+	roles, err := app.store(r).UserRoles(username)
+	if errors.Is(err, errUserNotFound) {
+		writeMessage(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get user roles")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(UserRoles{Username: username, Roles: roles})
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) adminUserRolesPut(w http.ResponseWriter, r *http.Request, username string) {
+	var body UserRoles
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || len(body.Roles) == 0 {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	principal, _ := principalFromContext(r.Context())
+	for _, role := range body.Roles {
+		if !isKnownRole(role) {
+			writeMessage(w, http.StatusBadRequest, "Unknown role "+role)
+			return
+		}
+		// Operators manage all tenants, only they may appoint others
+		if role == roleOperator && !principal.can(permTenantsManage) {
+			writeMessage(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+	}
+
+	err = app.store(r).SetUserRoles(username, body.Roles)
+	if errors.Is(err, errUserNotFound) {
+		writeMessage(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to update user roles")
+		return
+	}
+
+	roles, err := app.store(r).UserRoles(username)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get user roles")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(UserRoles{Username: username, Roles: roles})
+	if err != nil {
+		return
+	}
+}
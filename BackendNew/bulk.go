@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxOccurrences limits the shifts a single bulk request creates
+const maxOccurrences = 366
+
+// Results of the occurrences of a bulk request
+const (
+	occurrenceCreated   = "created"
+	occurrenceConflict  = "conflict"
+	occurrenceViolation = "violation"
+	occurrenceInvalid   = "invalid"
+)
+
+// BulkShiftReceive describes a series of shifts starting at Datum, either
+// an RRULE repeating the slot Time or a rotation that is repeated until
+// Until. Rotation days without a slot, or with "frei", are days off.
+type BulkShiftReceive struct {
+	Datum    string   `json:"datum"`
+	Time     string   `json:"time,omitempty"`
+	RRule    string   `json:"rrule,omitempty"`
+	Rotation []string `json:"rotation,omitempty"`
+	Until    string   `json:"until,omitempty"`
+	Team     string   `json:"team,omitempty"`
+	Skills   []string `json:"skills,omitempty"`
+}
+
+// Occurrence is the result of a single shift of a bulk request
+type Occurrence struct {
+	Datum   string `json:"datum"`
+	Time    string `json:"time"`
+	Status  string `json:"status"`
+	Uid     string `json:"uid,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Conflict is the ID of the shift the occurrence clashes with, if any
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// slotDate is a date and slot of an expanded series
+type slotDate struct {
+	Date time.Time
+	Time string
+}
+
+// Recurrence is the subset of RFC 5545 recurrence rules shifts repeat by
+type Recurrence struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []time.Weekday
+	ByMonthDay []int
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// parseRRule parses a DAILY, WEEKLY or MONTHLY rule ending with COUNT or
+// UNTIL, e.g. FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR;COUNT=30
+func parseRRule(value string) (*Recurrence, error) {
+	rule := &Recurrence{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(value), "RRULE:"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(value)
+			if err == nil && rule.Interval < 1 {
+				err = errors.New("must be positive")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(value)
+			if err == nil && rule.Count < 1 {
+				err = errors.New("must be positive")
+			}
+		case "UNTIL":
+			rule.Until, err = time.ParseInLocation("20060102", value[:min(len(value), 8)], time.Local)
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				weekday, ok := rruleWeekdays[strings.ToUpper(day)]
+				if !ok {
+					err = fmt.Errorf("unsupported weekday %q", day)
+					break
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(value, ",") {
+				monthDay, convErr := strconv.Atoi(day)
+				if convErr != nil || monthDay < 1 || monthDay > 31 {
+					err = fmt.Errorf("unsupported day of the month %q", day)
+					break
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, monthDay)
+			}
+		case "WKST":
+		default:
+			err = errors.New("is not supported")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.ToUpper(name), err)
+		}
+	}
+	switch rule.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY":
+	default:
+		return nil, errors.New("FREQ must be DAILY, WEEKLY or MONTHLY")
+	}
+	if rule.Count == 0 && rule.Until.IsZero() {
+		return nil, errors.New("the rule must end with COUNT or UNTIL")
+	}
+	return rule, nil
+}
+
+// daysBetween returns the number of calendar days from a to b
+func daysBetween(a, b time.Time) int {
+	from := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	to := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(to.Sub(from).Hours() / 24)
+}
+
+// matches reports whether the rule repeats on date for a series starting at start
+func (rule *Recurrence) matches(start, date time.Time) bool {
+	contains := func(weekdays []time.Weekday, weekday time.Weekday) bool {
+		for _, w := range weekdays {
+			if w == weekday {
+				return true
+			}
+		}
+		return false
+	}
+	containsDay := func(days []int, day int) bool {
+		for _, d := range days {
+			if d == day {
+				return true
+			}
+		}
+		return false
+	}
+	if rule.ByMonthDay != nil && !containsDay(rule.ByMonthDay, date.Day()) {
+		return false
+	}
+
+	switch rule.Freq {
+	case "DAILY":
+		return daysBetween(start, date)%rule.Interval == 0 && (rule.ByDay == nil || contains(rule.ByDay, date.Weekday()))
+	case "WEEKLY":
+		// Weeks start on Monday
+		monday := func(d time.Time) time.Time { return d.AddDate(0, 0, -(int(d.Weekday())+6)%7) }
+		if daysBetween(monday(start), monday(date))/7%rule.Interval != 0 {
+			return false
+		}
+		if rule.ByDay == nil {
+			return date.Weekday() == start.Weekday()
+		}
+		return contains(rule.ByDay, date.Weekday())
+	default:
+		months := (date.Year()-start.Year())*12 + int(date.Month()) - int(start.Month())
+		if months%rule.Interval != 0 {
+			return false
+		}
+		if rule.ByDay != nil {
+			return contains(rule.ByDay, date.Weekday())
+		}
+		return rule.ByMonthDay != nil || date.Day() == start.Day()
+	}
+}
+
+// dates expands the rule from start, it fails if the rule repeats more than
+// limit times
+func (rule *Recurrence) dates(start time.Time, limit int) ([]time.Time, error) {
+	var dates []time.Time
+	for date := start; rule.Until.IsZero() || !date.After(rule.Until); date = date.AddDate(0, 0, 1) {
+		// A rule that rarely matches ends after ten years without UNTIL
+		if rule.Count > 0 && len(dates) == rule.Count || daysBetween(start, date) > 10*365 {
+			break
+		}
+		if !rule.matches(start, date) {
+			continue
+		}
+		if len(dates) == limit {
+			return nil, fmt.Errorf("the rule repeats more than %d times", limit)
+		}
+		dates = append(dates, date)
+	}
+	return dates, nil
+}
+
+// isDayOff reports whether a rotation day has no slot
+func isDayOff(slot string) bool {
+	slot = strings.TrimSpace(slot)
+	return slot == "" || slot == "-" || strings.EqualFold(slot, "frei")
+}
+
+// rotationSlot returns the slot of a rotation on date for a cycle that
+// started at start, shifted by offset days; "" is a day off
+func rotationSlot(rotation []string, start, date time.Time, offset int) string {
+	day := (daysBetween(start, date) + offset) % len(rotation)
+	if day < 0 {
+		day += len(rotation)
+	}
+	if isDayOff(rotation[day]) {
+		return ""
+	}
+	return strings.TrimSpace(rotation[day])
+}
+
+// expandSeries returns the dates and slots of a bulk request
+func expandSeries(series BulkShiftReceive) ([]slotDate, []ValidationError) {
+	start, err := parseDate(series.Datum)
+	if err != nil {
+		return nil, []ValidationError{{Field: "datum", Message: "must be an ISO 8601 date"}}
+	}
+
+	var slots []slotDate
+	switch {
+	case series.RRule != "" && series.Rotation != nil:
+		return nil, []ValidationError{{Field: "rrule", Message: "must not be combined with a rotation"}}
+	case series.RRule != "":
+		if series.Time == "" {
+			return nil, []ValidationError{{Field: "time", Message: "must be set for an rrule"}}
+		}
+		rule, err := parseRRule(series.RRule)
+		if err != nil {
+			return nil, []ValidationError{{Field: "rrule", Message: err.Error()}}
+		}
+		dates, err := rule.dates(start, maxOccurrences)
+		if err != nil {
+			return nil, []ValidationError{{Field: "rrule", Message: err.Error()}}
+		}
+		for _, date := range dates {
+			slots = append(slots, slotDate{Date: date, Time: series.Time})
+		}
+	case series.Rotation != nil:
+		until, err := parseDate(series.Until)
+		if err != nil {
+			return nil, []ValidationError{{Field: "until", Message: "must be an ISO 8601 date"}}
+		}
+		if until.Before(start) {
+			return nil, []ValidationError{{Field: "until", Message: "must not be before datum"}}
+		}
+		if len(series.Rotation) == 0 {
+			return nil, []ValidationError{{Field: "rotation", Message: "must not be empty"}}
+		}
+		for date := start; !date.After(until); date = date.AddDate(0, 0, 1) {
+			if slot := rotationSlot(series.Rotation, start, date, 0); slot != "" {
+				if len(slots) == maxOccurrences {
+					return nil, []ValidationError{{Field: "until", Message: fmt.Sprintf("the rotation repeats more than %d times", maxOccurrences)}}
+				}
+				slots = append(slots, slotDate{Date: date, Time: slot})
+			}
+		}
+	default:
+		return nil, []ValidationError{{Field: "rrule", Message: "either rrule or rotation must be set"}}
+	}
+	if len(slots) == 0 {
+		return nil, []ValidationError{{Field: "rrule", Message: "the series has no shifts"}}
+	}
+	return slots, nil
+}
+
+// Bulk handler for /shifts/bulk, expands a series into shifts of the
+// principal and creates them in one transaction. Occurrences that are
+// invalid, double booked or break the working time rules are skipped and
+// reported with the created ones.
+func (app *App) shiftBulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	principal, ok := requirePermission(w, r, permShiftsWrite)
+	if !ok {
+		return
+	}
+
+	var series BulkShiftReceive
+	err := json.NewDecoder(r.Body).Decode(&series)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	slots, errs := expandSeries(series)
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	types, err := app.Store.ShiftTypes()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
+		return
+	}
+	if series.RRule != "" && !isShiftType(types, series.Time) {
+		writeValidationErrors(w, []ValidationError{{Field: "time", Message: fmt.Sprintf("unknown shift type %q", series.Time)}})
+		return
+	}
+	for i, slot := range series.Rotation {
+		if !isDayOff(slot) && !isShiftType(types, strings.TrimSpace(slot)) {
+			errs = append(errs, ValidationError{Field: fmt.Sprintf("rotation[%d]", i), Message: fmt.Sprintf("unknown shift type %q", slot)})
+		}
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	team, errs, err := app.resolveShiftTeam(r, principal, series.Team, true)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get team")
+		return
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	occurrences := make([]Occurrence, len(slots))
+	created := 0
+	var events []Event
+	err = app.store(r).Atomic(func(tx Store) error {
+		rules, err := app.rules(tx)
+		if err != nil {
+			return err
+		}
+		schedule, err := tx.ListShifts(principal.Username)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for i, slot := range slots {
+			occurrences[i] = Occurrence{Datum: formatDate(slot.Date), Time: slot.Time}
+			input, errs := parseShift(ShiftReceive{Datum: formatDate(slot.Date), Time: slot.Time, Skills: series.Skills}, types, now, isPastAllowed(principal))
+			if errs != nil {
+				occurrences[i].Status, occurrences[i].Message = occurrenceInvalid, errs[0].Field+" "+errs[0].Message
+				continue
+			}
+			input.Team = team
+			shift := input.shift(generateSessionID(), principal.Username)
+			if conflict := slotConflict(shift, schedule); conflict != nil {
+				occurrences[i].Status, occurrences[i].Message, occurrences[i].Conflict = occurrenceConflict, shiftConflictMessage(conflict), conflict.ID
+				continue
+			}
+			if violations := rules.check(shift, schedule); violations != nil {
+				occurrences[i].Status, occurrences[i].Message, occurrences[i].Conflict = occurrenceViolation, violations[0].Message, violations[0].Conflict
+				continue
+			}
+			err := tx.CreateShift(shift)
+			if errors.Is(err, errShiftConflict) {
+				// A concurrent request took the slot since the schedule was read
+				occurrences[i].Status, occurrences[i].Message = occurrenceConflict, shiftConflictMessage(&shift)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			schedule = append(schedule, shift)
+			sort.Slice(schedule, func(i, j int) bool { return schedule[i].StartsAt.Before(schedule[j].StartsAt) })
+			occurrences[i].Status, occurrences[i].Uid = occurrenceCreated, shift.ID
+			events = append(events, shiftEvent(requestTenant(r), "created", shift))
+			created++
+		}
+		return nil
+	})
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to add shifts")
+		return
+	}
+	app.publish(events...)
+
+	status := http.StatusCreated
+	if created == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     fmt.Sprintf("%d of %d shifts added", created, len(occurrences)),
+		"created":     created,
+		"skipped":     len(occurrences) - created,
+		"occurrences": occurrences,
+	})
+	if err != nil {
+		return
+	}
+}
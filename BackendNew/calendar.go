@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CalendarFeedReceive describes the calendar feed of the principal
+type CalendarFeedReceive struct {
+	Token   string    `json:"token"`
+	URL     string    `json:"url"`
+	Created time.Time `json:"created"`
+}
+
+// calendarFeedReceive returns the feed with the URL calendars subscribe to
+func calendarFeedReceive(r *http.Request, feed *CalendarFeed) CalendarFeedReceive {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return CalendarFeedReceive{
+		Token:   feed.Token,
+		URL:     fmt.Sprintf("%s://%s/calendar/%s.ics", scheme, r.Host, feed.Token),
+		Created: feed.Created,
+	}
+}
+
+// Calendar handler for /calendar, shows, rotates and revokes the
+// principal's feed token
+func (app *App) calendarHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePermission(w, r, permShiftsRead)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		feed, err := app.store(r).CalendarFeed(principal.Username)
+		if errors.Is(err, errCalendarNotFound) {
+			writeMessage(w, http.StatusNotFound, "No calendar feed, create one with POST")
+			return
+		}
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to get calendar feed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(calendarFeedReceive(r, feed))
+		if err != nil {
+			return
+		}
+	case http.MethodPost:
+		// A new token replaces the previous one, calendars subscribed with the
+		// old URL stop receiving updates
+		feed := CalendarFeed{Token: generateSessionID(), Username: principal.Username, Created: time.Now()}
+		err := app.store(r).SetCalendarFeed(feed)
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to create calendar feed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(calendarFeedReceive(r, &feed))
+		if err != nil {
+			return
+		}
+	case http.MethodDelete:
+		err := app.store(r).DeleteCalendarFeed(principal.Username)
+		if errors.Is(err, errCalendarNotFound) {
+			writeMessage(w, http.StatusNotFound, "No calendar feed")
+			return
+		}
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to revoke calendar feed")
+			return
+		}
+		writeMessage(w, http.StatusOK, "Calendar feed revoked")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Calendar feed handler for /calendar/{token}.ics, the token is the only
+// credential so that calendar apps can subscribe without a session
+func (app *App) calendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) != 2 || !strings.HasSuffix(pathSegments[1], ".ics") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	token := strings.TrimSuffix(pathSegments[1], ".ics")
+
+	feed, err := app.Store.CalendarFeedByToken(token)
+	if errors.Is(err, errCalendarNotFound) {
+		writeMessage(w, http.StatusNotFound, "Calendar feed not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get calendar feed")
+		return
+	}
+	tenant, err := app.Store.UserTenant(feed.Username)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get calendar feed")
+		return
+	}
+	store := app.Store.ForTenant(tenant)
+
+	shifts, err := store.ListShifts(feed.Username)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch shifts")
+		return
+	}
+	cancellations, err := store.CalendarCancellations(feed.Username, time.Now().Add(-app.Config.Calendar.CancellationRetention))
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch cancelled shifts")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	_, err = w.Write([]byte(app.renderCalendar(feed.Username, shifts, cancellations, time.Now())))
+	if err != nil {
+		return
+	}
+}
+
+// renderCalendar renders the shifts of a user as an RFC 5545 calendar. The
+// event UIDs are derived from the shift IDs, SEQUENCE grows with every
+// change and shifts that left the calendar are kept as cancelled events
+// until they come back.
+func (app *App) renderCalendar(username string, shifts []Shift, cancellations []CalendarCancellation, now time.Time) string {
+	var c icsWriter
+	c.line("BEGIN", "VCALENDAR")
+	c.line("VERSION", "2.0")
+	c.line("PRODID", "-//BackendNew//Shifts//EN")
+	c.line("CALSCALE", "GREGORIAN")
+	c.line("METHOD", "PUBLISH")
+	c.line("X-WR-CALNAME", icsText("Shifts of "+username))
+	c.line("REFRESH-INTERVAL;VALUE=DURATION", "PT1H")
+	c.line("X-PUBLISHED-TTL", "PT1H")
+
+	owned := make(map[string]bool, len(shifts))
+	for _, shift := range shifts {
+		owned[shift.ID] = true
+
+		var details []string
+		if shift.Team != "" {
+			details = append(details, "Team: "+shift.Team)
+		}
+		if len(shift.Skills) > 0 {
+			details = append(details, "Skills: "+strings.Join(shift.Skills, ", "))
+		}
+		if shift.Trade {
+			details = append(details, "Offered for trade")
+		}
+		if shift.Released {
+			details = append(details, "Released to the open shifts")
+		}
+
+		c.line("BEGIN", "VEVENT")
+		c.event(app.calendarUID(shift.ID), now, shift.Sequence, shift.Date, shift.StartsAt, shift.EndsAt)
+		c.line("SUMMARY", icsText(shiftSummary(shift.Time, shift.Team)))
+		if len(details) > 0 {
+			c.line("DESCRIPTION", icsText(strings.Join(details, "\n")))
+		}
+		c.line("STATUS", "CONFIRMED")
+		c.line("TRANSP", "OPAQUE")
+		c.line("END", "VEVENT")
+	}
+
+	for _, cancelled := range cancellations {
+		// A shift traded back to the user is published as confirmed above
+		if owned[cancelled.ShiftID] {
+			continue
+		}
+		c.line("BEGIN", "VEVENT")
+		c.event(app.calendarUID(cancelled.ShiftID), now, cancelled.Sequence, cancelled.Date, cancelled.StartsAt, cancelled.EndsAt)
+		c.line("SUMMARY", icsText(shiftSummary(cancelled.Time, "")))
+		c.line("STATUS", "CANCELLED")
+		c.line("TRANSP", "TRANSPARENT")
+		c.line("END", "VEVENT")
+	}
+
+	c.line("END", "VCALENDAR")
+	return c.String()
+}
+
+// calendarUID returns the stable event UID of a shift
+func (app *App) calendarUID(shiftID string) string {
+	return shiftID + "@" + app.Config.Calendar.UIDDomain
+}
+
+// shiftSummary returns the event title of a shift
+func shiftSummary(timeV, team string) string {
+	summary := "Shift " + timeV
+	if team != "" {
+		summary += " (" + team + ")"
+	}
+	return summary
+}
+
+// icsWriter builds an iCalendar document with CRLF line endings
+type icsWriter struct {
+	strings.Builder
+}
+
+// icsLineLimit is the length in octets after which content lines are folded
+const icsLineLimit = 75
+
+// line writes a content line, folding it without splitting UTF-8 sequences
+func (c *icsWriter) line(name, value string) {
+	content := name + ":" + value
+	limit := icsLineLimit
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+		c.WriteString(content[:cut] + "\r\n ")
+		content = content[cut:]
+		// continuation lines start with the folding space
+		limit = icsLineLimit - 1
+	}
+	c.WriteString(content + "\r\n")
+}
+
+// event writes the UID, timestamps and times of an event; shifts stored
+// without times span their whole date
+func (c *icsWriter) event(uid string, now time.Time, sequence int, date, startsAt, endsAt time.Time) {
+	c.line("UID", uid)
+	c.line("DTSTAMP", icsTime(now))
+	c.line("SEQUENCE", fmt.Sprint(sequence))
+	if startsAt.IsZero() || endsAt.IsZero() {
+		c.line("DTSTART;VALUE=DATE", date.Format("20060102"))
+		c.line("DTEND;VALUE=DATE", date.AddDate(0, 0, 1).Format("20060102"))
+		return
+	}
+	c.line("DTSTART", icsTime(startsAt))
+	c.line("DTEND", icsTime(endsAt))
+}
+
+// icsTime formats a time in UTC as an iCalendar DATE-TIME
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsText escapes a TEXT property value
+func icsText(value string) string {
+	return icsEscaper.Replace(value)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the effective configuration, built from defaults, an optional
+// YAML file and environment variables, in increasing order of precedence
+type Config struct {
+	Database  DatabaseConfig `yaml:"database"`
+	Server    ServerConfig   `yaml:"server"`
+	Session   SessionConfig  `yaml:"session"`
+	Trade     TradeConfig    `yaml:"trade"`
+	Rules     RuleConfig     `yaml:"rules"`
+	Events    EventsConfig   `yaml:"events"`
+	Calendar  CalendarConfig `yaml:"calendar"`
+	Import    ImportConfig   `yaml:"import"`
+	AdminUser string         `yaml:"admin_user"`
+}
+
+// Supported database drivers
+const (
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+type DatabaseConfig struct {
+	// Driver is postgres or sqlite, SQLite only uses Path
+	Driver string `yaml:"driver"`
+	Path   string `yaml:"path"`
+	// DSN replaces the individual connection settings if set
+	DSN             string        `yaml:"dsn"`
+	Host            string        `yaml:"host"`
+	Port            int           `yaml:"port"`
+	User            string        `yaml:"user"`
+	Password        string        `yaml:"password"`
+	Name            string        `yaml:"name"`
+	SSLMode         string        `yaml:"ssl_mode"`
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+}
+
+type ServerConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+}
+
+type SessionConfig struct {
+	TTL            time.Duration `yaml:"ttl"`
+	CookieSecure   bool          `yaml:"cookie_secure"`
+	CookieSameSite string        `yaml:"cookie_same_site"`
+	CookieDomain   string        `yaml:"cookie_domain"`
+}
+
+type TradeConfig struct {
+	ProposalTTL time.Duration `yaml:"proposal_ttl"`
+	// RequireApproval makes accepted trades wait for a supervisor's sign-off
+	RequireApproval bool `yaml:"require_approval"`
+	// ApprovalTTL is how long supervisors have to review an accepted trade
+	ApprovalTTL time.Duration `yaml:"approval_ttl"`
+}
+
+type EventsConfig struct {
+	// PostgresNotify relays events through LISTEN/NOTIFY so that clients of
+	// every backend replica receive them
+	PostgresNotify bool `yaml:"postgres_notify"`
+}
+
+type CalendarConfig struct {
+	// UIDDomain makes the event UIDs of the feeds globally unique, it must
+	// not change once calendars subscribed
+	UIDDomain string `yaml:"uid_domain"`
+	// CancellationRetention is how long deleted and traded away shifts stay
+	// in the feeds as cancelled events
+	CancellationRetention time.Duration `yaml:"cancellation_retention"`
+}
+
+type ImportConfig struct {
+	// Columns names the CSV header of each roster field, the team column is
+	// optional
+	Columns   RosterColumns `yaml:"columns"`
+	Delimiter string        `yaml:"delimiter"`
+	// DateFormat is the Go time layout of the date column
+	DateFormat string `yaml:"date_format"`
+}
+
+type RosterColumns struct {
+	Username string `yaml:"username"`
+	Date     string `yaml:"date"`
+	Time     string `yaml:"time"`
+	Team     string `yaml:"team"`
+}
+
+// defaultConfig matches the docker-compose setup
+func defaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{
+			Driver:          driverPostgres,
+			Path:            "shifts.db",
+			Host:            "postgres",
+			Port:            5432,
+			User:            "myuser",
+			Password:        "mypassword",
+			Name:            "mydatabase",
+			SSLMode:         "disable",
+			MaxOpenConns:    10,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+		},
+		Server: ServerConfig{
+			ListenAddress: ":4010",
+		},
+		Session: SessionConfig{
+			TTL:            24 * time.Hour,
+			CookieSameSite: "lax",
+		},
+		Trade: TradeConfig{
+			ProposalTTL: 48 * time.Hour,
+			ApprovalTTL: 72 * time.Hour,
+		},
+		Rules: RuleConfig{
+			MinRestHours:       11,
+			MaxConsecutiveDays: 6,
+			MaxWeeklyHours:     48,
+			NoDoubleBooking:    true,
+		},
+		Calendar: CalendarConfig{
+			UIDDomain:             "shifts.invalid",
+			CancellationRetention: 30 * 24 * time.Hour,
+		},
+		Import: ImportConfig{
+			Columns:    RosterColumns{Username: "username", Date: "datum", Time: "time", Team: "team"},
+			Delimiter:  ",",
+			DateFormat: dateLayout,
+		},
+	}
+}
+
+// loadConfig builds the configuration from the defaults, the YAML file at
+// path if one is given and the environment
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := yaml.NewDecoder(strings.NewReader(string(content)))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// applyEnv overrides settings with the environment variables that are set
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, target *string) {
+		if value, ok := lookup(name); ok {
+			*target = value
+		}
+	}
+	integer := func(name string, target *int) {
+		if value, ok := lookup(name); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	boolean := func(name string, target *bool) {
+		if value, ok := lookup(name); ok {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	float := func(name string, target *float64) {
+		if value, ok := lookup(name); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	duration := func(name string, target *time.Duration) {
+		if value, ok := lookup(name); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	str("DB_DRIVER", &c.Database.Driver)
+	str("DB_PATH", &c.Database.Path)
+	str("DB_DSN", &c.Database.DSN)
+	str("DB_HOST", &c.Database.Host)
+	integer("DB_PORT", &c.Database.Port)
+	str("DB_USER", &c.Database.User)
+	str("DB_PASSWORD", &c.Database.Password)
+	str("DB_NAME", &c.Database.Name)
+	str("DB_SSLMODE", &c.Database.SSLMode)
+	integer("DB_MAX_OPEN_CONNS", &c.Database.MaxOpenConns)
+	integer("DB_MAX_IDLE_CONNS", &c.Database.MaxIdleConns)
+	duration("DB_CONN_MAX_LIFETIME", &c.Database.ConnMaxLifetime)
+	str("LISTEN_ADDRESS", &c.Server.ListenAddress)
+	duration("SESSION_TTL", &c.Session.TTL)
+	boolean("COOKIE_SECURE", &c.Session.CookieSecure)
+	str("COOKIE_SAME_SITE", &c.Session.CookieSameSite)
+	str("COOKIE_DOMAIN", &c.Session.CookieDomain)
+	duration("TRADE_PROPOSAL_TTL", &c.Trade.ProposalTTL)
+	boolean("TRADE_REQUIRE_APPROVAL", &c.Trade.RequireApproval)
+	duration("TRADE_APPROVAL_TTL", &c.Trade.ApprovalTTL)
+	float("RULES_MIN_REST_HOURS", &c.Rules.MinRestHours)
+	integer("RULES_MAX_CONSECUTIVE_DAYS", &c.Rules.MaxConsecutiveDays)
+	float("RULES_MAX_WEEKLY_HOURS", &c.Rules.MaxWeeklyHours)
+	boolean("RULES_NO_DOUBLE_BOOKING", &c.Rules.NoDoubleBooking)
+	boolean("EVENTS_POSTGRES_NOTIFY", &c.Events.PostgresNotify)
+	str("CALENDAR_UID_DOMAIN", &c.Calendar.UIDDomain)
+	duration("CALENDAR_CANCELLATION_RETENTION", &c.Calendar.CancellationRetention)
+	str("IMPORT_COLUMN_USERNAME", &c.Import.Columns.Username)
+	str("IMPORT_COLUMN_DATE", &c.Import.Columns.Date)
+	str("IMPORT_COLUMN_TIME", &c.Import.Columns.Time)
+	str("IMPORT_COLUMN_TEAM", &c.Import.Columns.Team)
+	str("IMPORT_DELIMITER", &c.Import.Delimiter)
+	str("IMPORT_DATE_FORMAT", &c.Import.DateFormat)
+	str("ADMIN_USER", &c.AdminUser)
+
+	return errors.Join(errs...)
+}
+
+// validate rejects settings the backend cannot run with
+func (c *Config) validate() error {
+	var errs []error
+	switch c.Database.Driver {
+	case driverSQLite:
+		if c.Database.Path == "" {
+			errs = append(errs, errors.New("database.path must be set for sqlite"))
+		}
+	case driverPostgres:
+		if c.Database.DSN != "" {
+			break
+		}
+		if c.Database.Host == "" {
+			errs = append(errs, errors.New("database.host must be set"))
+		}
+		if c.Database.Port <= 0 || c.Database.Port > 65535 {
+			errs = append(errs, errors.New("database.port must be between 1 and 65535"))
+		}
+		if c.Database.User == "" || c.Database.Name == "" {
+			errs = append(errs, errors.New("database.user and database.name must be set"))
+		}
+	default:
+		errs = append(errs, errors.New("database.driver must be postgres or sqlite"))
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 {
+		errs = append(errs, errors.New("database pool sizes must not be negative"))
+	}
+	if c.Database.MaxOpenConns > 0 && c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		errs = append(errs, errors.New("database.max_idle_conns must not exceed database.max_open_conns"))
+	}
+	if c.Server.ListenAddress == "" {
+		errs = append(errs, errors.New("server.listen_address must be set"))
+	}
+	if c.Session.TTL <= 0 {
+		errs = append(errs, errors.New("session.ttl must be positive"))
+	}
+	switch strings.ToLower(c.Session.CookieSameSite) {
+	case "lax", "strict":
+	case "none":
+		if !c.Session.CookieSecure {
+			errs = append(errs, errors.New("session.cookie_same_site none requires session.cookie_secure"))
+		}
+	default:
+		errs = append(errs, errors.New("session.cookie_same_site must be lax, strict or none"))
+	}
+	if c.Trade.ProposalTTL <= 0 {
+		errs = append(errs, errors.New("trade.proposal_ttl must be positive"))
+	}
+	if c.Trade.ApprovalTTL <= 0 {
+		errs = append(errs, errors.New("trade.approval_ttl must be positive"))
+	}
+	if c.Events.PostgresNotify && c.Database.Driver != driverPostgres {
+		errs = append(errs, errors.New("events.postgres_notify requires the postgres driver"))
+	}
+	if c.Calendar.UIDDomain == "" {
+		errs = append(errs, errors.New("calendar.uid_domain must be set"))
+	}
+	if c.Calendar.CancellationRetention < 0 {
+		errs = append(errs, errors.New("calendar.cancellation_retention must not be negative"))
+	}
+	if err := c.Import.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("import: %w", err))
+	}
+	if err := c.Rules.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("rules: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// connectionString returns the DSN passed to the database driver
+func (c DatabaseConfig) connectionString() string {
+	if c.Driver == driverSQLite {
+		return sqliteDSN(c.Path)
+	}
+	if c.DSN != "" {
+		return c.DSN
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s", c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
+}
+
+// sameSite maps the configured SameSite mode to its cookie attribute
+func (c SessionConfig) sameSite() http.SameSite {
+	switch strings.ToLower(c.CookieSameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+var dsnPassword = regexp.MustCompile(`password=('[^']*'|\S+)`)
+
+// redacted returns the configuration as YAML with all secrets masked
+func (c Config) redacted() string {
+	if c.Database.Password != "" {
+		c.Database.Password = "xxxxx"
+	}
+	if c.Database.DSN != "" {
+		if parsed, err := url.Parse(c.Database.DSN); err == nil && parsed.Scheme != "" {
+			c.Database.DSN = parsed.Redacted()
+		} else {
+			c.Database.DSN = dsnPassword.ReplaceAllString(c.Database.DSN, "password=xxxxx")
+		}
+	}
+
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
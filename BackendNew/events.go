@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Event types pushed to the clients
+const (
+	eventShift     = "shift"      // a shift of the user was created, changed or handed over
+	eventOffers    = "offers"     // the offer counts of a date changed
+	eventTrade     = "trade"      // a trade of the user was proposed or changed its state
+	eventOpenShift = "open-shift" // a shift was released to or left the pool
+)
+
+// Event is a change pushed to the users it concerns
+type Event struct {
+	Type   string `json:"type"`
+	Tenant string `json:"tenant"`
+	// Users receive the event; if empty all users of the tenant, or of the
+	// team if one is given, receive it
+	Users []string        `json:"users,omitempty"`
+	Team  string          `json:"team,omitempty"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// eventSubscriberBuffer is the number of events kept for a slow client
+// before further events are dropped
+const eventSubscriberBuffer = 64
+
+// eventHub fans events out to the subscribers of this process
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]bool
+	// forward replaces local delivery if set, the events come back through
+	// deliver on every replica
+	forward func(event Event) error
+}
+
+// eventSubscriber is the event stream of a client
+type eventSubscriber struct {
+	tenant   string
+	username string
+	teams    map[string]bool
+	allTeams bool
+	events   chan Event
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[*eventSubscriber]bool)}
+}
+
+// Publish hands an event to the subscribers of all replicas; a nil hub
+// drops all events
+func (h *eventHub) Publish(event Event) {
+	if h == nil {
+		return
+	}
+	if h.forward != nil {
+		err := h.forward(event)
+		if err == nil {
+			return
+		}
+		log.Printf("forwarding %s event: %v, delivering it locally", event.Type, err)
+	}
+	h.deliver(event)
+}
+
+// deliver sends an event to the local subscribers it concerns, subscribers
+// whose buffer is full miss it
+func (h *eventHub) deliver(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscriber := range h.subscribers {
+		if !subscriber.receives(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+		}
+	}
+}
+
+// subscribe registers a subscriber until the returned function is called
+func (h *eventHub) subscribe(subscriber *eventSubscriber) func() {
+	subscriber.events = make(chan Event, eventSubscriberBuffer)
+	h.mu.Lock()
+	h.subscribers[subscriber] = true
+	h.mu.Unlock()
+	return func() {
+		h.mu.Lock()
+		delete(h.subscribers, subscriber)
+		h.mu.Unlock()
+	}
+}
+
+// receives reports whether the event concerns the subscriber
+func (s *eventSubscriber) receives(event Event) bool {
+	if event.Tenant != s.tenant {
+		return false
+	}
+	if len(event.Users) > 0 {
+		for _, username := range event.Users {
+			if username == s.username {
+				return true
+			}
+		}
+		return false
+	}
+	return event.Team == "" || s.allTeams || s.teams[event.Team]
+}
+
+// eventChannel is the Postgres notification channel of the event bridge
+const eventChannel = "shift_events"
+
+// bridgePostgres relays the hub's events through Postgres LISTEN/NOTIFY so
+// that the subscribers of every backend replica receive them. Events
+// published while the listener reconnects are lost.
+func (h *eventHub) bridgePostgres(db *sql.DB, dsn string) error {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("event listener: %v", err)
+		}
+	})
+	if err := listener.Listen(eventChannel); err != nil {
+		return err
+	}
+
+	h.forward = func(event Event) error {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("SELECT pg_notify($1, $2)", eventChannel, string(payload))
+		return err
+	}
+	go func() {
+		for notification := range listener.Notify {
+			// nil follows a reconnect
+			if notification == nil {
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+				log.Printf("event listener: %v", err)
+				continue
+			}
+			h.deliver(event)
+		}
+	}()
+	return nil
+}
+
+// newEvent returns an event of the given type carrying data
+func newEvent(eventType, tenant string, data interface{}) Event {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		payload = []byte("null")
+	}
+	return Event{Type: eventType, Tenant: tenant, Data: payload}
+}
+
+// shiftEvent tells the owner of a shift about a change to it
+func shiftEvent(tenant, action string, shift Shift) Event {
+	event := newEvent(eventShift, tenant, map[string]string{
+		"action": action,
+		"uid":    shift.ID,
+		"datum":  formatDate(shift.Date),
+		"time":   shift.Time,
+		"team":   shift.Team,
+	})
+	event.Users = []string{shift.Username}
+	return event
+}
+
+// offersEvent tells the members of a shift's team, or the whole tenant for
+// shifts without a team, that the offer counts of its date changed
+func offersEvent(tenant string, shift Shift) Event {
+	event := newEvent(eventOffers, tenant, map[string]string{
+		"datum": formatDate(shift.Date),
+		"team":  shift.Team,
+	})
+	event.Team = shift.Team
+	return event
+}
+
+// shiftChanged returns the events of a shift updated from before to after;
+// the offer counts change on both dates if either version is offered
+func shiftChanged(tenant string, before, after Shift) []Event {
+	after.Username = before.Username
+	if after.Team == "" {
+		after.Team = before.Team
+	}
+	events := []Event{shiftEvent(tenant, "updated", after)}
+	if before.Trade || after.Trade {
+		events = append(events, offersEvent(tenant, before))
+		if formatDate(before.Date) != formatDate(after.Date) || before.Team != after.Team {
+			events = append(events, offersEvent(tenant, after))
+		}
+	}
+	return events
+}
+
+// tradeEvent tells the participants of a trade about its state
+func tradeEvent(tenant string, trade *Trade) Event {
+	event := newEvent(eventTrade, tenant, map[string]string{
+		"uid":    trade.Uid,
+		"status": trade.Status,
+	})
+	for _, p := range trade.Participants {
+		event.Users = append(event.Users, p.Username)
+	}
+	return event
+}
+
+// openShiftEvent tells the colleagues who may claim an open shift that it
+// was released, claimed or withdrawn
+func openShiftEvent(tenant, action string, open OpenShift) Event {
+	event := newEvent(eventOpenShift, tenant, map[string]interface{}{
+		"action": action,
+		"shift":  openShiftReceive(open),
+	})
+	event.Team = open.Shift.Team
+	return event
+}
+
+// publish hands events to the hub, handlers call it once their changes are
+// committed
+func (app *App) publish(events ...Event) {
+	for _, event := range events {
+		app.Events.Publish(event)
+	}
+}
+
+// newEventSubscriber returns the subscriber of the principal's events, team
+// events reach the members of the team and admins
+func (app *App) newEventSubscriber(r *http.Request, principal *Principal) (*eventSubscriber, error) {
+	teams, err := app.store(r).UserTeams(principal.Username)
+	if err != nil {
+		return nil, err
+	}
+	subscriber := &eventSubscriber{
+		tenant:   requestTenant(r),
+		username: principal.Username,
+		teams:    make(map[string]bool, len(teams)),
+		allTeams: principal.can(permShiftsManageAll),
+	}
+	for _, team := range teams {
+		subscriber.teams[team] = true
+	}
+	return subscriber, nil
+}
+
+// eventKeepAlive is the interval of comments that keep idle streams open
+// through proxies
+const eventKeepAlive = 25 * time.Second
+
+// Event stream handler for /events, a Server-Sent Events stream of the
+// changes concerning the principal that ends when the session expires
+func (app *App) eventHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePermission(w, r, permShiftsRead)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || app.Events == nil {
+		writeMessage(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	subscriber, err := app.newEventSubscriber(r, principal)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get teams")
+		return
+	}
+	unsubscribe := app.Events.subscribe(subscriber)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, err = fmt.Fprint(w, "retry: 5000\n\n")
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	expired := time.NewTimer(time.Until(principal.Expires))
+	defer expired.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired.C:
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-subscriber.events:
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
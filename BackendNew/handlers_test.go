@@ -0,0 +1,1758 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient is a logged in user of a test server, the session cookie is
+// kept in its cookie jar
+type testClient struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+}
+
+// newTestStore returns the empty store the tests run on, TestSQLiteStore
+// swaps it for a SQLite database
+var newTestStore = func(t *testing.T) Store {
+	return newMemoryStore()
+}
+
+// newTestApp starts the API on an empty store
+func newTestApp(t *testing.T) (*App, *httptest.Server) {
+	t.Helper()
+	config := defaultConfig()
+	app := &App{Store: newTestStore(t), Config: &config, Events: newEventHub()}
+	server := httptest.NewServer(app.routes())
+	t.Cleanup(server.Close)
+	return app, server
+}
+
+func newTestClient(t *testing.T, server *httptest.Server) *testClient {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, server: server, client: &http.Client{Jar: jar}}
+}
+
+// register creates a user and returns a client logged in as that user
+func register(t *testing.T, server *httptest.Server, username string) *testClient {
+	t.Helper()
+	c := newTestClient(t, server)
+	c.expect(http.MethodPut, "/login", User{Username: username, Password: "secret"}, http.StatusOK, nil)
+	return c
+}
+
+// do sends a request with body encoded as JSON and returns status and response body
+func (c *testClient) do(method, path string, body interface{}) (int, []byte) {
+	c.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, c.server.URL+path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp.StatusCode, content
+}
+
+// expect sends a request, checks the status and decodes the response into out
+func (c *testClient) expect(method, path string, body interface{}, status int, out interface{}) {
+	c.t.Helper()
+	got, content := c.do(method, path, body)
+	if got != status {
+		c.t.Fatalf("%s %s: got status %d, want %d: %s", method, path, got, status, content)
+	}
+	if out != nil {
+		if err := json.Unmarshal(content, out); err != nil {
+			c.t.Fatalf("%s %s: %v: %s", method, path, err, content)
+		}
+	}
+}
+
+// addShift creates a shift and returns its ID
+func (c *testClient) addShift(datum, timeV string) string {
+	c.t.Helper()
+	var created map[string]string
+	c.expect(http.MethodPost, "/shifts", ShiftReceive{Datum: datum, Time: timeV}, http.StatusCreated, &created)
+	return created["uid"]
+}
+
+// offerTrade enables the trade of a shift, searching the given slots
+func (c *testClient) offerTrade(shiftID, datum, timeV string, searched ...string) ShiftReceive {
+	c.t.Helper()
+	shift := ShiftReceive{Datum: datum, Time: timeV, Trade: true}
+	for _, name := range searched {
+		shift.Search = append(shift.Search, map[string]interface{}{"name": name, "selected": true})
+	}
+	var updated ShiftReceive
+	c.expect(http.MethodPatch, "/shifts/"+shiftID, shift, http.StatusOK, &updated)
+	return updated
+}
+
+func (c *testClient) trades() []Trade {
+	c.t.Helper()
+	var trades []Trade
+	c.expect(http.MethodGet, "/trades", nil, http.StatusOK, &trades)
+	return trades
+}
+
+func (c *testClient) shifts() []ShiftReceive {
+	c.t.Helper()
+	var shifts []ShiftReceive
+	c.expect(http.MethodGet, "/shifts", nil, http.StatusOK, &shifts)
+	return shifts
+}
+
+// streamedEvent is an event read from the /events stream
+type streamedEvent struct {
+	Type string
+	Data map[string]interface{}
+}
+
+// events opens the event stream of the client, it is closed with the test
+func (c *testClient) events() <-chan streamedEvent {
+	c.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server.URL+"/events", nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("GET /events: got status %d", resp.StatusCode)
+	}
+
+	events := make(chan streamedEvent, 16)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var event streamedEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.Type = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Data)
+			case line == "" && event.Type != "":
+				events <- event
+				event = streamedEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// waitEvent returns the next event of the given type, skipping all others
+func waitEvent(t *testing.T, events <-chan streamedEvent, eventType string) streamedEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("event stream closed")
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event received", eventType)
+		}
+	}
+}
+
+// socketReply is a message read from the /shifts/ws socket
+type socketReply struct {
+	Type string                 `json:"type"`
+	Ref  string                 `json:"ref"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// socket opens the dashboard socket of the client, it is closed with the test
+func (c *testClient) socket() *websocket.Conn {
+	c.t.Helper()
+	url := "ws" + strings.TrimPrefix(c.server.URL, "http") + "/shifts/ws"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Cookie": {c.cookie()}})
+	if err != nil {
+		c.t.Fatalf("dial /shifts/ws: %v (%+v)", err, resp)
+	}
+	c.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// cookie returns the Cookie header of the client's session
+func (c *testClient) cookie() string {
+	u, err := neturl.Parse(c.server.URL)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var cookies []string
+	for _, cookie := range c.client.Jar.Cookies(u) {
+		cookies = append(cookies, cookie.String())
+	}
+	return strings.Join(cookies, "; ")
+}
+
+// waitSocket returns the next socket message of the given type, skipping
+// all others
+func waitSocket(t *testing.T, conn *websocket.Conn, messageType string) socketReply {
+	t.Helper()
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var reply socketReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("no %s message received: %v", messageType, err)
+		}
+		if reply.Type == messageType {
+			return reply
+		}
+	}
+}
+
+// nextWeek returns a date a week from now in ISO 8601 format
+func nextWeek() string {
+	return time.Now().AddDate(0, 0, 7).Format(dateLayout)
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	_, server := newTestApp(t)
+
+	alice := register(t, server, "alice")
+	var status map[string]bool
+	alice.expect(http.MethodGet, "/login", nil, http.StatusOK, &status)
+	if !status["loggedIn"] {
+		t.Fatal("registered user is not logged in")
+	}
+
+	alice.expect(http.MethodPost, "/logout", nil, http.StatusOK, nil)
+	alice.expect(http.MethodGet, "/login", nil, http.StatusOK, &status)
+	if status["loggedIn"] {
+		t.Fatal("user is still logged in after logout")
+	}
+	alice.expect(http.MethodGet, "/shifts", nil, http.StatusUnauthorized, nil)
+
+	alice.expect(http.MethodPost, "/login", User{Username: "alice", Password: "wrong"}, http.StatusUnauthorized, nil)
+	alice.expect(http.MethodPost, "/login", User{Username: "nobody", Password: "secret"}, http.StatusUnauthorized, nil)
+	alice.expect(http.MethodPost, "/login", User{Username: "alice", Password: "secret"}, http.StatusOK, nil)
+	alice.expect(http.MethodGet, "/shifts", nil, http.StatusOK, nil)
+
+	other := newTestClient(t, server)
+	other.expect(http.MethodPut, "/login", User{Username: "alice", Password: "other"}, http.StatusConflict, nil)
+}
+
+func TestExpiredSession(t *testing.T) {
+	app, server := newTestApp(t)
+	app.Config.Session.TTL = time.Millisecond
+
+	alice := register(t, server, "alice")
+	time.Sleep(5 * time.Millisecond)
+	alice.expect(http.MethodGet, "/shifts", nil, http.StatusUnauthorized, nil)
+}
+
+func TestShiftCRUD(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+
+	shiftID := alice.addShift(datum, "früh")
+	shifts := alice.shifts()
+	if len(shifts) != 1 || shifts[0].Uid != shiftID || shifts[0].Datum != datum || shifts[0].Time != "früh" {
+		t.Fatalf("unexpected shifts %+v", shifts)
+	}
+	if len(bob.shifts()) != 0 {
+		t.Fatal("bob sees alice's shifts")
+	}
+
+	var shift ShiftReceive
+	alice.expect(http.MethodGet, "/shifts/"+shiftID, nil, http.StatusOK, &shift)
+	if shift.Day == "" || len(shift.Search) != len(defaultShiftTypes) {
+		t.Fatalf("unexpected shift %+v", shift)
+	}
+
+	alice.expect(http.MethodPut, "/shifts/"+shiftID, ShiftReceive{Datum: datum, Time: "spät"}, http.StatusOK, nil)
+	alice.expect(http.MethodGet, "/shifts/"+shiftID, nil, http.StatusOK, &shift)
+	if shift.Time != "spät" {
+		t.Fatalf("shift was not updated: %+v", shift)
+	}
+
+	past := time.Now().AddDate(0, 0, -7).Format(dateLayout)
+	alice.expect(http.MethodPost, "/shifts", ShiftReceive{Datum: past, Time: "früh"}, http.StatusUnprocessableEntity, nil)
+	alice.expect(http.MethodPost, "/shifts", ShiftReceive{Datum: datum, Time: "mittag"}, http.StatusUnprocessableEntity, nil)
+
+	// Other users' shifts do not exist as far as bob is concerned
+	bob.expect(http.MethodGet, "/shifts/"+shiftID, nil, http.StatusNotFound, nil)
+	bob.expect(http.MethodPut, "/shifts/"+shiftID, ShiftReceive{Datum: datum, Time: "nacht"}, http.StatusNotFound, nil)
+	bob.expect(http.MethodDelete, "/shifts/"+shiftID, nil, http.StatusNotFound, nil)
+
+	alice.expect(http.MethodDelete, "/shifts/"+shiftID, nil, http.StatusOK, nil)
+	alice.expect(http.MethodGet, "/shifts/"+shiftID, nil, http.StatusNotFound, nil)
+}
+
+func TestShiftByIDPatchSwap(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "spät")
+
+	updated := alice.offerTrade(aliceShift, datum, "früh", "spät")
+	if !updated.Trade {
+		t.Fatal("trade is not enabled")
+	}
+	if len(alice.trades()) != 0 {
+		t.Fatal("trade proposed without a counterpart")
+	}
+
+	// Bob's offer closes the cycle and proposes the trade to both
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	trades := alice.trades()
+	if len(trades) != 1 || trades[0].Status != tradePending || len(trades[0].Participants) != 2 {
+		t.Fatalf("unexpected trades %+v", trades)
+	}
+	tradeID := trades[0].Uid
+
+	var trade Trade
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, &trade)
+	if trade.Status != tradePending {
+		t.Fatalf("trade completed before bob accepted: %+v", trade)
+	}
+	if shifts := alice.shifts(); shifts[0].Uid != aliceShift {
+		t.Fatal("shifts swapped before bob accepted")
+	}
+
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, &trade)
+	if trade.Status != tradeCompleted {
+		t.Fatalf("trade not completed: %+v", trade)
+	}
+
+	shifts := alice.shifts()
+	if len(shifts) != 1 || shifts[0].Uid != bobShift || shifts[0].Time != "spät" || shifts[0].Trade {
+		t.Fatalf("alice did not receive bob's shift: %+v", shifts)
+	}
+	shifts = bob.shifts()
+	if len(shifts) != 1 || shifts[0].Uid != aliceShift || shifts[0].Time != "früh" || shifts[0].Trade {
+		t.Fatalf("bob did not receive alice's shift: %+v", shifts)
+	}
+
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusConflict, nil)
+}
+
+func TestShiftByIDPatchThreeWaySwap(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	carol := register(t, server, "carol")
+	datum := nextWeek()
+
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "spät")
+	carolShift := carol.addShift(datum, "nacht")
+
+	// Nobody wants to swap directly, only the ring früh -> spät -> nacht -> früh works
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	bob.offerTrade(bobShift, datum, "spät", "nacht")
+	carol.offerTrade(carolShift, datum, "nacht", "früh")
+
+	trades := carol.trades()
+	if len(trades) != 1 || len(trades[0].Participants) != 3 {
+		t.Fatalf("unexpected trades %+v", trades)
+	}
+	tradeID := trades[0].Uid
+	for _, c := range []*testClient{alice, bob, carol} {
+		c.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	}
+
+	for c, want := range map[*testClient]string{alice: bobShift, bob: carolShift, carol: aliceShift} {
+		if shifts := c.shifts(); len(shifts) != 1 || shifts[0].Uid != want {
+			t.Fatalf("unexpected shifts after swap %+v", shifts)
+		}
+	}
+}
+
+func TestShiftByIDPatchDecline(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "spät")
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+
+	tradeID := alice.trades()[0].Uid
+	var trade Trade
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/decline", nil, http.StatusOK, &trade)
+	if trade.Status != tradeDeclined {
+		t.Fatalf("trade not declined: %+v", trade)
+	}
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusConflict, nil)
+	if shifts := alice.shifts(); shifts[0].Uid != aliceShift || !shifts[0].Trade {
+		t.Fatalf("declined trade changed the shift: %+v", shifts)
+	}
+}
+
+func TestShiftByIDPatchApproval(t *testing.T) {
+	app, server := newTestApp(t)
+	app.Config.Trade.RequireApproval = true
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	boss := register(t, server, "boss")
+	other := register(t, server, "other")
+	for _, supervisor := range []string{"boss", "other"} {
+		if err := app.Store.SetUserRoles(supervisor, []string{roleSupervisor}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "icu"}, http.StatusCreated, nil)
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "er"}, http.StatusCreated, nil)
+	for member, team := range map[string]string{"alice": "icu", "bob": "icu", "boss": "icu", "other": "er"} {
+		admin.expect(http.MethodPut, "/admin/teams/"+team+"/members/"+member, nil, http.StatusOK, nil)
+	}
+	datum := nextWeek()
+
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "spät")
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+
+	tradeID := alice.trades()[0].Uid
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	var trade Trade
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, &trade)
+	if trade.Status != tradeAwaitingApproval {
+		t.Fatalf("trade does not await approval: %+v", trade)
+	}
+
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/approve", nil, http.StatusForbidden, nil)
+	// A supervisor cannot review a trade they take part in
+	if err := app.Store.SetUserRoles("bob", []string{roleSupervisor}); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/approve", nil, http.StatusForbidden, nil)
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/reject", nil, http.StatusForbidden, nil)
+	// Supervisors review the trades of their own teams only
+	var approvals []Trade
+	other.expect(http.MethodGet, "/trades/approvals", nil, http.StatusOK, &approvals)
+	if len(approvals) != 0 {
+		t.Fatalf("approvals of another team are listed: %+v", approvals)
+	}
+	other.expect(http.MethodPost, "/trades/"+tradeID+"/approve", nil, http.StatusNotFound, nil)
+	other.expect(http.MethodPost, "/trades/"+tradeID+"/reject", nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodGet, "/trades/approvals", nil, http.StatusOK, &approvals)
+	if len(approvals) != 1 {
+		t.Fatalf("unexpected approvals %+v", approvals)
+	}
+	boss.expect(http.MethodPost, "/trades/"+tradeID+"/approve", nil, http.StatusOK, &trade)
+	if trade.Status != tradeCompleted || trade.Reviewer != "boss" {
+		t.Fatalf("trade not approved: %+v", trade)
+	}
+	if shifts := alice.shifts(); shifts[0].Uid != bobShift {
+		t.Fatalf("approved trade did not swap: %+v", shifts)
+	}
+}
+
+func TestAtomicRollsBack(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.CreateUser("alice", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	err := store.Atomic(func(tx Store) error {
+		if err := tx.CreateUser("bob", "hash"); err != nil {
+			return err
+		}
+		return tx.CreateUser("alice", "hash")
+	})
+	if err != errUserExists {
+		t.Fatalf("got %v, want %v", err, errUserExists)
+	}
+	if _, err := store.PasswordHash("bob"); err != errUserNotFound {
+		t.Fatal("changes of a failed Atomic call were kept")
+	}
+}
+
+func TestTeamScopedTrades(t *testing.T) {
+	app, server := newTestApp(t)
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	carol := register(t, server, "carol")
+	datum := nextWeek()
+
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "icu", Department: "intensive care"}, http.StatusCreated, nil)
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "er"}, http.StatusCreated, nil)
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "er"}, http.StatusConflict, nil)
+	alice.expect(http.MethodPost, "/admin/teams", Team{Name: "ward"}, http.StatusForbidden, nil)
+	for member, team := range map[string]string{"alice": "icu", "bob": "icu", "carol": "er"} {
+		admin.expect(http.MethodPut, "/admin/teams/"+team+"/members/"+member, nil, http.StatusOK, nil)
+	}
+
+	// Shifts of users with a single team are filed under it
+	aliceShift := alice.addShift(datum, "früh")
+	carolShift := carol.addShift(datum, "spät")
+	alice.expect(http.MethodPost, "/shifts", ShiftReceive{Datum: datum, Time: "nacht", Team: "er"}, http.StatusUnprocessableEntity, nil)
+
+	// Carol would swap, but she is in another team
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	carol.offerTrade(carolShift, datum, "spät", "früh")
+	if len(alice.trades()) != 0 {
+		t.Fatal("trade proposed across teams")
+	}
+	if offers := alice.shifts()[0].Search[1]["offers"]; offers != float64(0) {
+		t.Fatalf("offers of another team are counted: %v", offers)
+	}
+
+	bobShift := bob.addShift(datum, "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	trades := alice.trades()
+	if len(trades) != 1 || !trades[0].hasParticipant("bob") {
+		t.Fatalf("unexpected trades %+v", trades)
+	}
+	if shifts := alice.shifts(); shifts[0].Team != "icu" || shifts[0].Search[1]["offers"] != float64(1) {
+		t.Fatalf("unexpected shifts %+v", shifts)
+	}
+
+	var roster []TeamShift
+	alice.expect(http.MethodGet, "/teams/icu/shifts", nil, http.StatusOK, &roster)
+	if len(roster) != 2 {
+		t.Fatalf("unexpected roster %+v", roster)
+	}
+	carol.expect(http.MethodGet, "/teams/icu/shifts", nil, http.StatusNotFound, nil)
+	admin.expect(http.MethodDelete, "/admin/teams/icu", nil, http.StatusConflict, nil)
+}
+
+func TestSupervisorScope(t *testing.T) {
+	app, server := newTestApp(t)
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	boss := register(t, server, "boss")
+	if err := app.Store.SetUserRoles("boss", []string{roleSupervisor}); err != nil {
+		t.Fatal(err)
+	}
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "icu"}, http.StatusCreated, nil)
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "er"}, http.StatusCreated, nil)
+	for _, member := range []string{"alice", "boss"} {
+		admin.expect(http.MethodPut, "/admin/teams/icu/members/"+member, nil, http.StatusOK, nil)
+	}
+	admin.expect(http.MethodPut, "/admin/teams/er/members/bob", nil, http.StatusOK, nil)
+	datum := nextWeek()
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "früh")
+
+	// Supervisors reach the shifts of their teams only, admins all shifts
+	boss.expect(http.MethodGet, "/shifts/"+aliceShift, nil, http.StatusOK, nil)
+	boss.expect(http.MethodGet, "/shifts/"+bobShift, nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodDelete, "/shifts/"+bobShift, nil, http.StatusNotFound, nil)
+	admin.expect(http.MethodGet, "/shifts/"+bobShift, nil, http.StatusOK, nil)
+
+	boss.expect(http.MethodGet, "/teams/icu/rotation", nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodGet, "/teams/er/rotation", nil, http.StatusForbidden, nil)
+	boss.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Datum: datum, Time: "spät", Team: "er"}, http.StatusUnprocessableEntity, nil)
+	boss.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Datum: datum, Time: "spät"}, http.StatusForbidden, nil)
+	boss.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Datum: datum, Time: "spät", Team: "icu"}, http.StatusCreated, nil)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	app, server := newTestApp(t)
+	operator := register(t, server, "operator")
+	if err := app.Store.SetUserRoles("operator", []string{roleAdmin, roleOperator}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	datum := nextWeek()
+
+	alice.expect(http.MethodPost, "/admin/tenants", TenantReceive{ID: "acme", Name: "Acme"}, http.StatusForbidden, nil)
+	operator.expect(http.MethodPost, "/admin/tenants", TenantReceive{ID: "acme", Name: "Acme", Admin: &User{Username: "boss", Password: "secret"}}, http.StatusCreated, nil)
+	operator.expect(http.MethodPost, "/admin/tenants", TenantReceive{ID: "acme", Name: "Acme"}, http.StatusConflict, nil)
+	var tenants []Tenant
+	operator.expect(http.MethodGet, "/admin/tenants", nil, http.StatusOK, &tenants)
+	if len(tenants) != 2 {
+		t.Fatalf("unexpected tenants %+v", tenants)
+	}
+
+	// Only the admins of a tenant add its users
+	newTestClient(t, server).expect(http.MethodPut, "/login", User{Username: "eve", Password: "secret", Tenant: "nowhere"}, http.StatusForbidden, nil)
+	newTestClient(t, server).expect(http.MethodPut, "/login", User{Username: "eve", Password: "secret", Tenant: "acme"}, http.StatusForbidden, nil)
+	newTestClient(t, server).expect(http.MethodPost, "/login", User{Username: "boss", Password: "secret", Tenant: defaultTenant}, http.StatusUnauthorized, nil)
+	boss := newTestClient(t, server)
+	boss.expect(http.MethodPost, "/login", User{Username: "boss", Password: "secret"}, http.StatusOK, nil)
+	alice.expect(http.MethodPost, "/admin/users", User{Username: "dave", Password: "secret"}, http.StatusForbidden, nil)
+	boss.expect(http.MethodPost, "/admin/users", User{Username: "dave"}, http.StatusBadRequest, nil)
+	var created UserRoles
+	boss.expect(http.MethodPost, "/admin/users", User{Username: "dave", Password: "secret", Tenant: defaultTenant}, http.StatusCreated, &created)
+	if len(created.Roles) != 1 || created.Roles[0] != roleEmployee {
+		t.Fatalf("unexpected user %+v", created)
+	}
+	boss.expect(http.MethodPost, "/admin/users", User{Username: "alice", Password: "secret"}, http.StatusConflict, nil)
+	dave := newTestClient(t, server)
+	dave.expect(http.MethodPost, "/login", User{Username: "dave", Password: "secret"}, http.StatusOK, nil)
+
+	// Dave would swap, but he works for another tenant
+	aliceShift := alice.addShift(datum, "früh")
+	daveShift := dave.addShift(datum, "spät")
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	dave.offerTrade(daveShift, datum, "spät", "früh")
+	if len(alice.trades()) != 0 || len(dave.trades()) != 0 {
+		t.Fatal("trade proposed across tenants")
+	}
+	if offers := alice.shifts()[0].Search[1]["offers"]; offers != float64(0) {
+		t.Fatalf("offers of another tenant are counted: %v", offers)
+	}
+
+	var users []UserRoles
+	boss.expect(http.MethodGet, "/admin/users", nil, http.StatusOK, &users)
+	if len(users) != 2 || users[0].Username != "boss" || users[1].Username != "dave" {
+		t.Fatalf("unexpected users %+v", users)
+	}
+	boss.expect(http.MethodGet, "/admin/users/alice/roles", nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodPut, "/admin/users/dave/roles", UserRoles{Roles: []string{roleOperator}}, http.StatusForbidden, nil)
+	boss.expect(http.MethodGet, "/shifts/"+aliceShift, nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodDelete, "/shifts/"+aliceShift, nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodGet, "/shifts/"+daveShift, nil, http.StatusOK, nil)
+	boss.expect(http.MethodPut, "/shift-types/nacht", ShiftType{Name: "nacht", Start: "22:00", End: "06:00"}, http.StatusForbidden, nil)
+	boss.expect(http.MethodDelete, "/shift-types/nacht", nil, http.StatusForbidden, nil)
+
+	// Team names are unique per tenant only
+	operator.expect(http.MethodPost, "/admin/teams", Team{Name: "icu"}, http.StatusCreated, nil)
+	operator.expect(http.MethodPut, "/admin/teams/icu/members/alice", nil, http.StatusOK, nil)
+	var teams []Team
+	boss.expect(http.MethodGet, "/admin/teams", nil, http.StatusOK, &teams)
+	if len(teams) != 0 {
+		t.Fatalf("teams of another tenant are listed: %+v", teams)
+	}
+	boss.expect(http.MethodGet, "/admin/teams/icu", nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodPut, "/admin/teams/icu", Team{Name: "ward"}, http.StatusNotFound, nil)
+	boss.expect(http.MethodDelete, "/admin/teams/icu", nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodPost, "/admin/teams", Team{Name: "icu"}, http.StatusCreated, nil)
+	boss.expect(http.MethodPut, "/admin/teams/icu/members/alice", nil, http.StatusNotFound, nil)
+	var team Team
+	boss.expect(http.MethodPut, "/admin/teams/icu/members/dave", nil, http.StatusOK, &team)
+	if len(team.Members) != 1 || team.Members[0] != "dave" {
+		t.Fatalf("unexpected members %+v", team.Members)
+	}
+	boss.expect(http.MethodDelete, "/admin/teams/icu", nil, http.StatusOK, nil)
+	operator.expect(http.MethodGet, "/admin/teams/icu", nil, http.StatusOK, &team)
+	if len(team.Members) != 1 || team.Members[0] != "alice" {
+		t.Fatalf("unexpected members %+v", team.Members)
+	}
+
+	// So are the names of rotation templates
+	operator.expect(http.MethodPost, "/rotations", RotationTemplate{Name: "wechsel", Days: []string{"früh", ""}}, http.StatusCreated, nil)
+	var rotations []RotationTemplate
+	boss.expect(http.MethodGet, "/rotations", nil, http.StatusOK, &rotations)
+	if len(rotations) != 0 {
+		t.Fatalf("rotations of another tenant are listed: %+v", rotations)
+	}
+	boss.expect(http.MethodGet, "/rotations/wechsel", nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodPut, "/rotations/wechsel", RotationTemplate{Days: []string{"nacht"}}, http.StatusNotFound, nil)
+	boss.expect(http.MethodDelete, "/rotations/wechsel", nil, http.StatusNotFound, nil)
+	boss.expect(http.MethodPost, "/rotations", RotationTemplate{Name: "wechsel", Days: []string{"nacht"}}, http.StatusCreated, nil)
+	boss.expect(http.MethodDelete, "/rotations/wechsel", nil, http.StatusOK, nil)
+	var rotation RotationTemplate
+	operator.expect(http.MethodGet, "/rotations/wechsel", nil, http.StatusOK, &rotation)
+	if strings.Join(rotation.Days, ",") != "früh," {
+		t.Fatalf("unexpected days %q", rotation.Days)
+	}
+}
+
+func TestShiftTypeRename(t *testing.T) {
+	app, server := newTestApp(t)
+	operator := register(t, server, "operator")
+	if err := app.Store.SetUserRoles("operator", []string{roleAdmin, roleOperator}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming a slot onto another one is a conflict, both keep their times
+	var night ShiftType
+	operator.expect(http.MethodGet, "/shift-types/nacht", nil, http.StatusOK, &night)
+	night.Name = "früh"
+	operator.expect(http.MethodPut, "/shift-types/nacht", night, http.StatusConflict, nil)
+	var early ShiftType
+	operator.expect(http.MethodGet, "/shift-types/früh", nil, http.StatusOK, &early)
+	if early.Start != "06:00" {
+		t.Fatalf("früh was overwritten: %+v", early)
+	}
+	operator.expect(http.MethodGet, "/shift-types/nacht", nil, http.StatusOK, nil)
+
+	night.Name = "nachtdienst"
+	operator.expect(http.MethodPut, "/shift-types/nacht", night, http.StatusOK, nil)
+	operator.expect(http.MethodGet, "/shift-types/nachtdienst", nil, http.StatusOK, nil)
+	operator.expect(http.MethodGet, "/shift-types/nacht", nil, http.StatusNotFound, nil)
+}
+
+func TestSkillRequirements(t *testing.T) {
+	app, server := newTestApp(t)
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin, roleOperator}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+
+	var night ShiftType
+	admin.expect(http.MethodGet, "/shift-types/nacht", nil, http.StatusOK, &night)
+	night.Skills = []string{"nurse"}
+	admin.expect(http.MethodPut, "/shift-types/nacht", night, http.StatusOK, nil)
+	admin.expect(http.MethodPut, "/admin/users/bob/skills", UserSkills{Skills: []string{"nurse", "icu"}}, http.StatusOK, nil)
+	admin.expect(http.MethodPut, "/admin/users/nobody/skills", UserSkills{Skills: []string{"nurse"}}, http.StatusNotFound, nil)
+
+	// Alice would take bob's night shift, but she is no nurse
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "nacht")
+	bob.offerTrade(bobShift, datum, "nacht", "früh")
+	updated := alice.offerTrade(aliceShift, datum, "früh", "nacht")
+	if len(alice.trades()) != 0 {
+		t.Fatal("trade proposed to an unqualified user")
+	}
+	if len(updated.Excluded) != 1 || updated.Excluded[0].Uid != bobShift || updated.Excluded[0].Missing[0] != "nurse" {
+		t.Fatalf("unexpected exclusions %+v", updated.Excluded)
+	}
+
+	var skills UserSkills
+	admin.expect(http.MethodPut, "/admin/users/alice/skills", UserSkills{Skills: []string{"nurse"}}, http.StatusOK, &skills)
+	if len(skills.Skills) != 1 {
+		t.Fatalf("unexpected skills %+v", skills)
+	}
+	alice.offerTrade(aliceShift, datum, "früh", "nacht")
+	trades := alice.trades()
+	if len(trades) != 1 {
+		t.Fatalf("unexpected trades %+v", trades)
+	}
+
+	// The swap is rejected if alice loses the skill before everyone accepted
+	admin.expect(http.MethodPut, "/admin/users/alice/skills", UserSkills{Skills: []string{}}, http.StatusOK, nil)
+	alice.expect(http.MethodPost, "/trades/"+trades[0].Uid+"/accept", nil, http.StatusOK, nil)
+	bob.expect(http.MethodPost, "/trades/"+trades[0].Uid+"/accept", nil, http.StatusConflict, nil)
+	if shifts := alice.shifts(); shifts[0].Uid != aliceShift {
+		t.Fatal("unqualified user received the shift")
+	}
+
+	// Skills of a single shift add to those of its type
+	later := time.Now().AddDate(0, 0, 10).Format(dateLayout)
+	var created map[string]string
+	bob.expect(http.MethodPost, "/shifts", ShiftReceive{Datum: later, Time: "spät", Skills: []string{"icu"}}, http.StatusCreated, &created)
+	var shift ShiftReceive
+	bob.expect(http.MethodGet, "/shifts/"+created["uid"], nil, http.StatusOK, &shift)
+	if len(shift.Skills) != 1 || shift.Skills[0] != "icu" {
+		t.Fatalf("unexpected shift skills %+v", shift.Skills)
+	}
+	bob.expect(http.MethodPost, "/shifts", ShiftReceive{Datum: later, Time: "spät", Skills: []string{" "}}, http.StatusUnprocessableEntity, nil)
+
+	// Only supervisors lift the requirement, bob's attempts keep it
+	lifted := map[string]interface{}{"datum": later, "time": "spät", "skills": []string{}}
+	bob.expect(http.MethodPut, "/shifts/"+created["uid"], lifted, http.StatusOK, nil)
+	var patched ShiftReceive
+	bob.expect(http.MethodPatch, "/shifts/"+created["uid"], lifted, http.StatusOK, &patched)
+	if len(patched.Skills) != 1 || patched.Skills[0] != "icu" {
+		t.Fatalf("unexpected patched skills %+v", patched.Skills)
+	}
+	bob.expect(http.MethodGet, "/shifts/"+created["uid"], nil, http.StatusOK, &shift)
+	if len(shift.Skills) != 1 || shift.Skills[0] != "icu" {
+		t.Fatalf("employee changed the shift skills: %+v", shift.Skills)
+	}
+	admin.expect(http.MethodPut, "/shifts/"+created["uid"], lifted, http.StatusOK, nil)
+	var cleared ShiftReceive
+	admin.expect(http.MethodGet, "/shifts/"+created["uid"], nil, http.StatusOK, &cleared)
+	if len(cleared.Skills) != 0 {
+		t.Fatalf("supervisor could not change the shift skills: %+v", cleared.Skills)
+	}
+}
+
+func TestWorkingTimeRules(t *testing.T) {
+	app, server := newTestApp(t)
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	day := func(offset int) string {
+		return time.Now().AddDate(0, 0, 7+offset).Format(dateLayout)
+	}
+	violated := func(c *testClient, shift ShiftReceive, rule string) {
+		t.Helper()
+		var body struct {
+			Violations []RuleViolation `json:"violations"`
+		}
+		c.expect(http.MethodPost, "/shifts", shift, http.StatusUnprocessableEntity, &body)
+		for _, violation := range body.Violations {
+			if violation.Rule == rule {
+				return
+			}
+		}
+		t.Fatalf("%s not violated: %+v", rule, body.Violations)
+	}
+
+	// An early shift right after a night shift leaves no rest
+	alice.addShift(day(0), "nacht")
+	violated(alice, ShiftReceive{Datum: day(1), Time: "früh"}, ruleMinRest)
+	violated(alice, ShiftReceive{Datum: day(0), Time: "spät"}, ruleNoDoubleBooking)
+
+	var rules RuleConfig
+	admin.expect(http.MethodGet, "/admin/rules", nil, http.StatusOK, &rules)
+	if rules != app.Config.Rules {
+		t.Fatalf("unexpected default rules %+v", rules)
+	}
+	alice.expect(http.MethodPut, "/admin/rules", RuleConfig{}, http.StatusForbidden, nil)
+	admin.expect(http.MethodPut, "/admin/rules", RuleConfig{MaxConsecutiveDays: 2, NoDoubleBooking: true}, http.StatusOK, &rules)
+	alice.addShift(day(1), "früh")
+	violated(alice, ShiftReceive{Datum: day(2), Time: "früh"}, ruleMaxConsecutiveDays)
+	admin.expect(http.MethodPut, "/admin/rules", app.Config.Rules, http.StatusOK, nil)
+
+	// Moving a shift right after a night shift breaks the rest period too
+	alice.addShift(day(12), "nacht")
+	later := alice.addShift(day(14), "spät")
+	for _, method := range []string{http.MethodPut, http.MethodPatch} {
+		var body struct {
+			Violations []RuleViolation `json:"violations"`
+		}
+		alice.expect(method, "/shifts/"+later, ShiftReceive{Datum: day(13), Time: "früh"}, http.StatusUnprocessableEntity, &body)
+		if len(body.Violations) == 0 || body.Violations[0].Rule != ruleMinRest {
+			t.Fatalf("unexpected violations %+v", body.Violations)
+		}
+	}
+	alice.expect(http.MethodPut, "/shifts/"+later, ShiftReceive{Datum: day(13), Time: "nacht"}, http.StatusOK, nil)
+
+	// Dave would take carol's early shift, but it starts 8h after his late shift ends
+	carol := register(t, server, "carol")
+	dave := register(t, server, "dave")
+	carolShift := carol.addShift(day(5), "früh")
+	dave.addShift(day(4), "spät")
+	daveShift := dave.addShift(day(5), "nacht")
+	dave.offerTrade(daveShift, day(5), "nacht", "früh")
+	updated := carol.offerTrade(carolShift, day(5), "früh", "nacht")
+	if len(carol.trades()) != 0 {
+		t.Fatal("trade proposed that breaks the rest period")
+	}
+	if len(updated.Excluded) != 1 || updated.Excluded[0].Uid != daveShift || updated.Excluded[0].Violations[0].Rule != ruleMinRest {
+		t.Fatalf("unexpected exclusions %+v", updated.Excluded)
+	}
+}
+
+func TestDoubleBooking(t *testing.T) {
+	app, server := newTestApp(t)
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	// The slot stays unique with all working time rules switched off
+	admin.expect(http.MethodPut, "/admin/rules", RuleConfig{}, http.StatusOK, nil)
+
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	day := nextWeek()
+	early := alice.addShift(day, "früh")
+	var conflict struct {
+		Message  string `json:"message"`
+		Conflict string `json:"conflict"`
+	}
+	alice.expect(http.MethodPost, "/shifts", ShiftReceive{Datum: day, Time: "früh"}, http.StatusConflict, &conflict)
+	if conflict.Conflict != early {
+		t.Fatalf("conflict names %q instead of %q", conflict.Conflict, early)
+	}
+
+	night := alice.addShift(day, "nacht")
+	conflict.Conflict = ""
+	alice.expect(http.MethodPut, "/shifts/"+night, ShiftReceive{Datum: day, Time: "früh"}, http.StatusConflict, &conflict)
+	if conflict.Conflict != early {
+		t.Fatalf("conflict names %q instead of %q", conflict.Conflict, early)
+	}
+
+	// Alice would receive a second early shift on the same date
+	bobShift := bob.addShift(day, "früh")
+	bob.offerTrade(bobShift, day, "früh", "nacht")
+	updated := alice.offerTrade(night, day, "nacht", "früh")
+	if len(alice.trades()) != 0 {
+		t.Fatal("trade proposed that double books a slot")
+	}
+	if len(updated.Excluded) != 1 || updated.Excluded[0].Violations[0].Rule != ruleUniqueSlot || updated.Excluded[0].Violations[0].Conflict != early {
+		t.Fatalf("unexpected exclusions %+v", updated.Excluded)
+	}
+
+	// The store refuses double bookings that bypass the handlers
+	date, err := parseDate(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Store.CreateShift(Shift{ID: "duplicate", Username: "alice", Date: date, Time: "früh"}); !errors.Is(err, errShiftConflict) {
+		t.Fatalf("store accepted a double booking: %v", err)
+	}
+}
+
+func TestOpenShifts(t *testing.T) {
+	app, server := newTestApp(t)
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	carol := register(t, server, "carol")
+	datum := nextWeek()
+
+	// Alice gives her shift away, released shifts stay out of swaps
+	aliceShift := alice.addShift(datum, "früh")
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	alice.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Uid: aliceShift}, http.StatusCreated, nil)
+	alice.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Uid: aliceShift}, http.StatusConflict, nil)
+	bob.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Uid: aliceShift}, http.StatusNotFound, nil)
+	if shifts := alice.shifts(); len(shifts) != 1 || !shifts[0].Released || shifts[0].Trade {
+		t.Fatalf("unexpected shifts %+v", shifts)
+	}
+	bobShift := bob.addShift(datum, "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	if len(bob.trades()) != 0 {
+		t.Fatal("trade proposed with a released shift")
+	}
+	alice.expect(http.MethodPatch, "/shifts/"+aliceShift, ShiftReceive{Datum: datum, Time: "früh", Trade: true}, http.StatusConflict, nil)
+
+	var pool []OpenShiftReceive
+	carol.expect(http.MethodGet, "/open-shifts", nil, http.StatusOK, &pool)
+	if len(pool) != 1 || pool[0].Uid != aliceShift || pool[0].ReleasedBy != "alice" {
+		t.Fatalf("unexpected open shifts %+v", pool)
+	}
+	alice.expect(http.MethodPost, "/open-shifts/"+aliceShift+"/claim", nil, http.StatusConflict, nil)
+	bob.expect(http.MethodPost, "/open-shifts/"+aliceShift+"/claim", nil, http.StatusUnprocessableEntity, nil) // works the same date
+	carol.expect(http.MethodPost, "/open-shifts/"+aliceShift+"/claim", nil, http.StatusOK, nil)
+	if len(alice.shifts()) != 0 || len(carol.shifts()) != 1 {
+		t.Fatal("claimed shift not handed over")
+	}
+	bob.expect(http.MethodPost, "/open-shifts/"+aliceShift+"/claim", nil, http.StatusConflict, nil)
+
+	// An unfilled slot of a team, picked up without giveback
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "icu"}, http.StatusCreated, nil)
+	admin.expect(http.MethodPut, "/admin/teams/icu/members/bob", nil, http.StatusOK, nil)
+	admin.expect(http.MethodPut, "/admin/teams/icu/members/carol", nil, http.StatusOK, nil)
+	later := time.Now().AddDate(0, 0, 14).Format(dateLayout)
+	alice.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Datum: later, Time: "nacht", Team: "icu"}, http.StatusForbidden, nil)
+	var posted OpenShiftReceive
+	admin.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Datum: later, Time: "nacht", Team: "icu", Skills: []string{"nurse"}, PickupOnly: true}, http.StatusCreated, &posted)
+	if posted.Owner != "" || !posted.PickupOnly {
+		t.Fatalf("unexpected posting %+v", posted)
+	}
+	alice.expect(http.MethodGet, "/open-shifts", nil, http.StatusOK, &pool)
+	if len(pool) != 0 {
+		t.Fatalf("open shift of another team listed %+v", pool)
+	}
+	alice.expect(http.MethodPost, "/open-shifts/"+posted.Uid+"/claim", nil, http.StatusForbidden, nil)
+	var refused struct {
+		Missing []string `json:"missing"`
+	}
+	bob.expect(http.MethodPost, "/open-shifts/"+posted.Uid+"/claim", nil, http.StatusForbidden, &refused)
+	if len(refused.Missing) != 1 || refused.Missing[0] != "nurse" {
+		t.Fatalf("unexpected refusal %+v", refused)
+	}
+	admin.expect(http.MethodPut, "/admin/users/bob/skills", UserSkills{Skills: []string{"nurse"}}, http.StatusOK, nil)
+	bob.expect(http.MethodPost, "/open-shifts/"+posted.Uid+"/claim", nil, http.StatusOK, nil)
+	bob.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Uid: posted.Uid}, http.StatusConflict, nil)
+	bob.expect(http.MethodPatch, "/shifts/"+posted.Uid, ShiftReceive{Datum: later, Time: "nacht", Trade: true}, http.StatusConflict, nil)
+
+	// Withdrawing a posting without owner deletes the shift
+	admin.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Datum: later, Time: "früh"}, http.StatusCreated, &posted)
+	carol.expect(http.MethodDelete, "/open-shifts/"+posted.Uid, nil, http.StatusNotFound, nil)
+	admin.expect(http.MethodDelete, "/open-shifts/"+posted.Uid, nil, http.StatusOK, nil)
+	admin.expect(http.MethodGet, "/open-shifts", nil, http.StatusOK, &pool)
+	if len(pool) != 0 {
+		t.Fatalf("withdrawn shift still open %+v", pool)
+	}
+}
+
+func TestOpenShiftClaimRace(t *testing.T) {
+	app, server := newTestApp(t)
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	var posted OpenShiftReceive
+	admin.expect(http.MethodPost, "/open-shifts", OpenShiftReceive{Datum: nextWeek(), Time: "spät"}, http.StatusCreated, &posted)
+
+	// Of several concurrent claims exactly one wins
+	clients := make([]*testClient, 5)
+	for i := range clients {
+		clients[i] = register(t, server, fmt.Sprintf("user%d", i))
+	}
+	statuses := make(chan int, len(clients))
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *testClient) {
+			defer wg.Done()
+			status, _ := c.do(http.MethodPost, "/open-shifts/"+posted.Uid+"/claim", nil)
+			statuses <- status
+		}(c)
+	}
+	wg.Wait()
+	close(statuses)
+
+	claimed := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			claimed++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	if claimed != 1 {
+		t.Fatalf("%d claims succeeded", claimed)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+	aliceEvents := alice.events()
+	bobEvents := bob.events()
+
+	aliceShift := alice.addShift(datum, "früh")
+	if event := waitEvent(t, aliceEvents, eventShift); event.Data["action"] != "created" || event.Data["uid"] != aliceShift {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// Offers concern everyone, the shift itself only alice
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	for _, events := range []<-chan streamedEvent{aliceEvents, bobEvents} {
+		if event := waitEvent(t, events, eventOffers); event.Data["datum"] != datum {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	}
+
+	// A matching offer proposes a trade to both
+	bobShift := bob.addShift(datum, "spät")
+	if event := waitEvent(t, bobEvents, eventShift); event.Data["uid"] != bobShift {
+		t.Fatalf("bob received an event of another shift %+v", event)
+	}
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	var tradeID string
+	for _, events := range []<-chan streamedEvent{aliceEvents, bobEvents} {
+		event := waitEvent(t, events, eventTrade)
+		if event.Data["status"] != tradePending {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		tradeID = event.Data["uid"].(string)
+	}
+
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	event := waitEvent(t, aliceEvents, eventTrade)
+	for event.Data["status"] != tradeCompleted {
+		event = waitEvent(t, aliceEvents, eventTrade)
+	}
+	if event = waitEvent(t, aliceEvents, eventShift); event.Data["action"] != "swapped" || event.Data["uid"] != bobShift {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestDashboardSocket(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+
+	// The handshake needs the session cookie
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/shifts/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a session, got %v (%+v)", err, resp)
+	}
+
+	conn := alice.socket()
+	send := func(request SocketRequest) {
+		t.Helper()
+		if err := conn.WriteJSON(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(SocketRequest{Type: socketSubscribe, Ref: "1", ShiftTypes: []string{"unbekannt"}})
+	if reply := waitSocket(t, conn, socketError); reply.Ref != "1" || reply.Data["status"] != float64(http.StatusUnprocessableEntity) {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+
+	// Subscribing sends the current counts of the date
+	send(SocketRequest{Type: socketSubscribe, Ref: "2", Dates: []string{datum}, ShiftTypes: []string{"spät"}})
+	if reply := waitSocket(t, conn, socketSubscribed); reply.Ref != "2" {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if reply := waitSocket(t, conn, eventOffers); reply.Data["datum"] != datum || len(reply.Data["offers"].(map[string]interface{})) != 0 {
+		t.Fatalf("unexpected offers %+v", reply)
+	}
+
+	// Offers of other dates are not sent, the counts of the date are
+	other := time.Now().AddDate(0, 0, 8).Format(dateLayout)
+	otherShift := bob.addShift(other, "spät")
+	bob.offerTrade(otherShift, other, "spät", "früh")
+	bobShift := bob.addShift(datum, "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	reply := waitSocket(t, conn, eventOffers)
+	if reply.Data["datum"] != datum || reply.Data["offers"].(map[string]interface{})["spät"] != float64(1) {
+		t.Fatalf("unexpected offers %+v", reply)
+	}
+
+	// A trade intent of an unknown shift fails, one of alice's shift proposes
+	// the swap with bob
+	send(SocketRequest{Type: socketTrade, Ref: "3", Uid: "unknown", Search: []string{"spät"}})
+	if reply := waitSocket(t, conn, socketError); reply.Ref != "3" || reply.Data["status"] != float64(http.StatusNotFound) {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	aliceShift := alice.addShift(datum, "früh")
+	send(SocketRequest{Type: socketTrade, Ref: "4", Uid: aliceShift, Search: []string{"spät"}})
+	if reply := waitSocket(t, conn, socketResult); reply.Ref != "4" || reply.Data["uid"] != aliceShift || reply.Data["trade"] != true {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if reply := waitSocket(t, conn, eventTrade); reply.Data["status"] != tradePending {
+		t.Fatalf("unexpected trade %+v", reply)
+	}
+	if trades := bob.trades(); len(trades) != 1 {
+		t.Fatalf("expected a trade proposed to bob, got %+v", trades)
+	}
+}
+
+// calendarEvents fetches a calendar feed and returns its events by UID with
+// their properties
+func calendarEvents(t *testing.T, url string) (int, map[string]map[string]string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+
+	events := make(map[string]map[string]string)
+	var event map[string]string
+	for _, line := range strings.Split(strings.ReplaceAll(string(body), "\r\n ", ""), "\r\n") {
+		name, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "BEGIN:VEVENT":
+			event = make(map[string]string)
+		case line == "END:VEVENT":
+			events[event["UID"]] = event
+			event = nil
+		case event != nil:
+			event[name] = value
+		}
+	}
+	return resp.StatusCode, events
+}
+
+func TestCalendarFeed(t *testing.T) {
+	app, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+
+	alice.expect(http.MethodGet, "/calendar", nil, http.StatusNotFound, nil)
+	var feed CalendarFeedReceive
+	alice.expect(http.MethodPost, "/calendar", nil, http.StatusCreated, &feed)
+	if feed.Token == "" || !strings.HasSuffix(feed.URL, "/calendar/"+feed.Token+".ics") {
+		t.Fatalf("unexpected feed %+v", feed)
+	}
+
+	// Events carry the slot's times and a UID derived from the shift ID
+	aliceShift := alice.addShift(datum, "früh")
+	doomed := alice.addShift(time.Now().AddDate(0, 0, 9).Format(dateLayout), "spät")
+	status, events := calendarEvents(t, feed.URL)
+	if status != http.StatusOK || len(events) != 2 {
+		t.Fatalf("unexpected feed %d %+v", status, events)
+	}
+	day, _ := parseDate(datum)
+	startsAt, endsAt := shiftTimes(day, defaultShiftTypes[0])
+	event := events[app.calendarUID(aliceShift)]
+	if event["DTSTART"] != icsTime(startsAt) || event["DTEND"] != icsTime(endsAt) || event["STATUS"] != "CONFIRMED" || event["SEQUENCE"] != "0" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// Rotation replaces the token
+	var rotated CalendarFeedReceive
+	alice.expect(http.MethodPost, "/calendar", nil, http.StatusCreated, &rotated)
+	if status, _ := calendarEvents(t, feed.URL); status != http.StatusNotFound || rotated.Token == feed.Token {
+		t.Fatalf("old token still works: %d", status)
+	}
+	feed = rotated
+
+	// Updates raise the sequence, deleted shifts are cancelled
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	alice.expect(http.MethodDelete, "/shifts/"+doomed, nil, http.StatusOK, nil)
+	_, events = calendarEvents(t, feed.URL)
+	if event := events[app.calendarUID(aliceShift)]; event["SEQUENCE"] != "1" || !strings.Contains(event["DESCRIPTION"], "Offered for trade") {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if event := events[app.calendarUID(doomed)]; event["STATUS"] != "CANCELLED" || event["SEQUENCE"] != "1" {
+		t.Fatalf("deleted shift not cancelled: %+v", event)
+	}
+
+	// A trade cancels the shift given away and adds the one received
+	bobShift := bob.addShift(datum, "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	tradeID := alice.trades()[0].Uid
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	_, events = calendarEvents(t, feed.URL)
+	if event := events[app.calendarUID(aliceShift)]; event["STATUS"] != "CANCELLED" || event["SEQUENCE"] != "2" {
+		t.Fatalf("traded shift not cancelled: %+v", event)
+	}
+	if event := events[app.calendarUID(bobShift)]; event["STATUS"] != "CONFIRMED" || event["SUMMARY"] != "Shift spät" {
+		t.Fatalf("received shift missing: %+v", event)
+	}
+
+	alice.expect(http.MethodDelete, "/calendar", nil, http.StatusOK, nil)
+	if status, _ := calendarEvents(t, feed.URL); status != http.StatusNotFound {
+		t.Fatalf("revoked feed still works: %d", status)
+	}
+}
+
+// importRoster posts a roster file to /roster/import and decodes the report
+func (c *testClient) importRoster(query, content string, status int) RosterReport {
+	c.t.Helper()
+	resp, err := c.client.Post(c.server.URL+"/roster/import?"+query, "text/csv", strings.NewReader(content))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		c.t.Fatalf("POST /roster/import?%s: got status %d, want %d: %s", query, resp.StatusCode, status, body)
+	}
+	var report RosterReport
+	if status == http.StatusOK || status == http.StatusUnprocessableEntity {
+		if err := json.Unmarshal(body, &report); err != nil {
+			c.t.Fatalf("POST /roster/import: %v: %s", err, body)
+		}
+	}
+	return report
+}
+
+func TestRosterImport(t *testing.T) {
+	app, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	boss := register(t, server, "boss")
+	if err := app.Store.SetUserRoles("boss", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	lead := register(t, server, "lead")
+	if err := app.Store.SetUserRoles("lead", []string{roleSupervisor}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().AddDate(0, 0, 7)
+	day := func(offset int) string { return start.AddDate(0, 0, offset).Format(dateLayout) }
+
+	kept := alice.addShift(day(0), "früh")
+	moved := alice.addShift(day(1), "spät")
+	alice.addShift(day(3), "spät")
+	bob.addShift(day(10), "früh")
+
+	roster := "username,datum,time\n" +
+		"alice," + day(0) + ",früh\n" +
+		"alice," + day(1) + ",22:00\n" +
+		"bob," + day(3) + ",spät\n" +
+		"carol," + day(3) + ",früh\n" +
+		"bob," + day(3) + ",mittag\n"
+	alice.importRoster("dry_run=true", roster, http.StatusForbidden)
+	// Supervisors only import the shifts of their teams
+	report := lead.importRoster("dry_run=true", roster, http.StatusOK)
+	if len(report.Errors) != 5 || report.Errors[0].Field != "team" || report.Inserted+report.Updated+report.Deleted != 0 {
+		t.Fatalf("unexpected supervisor dry run %+v", report)
+	}
+
+	report = boss.importRoster("dry_run=true", roster, http.StatusOK)
+	if len(report.Errors) != 2 || report.Errors[0].Row != 5 || report.Errors[0].Field != "username" || report.Errors[1].Row != 6 || report.Errors[1].Field != "time" {
+		t.Fatalf("unexpected row errors %+v", report.Errors)
+	}
+	if report.From != day(0) || report.To != day(3) || report.Inserted != 1 || report.Updated != 1 || report.Deleted != 1 || report.Unchanged != 1 {
+		t.Fatalf("unexpected diff %+v", report)
+	}
+	for _, change := range report.Changes {
+		if change.Action == rosterUpdate && (change.Uid != moved || change.Time != "nacht" || change.Previous.Time != "spät") {
+			t.Fatalf("unexpected update %+v", change)
+		}
+	}
+	boss.importRoster("", roster, http.StatusUnprocessableEntity)
+	if shifts := alice.shifts(); len(shifts) != 3 {
+		t.Fatalf("rejected roster changed shifts: %+v", shifts)
+	}
+
+	events := alice.events()
+	roster = strings.Join(strings.Split(roster, "\n")[:4], "\n")
+	report = boss.importRoster("", roster, http.StatusOK)
+	if report.DryRun || len(report.Errors) != 0 || report.Inserted != 1 || report.Updated != 1 || report.Deleted != 1 {
+		t.Fatalf("unexpected import %+v", report)
+	}
+	waitEvent(t, events, eventShift)
+	shifts := alice.shifts()
+	if len(shifts) != 2 || shifts[0].Uid != kept || shifts[1].Uid != moved || shifts[1].Time != "nacht" {
+		t.Fatalf("unexpected shifts after import: %+v", shifts)
+	}
+	// Shifts of bob outside of the roster's dates are kept
+	if shifts := bob.shifts(); len(shifts) != 2 {
+		t.Fatalf("unexpected shifts of bob: %+v", shifts)
+	}
+
+	// A second import of the same roster changes nothing
+	report = boss.importRoster("", roster, http.StatusOK)
+	if report.Unchanged != 3 || report.Inserted+report.Updated+report.Deleted != 0 {
+		t.Fatalf("repeated import changed shifts: %+v", report)
+	}
+
+	// Column mapping and date format are taken from the query
+	custom := "Mitarbeiter;Tag;Schicht\nAlice;" + start.AddDate(0, 0, 4).Format("02.01.2006") + ";Spätdienst\n"
+	query := neturl.Values{"username_column": {"Mitarbeiter"}, "date_column": {"Tag"}, "time_column": {"Schicht"}, "delimiter": {";"}, "date_format": {"02.01.2006"}}
+	report = boss.importRoster(query.Encode(), custom, http.StatusOK)
+	if report.Inserted != 1 || report.Changes[0].Username != "alice" || report.Changes[0].Time != "spät" {
+		t.Fatalf("unexpected mapped import %+v", report)
+	}
+	boss.importRoster("username_column=Name", custom, http.StatusBadRequest)
+
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Frühdienst\r\nDTSTART;VALUE=DATE:" + start.AddDate(0, 0, 5).Format("20060102") + "\r\n" +
+		"ATTENDEE;CN=\"Bob, B.\":mailto:bob@example.com\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:2\r\nDTSTART:" + start.AddDate(0, 0, 6).Format("20060102") + "T140000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:3\r\nSTATUS:CANCELLED\r\nDTSTART:" + start.AddDate(0, 0, 6).Format("20060102") + "T220000\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+	report = boss.importRoster("format=ics&dry_run=true", ics, http.StatusOK)
+	if len(report.Errors) != 1 || report.Errors[0].Row != 2 || report.Errors[0].Field != "ATTENDEE" || report.Inserted != 1 {
+		t.Fatalf("unexpected ICS dry run %+v", report)
+	}
+	report = boss.importRoster("format=ics&username=bob", ics, http.StatusOK)
+	if report.Inserted != 2 || len(report.Errors) != 0 {
+		t.Fatalf("unexpected ICS import %+v", report)
+	}
+	if shifts := bob.shifts(); len(shifts) != 4 || shifts[1].Time != "früh" || shifts[2].Time != "spät" {
+		t.Fatalf("unexpected shifts of bob after ICS import: %+v", shifts)
+	}
+
+	// Rows breaking the working time rules, assigning a team the user is
+	// not in or needing skills the user lacks are rejected
+	if err := app.Store.CreateTeam(Team{Name: "icu"}); err != nil {
+		t.Fatal(err)
+	}
+	night, err := app.Store.GetShiftType("nacht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	night.Skills = []string{"nurse"}
+	if err := app.Store.UpdateShiftType("nacht", *night); err != nil {
+		t.Fatal(err)
+	}
+	roster = "username,datum,time,team\n" +
+		"alice," + day(20) + ",spät,\n" +
+		"alice," + day(21) + ",früh,\n" +
+		"bob," + day(22) + ",spät,icu\n" +
+		"bob," + day(23) + ",nacht,\n"
+	report = boss.importRoster("dry_run=true", roster, http.StatusOK)
+	rejected := map[int]string{}
+	for _, rowErr := range report.Errors {
+		rejected[rowErr.Row] = rowErr.Field
+	}
+	if len(rejected) != 4 || rejected[2] != "time" || rejected[3] != "time" || rejected[4] != "team" || rejected[5] != "time" {
+		t.Fatalf("unexpected row errors %+v", report.Errors)
+	}
+	for _, change := range report.Changes {
+		if change.Row == 3 && (len(change.Violations) == 0 || change.Violations[0].Rule != ruleMinRest) {
+			t.Fatalf("unexpected violations %+v", change)
+		}
+		if change.Row == 5 && (len(change.Missing) != 1 || change.Missing[0] != "nurse") {
+			t.Fatalf("unexpected missing skills %+v", change)
+		}
+	}
+	boss.importRoster("", roster, http.StatusUnprocessableEntity)
+}
+
+// bulkResult is the response of /shifts/bulk
+type bulkResult struct {
+	Created     int
+	Skipped     int
+	Occurrences []Occurrence
+}
+
+func TestShiftBulk(t *testing.T) {
+	_, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	carol := register(t, server, "carol")
+	monday := time.Now().AddDate(0, 0, 7)
+	for monday.Weekday() != time.Monday {
+		monday = monday.AddDate(0, 0, 1)
+	}
+	day := func(offset int) string { return monday.AddDate(0, 0, offset).Format(dateLayout) }
+
+	taken := alice.addShift(day(2), "früh")
+	var result bulkResult
+	alice.expect(http.MethodPost, "/shifts/bulk", BulkShiftReceive{Datum: day(0), Time: "früh", RRule: "FREQ=WEEKLY;BYDAY=MO,TU,WE,TH,FR;COUNT=10"}, http.StatusCreated, &result)
+	if result.Created != 9 || result.Skipped != 1 || len(result.Occurrences) != 10 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	skipped := result.Occurrences[2]
+	if skipped.Datum != day(2) || skipped.Status != occurrenceConflict || skipped.Conflict != taken {
+		t.Fatalf("unexpected conflict %+v", skipped)
+	}
+	if last := result.Occurrences[9]; last.Datum != day(11) || last.Status != occurrenceCreated {
+		t.Fatalf("unexpected last occurrence %+v", last)
+	}
+	if shifts := alice.shifts(); len(shifts) != 10 {
+		t.Fatalf("got %d shifts, want 10", len(shifts))
+	}
+
+	// Four days on, four days off
+	rotation := []string{"spät", "spät", "spät", "spät", "frei", "", "-", "frei"}
+	result = bulkResult{}
+	bob.expect(http.MethodPost, "/shifts/bulk", BulkShiftReceive{Datum: day(0), Rotation: rotation, Until: day(15)}, http.StatusCreated, &result)
+	if result.Created != 8 || result.Occurrences[4].Datum != day(8) {
+		t.Fatalf("unexpected rotation result %+v", result)
+	}
+
+	// Working time rules apply to every occurrence, the seventh day in a row
+	// is skipped
+	result = bulkResult{}
+	carol.expect(http.MethodPost, "/shifts/bulk", BulkShiftReceive{Datum: day(0), Time: "früh", RRule: "FREQ=DAILY;UNTIL=" + monday.AddDate(0, 0, 7).Format("20060102")}, http.StatusCreated, &result)
+	if result.Created != 7 || result.Occurrences[6].Status != occurrenceViolation || result.Occurrences[7].Status != occurrenceCreated {
+		t.Fatalf("unexpected rule result %+v", result)
+	}
+	yesterday := time.Now().AddDate(0, 0, -1).Format(dateLayout)
+	result = bulkResult{}
+	carol.expect(http.MethodPost, "/shifts/bulk", BulkShiftReceive{Datum: yesterday, Time: "nacht", RRule: "FREQ=DAILY;COUNT=2"}, http.StatusCreated, &result)
+	if result.Created != 1 || result.Occurrences[0].Status != occurrenceInvalid {
+		t.Fatalf("unexpected past result %+v", result)
+	}
+
+	for _, series := range []BulkShiftReceive{
+		{Datum: day(0), Time: "früh", RRule: "FREQ=WEEKLY;BYDAY=MO"},
+		{Datum: day(0), Time: "früh", RRule: "FREQ=YEARLY;COUNT=2"},
+		{Datum: day(0), Time: "mittag", RRule: "FREQ=DAILY;COUNT=2"},
+		{Datum: day(0), Rotation: []string{"früh", "mittag"}, Until: day(3)},
+		{Datum: day(0), Rotation: []string{"früh"}},
+		{Datum: day(0), Time: "früh", RRule: "FREQ=DAILY;COUNT=400"},
+		{Datum: day(0)},
+	} {
+		alice.expect(http.MethodPost, "/shifts/bulk", series, http.StatusUnprocessableEntity, nil)
+	}
+}
+
+// racingStore takes the slot of every shift right before it is created, as
+// a concurrent request would
+type racingStore struct {
+	Store
+}
+
+func (s racingStore) ForTenant(tenantID string) Store {
+	return racingStore{s.Store.ForTenant(tenantID)}
+}
+
+func (s racingStore) Atomic(fn func(tx Store) error) error {
+	return s.Store.Atomic(func(tx Store) error { return fn(racingStore{tx}) })
+}
+
+func (s racingStore) CreateShift(shift Shift) error {
+	taken := shift
+	taken.ID = shift.ID + "-taken"
+	if err := s.Store.CreateShift(taken); err != nil {
+		return err
+	}
+	return s.Store.CreateShift(shift)
+}
+
+func TestShiftBulkRace(t *testing.T) {
+	app, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	app.Store = racingStore{app.Store}
+
+	// Slots taken since the schedule was read are skipped like any conflict
+	var result bulkResult
+	alice.expect(http.MethodPost, "/shifts/bulk", BulkShiftReceive{Datum: nextWeek(), Time: "früh", RRule: "FREQ=DAILY;COUNT=3"}, http.StatusOK, &result)
+	if result.Created != 0 || result.Skipped != 3 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for _, occurrence := range result.Occurrences {
+		if occurrence.Status != occurrenceConflict {
+			t.Fatalf("unexpected occurrence %+v", occurrence)
+		}
+	}
+	if shifts := alice.shifts(); len(shifts) != 3 {
+		t.Fatalf("got %d shifts, want the 3 concurrent ones", len(shifts))
+	}
+}
+
+// swapRacingStore gives the first user of a swap the slot they receive just
+// before the shifts are swapped
+type swapRacingStore struct {
+	Store
+}
+
+func (s swapRacingStore) ForTenant(tenantID string) Store {
+	return swapRacingStore{s.Store.ForTenant(tenantID)}
+}
+
+func (s swapRacingStore) Atomic(fn func(tx Store) error) error {
+	return s.Store.Atomic(func(tx Store) error { return fn(swapRacingStore{tx}) })
+}
+
+func (s swapRacingStore) SwapShifts(cycle []tradeNode) error {
+	received, err := s.Store.GetShift(ShiftScope{All: true}, cycle[1].ShiftID)
+	if err != nil {
+		return err
+	}
+	taken := *received
+	taken.ID, taken.Username, taken.Trade = received.ID+"-taken", cycle[0].Username, false
+	if err := s.Store.CreateShift(taken); err != nil {
+		return err
+	}
+	return s.Store.SwapShifts(cycle)
+}
+
+func TestTradeSwapRace(t *testing.T) {
+	app, server := newTestApp(t)
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	datum := nextWeek()
+
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "spät")
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	tradeID := alice.trades()[0].Uid
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+
+	// The trade fails for good if a slot is taken while it is swapped
+	app.Store = swapRacingStore{app.Store}
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusConflict, nil)
+	var trade Trade
+	alice.expect(http.MethodGet, "/trades/"+tradeID, nil, http.StatusOK, &trade)
+	if trade.Status != tradeFailed {
+		t.Fatalf("unexpected trade %+v", trade)
+	}
+	for owner, shiftID := range map[*testClient]string{alice: aliceShift, bob: bobShift} {
+		var shift ShiftReceive
+		owner.expect(http.MethodGet, "/shifts/"+shiftID, nil, http.StatusOK, &shift)
+	}
+}
+
+func TestTradeApprovalExpiry(t *testing.T) {
+	app, server := newTestApp(t)
+	app.Config.Trade.RequireApproval = true
+	app.Config.Trade.ApprovalTTL = time.Millisecond
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	datum := nextWeek()
+
+	aliceShift := alice.addShift(datum, "früh")
+	bobShift := bob.addShift(datum, "spät")
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	bob.offerTrade(bobShift, datum, "spät", "früh")
+	tradeID := alice.trades()[0].Uid
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+
+	// Trades nobody reviewed in time expire and free their shifts
+	time.Sleep(10 * time.Millisecond)
+	var approvals []Trade
+	admin.expect(http.MethodGet, "/trades/approvals", nil, http.StatusOK, &approvals)
+	if len(approvals) != 0 {
+		t.Fatalf("expired trades await approval: %+v", approvals)
+	}
+	admin.expect(http.MethodPost, "/trades/"+tradeID+"/approve", nil, http.StatusConflict, nil)
+	var trade Trade
+	alice.expect(http.MethodGet, "/trades/"+tradeID, nil, http.StatusOK, &trade)
+	if trade.Status != tradeExpired {
+		t.Fatalf("unexpected trade %+v", trade)
+	}
+
+	app.Config.Trade.ApprovalTTL = time.Hour
+	alice.offerTrade(aliceShift, datum, "früh", "spät")
+	if trades := alice.trades(); len(trades) != 2 {
+		t.Fatalf("shifts of the expired trade are still blocked: %+v", trades)
+	}
+}
+
+func TestTeamRotation(t *testing.T) {
+	app, server := newTestApp(t)
+	// Swapping early and night shifts would break the rest rule
+	app.Config.Rules.MinRestHours = 0
+	admin := register(t, server, "admin")
+	if err := app.Store.SetUserRoles("admin", []string{roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	alice := register(t, server, "alice")
+	bob := register(t, server, "bob")
+	register(t, server, "carol")
+	admin.expect(http.MethodPost, "/admin/teams", Team{Name: "icu"}, http.StatusCreated, nil)
+	for _, member := range []string{"alice", "bob"} {
+		admin.expect(http.MethodPut, "/admin/teams/icu/members/"+member, nil, http.StatusOK, nil)
+	}
+	now := time.Now()
+	first := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.Local)
+	month := "/teams/icu/rotation/generate?month=" + first.Format(monthLayout)
+
+	days := []string{"Früh", "früh", "Spät", "spät", "Nacht", "nacht", "Frei", ""}
+	alice.expect(http.MethodPost, "/rotations", RotationTemplate{Name: "wechsel", Days: days}, http.StatusForbidden, nil)
+	admin.expect(http.MethodPost, "/rotations", RotationTemplate{Name: "kaputt", Days: []string{"früh", "mittag"}}, http.StatusUnprocessableEntity, nil)
+	var rotation RotationTemplate
+	admin.expect(http.MethodPost, "/rotations", RotationTemplate{Name: "wechsel", Days: days}, http.StatusCreated, &rotation)
+	if strings.Join(rotation.Days, ",") != "früh,früh,spät,spät,nacht,nacht,," {
+		t.Fatalf("unexpected days %q", rotation.Days)
+	}
+	admin.expect(http.MethodPost, "/rotations", RotationTemplate{Name: "wechsel", Days: days}, http.StatusConflict, nil)
+
+	admin.expect(http.MethodGet, "/teams/icu/rotation", nil, http.StatusNotFound, nil)
+
+	// A week of early shifts in a row breaks the consecutive days rule
+	admin.expect(http.MethodPost, "/rotations", RotationTemplate{Name: "dauer", Days: []string{"früh", "früh", "früh", "früh", "früh", "früh", "früh", ""}}, http.StatusCreated, nil)
+	admin.expect(http.MethodPut, "/teams/icu/rotation", TeamRotationReceive{Template: "dauer", Start: formatDate(first), Members: []RotationMember{{Username: "alice"}}}, http.StatusOK, nil)
+	var rejected RosterReport
+	admin.expect(http.MethodGet, strings.Replace(month, "generate", "preview", 1), nil, http.StatusOK, &rejected)
+	if len(rejected.Errors) == 0 || rejected.Changes[6].Violations[0].Rule != ruleMaxConsecutiveDays {
+		t.Fatalf("unexpected preview %+v", rejected)
+	}
+	admin.expect(http.MethodPost, month, nil, http.StatusUnprocessableEntity, nil)
+	if shifts := alice.shifts(); len(shifts) != 0 {
+		t.Fatalf("rejected rotation created shifts: %+v", shifts)
+	}
+
+	assignment := TeamRotationReceive{Template: "wechsel", Start: formatDate(first), Members: []RotationMember{{Username: "alice"}, {Username: "bob", Offset: 4}}}
+	admin.expect(http.MethodPut, "/teams/icu/rotation", TeamRotationReceive{Template: "wechsel", Start: formatDate(first), Members: []RotationMember{{Username: "carol"}}}, http.StatusUnprocessableEntity, nil)
+	admin.expect(http.MethodPut, "/teams/icu/rotation", assignment, http.StatusOK, nil)
+	admin.expect(http.MethodDelete, "/rotations/wechsel", nil, http.StatusConflict, nil)
+
+	expected := map[string]int{}
+	last := first.AddDate(0, 1, -1)
+	for date := first; !date.After(last); date = date.AddDate(0, 0, 1) {
+		for _, member := range assignment.Members {
+			if rotationSlot(rotation.Days, first, date, member.Offset) != "" {
+				expected[member.Username]++
+			}
+		}
+	}
+
+	var report RosterReport
+	admin.expect(http.MethodGet, strings.Replace(month, "generate", "preview", 1), nil, http.StatusOK, &report)
+	if !report.DryRun || report.Inserted != expected["alice"]+expected["bob"] || report.From != formatDate(first) || report.To != formatDate(last) {
+		t.Fatalf("unexpected preview %+v", report)
+	}
+	if shifts := alice.shifts(); len(shifts) != 0 {
+		t.Fatalf("preview created shifts: %+v", shifts)
+	}
+
+	report = RosterReport{}
+	admin.expect(http.MethodPost, month, nil, http.StatusOK, &report)
+	aliceShifts, bobShifts := alice.shifts(), bob.shifts()
+	if report.DryRun || len(aliceShifts) != expected["alice"] || len(bobShifts) != expected["bob"] {
+		t.Fatalf("unexpected generation %+v", report)
+	}
+	if aliceShifts[0].Datum != formatDate(first) || aliceShifts[0].Time != "früh" || bobShifts[0].Time != "nacht" || aliceShifts[0].Team != "icu" {
+		t.Fatalf("unexpected first shifts %+v %+v", aliceShifts[0], bobShifts[0])
+	}
+
+	// Alice and bob swap their shifts on the first day
+	alice.offerTrade(aliceShifts[0].Uid, aliceShifts[0].Datum, "früh", "nacht")
+	bob.offerTrade(bobShifts[0].Uid, bobShifts[0].Datum, "nacht", "früh")
+	tradeID := alice.trades()[0].Uid
+	alice.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+	bob.expect(http.MethodPost, "/trades/"+tradeID+"/accept", nil, http.StatusOK, nil)
+
+	// Regenerating leaves the traded shifts alone
+	report = RosterReport{}
+	admin.expect(http.MethodPost, month, nil, http.StatusOK, &report)
+	if report.Kept != 2 || report.Inserted+report.Updated+report.Deleted != 0 {
+		t.Fatalf("unexpected regeneration %+v", report)
+	}
+	if shifts := alice.shifts(); shifts[0].Uid != bobShifts[0].Uid || shifts[0].Time != "nacht" {
+		t.Fatalf("traded shift was replaced: %+v", shifts[0])
+	}
+
+	// A changed template moves the generated shifts, bob leaves the rotation
+	days = []string{"spät", "spät", "früh", "früh", "nacht", "nacht", "", ""}
+	admin.expect(http.MethodPut, "/rotations/wechsel", RotationTemplate{Days: days}, http.StatusOK, nil)
+	assignment.Members = assignment.Members[:1]
+	admin.expect(http.MethodPut, "/teams/icu/rotation", assignment, http.StatusOK, nil)
+	report = RosterReport{}
+	admin.expect(http.MethodPost, month, nil, http.StatusOK, &report)
+	if report.Kept != 1 || report.Updated == 0 || report.Deleted != expected["bob"]-1 || report.Inserted != 0 {
+		t.Fatalf("unexpected regeneration %+v", report)
+	}
+	if shifts := bob.shifts(); len(shifts) != 1 || shifts[0].Uid != aliceShifts[0].Uid {
+		t.Fatalf("unexpected shifts of bob: %+v", shifts)
+	}
+	if shifts := alice.shifts(); shifts[0].Time != "nacht" || shifts[1].Time != "spät" {
+		t.Fatalf("unexpected shifts of alice: %+v", shifts[:2])
+	}
+
+	admin.expect(http.MethodDelete, "/shift-types/früh", nil, http.StatusForbidden, nil)
+	if err := app.Store.DeleteShiftType("früh"); !errors.Is(err, errShiftTypeInUse) {
+		t.Fatalf("deleted a shift type in use: %v", err)
+	}
+	admin.expect(http.MethodDelete, "/teams/icu/rotation", nil, http.StatusOK, nil)
+	admin.expect(http.MethodDelete, "/rotations/wechsel", nil, http.StatusOK, nil)
+	admin.expect(http.MethodPost, month, nil, http.StatusNotFound, nil)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+)
+
+// tradeNode is a trade-enabled shift as seen by the matching engine
+type tradeNode struct {
+	ShiftID  string
+	Username string
+	Tenant   string
+	Team     string
+	Date     string
+	Time     string
+	Search   map[string]bool
+	Targets  []TradeTarget
+	Requires []string        // skills needed to work the shift
+	Skills   map[string]bool // skills of the shift's owner
+}
+
+// wants reports whether the owner of n would take other's shift in exchange
+// for n and is qualified to work it
+func (n tradeNode) wants(other tradeNode) bool {
+	return n.prefers(other) && len(n.missingSkills(other)) == 0
+}
+
+// prefers reports whether other's shift matches the trade offer of n;
+// shifts are only traded within the same tenant and team
+func (n tradeNode) prefers(other tradeNode) bool {
+	if n.ShiftID == other.ShiftID || n.Username == other.Username || n.Tenant != other.Tenant || n.Team != other.Team {
+		return false
+	}
+	if n.Date == other.Date && n.Search[other.Time] {
+		return true
+	}
+	for _, target := range n.Targets {
+		if target.covers(other.Date, other.Time, n.Search) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingSkills returns the skills required by other's shift that the owner
+// of n lacks
+func (n tradeNode) missingSkills(other tradeNode) []string {
+	var missing []string
+	for _, skill := range other.Requires {
+		if !n.Skills[skill] {
+			missing = append(missing, skill)
+		}
+	}
+	return missing
+}
+
+// newTradeNode returns the matching engine's view of a shift whose type
+// requires typeSkills and whose owner has ownerSkills
+func newTradeNode(shift Shift, typeSkills []string, ownerSkills map[string]bool) tradeNode {
+	return tradeNode{
+		ShiftID:  shift.ID,
+		Username: shift.Username,
+		Tenant:   shift.Tenant,
+		Team:     shift.Team,
+		Date:     formatDate(shift.Date),
+		Time:     shift.Time,
+		Search:   shift.Search,
+		Targets:  shift.Targets,
+		Requires: mergeSkills(typeSkills, shift.Skills),
+		Skills:   ownerSkills,
+	}
+}
+
+// findShortestCycle returns the shortest trade cycle that contains the shift
+// with the given ID, or nil if there is none. Every node in the returned
+// cycle wants the shift of the node following it and is allowed to take it;
+// the last node wants the shift of the first one.
+func findShortestCycle(nodes []tradeNode, startID string, allowed func(n, other tradeNode) bool) []tradeNode {
+	sorted := make([]tradeNode, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ShiftID < sorted[j].ShiftID })
+
+	start := -1
+	for i, node := range sorted {
+		if node.ShiftID == startID {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+
+	// Breadth-first search from the start node, the first edge leading back
+	// to it closes the shortest cycle
+	parent := make([]int, len(sorted))
+	for i := range parent {
+		parent[i] = -1
+	}
+	queue := []int{start}
+	parent[start] = start
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for next := range sorted {
+			if !sorted[current].wants(sorted[next]) || !allowed(sorted[current], sorted[next]) {
+				continue
+			}
+			if next == start {
+				var cycle []tradeNode
+				for i := current; i != start; i = parent[i] {
+					cycle = append(cycle, sorted[i])
+				}
+				cycle = append(cycle, sorted[start])
+				for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+					cycle[i], cycle[j] = cycle[j], cycle[i]
+				}
+				return cycle
+			}
+			if parent[next] < 0 {
+				parent[next] = current
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
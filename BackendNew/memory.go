@@ -0,0 +1,1476 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore implements Store in memory, e.g. for tests. All operations
+// are serialised by a single lock, Atomic holds it for the whole call.
+type memoryStore struct {
+	mu     *sync.Mutex
+	data   *memoryData
+	inTx   bool
+	tenant string // empty unless limited by ForTenant
+}
+
+var _ Store = (*memoryStore)(nil)
+
+type memoryData struct {
+	tenants    map[string]string     // name by tenant ID
+	rules      map[string]RuleConfig // by tenant ID
+	passwords  map[string]string
+	userTenant map[string]string // tenant ID by username
+	roles      map[string][]string
+	skills     map[string][]string
+	sessions   map[string]Session
+	shifts     map[string]Shift
+	shiftTypes map[string]ShiftType
+	teams      map[tenantKey]string          // department by team
+	members    map[tenantKey]map[string]bool // usernames by team
+	trades     map[string]*memoryTrade
+	open       map[string]OpenShift // postings by shift ID, without the shift
+	feeds      map[string]CalendarFeed
+	cancelled  map[string]CalendarCancellation // by shift ID and username
+	rotations  map[tenantKey][]string          // days by template
+	following  map[tenantKey]TeamRotation      // by team
+}
+
+// tenantKey identifies a team or rotation template, their names are unique
+// per tenant
+type tenantKey struct {
+	Tenant string
+	Name   string
+}
+
+type memoryTrade struct {
+	ID           string
+	Status       string
+	Created      time.Time
+	Expires      time.Time
+	Reviewer     string
+	Participants []memoryParticipant
+}
+
+type memoryParticipant struct {
+	ShiftID  string
+	Username string
+	Receives string
+	Decision string
+}
+
+// newMemoryStore returns an empty store with the default shift types
+func newMemoryStore() *memoryStore {
+	data := &memoryData{
+		tenants:    map[string]string{defaultTenant: "Default"},
+		rules:      make(map[string]RuleConfig),
+		passwords:  make(map[string]string),
+		userTenant: make(map[string]string),
+		roles:      make(map[string][]string),
+		skills:     make(map[string][]string),
+		sessions:   make(map[string]Session),
+		shifts:     make(map[string]Shift),
+		shiftTypes: make(map[string]ShiftType),
+		teams:      make(map[tenantKey]string),
+		members:    make(map[tenantKey]map[string]bool),
+		trades:     make(map[string]*memoryTrade),
+		open:       make(map[string]OpenShift),
+		feeds:      make(map[string]CalendarFeed),
+		cancelled:  make(map[string]CalendarCancellation),
+		rotations:  make(map[tenantKey][]string),
+		following:  make(map[tenantKey]TeamRotation),
+	}
+	for _, t := range defaultShiftTypes {
+		t.Skills = []string{}
+		data.shiftTypes[t.Name] = t
+	}
+	return &memoryStore{mu: &sync.Mutex{}, data: data}
+}
+
+// cloneShift returns a copy of the shift that shares no maps or slices
+func cloneShift(shift Shift) Shift {
+	if shift.Search != nil {
+		search := make(map[string]bool, len(shift.Search))
+		for name, selected := range shift.Search {
+			if selected {
+				search[name] = true
+			}
+		}
+		shift.Search = search
+	}
+	if shift.Targets != nil {
+		targets := make([]TradeTarget, len(shift.Targets))
+		for i, target := range shift.Targets {
+			target.Times = append([]string(nil), target.Times...)
+			targets[i] = target
+		}
+		shift.Targets = targets
+	}
+	if shift.Skills != nil {
+		shift.Skills = append([]string{}, shift.Skills...)
+	}
+	return shift
+}
+
+// clone returns a deep copy of the data, Atomic restores it on failure
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		tenants:    make(map[string]string, len(d.tenants)),
+		rules:      make(map[string]RuleConfig, len(d.rules)),
+		passwords:  make(map[string]string, len(d.passwords)),
+		userTenant: make(map[string]string, len(d.userTenant)),
+		roles:      make(map[string][]string, len(d.roles)),
+		skills:     make(map[string][]string, len(d.skills)),
+		sessions:   make(map[string]Session, len(d.sessions)),
+		shifts:     make(map[string]Shift, len(d.shifts)),
+		shiftTypes: make(map[string]ShiftType, len(d.shiftTypes)),
+		teams:      make(map[tenantKey]string, len(d.teams)),
+		members:    make(map[tenantKey]map[string]bool, len(d.members)),
+		trades:     make(map[string]*memoryTrade, len(d.trades)),
+		open:       make(map[string]OpenShift, len(d.open)),
+		feeds:      make(map[string]CalendarFeed, len(d.feeds)),
+		cancelled:  make(map[string]CalendarCancellation, len(d.cancelled)),
+		rotations:  make(map[tenantKey][]string, len(d.rotations)),
+		following:  make(map[tenantKey]TeamRotation, len(d.following)),
+	}
+	for k, v := range d.tenants {
+		c.tenants[k] = v
+	}
+	for k, v := range d.rules {
+		c.rules[k] = v
+	}
+	for k, v := range d.passwords {
+		c.passwords[k] = v
+	}
+	for k, v := range d.userTenant {
+		c.userTenant[k] = v
+	}
+	for k, v := range d.roles {
+		c.roles[k] = append([]string(nil), v...)
+	}
+	for k, v := range d.skills {
+		c.skills[k] = append([]string(nil), v...)
+	}
+	for k, v := range d.sessions {
+		c.sessions[k] = v
+	}
+	for k, v := range d.shifts {
+		c.shifts[k] = cloneShift(v)
+	}
+	for k, v := range d.shiftTypes {
+		v.Skills = append([]string(nil), v.Skills...)
+		c.shiftTypes[k] = v
+	}
+	for k, v := range d.teams {
+		c.teams[k] = v
+	}
+	for k, v := range d.members {
+		c.members[k] = make(map[string]bool, len(v))
+		for username := range v {
+			c.members[k][username] = true
+		}
+	}
+	for k, v := range d.open {
+		c.open[k] = v
+	}
+	for k, v := range d.feeds {
+		c.feeds[k] = v
+	}
+	for k, v := range d.cancelled {
+		c.cancelled[k] = v
+	}
+	for k, v := range d.rotations {
+		c.rotations[k] = append([]string(nil), v...)
+	}
+	for k, v := range d.following {
+		v.Members = append([]RotationMember(nil), v.Members...)
+		c.following[k] = v
+	}
+	for k, v := range d.trades {
+		trade := *v
+		trade.Participants = append([]memoryParticipant(nil), v.Participants...)
+		c.trades[k] = &trade
+	}
+	return c
+}
+
+// do runs fn on the data, holding the lock unless called within Atomic
+func (s *memoryStore) do(fn func(d *memoryData) error) error {
+	if !s.inTx {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	return fn(s.data)
+}
+
+func (s *memoryStore) Atomic(fn func(tx Store) error) error {
+	if s.inTx {
+		snapshot := s.data.clone()
+		if err := fn(s); err != nil {
+			*s.data = *snapshot
+			return err
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.data.clone()
+	if err := fn(&memoryStore{mu: s.mu, data: s.data, inTx: true, tenant: s.tenant}); err != nil {
+		*s.data = *snapshot
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) ForTenant(tenantID string) Store {
+	scoped := *s
+	scoped.tenant = tenantID
+	return &scoped
+}
+
+// sees reports whether rows of the given tenant are visible to the store
+func (s *memoryStore) sees(tenantID string) bool {
+	return s.tenant == "" || s.tenant == tenantID
+}
+
+// hasUser reports whether the user exists and is visible to the store
+func (s *memoryStore) hasUser(d *memoryData, username string) bool {
+	_, ok := d.passwords[username]
+	return ok && s.sees(d.userTenant[username])
+}
+
+// tenantFor returns the tenant new rows are created in
+func (s *memoryStore) tenantFor(tenantID string) string {
+	if s.tenant != "" {
+		return s.tenant
+	}
+	if tenantID != "" {
+		return tenantID
+	}
+	return defaultTenant
+}
+
+func (s *memoryStore) Tenants() ([]Tenant, error) {
+	tenants := []Tenant{}
+	err := s.do(func(d *memoryData) error {
+		for id, name := range d.tenants {
+			tenants = append(tenants, Tenant{ID: id, Name: name})
+		}
+		return nil
+	})
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, err
+}
+
+func (s *memoryStore) GetTenant(tenantID string) (*Tenant, error) {
+	var tenant Tenant
+	err := s.do(func(d *memoryData) error {
+		name, ok := d.tenants[tenantID]
+		if !ok {
+			return errTenantNotFound
+		}
+		tenant = Tenant{ID: tenantID, Name: name}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+func (s *memoryStore) CreateTenant(tenant Tenant) error {
+	return s.do(func(d *memoryData) error {
+		if _, ok := d.tenants[tenant.ID]; ok {
+			return errTenantExists
+		}
+		d.tenants[tenant.ID] = tenant.Name
+		return nil
+	})
+}
+
+func (s *memoryStore) CreateUser(username, passwordHash string) error {
+	return s.do(func(d *memoryData) error {
+		if _, ok := d.passwords[username]; ok {
+			return errUserExists
+		}
+		d.passwords[username] = passwordHash
+		d.userTenant[username] = s.tenantFor("")
+		d.roles[username] = []string{roleEmployee}
+		return nil
+	})
+}
+
+func (s *memoryStore) UserTenant(username string) (string, error) {
+	var tenantID string
+	err := s.do(func(d *memoryData) error {
+		if !s.hasUser(d, username) {
+			return errUserNotFound
+		}
+		tenantID = d.userTenant[username]
+		return nil
+	})
+	return tenantID, err
+}
+
+func (s *memoryStore) PasswordHash(username string) (string, error) {
+	var passwordHash string
+	err := s.do(func(d *memoryData) error {
+		if !s.hasUser(d, username) {
+			return errUserNotFound
+		}
+		passwordHash = d.passwords[username]
+		return nil
+	})
+	return passwordHash, err
+}
+
+func (s *memoryStore) Usernames() ([]string, error) {
+	usernames := []string{}
+	err := s.do(func(d *memoryData) error {
+		for username := range d.passwords {
+			if s.hasUser(d, username) {
+				usernames = append(usernames, username)
+			}
+		}
+		sort.Strings(usernames)
+		return nil
+	})
+	return usernames, err
+}
+
+func (s *memoryStore) UserRoles(username string) ([]string, error) {
+	var roles []string
+	err := s.do(func(d *memoryData) error {
+		if !s.hasUser(d, username) {
+			return errUserNotFound
+		}
+		roles = append(roles, d.roles[username]...)
+		sort.Strings(roles)
+		if len(roles) == 0 {
+			roles = []string{roleEmployee}
+		}
+		return nil
+	})
+	return roles, err
+}
+
+func (s *memoryStore) SetUserRoles(username string, roles []string) error {
+	return s.do(func(d *memoryData) error {
+		if !s.hasUser(d, username) {
+			return errUserNotFound
+		}
+		d.roles[username] = nil
+		for _, role := range roles {
+			d.grant(username, role)
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) GrantRole(username, role string) error {
+	return s.do(func(d *memoryData) error {
+		if s.hasUser(d, username) {
+			d.grant(username, role)
+		}
+		return nil
+	})
+}
+
+// grant adds a role to a user unless it has been granted already
+func (d *memoryData) grant(username, role string) {
+	for _, granted := range d.roles[username] {
+		if granted == role {
+			return
+		}
+	}
+	d.roles[username] = append(d.roles[username], role)
+}
+
+func (s *memoryStore) UserSkills(username string) ([]string, error) {
+	var skills []string
+	err := s.do(func(d *memoryData) error {
+		if !s.hasUser(d, username) {
+			return errUserNotFound
+		}
+		skills = mergeSkills(d.skills[username])
+		return nil
+	})
+	return skills, err
+}
+
+func (s *memoryStore) SetUserSkills(username string, skills []string) error {
+	return s.do(func(d *memoryData) error {
+		if !s.hasUser(d, username) {
+			return errUserNotFound
+		}
+		d.skills[username] = mergeSkills(skills)
+		return nil
+	})
+}
+
+func (s *memoryStore) CreateSession(session Session) error {
+	return s.do(func(d *memoryData) error {
+		if !s.hasUser(d, session.Username) {
+			return errUserNotFound
+		}
+		session.Tenant = s.tenantFor(session.Tenant)
+		d.sessions[session.ID] = session
+		return nil
+	})
+}
+
+func (s *memoryStore) GetSession(sessionID string) (*Session, error) {
+	var session Session
+	err := s.do(func(d *memoryData) error {
+		var ok bool
+		session, ok = d.sessions[sessionID]
+		if !ok || !session.Expires.After(time.Now()) || !s.sees(session.Tenant) {
+			return errSessionNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *memoryStore) DeleteSession(sessionID string) error {
+	return s.do(func(d *memoryData) error {
+		if session, ok := d.sessions[sessionID]; ok && s.sees(session.Tenant) {
+			delete(d.sessions, sessionID)
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) ListShifts(username string) ([]Shift, error) {
+	shifts := []Shift{}
+	err := s.do(func(d *memoryData) error {
+		for _, shift := range d.shifts {
+			if shift.Username == username && s.sees(shift.Tenant) {
+				shifts = append(shifts, d.loadShift(shift))
+			}
+		}
+		return nil
+	})
+	sort.Slice(shifts, func(i, j int) bool {
+		if !shifts[i].Date.Equal(shifts[j].Date) {
+			return shifts[i].Date.Before(shifts[j].Date)
+		}
+		if !shifts[i].StartsAt.Equal(shifts[j].StartsAt) {
+			return shifts[i].StartsAt.Before(shifts[j].StartsAt)
+		}
+		return shifts[i].ID < shifts[j].ID
+	})
+	return shifts, err
+}
+
+func (s *memoryStore) GetShift(scope ShiftScope, shiftID string) (*Shift, error) {
+	var shift Shift
+	err := s.do(func(d *memoryData) error {
+		stored, ok := d.shifts[shiftID]
+		if !ok || !scope.includes(stored) || !s.sees(stored.Tenant) {
+			return errShiftNotFound
+		}
+		shift = d.loadShift(stored)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &shift, nil
+}
+
+func (s *memoryStore) CreateShift(shift Shift) error {
+	return s.do(func(d *memoryData) error {
+		if _, ok := d.shifts[shift.ID]; ok {
+			return errors.New("shift already exists")
+		}
+		if d.slotTaken(shift.Username, shift, nil) {
+			return errShiftConflict
+		}
+		shift.Tenant, shift.Released = s.tenantFor(shift.Tenant), false
+		shift.Skills = mergeSkills(shift.Skills)
+		d.shifts[shift.ID] = cloneShift(shift)
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateShift(scope ShiftScope, shift Shift) error {
+	return s.do(func(d *memoryData) error {
+		stored, ok := d.shifts[shift.ID]
+		if !ok || !scope.includes(stored) || !s.sees(stored.Tenant) {
+			return errShiftNotFound
+		}
+		shift.Username, shift.Tenant, shift.NoGiveback = stored.Username, stored.Tenant, stored.NoGiveback
+		shift.Sequence, shift.Generated = stored.Sequence+1, stored.Generated
+		if d.slotTaken(shift.Username, shift, nil) {
+			return errShiftConflict
+		}
+		if shift.Team == "" {
+			shift.Team = stored.Team
+		}
+		if shift.Skills == nil {
+			shift.Skills = stored.Skills
+		}
+		shift.Skills = mergeSkills(shift.Skills)
+		d.shifts[shift.ID] = cloneShift(shift)
+		return nil
+	})
+}
+
+// loadShift returns a copy of a stored shift with its pool state
+func (d *memoryData) loadShift(shift Shift) Shift {
+	shift = cloneShift(shift)
+	_, shift.Released = d.open[shift.ID]
+	return shift
+}
+
+// cancelCalendarEvent records a shift as cancelled in its owner's calendar,
+// one change after its current one
+func (d *memoryData) cancelCalendarEvent(shift Shift) {
+	if shift.Username == "" {
+		return
+	}
+	d.cancelled[shift.ID+"/"+shift.Username] = CalendarCancellation{
+		ShiftID:   shift.ID,
+		Username:  shift.Username,
+		Date:      shift.Date,
+		Time:      shift.Time,
+		StartsAt:  shift.StartsAt,
+		EndsAt:    shift.EndsAt,
+		Sequence:  shift.Sequence + 1,
+		Cancelled: time.Now(),
+	}
+}
+
+// slotTaken reports whether username works a shift other than the given
+// one on its date and slot, shifts in ignored are left out
+func (d *memoryData) slotTaken(username string, shift Shift, ignored map[string]bool) bool {
+	if username == "" {
+		return false
+	}
+	for id, other := range d.shifts {
+		if id != shift.ID && !ignored[id] && other.Username == username && other.Time == shift.Time && formatDate(other.Date) == formatDate(shift.Date) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) DeleteShift(scope ShiftScope, shiftID string) error {
+	return s.do(func(d *memoryData) error {
+		stored, ok := d.shifts[shiftID]
+		if !ok || !scope.includes(stored) || !s.sees(stored.Tenant) {
+			return errShiftNotFound
+		}
+		d.cancelCalendarEvent(stored)
+		delete(d.shifts, shiftID)
+		delete(d.open, shiftID)
+		return nil
+	})
+}
+
+func (s *memoryStore) ListOpenShifts() ([]OpenShift, error) {
+	open := []OpenShift{}
+	err := s.do(func(d *memoryData) error {
+		for shiftID, posting := range d.open {
+			if shift := d.shifts[shiftID]; s.sees(shift.Tenant) {
+				posting.Shift = d.loadShift(shift)
+				open = append(open, posting)
+			}
+		}
+		return nil
+	})
+	sort.Slice(open, func(i, j int) bool {
+		a, b := open[i].Shift, open[j].Shift
+		if !a.StartsAt.Equal(b.StartsAt) {
+			return a.StartsAt.Before(b.StartsAt)
+		}
+		return a.ID < b.ID
+	})
+	return open, err
+}
+
+func (s *memoryStore) GetOpenShift(shiftID string) (*OpenShift, error) {
+	var open OpenShift
+	err := s.do(func(d *memoryData) error {
+		posting, ok := d.open[shiftID]
+		if !ok || !s.sees(d.shifts[shiftID].Tenant) {
+			return errShiftNotOpen
+		}
+		open = posting
+		open.Shift = d.loadShift(d.shifts[shiftID])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &open, nil
+}
+
+func (s *memoryStore) ReleaseShift(open OpenShift) error {
+	return s.do(func(d *memoryData) error {
+		shift, ok := d.shifts[open.Shift.ID]
+		if !ok || !s.sees(shift.Tenant) {
+			return errShiftNotFound
+		}
+		if _, ok := d.open[shift.ID]; ok {
+			return errShiftReleased
+		}
+		shift.Trade, shift.Search, shift.Targets = false, nil, nil
+		d.shifts[shift.ID] = shift
+		open.Shift = Shift{}
+		d.open[shift.ID] = open
+		return nil
+	})
+}
+
+func (s *memoryStore) WithdrawShift(shiftID string) error {
+	return s.do(func(d *memoryData) error {
+		if _, ok := d.open[shiftID]; !ok || !s.sees(d.shifts[shiftID].Tenant) {
+			return errShiftNotOpen
+		}
+		delete(d.open, shiftID)
+		return nil
+	})
+}
+
+func (s *memoryStore) ClaimShift(shiftID, username string) error {
+	return s.do(func(d *memoryData) error {
+		open, ok := d.open[shiftID]
+		shift := d.shifts[shiftID]
+		if !ok || !s.sees(shift.Tenant) {
+			return errShiftNotOpen
+		}
+		if d.slotTaken(username, shift, nil) {
+			return errShiftConflict
+		}
+		d.cancelCalendarEvent(shift)
+		shift.Username, shift.NoGiveback, shift.Sequence = username, open.PickupOnly, shift.Sequence+1
+		shift.Generated = false
+		shift.Trade, shift.Search, shift.Targets = false, nil, nil
+		d.shifts[shiftID] = shift
+		delete(d.open, shiftID)
+		return nil
+	})
+}
+
+func (s *memoryStore) CountOffers(date, team string) (map[string]int, error) {
+	offers := make(map[string]int)
+	err := s.do(func(d *memoryData) error {
+		for _, shift := range d.shifts {
+			if shift.Trade && formatDate(shift.Date) == date && shift.Team == team && d.isTeamMember(shift) && s.sees(shift.Tenant) {
+				offers[shift.Time]++
+			}
+		}
+		return nil
+	})
+	return offers, err
+}
+
+func (s *memoryStore) ListTeamShifts(team string) ([]Shift, error) {
+	shifts := []Shift{}
+	err := s.do(func(d *memoryData) error {
+		for _, shift := range d.shifts {
+			if shift.Team == team && s.sees(shift.Tenant) {
+				shifts = append(shifts, d.loadShift(shift))
+			}
+		}
+		return nil
+	})
+	sort.Slice(shifts, func(i, j int) bool {
+		if !shifts[i].StartsAt.Equal(shifts[j].StartsAt) {
+			return shifts[i].StartsAt.Before(shifts[j].StartsAt)
+		}
+		if shifts[i].Username != shifts[j].Username {
+			return shifts[i].Username < shifts[j].Username
+		}
+		return shifts[i].ID < shifts[j].ID
+	})
+	return shifts, err
+}
+
+// isTeamMember reports whether the shift has no team or its owner is a
+// member of its team
+func (d *memoryData) isTeamMember(shift Shift) bool {
+	return shift.Team == "" || d.members[tenantKey{shift.Tenant, shift.Team}][shift.Username]
+}
+
+func (s *memoryStore) ShiftTypes() ([]ShiftType, error) {
+	types := []ShiftType{}
+	err := s.do(func(d *memoryData) error {
+		for _, t := range d.shiftTypes {
+			t.Skills = append([]string{}, t.Skills...)
+			types = append(types, t)
+		}
+		return nil
+	})
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Position != types[j].Position {
+			return types[i].Position < types[j].Position
+		}
+		return types[i].Name < types[j].Name
+	})
+	return types, err
+}
+
+func (s *memoryStore) GetShiftType(name string) (*ShiftType, error) {
+	var shiftType ShiftType
+	err := s.do(func(d *memoryData) error {
+		var ok bool
+		shiftType, ok = d.shiftTypes[name]
+		if !ok {
+			return errShiftTypeNotFound
+		}
+		shiftType.Skills = append([]string{}, shiftType.Skills...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &shiftType, nil
+}
+
+func (s *memoryStore) CreateShiftType(shiftType ShiftType) error {
+	return s.do(func(d *memoryData) error {
+		if _, ok := d.shiftTypes[shiftType.Name]; ok {
+			return errShiftTypeExists
+		}
+		shiftType.Skills = mergeSkills(shiftType.Skills)
+		d.shiftTypes[shiftType.Name] = shiftType
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateShiftType(name string, shiftType ShiftType) error {
+	return s.do(func(d *memoryData) error {
+		if _, ok := d.shiftTypes[name]; !ok {
+			return errShiftTypeNotFound
+		}
+		if _, ok := d.shiftTypes[shiftType.Name]; ok && shiftType.Name != name {
+			return errShiftTypeExists
+		}
+		delete(d.shiftTypes, name)
+		shiftType.Skills = mergeSkills(shiftType.Skills)
+		d.shiftTypes[shiftType.Name] = shiftType
+
+		for id, shift := range d.shifts {
+			if shift.Time == name {
+				shift.Time = shiftType.Name
+				day, err := parseDate(formatDate(shift.Date))
+				if err != nil {
+					return err
+				}
+				shift.StartsAt, shift.EndsAt = shiftTimes(day, shiftType)
+				shift.Sequence++
+			}
+			if shift.Search[name] {
+				delete(shift.Search, name)
+				shift.Search[shiftType.Name] = true
+			}
+			for i := range shift.Targets {
+				for j, timeV := range shift.Targets[i].Times {
+					if timeV == name {
+						shift.Targets[i].Times[j] = shiftType.Name
+					}
+				}
+			}
+			d.shifts[id] = shift
+		}
+		for _, days := range d.rotations {
+			for i, timeV := range days {
+				if timeV == name {
+					days[i] = shiftType.Name
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteShiftType(name string) error {
+	return s.do(func(d *memoryData) error {
+		for _, shift := range d.shifts {
+			if shift.Time == name {
+				return errShiftTypeInUse
+			}
+		}
+		for _, days := range d.rotations {
+			for _, timeV := range days {
+				if timeV == name {
+					return errShiftTypeInUse
+				}
+			}
+		}
+		if _, ok := d.shiftTypes[name]; !ok {
+			return errShiftTypeNotFound
+		}
+		delete(d.shiftTypes, name)
+		for _, shift := range d.shifts {
+			delete(shift.Search, name)
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) Teams() ([]Team, error) {
+	teams := []Team{}
+	err := s.do(func(d *memoryData) error {
+		for key := range d.teams {
+			if s.sees(key.Tenant) {
+				teams = append(teams, s.team(d, key))
+			}
+		}
+		return nil
+	})
+	sort.Slice(teams, func(i, j int) bool {
+		if teams[i].Department != teams[j].Department {
+			return teams[i].Department < teams[j].Department
+		}
+		return teams[i].Name < teams[j].Name
+	})
+	return teams, err
+}
+
+// findTeam returns the key of the named team visible to the store
+func (s *memoryStore) findTeam(d *memoryData, name string) (tenantKey, bool) {
+	if s.tenant != "" {
+		key := tenantKey{s.tenant, name}
+		_, ok := d.teams[key]
+		return key, ok
+	}
+	for key := range d.teams {
+		if key.Name == name {
+			return key, true
+		}
+	}
+	return tenantKey{}, false
+}
+
+// team returns a stored team with its members visible to the store
+func (s *memoryStore) team(d *memoryData, key tenantKey) Team {
+	team := Team{Name: key.Name, Department: d.teams[key], Members: []string{}}
+	for username := range d.members[key] {
+		if s.hasUser(d, username) {
+			team.Members = append(team.Members, username)
+		}
+	}
+	sort.Strings(team.Members)
+	return team
+}
+
+func (s *memoryStore) GetTeam(name string) (*Team, error) {
+	var team Team
+	err := s.do(func(d *memoryData) error {
+		key, ok := s.findTeam(d, name)
+		if !ok {
+			return errTeamNotFound
+		}
+		team = s.team(d, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &team, nil
+}
+
+func (s *memoryStore) UserTeams(username string) ([]string, error) {
+	teams := []string{}
+	err := s.do(func(d *memoryData) error {
+		for key, members := range d.members {
+			if members[username] && s.sees(key.Tenant) {
+				teams = append(teams, key.Name)
+			}
+		}
+		sort.Strings(teams)
+		return nil
+	})
+	return teams, err
+}
+
+func (s *memoryStore) CreateTeam(team Team) error {
+	return s.do(func(d *memoryData) error {
+		key := tenantKey{s.tenantFor(""), team.Name}
+		if _, ok := d.teams[key]; ok {
+			return errTeamExists
+		}
+		d.teams[key] = team.Department
+		d.members[key] = make(map[string]bool)
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateTeam(name string, team Team) error {
+	return s.do(func(d *memoryData) error {
+		key, ok := s.findTeam(d, name)
+		if !ok {
+			return errTeamNotFound
+		}
+		renamed := tenantKey{key.Tenant, team.Name}
+		if _, ok := d.teams[renamed]; ok && team.Name != name {
+			return errTeamExists
+		}
+		members := d.members[key]
+		delete(d.teams, key)
+		delete(d.members, key)
+		d.teams[renamed] = team.Department
+		d.members[renamed] = members
+
+		for id, shift := range d.shifts {
+			if shift.Tenant == key.Tenant && shift.Team == name {
+				shift.Team = team.Name
+				d.shifts[id] = shift
+			}
+		}
+		if rotation, ok := d.following[key]; ok {
+			delete(d.following, key)
+			rotation.Team = team.Name
+			d.following[renamed] = rotation
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteTeam(name string) error {
+	return s.do(func(d *memoryData) error {
+		key, ok := s.findTeam(d, name)
+		if !ok {
+			return errTeamNotFound
+		}
+		for _, shift := range d.shifts {
+			if shift.Tenant == key.Tenant && shift.Team == name {
+				return errTeamInUse
+			}
+		}
+		delete(d.teams, key)
+		delete(d.members, key)
+		delete(d.following, key)
+		return nil
+	})
+}
+
+func (s *memoryStore) AddTeamMember(team, username string) error {
+	return s.do(func(d *memoryData) error {
+		key, ok := s.findTeam(d, team)
+		if !ok {
+			return errTeamNotFound
+		}
+		// Members come from the tenant of their team
+		if !s.hasUser(d, username) || d.userTenant[username] != key.Tenant {
+			return errUserNotFound
+		}
+		d.members[key][username] = true
+		return nil
+	})
+}
+
+func (s *memoryStore) RemoveTeamMember(team, username string) error {
+	return s.do(func(d *memoryData) error {
+		key, ok := s.findTeam(d, team)
+		if !ok || !d.members[key][username] {
+			return errNotTeamMember
+		}
+		delete(d.members[key], username)
+		return nil
+	})
+}
+
+func (s *memoryStore) Rules() (*RuleConfig, error) {
+	var config RuleConfig
+	err := s.do(func(d *memoryData) error {
+		var ok bool
+		config, ok = d.rules[s.tenantFor("")]
+		if !ok {
+			return errRulesNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (s *memoryStore) SetRules(config RuleConfig) error {
+	return s.do(func(d *memoryData) error {
+		d.rules[s.tenantFor("")] = config
+		return nil
+	})
+}
+
+func (s *memoryStore) ExpireTrades() error {
+	return s.do(func(d *memoryData) error {
+		now := time.Now()
+		for _, trade := range d.trades {
+			if (trade.Status == tradePending || trade.Status == tradeAwaitingApproval) && !trade.Expires.After(now) {
+				trade.Status = tradeExpired
+			}
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) TradeGraph() ([]tradeNode, error) {
+	var nodes []tradeNode
+	err := s.do(func(d *memoryData) error {
+		now := time.Now()
+		blocked := make(map[string]bool)
+		for _, trade := range d.trades {
+			if (trade.Status == tradePending || trade.Status == tradeAwaitingApproval) && trade.Expires.After(now) {
+				for _, p := range trade.Participants {
+					blocked[p.ShiftID] = true
+				}
+			}
+		}
+		nodes = d.tradeNodes(func(shift Shift) bool { return !blocked[shift.ID] && s.sees(shift.Tenant) })
+		return nil
+	})
+	return nodes, err
+}
+
+func (s *memoryStore) TradeNodes(tradeID string) ([]tradeNode, error) {
+	var nodes []tradeNode
+	err := s.do(func(d *memoryData) error {
+		included := make(map[string]bool)
+		if trade, ok := d.trades[tradeID]; ok {
+			for _, p := range trade.Participants {
+				included[p.ShiftID] = true
+			}
+		}
+		nodes = d.tradeNodes(func(shift Shift) bool { return included[shift.ID] && s.sees(shift.Tenant) })
+		return nil
+	})
+	return nodes, err
+}
+
+// tradeNodes returns the trade-enabled shifts accepted by filter ordered by ID
+func (d *memoryData) tradeNodes(filter func(shift Shift) bool) []tradeNode {
+	var nodes []tradeNode
+	for _, shift := range d.shifts {
+		if _, released := d.open[shift.ID]; shift.Trade && !released && d.isTeamMember(shift) && filter(shift) {
+			nodes = append(nodes, newTradeNode(cloneShift(shift), d.shiftTypes[shift.Time].Skills, skillSet(d.skills[shift.Username])))
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ShiftID < nodes[j].ShiftID })
+	return nodes
+}
+
+func (s *memoryStore) CreateTrade(cycle []tradeNode, ttl time.Duration) (string, error) {
+	tradeID := generateSessionID()
+	err := s.do(func(d *memoryData) error {
+		now := time.Now()
+		trade := &memoryTrade{ID: tradeID, Status: tradePending, Created: now, Expires: now.Add(ttl)}
+		for i, node := range cycle {
+			next := cycle[(i+1)%len(cycle)]
+			trade.Participants = append(trade.Participants, memoryParticipant{
+				ShiftID:  node.ShiftID,
+				Username: node.Username,
+				Receives: next.ShiftID,
+				Decision: decisionPending,
+			})
+		}
+		d.trades[tradeID] = trade
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return tradeID, nil
+}
+
+// trade builds the API view of a stored trade, participants whose shifts
+// no longer exist are left out
+func (d *memoryData) trade(stored *memoryTrade) *Trade {
+	trade := &Trade{
+		Uid:      stored.ID,
+		Status:   stored.Status,
+		Created:  stored.Created,
+		Expires:  stored.Expires,
+		Reviewer: stored.Reviewer,
+	}
+	tradeShift := func(shiftID string) (TradeShift, bool) {
+		shift, ok := d.shifts[shiftID]
+		return TradeShift{Uid: shift.ID, Datum: formatDate(shift.Date), Time: shift.Time, Day: weekdayName(shift.Date)}, ok
+	}
+	for _, p := range stored.Participants {
+		gives, ok := tradeShift(p.ShiftID)
+		if !ok {
+			continue
+		}
+		receives, ok := tradeShift(p.Receives)
+		if !ok {
+			continue
+		}
+		trade.Participants = append(trade.Participants, TradeParticipant{Username: p.Username, Gives: gives, Receives: receives, Decision: p.Decision})
+	}
+	return trade
+}
+
+func (s *memoryStore) GetTrade(tradeID string) (*Trade, error) {
+	var trade *Trade
+	err := s.do(func(d *memoryData) error {
+		stored, ok := d.trades[tradeID]
+		if !ok || !s.seesTrade(d, stored) {
+			return errTradeNotFound
+		}
+		trade = d.trade(stored)
+		if len(trade.Participants) == 0 {
+			return errTradeNotFound
+		}
+		return nil
+	})
+	return trade, err
+}
+
+func (s *memoryStore) ListTrades(username string) ([]*Trade, error) {
+	return s.listTrades(func(trade *memoryTrade) bool {
+		for _, p := range trade.Participants {
+			if p.Username == username {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *memoryStore) ListTradesByStatus(status string) ([]*Trade, error) {
+	return s.listTrades(func(trade *memoryTrade) bool { return trade.Status == status })
+}
+
+// listTrades returns the trades accepted by filter, newest first
+func (s *memoryStore) listTrades(filter func(trade *memoryTrade) bool) ([]*Trade, error) {
+	trades := []*Trade{}
+	err := s.do(func(d *memoryData) error {
+		for _, stored := range d.trades {
+			if !filter(stored) || !s.seesTrade(d, stored) {
+				continue
+			}
+			if trade := d.trade(stored); len(trade.Participants) > 0 {
+				trades = append(trades, trade)
+			}
+		}
+		return nil
+	})
+	sort.Slice(trades, func(i, j int) bool { return trades[i].Created.After(trades[j].Created) })
+	return trades, err
+}
+
+// withTrade runs fn on the stored trade with the given ID
+func (s *memoryStore) withTrade(tradeID string, fn func(trade *memoryTrade)) error {
+	return s.do(func(d *memoryData) error {
+		trade, ok := d.trades[tradeID]
+		if !ok || !s.seesTrade(d, trade) {
+			return errTradeNotFound
+		}
+		fn(trade)
+		return nil
+	})
+}
+
+// seesTrade reports whether the shifts of the trade are visible to the store
+func (s *memoryStore) seesTrade(d *memoryData, trade *memoryTrade) bool {
+	for _, p := range trade.Participants {
+		if shift, ok := d.shifts[p.ShiftID]; ok && !s.sees(shift.Tenant) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *memoryStore) TradeStatus(tradeID string) (string, error) {
+	var status string
+	err := s.withTrade(tradeID, func(trade *memoryTrade) { status = trade.Status })
+	return status, err
+}
+
+func (s *memoryStore) SetTradeStatus(tradeID, status string) error {
+	return s.withTrade(tradeID, func(trade *memoryTrade) { trade.Status = status })
+}
+
+func (s *memoryStore) RequestTradeApproval(tradeID string, expires time.Time) error {
+	return s.withTrade(tradeID, func(trade *memoryTrade) { trade.Status, trade.Expires = tradeAwaitingApproval, expires })
+}
+
+func (s *memoryStore) SetTradeReviewer(tradeID, reviewer string) error {
+	return s.do(func(d *memoryData) error {
+		trade, ok := d.trades[tradeID]
+		if !ok || !s.seesTrade(d, trade) {
+			return errTradeNotFound
+		}
+		for _, p := range trade.Participants {
+			if p.Username == reviewer {
+				return errTradeParticipant
+			}
+		}
+		trade.Reviewer = reviewer
+		return nil
+	})
+}
+
+func (s *memoryStore) SetTradeDecision(tradeID, username, decision string) error {
+	return s.withTrade(tradeID, func(trade *memoryTrade) {
+		for i := range trade.Participants {
+			if trade.Participants[i].Username == username {
+				trade.Participants[i].Decision = decision
+			}
+		}
+	})
+}
+
+func (s *memoryStore) OpenDecisions(tradeID string) (int, error) {
+	open := 0
+	err := s.withTrade(tradeID, func(trade *memoryTrade) {
+		for _, p := range trade.Participants {
+			if p.Decision != decisionAccepted {
+				open++
+			}
+		}
+	})
+	return open, err
+}
+
+func (s *memoryStore) SwapShifts(cycle []tradeNode) error {
+	return s.do(func(d *memoryData) error {
+		swapped := make(map[string]bool, len(cycle))
+		for _, node := range cycle {
+			if _, ok := d.shifts[node.ShiftID]; !ok {
+				return errShiftNotFound
+			}
+			swapped[node.ShiftID] = true
+		}
+		for i, node := range cycle {
+			if d.slotTaken(node.Username, d.shifts[cycle[(i+1)%len(cycle)].ShiftID], swapped) {
+				return errShiftConflict
+			}
+		}
+		for i, node := range cycle {
+			next := cycle[(i+1)%len(cycle)]
+			shift := d.shifts[next.ShiftID]
+			d.cancelCalendarEvent(shift)
+			shift.Username, shift.Trade, shift.Search, shift.Targets = node.Username, false, nil, nil
+			shift.Sequence, shift.Generated = shift.Sequence+1, false
+			d.shifts[next.ShiftID] = shift
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) CalendarFeed(username string) (*CalendarFeed, error) {
+	var feed CalendarFeed
+	err := s.do(func(d *memoryData) error {
+		var ok bool
+		feed, ok = d.feeds[username]
+		if !ok || !s.hasUser(d, username) {
+			return errCalendarNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+func (s *memoryStore) CalendarFeedByToken(token string) (*CalendarFeed, error) {
+	var found *CalendarFeed
+	err := s.do(func(d *memoryData) error {
+		for username, feed := range d.feeds {
+			if feed.Token == token && s.hasUser(d, username) {
+				found = &feed
+				return nil
+			}
+		}
+		return errCalendarNotFound
+	})
+	return found, err
+}
+
+func (s *memoryStore) SetCalendarFeed(feed CalendarFeed) error {
+	return s.do(func(d *memoryData) error {
+		if !s.hasUser(d, feed.Username) {
+			return errUserNotFound
+		}
+		d.feeds[feed.Username] = feed
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteCalendarFeed(username string) error {
+	return s.do(func(d *memoryData) error {
+		if _, ok := d.feeds[username]; !ok || !s.hasUser(d, username) {
+			return errCalendarNotFound
+		}
+		delete(d.feeds, username)
+		return nil
+	})
+}
+
+func (s *memoryStore) CalendarCancellations(username string, since time.Time) ([]CalendarCancellation, error) {
+	cancellations := []CalendarCancellation{}
+	err := s.do(func(d *memoryData) error {
+		if !s.hasUser(d, username) {
+			return nil
+		}
+		for _, c := range d.cancelled {
+			if c.Username == username && c.Cancelled.After(since) {
+				cancellations = append(cancellations, c)
+			}
+		}
+		return nil
+	})
+	sort.Slice(cancellations, func(i, j int) bool {
+		if !cancellations[i].Date.Equal(cancellations[j].Date) {
+			return cancellations[i].Date.Before(cancellations[j].Date)
+		}
+		if !cancellations[i].StartsAt.Equal(cancellations[j].StartsAt) {
+			return cancellations[i].StartsAt.Before(cancellations[j].StartsAt)
+		}
+		return cancellations[i].ShiftID < cancellations[j].ShiftID
+	})
+	return cancellations, err
+}
+
+func (s *memoryStore) Rotations() ([]RotationTemplate, error) {
+	rotations := []RotationTemplate{}
+	err := s.do(func(d *memoryData) error {
+		for key, days := range d.rotations {
+			if s.sees(key.Tenant) {
+				rotations = append(rotations, RotationTemplate{Name: key.Name, Days: append([]string(nil), days...)})
+			}
+		}
+		return nil
+	})
+	sort.Slice(rotations, func(i, j int) bool { return rotations[i].Name < rotations[j].Name })
+	return rotations, err
+}
+
+// findRotation returns the key of the named template visible to the store
+func (s *memoryStore) findRotation(d *memoryData, name string) (tenantKey, bool) {
+	if s.tenant != "" {
+		key := tenantKey{s.tenant, name}
+		_, ok := d.rotations[key]
+		return key, ok
+	}
+	for key := range d.rotations {
+		if key.Name == name {
+			return key, true
+		}
+	}
+	return tenantKey{}, false
+}
+
+func (s *memoryStore) GetRotation(name string) (*RotationTemplate, error) {
+	var rotation RotationTemplate
+	err := s.do(func(d *memoryData) error {
+		key, ok := s.findRotation(d, name)
+		if !ok {
+			return errRotationNotFound
+		}
+		rotation = RotationTemplate{Name: name, Days: append([]string(nil), d.rotations[key]...)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+func (s *memoryStore) CreateRotation(rotation RotationTemplate) error {
+	return s.do(func(d *memoryData) error {
+		key := tenantKey{s.tenantFor(""), rotation.Name}
+		if _, ok := d.rotations[key]; ok {
+			return errRotationExists
+		}
+		d.rotations[key] = append([]string(nil), rotation.Days...)
+		return nil
+	})
+}
+
+func (s *memoryStore) UpdateRotation(name string, rotation RotationTemplate) error {
+	return s.do(func(d *memoryData) error {
+		key, ok := s.findRotation(d, name)
+		if !ok {
+			return errRotationNotFound
+		}
+		renamed := tenantKey{key.Tenant, rotation.Name}
+		if _, ok := d.rotations[renamed]; ok && rotation.Name != name {
+			return errRotationExists
+		}
+		delete(d.rotations, key)
+		d.rotations[renamed] = append([]string(nil), rotation.Days...)
+
+		for team, following := range d.following {
+			if team.Tenant == key.Tenant && following.Template == name {
+				following.Template = rotation.Name
+				d.following[team] = following
+			}
+		}
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteRotation(name string) error {
+	return s.do(func(d *memoryData) error {
+		key, ok := s.findRotation(d, name)
+		if !ok {
+			return errRotationNotFound
+		}
+		for team, following := range d.following {
+			if team.Tenant == key.Tenant && following.Template == name {
+				return errRotationInUse
+			}
+		}
+		delete(d.rotations, key)
+		return nil
+	})
+}
+
+func (s *memoryStore) TeamRotation(team string) (*TeamRotation, error) {
+	var rotation TeamRotation
+	err := s.do(func(d *memoryData) error {
+		key, _ := s.findTeam(d, team)
+		following, ok := d.following[key]
+		if !ok {
+			return errRotationNotFound
+		}
+		rotation = following
+		rotation.Members = []RotationMember{}
+		for _, member := range following.Members {
+			if s.hasUser(d, member.Username) {
+				rotation.Members = append(rotation.Members, member)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rotation, nil
+}
+
+func (s *memoryStore) SetTeamRotation(rotation TeamRotation) error {
+	return s.do(func(d *memoryData) error {
+		rotation.Members = append([]RotationMember(nil), rotation.Members...)
+		sort.Slice(rotation.Members, func(i, j int) bool { return rotation.Members[i].Username < rotation.Members[j].Username })
+		d.following[tenantKey{s.tenantFor(""), rotation.Team}] = rotation
+		return nil
+	})
+}
+
+func (s *memoryStore) DeleteTeamRotation(team string) error {
+	return s.do(func(d *memoryData) error {
+		key, _ := s.findTeam(d, team)
+		if _, ok := d.following[key]; !ok {
+			return errRotationNotFound
+		}
+		delete(d.following, key)
+		return nil
+	})
+}
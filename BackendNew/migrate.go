@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The migrations of each driver live in migrations/<driver> and are
+// numbered independently
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the Postgres advisory lock key that serialises
+// migrations across backend replicas
+const migrationLockID = 4010
+
+// migration is one numbered schema change with its up and down scripts
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads the embedded NNNN_name.up.sql / NNNN_name.down.sql
+// pairs of a driver ordered by version
+func loadMigrations(driver string) ([]migration, error) {
+	dir := "migrations/" + driver
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		prefix, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: missing name", fileName)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version", fileName)
+		}
+
+		content, err := fs.ReadFile(migrationFiles, dir+"/"+fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d: conflicting names %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d: missing up script", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// lock, SQLite has a single writer and needs no lock
+func withMigrationLock(ctx context.Context, db *sql.DB, driver string, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func(conn *sql.Conn) {
+		err := conn.Close()
+		if err != nil {
+
+		}
+	}(conn)
+
+	// The SQLite driver only reads TIMESTAMP columns back as times
+	timestampType := "TIMESTAMP"
+	if driver == driverPostgres {
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+			if err != nil {
+				log.Println("failed to release migration lock:", err)
+			}
+		}()
+		// Migrations move the rows of every tenant
+		_, err = conn.ExecContext(ctx, setTenant, allTenants)
+		if err != nil {
+			return err
+		}
+		timestampType = "TIMESTAMPTZ"
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at `+timestampType+` NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// appliedMigrations returns the versions recorded in schema_migrations
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runMigration executes one script and records the result in the same transaction
+func runMigration(ctx context.Context, conn *sql.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil {
+
+		}
+	}(tx)
+
+	script := m.Up
+	if !up {
+		script = m.Down
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)", m.Version, m.Name, time.Now())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=$1", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies pending migrations in order, at most steps of them if steps > 0
+func migrateUp(ctx context.Context, db *sql.DB, driver string, steps int) error {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, driver, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if steps > 0 && count == steps {
+				break
+			}
+			log.Printf("applying migration %04d_%s", m.Version, m.Name)
+			if err := runMigration(ctx, conn, m, true); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+}
+
+// migrateDown reverts the most recently applied migrations, one if steps <= 0
+func migrateDown(ctx context.Context, db *sql.DB, driver string, steps int) error {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return err
+	}
+	if steps <= 0 {
+		steps = 1
+	}
+
+	return withMigrationLock(ctx, db, driver, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s: missing down script", m.Version, m.Name)
+			}
+			log.Printf("reverting migration %04d_%s", m.Version, m.Name)
+			if err := runMigration(ctx, conn, m, false); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+}
+
+// migrationStatus prints every known migration and whether it is applied
+func migrationStatus(ctx context.Context, db *sql.DB, driver string) error {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, driver, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			status := "pending"
+			if appliedAt, ok := applied[m.Version]; ok {
+				status = "applied " + appliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-24s %s\n", m.Version, m.Name, status)
+		}
+		return nil
+	})
+}
+
+// runMigrateCommand implements `main migrate up|down|status [steps]`
+func runMigrateCommand(db *sql.DB, driver string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down|status [steps]")
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps < 0 {
+			return fmt.Errorf("invalid number of steps %q", args[1])
+		}
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		return migrateUp(ctx, db, driver, steps)
+	case "down":
+		return migrateDown(ctx, db, driver, steps)
+	case "status":
+		return migrationStatus(ctx, db, driver)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,27 @@
+-- Schema as originally created by initDB. All statements are idempotent so
+-- databases set up before migrations existed can be brought under version
+-- control without changes.
+CREATE TABLE IF NOT EXISTS user_base (
+    username TEXT PRIMARY KEY,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    sessionID TEXT PRIMARY KEY,
+    username TEXT NOT NULL,
+    timeout TIMESTAMP NOT NULL,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS shifts (
+    shiftID TEXT PRIMARY KEY,
+    username TEXT,
+    date TEXT NOT NULL,
+    time TEXT NOT NULL,
+    day TEXT NOT NULL,
+    TRADE BOOLEAN default false,
+    search_early BOOLEAN default false,
+    search_evening BOOLEAN default false,
+    search_night BOOLEAN default false,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS shift_trade_targets (
+    shiftID TEXT NOT NULL,
+    date_from TEXT NOT NULL,
+    date_to TEXT NOT NULL,
+    time TEXT,
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS trade_participants;
+DROP TABLE IF EXISTS trades;
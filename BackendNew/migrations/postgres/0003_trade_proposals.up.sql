@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS trades (
+    tradeID TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    created TIMESTAMP NOT NULL,
+    expires TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS trade_participants (
+    tradeID TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    shiftID TEXT NOT NULL,
+    username TEXT NOT NULL,
+    receives TEXT NOT NULL,
+    decision TEXT NOT NULL,
+    PRIMARY KEY (tradeID, position),
+    FOREIGN KEY (tradeID) REFERENCES trades(tradeID) ON DELETE CASCADE,
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE,
+    FOREIGN KEY (receives) REFERENCES shifts(shiftID) ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
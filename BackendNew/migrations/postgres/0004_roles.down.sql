@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_roles;
+ALTER TABLE trades DROP COLUMN IF EXISTS reviewer;
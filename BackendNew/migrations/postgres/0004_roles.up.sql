@@ -0,0 +1,8 @@
+ALTER TABLE trades ADD COLUMN IF NOT EXISTS reviewer TEXT;
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    username TEXT NOT NULL,
+    role TEXT NOT NULL,
+    PRIMARY KEY (username, role),
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
@@ -0,0 +1,12 @@
+ALTER TABLE shifts
+    ADD COLUMN search_early BOOLEAN default false,
+    ADD COLUMN search_evening BOOLEAN default false,
+    ADD COLUMN search_night BOOLEAN default false;
+
+UPDATE shifts SET
+    search_early = EXISTS (SELECT 1 FROM shift_searches s WHERE s.shiftID = shifts.shiftID AND s.shift_type = 'früh'),
+    search_evening = EXISTS (SELECT 1 FROM shift_searches s WHERE s.shiftID = shifts.shiftID AND s.shift_type = 'spät'),
+    search_night = EXISTS (SELECT 1 FROM shift_searches s WHERE s.shiftID = shifts.shiftID AND s.shift_type = 'nacht');
+
+DROP TABLE IF EXISTS shift_searches;
+DROP TABLE IF EXISTS shift_types;
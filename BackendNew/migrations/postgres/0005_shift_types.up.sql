@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS shift_types (
+    name TEXT PRIMARY KEY,
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL,
+    color TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO shift_types (name, start_time, end_time, color, position) VALUES
+    ('früh', '06:00', '14:00', '#f6c945', 1),
+    ('spät', '14:00', '22:00', '#e8833a', 2),
+    ('nacht', '22:00', '06:00', '#3a5ba0', 3)
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS shift_searches (
+    shiftID TEXT NOT NULL,
+    shift_type TEXT NOT NULL,
+    PRIMARY KEY (shiftID, shift_type),
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE,
+    FOREIGN KEY (shift_type) REFERENCES shift_types(name) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+-- Move the searches out of the former per-slot columns
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='shifts' AND column_name='search_early') THEN
+        INSERT INTO shift_searches (shiftID, shift_type) SELECT shiftID, 'früh' FROM shifts WHERE search_early ON CONFLICT DO NOTHING;
+        INSERT INTO shift_searches (shiftID, shift_type) SELECT shiftID, 'spät' FROM shifts WHERE search_evening ON CONFLICT DO NOTHING;
+        INSERT INTO shift_searches (shiftID, shift_type) SELECT shiftID, 'nacht' FROM shifts WHERE search_night ON CONFLICT DO NOTHING;
+        ALTER TABLE shifts DROP COLUMN search_early, DROP COLUMN search_evening, DROP COLUMN search_night;
+    END IF;
+END $$;
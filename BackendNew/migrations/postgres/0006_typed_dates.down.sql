@@ -0,0 +1,10 @@
+ALTER TABLE shifts ADD COLUMN day TEXT;
+UPDATE shifts SET day = trim(to_char(date, 'Day'));
+ALTER TABLE shifts ALTER COLUMN day SET NOT NULL;
+ALTER TABLE shifts DROP COLUMN starts_at, DROP COLUMN ends_at;
+ALTER TABLE shifts ALTER COLUMN date TYPE TEXT USING to_char(date, 'YYYY-MM-DD');
+ALTER TABLE shift_trade_targets
+    ALTER COLUMN date_from TYPE TEXT USING to_char(date_from, 'YYYY-MM-DD'),
+    ALTER COLUMN date_to TYPE TEXT USING to_char(date_to, 'YYYY-MM-DD');
+ALTER TABLE sessions ALTER COLUMN timeout TYPE TIMESTAMP;
+ALTER TABLE trades ALTER COLUMN created TYPE TIMESTAMP, ALTER COLUMN expires TYPE TIMESTAMP;
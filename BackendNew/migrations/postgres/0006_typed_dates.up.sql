@@ -0,0 +1,17 @@
+-- Switch free text dates and timestamps to proper types, the weekday is
+-- derived from the date from now on
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='shifts' AND column_name='date' AND data_type='text') THEN
+        ALTER TABLE shifts ALTER COLUMN date TYPE DATE USING date::date;
+        ALTER TABLE shift_trade_targets ALTER COLUMN date_from TYPE DATE USING date_from::date, ALTER COLUMN date_to TYPE DATE USING date_to::date;
+        ALTER TABLE sessions ALTER COLUMN timeout TYPE TIMESTAMPTZ;
+        ALTER TABLE trades ALTER COLUMN created TYPE TIMESTAMPTZ, ALTER COLUMN expires TYPE TIMESTAMPTZ;
+        ALTER TABLE shifts ADD COLUMN starts_at TIMESTAMPTZ, ADD COLUMN ends_at TIMESTAMPTZ;
+        UPDATE shifts s SET
+            starts_at = (s.date + t.start_time::time)::timestamp AT TIME ZONE current_setting('TimeZone'),
+            ends_at = (s.date + t.end_time::time + CASE WHEN t.end_time <= t.start_time THEN interval '1 day' ELSE interval '0' END)::timestamp AT TIME ZONE current_setting('TimeZone')
+        FROM shift_types t WHERE t.name = s.time;
+        ALTER TABLE shifts DROP COLUMN day;
+    END IF;
+END $$;
@@ -0,0 +1,3 @@
+ALTER TABLE shifts DROP COLUMN IF EXISTS team;
+DROP TABLE IF EXISTS team_members;
+DROP TABLE IF EXISTS teams;
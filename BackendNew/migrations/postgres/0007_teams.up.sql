@@ -0,0 +1,16 @@
+-- Teams group users, e.g. the wards of a department. Shifts of a team are
+-- only traded between its members.
+CREATE TABLE IF NOT EXISTS teams (
+    name TEXT PRIMARY KEY,
+    department TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS team_members (
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    PRIMARY KEY (team, username),
+    FOREIGN KEY (team) REFERENCES teams(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+ALTER TABLE shifts ADD COLUMN IF NOT EXISTS team TEXT REFERENCES teams(name) ON UPDATE CASCADE;
@@ -0,0 +1,14 @@
+DROP POLICY IF EXISTS tenant_isolation ON shifts;
+DROP POLICY IF EXISTS tenant_isolation ON sessions;
+DROP POLICY IF EXISTS tenant_isolation ON user_base;
+ALTER TABLE shifts NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE shifts DISABLE ROW LEVEL SECURITY;
+ALTER TABLE sessions NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE sessions DISABLE ROW LEVEL SECURITY;
+ALTER TABLE user_base NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE user_base DISABLE ROW LEVEL SECURITY;
+
+ALTER TABLE shifts DROP COLUMN IF EXISTS tenant;
+ALTER TABLE sessions DROP COLUMN IF EXISTS tenant;
+ALTER TABLE user_base DROP COLUMN IF EXISTS tenant;
+DROP TABLE IF EXISTS tenants;
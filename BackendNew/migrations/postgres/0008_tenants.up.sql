@@ -0,0 +1,36 @@
+-- Tenants are organisations sharing the service. Users, sessions and shifts
+-- belong to exactly one tenant, existing rows to the default tenant.
+CREATE TABLE IF NOT EXISTS tenants (
+    tenantID TEXT PRIMARY KEY,
+    name TEXT NOT NULL
+);
+
+INSERT INTO tenants (tenantID, name) VALUES ('default', 'Default') ON CONFLICT DO NOTHING;
+
+ALTER TABLE user_base ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default' REFERENCES tenants(tenantID);
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default' REFERENCES tenants(tenantID);
+ALTER TABLE shifts ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default' REFERENCES tenants(tenantID);
+
+CREATE INDEX IF NOT EXISTS user_base_tenant_idx ON user_base (tenant);
+CREATE INDEX IF NOT EXISTS sessions_tenant_idx ON sessions (tenant);
+CREATE INDEX IF NOT EXISTS shifts_tenant_idx ON shifts (tenant);
+
+-- The queries filter by tenant themselves, row-level security is a safety
+-- net for transactions that set app.tenant. Without the setting all rows
+-- stay visible, e.g. for login and migrations.
+ALTER TABLE user_base ENABLE ROW LEVEL SECURITY;
+ALTER TABLE user_base FORCE ROW LEVEL SECURITY;
+ALTER TABLE sessions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE sessions FORCE ROW LEVEL SECURITY;
+ALTER TABLE shifts ENABLE ROW LEVEL SECURITY;
+ALTER TABLE shifts FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON user_base;
+CREATE POLICY tenant_isolation ON user_base
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON sessions;
+CREATE POLICY tenant_isolation ON sessions
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON shifts;
+CREATE POLICY tenant_isolation ON shifts
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
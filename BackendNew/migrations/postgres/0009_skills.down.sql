@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS shift_skills;
+DROP TABLE IF EXISTS shift_type_skills;
+DROP TABLE IF EXISTS user_skills;
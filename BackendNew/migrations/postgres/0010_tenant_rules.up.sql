@@ -0,0 +1,10 @@
+-- Working time rules of tenants that do not use the configured defaults,
+-- a limit of 0 disables the rule
+CREATE TABLE IF NOT EXISTS tenant_rules (
+    tenant TEXT PRIMARY KEY,
+    min_rest_hours DOUBLE PRECISION NOT NULL,
+    max_consecutive_days INTEGER NOT NULL,
+    max_weekly_hours DOUBLE PRECISION NOT NULL,
+    no_double_booking BOOLEAN NOT NULL,
+    FOREIGN KEY (tenant) REFERENCES tenants(tenantID) ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS shifts_username_date_time_key;
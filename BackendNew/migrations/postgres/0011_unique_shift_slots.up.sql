@@ -0,0 +1,15 @@
+-- A user works a slot at most once per date. Existing double bookings have
+-- to be resolved by hand, the migration refuses to pick one of them.
+DO $$
+DECLARE
+    duplicates INTEGER;
+BEGIN
+    SELECT COUNT(*) INTO duplicates FROM (
+        SELECT 1 FROM shifts WHERE username IS NOT NULL GROUP BY username, date, time HAVING COUNT(*) > 1
+    ) d;
+    IF duplicates > 0 THEN
+        RAISE EXCEPTION 'shifts contains % double booked slots, remove the duplicates before migrating', duplicates;
+    END IF;
+END $$;
+
+CREATE UNIQUE INDEX IF NOT EXISTS shifts_username_date_time_key ON shifts (username, date, time);
@@ -0,0 +1,2 @@
+ALTER TABLE shifts DROP COLUMN IF EXISTS no_giveback;
+DROP TABLE IF EXISTS open_shifts;
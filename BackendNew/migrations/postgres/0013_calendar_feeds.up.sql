@@ -0,0 +1,27 @@
+-- Calendar feeds publish a user's shifts at /calendar/{token}.ics, a new
+-- token replaces the previous one.
+CREATE TABLE IF NOT EXISTS calendar_feeds (
+    username TEXT PRIMARY KEY,
+    token TEXT NOT NULL UNIQUE,
+    created TIMESTAMPTZ NOT NULL,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+-- sequence counts the changes of a shift so that calendars replace their
+-- copy of it
+ALTER TABLE shifts ADD COLUMN IF NOT EXISTS sequence INTEGER NOT NULL DEFAULT 0;
+
+-- Shifts that left a user's calendar because they were deleted or handed to
+-- someone else, the feed publishes them as cancelled events
+CREATE TABLE IF NOT EXISTS calendar_cancellations (
+    shiftID TEXT NOT NULL,
+    username TEXT NOT NULL,
+    date DATE NOT NULL,
+    time TEXT NOT NULL,
+    starts_at TIMESTAMPTZ,
+    ends_at TIMESTAMPTZ,
+    sequence INTEGER NOT NULL,
+    cancelled TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (shiftID, username),
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
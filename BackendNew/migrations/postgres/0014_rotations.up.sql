@@ -0,0 +1,36 @@
+-- Rotation templates are named cycles of slots, days without a slot are
+-- days off
+CREATE TABLE IF NOT EXISTS rotation_templates (
+    name TEXT PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS rotation_days (
+    template TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    time TEXT,
+    PRIMARY KEY (template, position),
+    FOREIGN KEY (template) REFERENCES rotation_templates(name) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+-- A team follows one template from start_date, the offset of a member moves
+-- the day of the cycle they start with
+CREATE TABLE IF NOT EXISTS team_rotations (
+    team TEXT PRIMARY KEY,
+    template TEXT NOT NULL,
+    start_date DATE NOT NULL,
+    FOREIGN KEY (team) REFERENCES teams(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (template) REFERENCES rotation_templates(name) ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS team_rotation_members (
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    day_offset INTEGER NOT NULL,
+    PRIMARY KEY (team, username),
+    FOREIGN KEY (team) REFERENCES team_rotations(team) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+-- generated marks shifts created from their team's rotation, regenerating
+-- replaces them until they are traded
+ALTER TABLE shifts ADD COLUMN IF NOT EXISTS generated BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,54 @@
+-- Copies of a team in several tenants cannot be merged back into one team
+DO $$
+DECLARE
+    duplicates INTEGER;
+BEGIN
+    SELECT COUNT(*) INTO duplicates FROM (
+        SELECT 1 FROM teams GROUP BY name HAVING COUNT(*) > 1
+    ) d;
+    IF duplicates > 0 THEN
+        RAISE EXCEPTION 'teams contains % names used by several tenants, rename them before migrating down', duplicates;
+    END IF;
+END $$;
+
+DROP POLICY IF EXISTS tenant_isolation ON team_rotation_members;
+DROP POLICY IF EXISTS tenant_isolation ON team_rotations;
+DROP POLICY IF EXISTS tenant_isolation ON team_members;
+DROP POLICY IF EXISTS tenant_isolation ON teams;
+ALTER TABLE team_rotation_members NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE team_rotation_members DISABLE ROW LEVEL SECURITY;
+ALTER TABLE team_rotations NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE team_rotations DISABLE ROW LEVEL SECURITY;
+ALTER TABLE team_members NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE team_members DISABLE ROW LEVEL SECURITY;
+ALTER TABLE teams NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE teams DISABLE ROW LEVEL SECURITY;
+
+ALTER TABLE team_rotation_members DROP CONSTRAINT IF EXISTS team_rotation_members_team_fkey;
+ALTER TABLE team_rotations DROP CONSTRAINT IF EXISTS team_rotations_team_fkey;
+ALTER TABLE team_members DROP CONSTRAINT IF EXISTS team_members_team_fkey;
+ALTER TABLE shifts DROP CONSTRAINT IF EXISTS shifts_team_fkey;
+
+ALTER TABLE team_rotation_members DROP CONSTRAINT IF EXISTS team_rotation_members_pkey;
+ALTER TABLE team_rotations DROP CONSTRAINT IF EXISTS team_rotations_pkey;
+ALTER TABLE team_members DROP CONSTRAINT IF EXISTS team_members_pkey;
+ALTER TABLE teams DROP CONSTRAINT IF EXISTS teams_pkey;
+
+ALTER TABLE teams ADD PRIMARY KEY (name);
+ALTER TABLE team_members ADD PRIMARY KEY (team, username);
+ALTER TABLE team_rotations ADD PRIMARY KEY (team);
+ALTER TABLE team_rotation_members ADD PRIMARY KEY (team, username);
+
+ALTER TABLE shifts ADD CONSTRAINT shifts_team_fkey
+    FOREIGN KEY (team) REFERENCES teams(name) ON UPDATE CASCADE;
+ALTER TABLE team_members ADD CONSTRAINT team_members_team_fkey
+    FOREIGN KEY (team) REFERENCES teams(name) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE team_rotations ADD CONSTRAINT team_rotations_team_fkey
+    FOREIGN KEY (team) REFERENCES teams(name) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE team_rotation_members ADD CONSTRAINT team_rotation_members_team_fkey
+    FOREIGN KEY (team) REFERENCES team_rotations(team) ON UPDATE CASCADE ON DELETE CASCADE;
+
+ALTER TABLE team_rotation_members DROP COLUMN IF EXISTS tenant;
+ALTER TABLE team_rotations DROP COLUMN IF EXISTS tenant;
+ALTER TABLE team_members DROP COLUMN IF EXISTS tenant;
+ALTER TABLE teams DROP COLUMN IF EXISTS tenant;
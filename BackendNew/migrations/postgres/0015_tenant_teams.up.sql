@@ -0,0 +1,70 @@
+-- Teams belong to a tenant and their names are unique per tenant. Members
+-- and rotations carry the tenant of their team. A team used by several
+-- tenants is copied into each of them.
+ALTER TABLE teams ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default' REFERENCES tenants(tenantID);
+ALTER TABLE team_members ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE team_rotations ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE team_rotation_members ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+
+ALTER TABLE team_rotation_members DROP CONSTRAINT IF EXISTS team_rotation_members_team_fkey;
+ALTER TABLE team_rotations DROP CONSTRAINT IF EXISTS team_rotations_team_fkey;
+ALTER TABLE team_members DROP CONSTRAINT IF EXISTS team_members_team_fkey;
+ALTER TABLE shifts DROP CONSTRAINT IF EXISTS shifts_team_fkey;
+
+ALTER TABLE team_rotation_members DROP CONSTRAINT IF EXISTS team_rotation_members_pkey;
+ALTER TABLE team_rotations DROP CONSTRAINT IF EXISTS team_rotations_pkey;
+ALTER TABLE team_members DROP CONSTRAINT IF EXISTS team_members_pkey;
+ALTER TABLE teams DROP CONSTRAINT IF EXISTS teams_pkey;
+
+UPDATE team_members m SET tenant = u.tenant FROM user_base u WHERE u.username = m.username;
+UPDATE team_rotation_members m SET tenant = u.tenant FROM user_base u WHERE u.username = m.username;
+
+INSERT INTO teams (tenant, name, department)
+SELECT DISTINCT used.tenant, t.name, t.department FROM teams t
+JOIN (
+    SELECT tenant, team FROM shifts WHERE team IS NOT NULL
+    UNION SELECT tenant, team FROM team_members
+    UNION SELECT tenant, team FROM team_rotation_members
+) used ON used.team = t.name
+WHERE used.tenant <> t.tenant;
+
+INSERT INTO team_rotations (tenant, team, template, start_date)
+SELECT DISTINCT m.tenant, r.team, r.template, r.start_date FROM team_rotations r
+JOIN team_rotation_members m ON m.team = r.team
+WHERE m.tenant <> r.tenant;
+
+ALTER TABLE teams ADD PRIMARY KEY (tenant, name);
+ALTER TABLE team_members ADD PRIMARY KEY (tenant, team, username);
+ALTER TABLE team_rotations ADD PRIMARY KEY (tenant, team);
+ALTER TABLE team_rotation_members ADD PRIMARY KEY (tenant, team, username);
+
+ALTER TABLE shifts ADD CONSTRAINT shifts_team_fkey
+    FOREIGN KEY (tenant, team) REFERENCES teams(tenant, name) ON UPDATE CASCADE;
+ALTER TABLE team_members ADD CONSTRAINT team_members_team_fkey
+    FOREIGN KEY (tenant, team) REFERENCES teams(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE team_rotations ADD CONSTRAINT team_rotations_team_fkey
+    FOREIGN KEY (tenant, team) REFERENCES teams(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE team_rotation_members ADD CONSTRAINT team_rotation_members_team_fkey
+    FOREIGN KEY (tenant, team) REFERENCES team_rotations(tenant, team) ON UPDATE CASCADE ON DELETE CASCADE;
+
+ALTER TABLE teams ENABLE ROW LEVEL SECURITY;
+ALTER TABLE teams FORCE ROW LEVEL SECURITY;
+ALTER TABLE team_members ENABLE ROW LEVEL SECURITY;
+ALTER TABLE team_members FORCE ROW LEVEL SECURITY;
+ALTER TABLE team_rotations ENABLE ROW LEVEL SECURITY;
+ALTER TABLE team_rotations FORCE ROW LEVEL SECURITY;
+ALTER TABLE team_rotation_members ENABLE ROW LEVEL SECURITY;
+ALTER TABLE team_rotation_members FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON teams;
+CREATE POLICY tenant_isolation ON teams
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_members;
+CREATE POLICY tenant_isolation ON team_members
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_rotations;
+CREATE POLICY tenant_isolation ON team_rotations
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_rotation_members;
+CREATE POLICY tenant_isolation ON team_rotation_members
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
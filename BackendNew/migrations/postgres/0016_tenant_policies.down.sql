@@ -0,0 +1,22 @@
+-- Without the setting all rows stay visible again
+DROP POLICY IF EXISTS tenant_isolation ON user_base;
+CREATE POLICY tenant_isolation ON user_base
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON sessions;
+CREATE POLICY tenant_isolation ON sessions
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON shifts;
+CREATE POLICY tenant_isolation ON shifts
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON teams;
+CREATE POLICY tenant_isolation ON teams
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_members;
+CREATE POLICY tenant_isolation ON team_members
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_rotations;
+CREATE POLICY tenant_isolation ON team_rotations
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_rotation_members;
+CREATE POLICY tenant_isolation ON team_rotation_members
+    USING (COALESCE(current_setting('app.tenant', true), '') IN ('', tenant));
@@ -0,0 +1,23 @@
+-- Every connection sets app.tenant, to its tenant or to '*' if it is not
+-- limited to one. Connections without the setting see no rows at all.
+DROP POLICY IF EXISTS tenant_isolation ON user_base;
+CREATE POLICY tenant_isolation ON user_base
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON sessions;
+CREATE POLICY tenant_isolation ON sessions
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON shifts;
+CREATE POLICY tenant_isolation ON shifts
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON teams;
+CREATE POLICY tenant_isolation ON teams
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_members;
+CREATE POLICY tenant_isolation ON team_members
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_rotations;
+CREATE POLICY tenant_isolation ON team_rotations
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON team_rotation_members;
+CREATE POLICY tenant_isolation ON team_rotation_members
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
@@ -0,0 +1,35 @@
+-- Copies of a template in several tenants cannot be merged back into one
+DO $$
+DECLARE
+    duplicates INTEGER;
+BEGIN
+    SELECT COUNT(*) INTO duplicates FROM (
+        SELECT 1 FROM rotation_templates GROUP BY name HAVING COUNT(*) > 1
+    ) d;
+    IF duplicates > 0 THEN
+        RAISE EXCEPTION 'rotation_templates contains % names used by several tenants, rename them before migrating down', duplicates;
+    END IF;
+END $$;
+
+DROP POLICY IF EXISTS tenant_isolation ON rotation_days;
+DROP POLICY IF EXISTS tenant_isolation ON rotation_templates;
+ALTER TABLE rotation_days NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE rotation_days DISABLE ROW LEVEL SECURITY;
+ALTER TABLE rotation_templates NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE rotation_templates DISABLE ROW LEVEL SECURITY;
+
+ALTER TABLE team_rotations DROP CONSTRAINT IF EXISTS team_rotations_template_fkey;
+ALTER TABLE rotation_days DROP CONSTRAINT IF EXISTS rotation_days_template_fkey;
+ALTER TABLE rotation_days DROP CONSTRAINT IF EXISTS rotation_days_pkey;
+ALTER TABLE rotation_templates DROP CONSTRAINT IF EXISTS rotation_templates_pkey;
+
+ALTER TABLE rotation_templates ADD PRIMARY KEY (name);
+ALTER TABLE rotation_days ADD PRIMARY KEY (template, position);
+
+ALTER TABLE rotation_days ADD CONSTRAINT rotation_days_template_fkey
+    FOREIGN KEY (template) REFERENCES rotation_templates(name) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE team_rotations ADD CONSTRAINT team_rotations_template_fkey
+    FOREIGN KEY (template) REFERENCES rotation_templates(name) ON UPDATE CASCADE;
+
+ALTER TABLE rotation_days DROP COLUMN IF EXISTS tenant;
+ALTER TABLE rotation_templates DROP COLUMN IF EXISTS tenant;
@@ -0,0 +1,40 @@
+-- Rotation templates belong to a tenant and their names are unique per
+-- tenant. A template followed by teams of several tenants is copied into
+-- each of them.
+ALTER TABLE rotation_templates ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default' REFERENCES tenants(tenantID);
+ALTER TABLE rotation_days ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT 'default';
+
+ALTER TABLE team_rotations DROP CONSTRAINT IF EXISTS team_rotations_template_fkey;
+ALTER TABLE rotation_days DROP CONSTRAINT IF EXISTS rotation_days_template_fkey;
+ALTER TABLE rotation_days DROP CONSTRAINT IF EXISTS rotation_days_pkey;
+ALTER TABLE rotation_templates DROP CONSTRAINT IF EXISTS rotation_templates_pkey;
+
+INSERT INTO rotation_templates (tenant, name)
+SELECT DISTINCT r.tenant, t.name FROM rotation_templates t
+JOIN team_rotations r ON r.template = t.name
+WHERE r.tenant <> t.tenant;
+
+INSERT INTO rotation_days (tenant, template, position, time)
+SELECT t.tenant, d.template, d.position, d.time FROM rotation_days d
+JOIN rotation_templates t ON t.name = d.template
+WHERE t.tenant <> d.tenant;
+
+ALTER TABLE rotation_templates ADD PRIMARY KEY (tenant, name);
+ALTER TABLE rotation_days ADD PRIMARY KEY (tenant, template, position);
+
+ALTER TABLE rotation_days ADD CONSTRAINT rotation_days_template_fkey
+    FOREIGN KEY (tenant, template) REFERENCES rotation_templates(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE;
+ALTER TABLE team_rotations ADD CONSTRAINT team_rotations_template_fkey
+    FOREIGN KEY (tenant, template) REFERENCES rotation_templates(tenant, name) ON UPDATE CASCADE;
+
+ALTER TABLE rotation_templates ENABLE ROW LEVEL SECURITY;
+ALTER TABLE rotation_templates FORCE ROW LEVEL SECURITY;
+ALTER TABLE rotation_days ENABLE ROW LEVEL SECURITY;
+ALTER TABLE rotation_days FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON rotation_templates;
+CREATE POLICY tenant_isolation ON rotation_templates
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
+DROP POLICY IF EXISTS tenant_isolation ON rotation_days;
+CREATE POLICY tenant_isolation ON rotation_days
+    USING (current_setting('app.tenant', true) IN ('*', tenant));
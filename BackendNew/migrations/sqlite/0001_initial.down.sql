@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS trade_participants;
+DROP TABLE IF EXISTS trades;
+DROP TABLE IF EXISTS shift_trade_targets;
+DROP TABLE IF EXISTS shift_searches;
+DROP TABLE IF EXISTS shifts;
+DROP TABLE IF EXISTS shift_types;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS user_base;
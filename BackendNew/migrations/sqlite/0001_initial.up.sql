@@ -0,0 +1,83 @@
+-- Full schema for SQLite, matching the Postgres schema after
+-- 0006_typed_dates. Dates and timestamps are stored as text that the driver
+-- parses back for DATE and TIMESTAMP columns.
+CREATE TABLE user_base (
+    username TEXT PRIMARY KEY,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE user_roles (
+    username TEXT NOT NULL,
+    role TEXT NOT NULL,
+    PRIMARY KEY (username, role),
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+CREATE TABLE sessions (
+    sessionID TEXT PRIMARY KEY,
+    username TEXT NOT NULL,
+    timeout TIMESTAMP NOT NULL,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+CREATE TABLE shift_types (
+    name TEXT PRIMARY KEY,
+    start_time TEXT NOT NULL,
+    end_time TEXT NOT NULL,
+    color TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO shift_types (name, start_time, end_time, color, position) VALUES
+    ('früh', '06:00', '14:00', '#f6c945', 1),
+    ('spät', '14:00', '22:00', '#e8833a', 2),
+    ('nacht', '22:00', '06:00', '#3a5ba0', 3);
+
+CREATE TABLE shifts (
+    shiftID TEXT PRIMARY KEY,
+    username TEXT,
+    date DATE NOT NULL,
+    time TEXT NOT NULL,
+    TRADE BOOLEAN default false,
+    starts_at TIMESTAMP,
+    ends_at TIMESTAMP,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+CREATE TABLE shift_searches (
+    shiftID TEXT NOT NULL,
+    shift_type TEXT NOT NULL,
+    PRIMARY KEY (shiftID, shift_type),
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE,
+    FOREIGN KEY (shift_type) REFERENCES shift_types(name) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE shift_trade_targets (
+    shiftID TEXT NOT NULL,
+    date_from DATE NOT NULL,
+    date_to DATE NOT NULL,
+    time TEXT,
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE
+);
+
+CREATE TABLE trades (
+    tradeID TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    created TIMESTAMP NOT NULL,
+    expires TIMESTAMP NOT NULL,
+    reviewer TEXT
+);
+
+CREATE TABLE trade_participants (
+    tradeID TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    shiftID TEXT NOT NULL,
+    username TEXT NOT NULL,
+    receives TEXT NOT NULL,
+    decision TEXT NOT NULL,
+    PRIMARY KEY (tradeID, position),
+    FOREIGN KEY (tradeID) REFERENCES trades(tradeID) ON DELETE CASCADE,
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE,
+    FOREIGN KEY (receives) REFERENCES shifts(shiftID) ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS shifts_tenant_idx;
+DROP INDEX IF EXISTS sessions_tenant_idx;
+DROP INDEX IF EXISTS user_base_tenant_idx;
+ALTER TABLE shifts DROP COLUMN tenant;
+ALTER TABLE sessions DROP COLUMN tenant;
+ALTER TABLE user_base DROP COLUMN tenant;
+DROP TABLE IF EXISTS tenants;
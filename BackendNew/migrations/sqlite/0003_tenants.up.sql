@@ -0,0 +1,18 @@
+-- Tenants are organisations sharing the service. Users, sessions and shifts
+-- belong to exactly one tenant, existing rows to the default tenant.
+CREATE TABLE tenants (
+    tenantID TEXT PRIMARY KEY,
+    name TEXT NOT NULL
+);
+
+INSERT INTO tenants (tenantID, name) VALUES ('default', 'Default');
+
+-- SQLite cannot add a column with both a foreign key and a non-NULL default,
+-- the tenant columns are checked by the application only
+ALTER TABLE user_base ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE sessions ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE shifts ADD COLUMN tenant TEXT NOT NULL DEFAULT 'default';
+
+CREATE INDEX user_base_tenant_idx ON user_base (tenant);
+CREATE INDEX sessions_tenant_idx ON sessions (tenant);
+CREATE INDEX shifts_tenant_idx ON shifts (tenant);
@@ -0,0 +1,23 @@
+-- Skills are qualifications, e.g. a nursing certificate. Shift types and
+-- single shifts may require skills, trades only hand a shift to a user who
+-- has all of them.
+CREATE TABLE user_skills (
+    username TEXT NOT NULL,
+    skill TEXT NOT NULL,
+    PRIMARY KEY (username, skill),
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+CREATE TABLE shift_type_skills (
+    shift_type TEXT NOT NULL,
+    skill TEXT NOT NULL,
+    PRIMARY KEY (shift_type, skill),
+    FOREIGN KEY (shift_type) REFERENCES shift_types(name) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE shift_skills (
+    shiftID TEXT NOT NULL,
+    skill TEXT NOT NULL,
+    PRIMARY KEY (shiftID, skill),
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- A user works a slot at most once per date, the index cannot be created
+-- while double bookings exist
+CREATE UNIQUE INDEX shifts_username_date_time_key ON shifts (username, date, time);
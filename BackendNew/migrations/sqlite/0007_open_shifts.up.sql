@@ -0,0 +1,14 @@
+-- Open shifts are released to a pool where eligible colleagues claim them.
+-- Shifts posted by a supervisor for an unfilled slot have no owner until
+-- they are claimed. no_giveback marks shifts picked up from a pickup-only
+-- posting, their new owner cannot release or trade them again.
+CREATE TABLE open_shifts (
+    shiftID TEXT PRIMARY KEY,
+    released_by TEXT,
+    released TIMESTAMP NOT NULL,
+    pickup_only BOOLEAN NOT NULL DEFAULT false,
+    FOREIGN KEY (shiftID) REFERENCES shifts(shiftID) ON DELETE CASCADE,
+    FOREIGN KEY (released_by) REFERENCES user_base(username) ON DELETE SET NULL
+);
+
+ALTER TABLE shifts ADD COLUMN no_giveback BOOLEAN NOT NULL DEFAULT false;
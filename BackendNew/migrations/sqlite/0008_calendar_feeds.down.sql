@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS calendar_cancellations;
+ALTER TABLE shifts DROP COLUMN sequence;
+DROP TABLE IF EXISTS calendar_feeds;
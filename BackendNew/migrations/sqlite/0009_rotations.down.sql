@@ -0,0 +1,5 @@
+ALTER TABLE shifts DROP COLUMN generated;
+DROP TABLE IF EXISTS team_rotation_members;
+DROP TABLE IF EXISTS team_rotations;
+DROP TABLE IF EXISTS rotation_days;
+DROP TABLE IF EXISTS rotation_templates;
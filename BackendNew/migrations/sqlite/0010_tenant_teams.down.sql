@@ -0,0 +1,56 @@
+-- Copies of a team in several tenants cannot be merged back into one team,
+-- the primary key of teams_old rejects them
+CREATE TABLE teams_old (
+    name TEXT PRIMARY KEY,
+    department TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO teams_old (name, department) SELECT name, department FROM teams;
+
+CREATE TABLE team_members_old (
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    PRIMARY KEY (team, username),
+    FOREIGN KEY (team) REFERENCES teams_old(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+INSERT INTO team_members_old (team, username) SELECT team, username FROM team_members;
+
+CREATE TABLE team_rotations_old (
+    team TEXT PRIMARY KEY,
+    template TEXT NOT NULL,
+    start_date DATE NOT NULL,
+    FOREIGN KEY (team) REFERENCES teams_old(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (template) REFERENCES rotation_templates(name) ON UPDATE CASCADE
+);
+
+INSERT INTO team_rotations_old (team, template, start_date)
+SELECT team, template, start_date FROM team_rotations;
+
+CREATE TABLE team_rotation_members_old (
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    day_offset INTEGER NOT NULL,
+    PRIMARY KEY (team, username),
+    FOREIGN KEY (team) REFERENCES team_rotations_old(team) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+INSERT INTO team_rotation_members_old (team, username, day_offset)
+SELECT team, username, day_offset FROM team_rotation_members;
+
+DROP TABLE team_rotation_members;
+DROP TABLE team_rotations;
+DROP TABLE team_members;
+DROP TABLE teams;
+
+ALTER TABLE teams_old RENAME TO teams;
+ALTER TABLE team_members_old RENAME TO team_members;
+ALTER TABLE team_rotations_old RENAME TO team_rotations;
+ALTER TABLE team_rotation_members_old RENAME TO team_rotation_members;
+
+ALTER TABLE shifts ADD COLUMN team_name TEXT REFERENCES teams(name) ON UPDATE CASCADE;
+UPDATE shifts SET team_name = team;
+ALTER TABLE shifts DROP COLUMN team;
+ALTER TABLE shifts RENAME COLUMN team_name TO team;
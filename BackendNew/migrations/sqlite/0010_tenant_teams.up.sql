@@ -0,0 +1,82 @@
+-- Teams belong to a tenant and their names are unique per tenant. Members
+-- and rotations carry the tenant of their team. A team used by several
+-- tenants is copied into each of them. SQLite cannot change keys in place,
+-- the tables are rebuilt.
+CREATE TABLE teams_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    name TEXT NOT NULL,
+    department TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (tenant, name)
+);
+
+INSERT INTO teams_new (tenant, name, department)
+SELECT 'default', name, department FROM teams;
+
+INSERT OR IGNORE INTO teams_new (tenant, name, department)
+SELECT used.tenant, t.name, t.department FROM teams t
+JOIN (
+    SELECT tenant, team FROM shifts WHERE team IS NOT NULL
+    UNION SELECT u.tenant, m.team FROM team_members m JOIN user_base u ON u.username = m.username
+    UNION SELECT u.tenant, m.team FROM team_rotation_members m JOIN user_base u ON u.username = m.username
+) used ON used.team = t.name;
+
+CREATE TABLE team_members_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    PRIMARY KEY (tenant, team, username),
+    FOREIGN KEY (tenant, team) REFERENCES teams_new(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+INSERT INTO team_members_new (tenant, team, username)
+SELECT u.tenant, m.team, m.username FROM team_members m
+JOIN user_base u ON u.username = m.username;
+
+CREATE TABLE team_rotations_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    team TEXT NOT NULL,
+    template TEXT NOT NULL,
+    start_date DATE NOT NULL,
+    PRIMARY KEY (tenant, team),
+    FOREIGN KEY (tenant, team) REFERENCES teams_new(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (template) REFERENCES rotation_templates(name) ON UPDATE CASCADE
+);
+
+INSERT INTO team_rotations_new (tenant, team, template, start_date)
+SELECT 'default', team, template, start_date FROM team_rotations;
+
+INSERT OR IGNORE INTO team_rotations_new (tenant, team, template, start_date)
+SELECT u.tenant, r.team, r.template, r.start_date FROM team_rotations r
+JOIN team_rotation_members m ON m.team = r.team
+JOIN user_base u ON u.username = m.username;
+
+CREATE TABLE team_rotation_members_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    day_offset INTEGER NOT NULL,
+    PRIMARY KEY (tenant, team, username),
+    FOREIGN KEY (tenant, team) REFERENCES team_rotations_new(tenant, team) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+INSERT INTO team_rotation_members_new (tenant, team, username, day_offset)
+SELECT u.tenant, m.team, m.username, m.day_offset FROM team_rotation_members m
+JOIN user_base u ON u.username = m.username;
+
+-- The team of a shift is checked by the application only, like its tenant
+ALTER TABLE shifts ADD COLUMN team_name TEXT;
+UPDATE shifts SET team_name = team;
+ALTER TABLE shifts DROP COLUMN team;
+ALTER TABLE shifts RENAME COLUMN team_name TO team;
+
+DROP TABLE team_rotation_members;
+DROP TABLE team_rotations;
+DROP TABLE team_members;
+DROP TABLE teams;
+
+ALTER TABLE teams_new RENAME TO teams;
+ALTER TABLE team_members_new RENAME TO team_members;
+ALTER TABLE team_rotations_new RENAME TO team_rotations;
+ALTER TABLE team_rotation_members_new RENAME TO team_rotation_members;
@@ -0,0 +1,54 @@
+-- Copies of a template in several tenants cannot be merged back into one,
+-- the primary key of rotation_templates_old rejects them
+CREATE TABLE rotation_templates_old (
+    name TEXT PRIMARY KEY
+);
+
+INSERT INTO rotation_templates_old (name) SELECT name FROM rotation_templates;
+
+CREATE TABLE rotation_days_old (
+    template TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    time TEXT,
+    PRIMARY KEY (template, position),
+    FOREIGN KEY (template) REFERENCES rotation_templates_old(name) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+INSERT INTO rotation_days_old (template, position, time)
+SELECT template, position, time FROM rotation_days;
+
+CREATE TABLE team_rotations_old (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    team TEXT NOT NULL,
+    template TEXT NOT NULL,
+    start_date DATE NOT NULL,
+    PRIMARY KEY (tenant, team),
+    FOREIGN KEY (tenant, team) REFERENCES teams(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (template) REFERENCES rotation_templates_old(name) ON UPDATE CASCADE
+);
+
+INSERT INTO team_rotations_old (tenant, team, template, start_date)
+SELECT tenant, team, template, start_date FROM team_rotations;
+
+CREATE TABLE team_rotation_members_old (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    day_offset INTEGER NOT NULL,
+    PRIMARY KEY (tenant, team, username),
+    FOREIGN KEY (tenant, team) REFERENCES team_rotations_old(tenant, team) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+INSERT INTO team_rotation_members_old (tenant, team, username, day_offset)
+SELECT tenant, team, username, day_offset FROM team_rotation_members;
+
+DROP TABLE team_rotation_members;
+DROP TABLE team_rotations;
+DROP TABLE rotation_days;
+DROP TABLE rotation_templates;
+
+ALTER TABLE rotation_templates_old RENAME TO rotation_templates;
+ALTER TABLE rotation_days_old RENAME TO rotation_days;
+ALTER TABLE team_rotations_old RENAME TO team_rotations;
+ALTER TABLE team_rotation_members_old RENAME TO team_rotation_members;
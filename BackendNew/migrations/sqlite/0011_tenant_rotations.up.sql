@@ -0,0 +1,64 @@
+-- Rotation templates belong to a tenant and their names are unique per
+-- tenant. A template followed by teams of several tenants is copied into
+-- each of them. The rotations of teams refer to the templates and are
+-- rebuilt with them.
+CREATE TABLE rotation_templates_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    name TEXT NOT NULL,
+    PRIMARY KEY (tenant, name)
+);
+
+INSERT INTO rotation_templates_new (tenant, name)
+SELECT 'default', name FROM rotation_templates;
+
+INSERT OR IGNORE INTO rotation_templates_new (tenant, name)
+SELECT r.tenant, r.template FROM team_rotations r;
+
+CREATE TABLE rotation_days_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    template TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    time TEXT,
+    PRIMARY KEY (tenant, template, position),
+    FOREIGN KEY (tenant, template) REFERENCES rotation_templates_new(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+INSERT INTO rotation_days_new (tenant, template, position, time)
+SELECT t.tenant, d.template, d.position, d.time FROM rotation_days d
+JOIN rotation_templates_new t ON t.name = d.template;
+
+CREATE TABLE team_rotations_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    team TEXT NOT NULL,
+    template TEXT NOT NULL,
+    start_date DATE NOT NULL,
+    PRIMARY KEY (tenant, team),
+    FOREIGN KEY (tenant, team) REFERENCES teams(tenant, name) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (tenant, template) REFERENCES rotation_templates_new(tenant, name) ON UPDATE CASCADE
+);
+
+INSERT INTO team_rotations_new (tenant, team, template, start_date)
+SELECT tenant, team, template, start_date FROM team_rotations;
+
+CREATE TABLE team_rotation_members_new (
+    tenant TEXT NOT NULL DEFAULT 'default',
+    team TEXT NOT NULL,
+    username TEXT NOT NULL,
+    day_offset INTEGER NOT NULL,
+    PRIMARY KEY (tenant, team, username),
+    FOREIGN KEY (tenant, team) REFERENCES team_rotations_new(tenant, team) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES user_base(username) ON DELETE CASCADE
+);
+
+INSERT INTO team_rotation_members_new (tenant, team, username, day_offset)
+SELECT tenant, team, username, day_offset FROM team_rotation_members;
+
+DROP TABLE team_rotation_members;
+DROP TABLE team_rotations;
+DROP TABLE rotation_days;
+DROP TABLE rotation_templates;
+
+ALTER TABLE rotation_templates_new RENAME TO rotation_templates;
+ALTER TABLE rotation_days_new RENAME TO rotation_days;
+ALTER TABLE team_rotations_new RENAME TO team_rotations;
+ALTER TABLE team_rotation_members_new RENAME TO team_rotation_members;
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenShiftReceive is a shift in the pool of open shifts. Posting one with
+// a Uid releases that shift, without a Uid a supervisor posts a new shift
+// that has no owner until it is claimed.
+type OpenShiftReceive struct {
+	Uid        string    `json:"uid"`
+	Datum      string    `json:"datum"`
+	Day        string    `json:"day"`
+	Time       string    `json:"time"`
+	Team       string    `json:"team,omitempty"`
+	Skills     []string  `json:"skills,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	ReleasedBy string    `json:"releasedBy,omitempty"`
+	Released   time.Time `json:"released"`
+	PickupOnly bool      `json:"pickupOnly"`
+}
+
+var (
+	errNoGiveback = errors.New("shift was picked up without giveback")
+	errShiftEnded = errors.New("shift has already ended")
+)
+
+// openShiftReceive returns the API view of a posting
+func openShiftReceive(open OpenShift) OpenShiftReceive {
+	return OpenShiftReceive{
+		Uid:        open.Shift.ID,
+		Datum:      formatDate(open.Shift.Date),
+		Day:        weekdayName(open.Shift.Date),
+		Time:       open.Shift.Time,
+		Team:       open.Shift.Team,
+		Skills:     open.Shift.Skills,
+		Owner:      open.Shift.Username,
+		ReleasedBy: open.ReleasedBy,
+		Released:   open.Released,
+		PickupOnly: open.PickupOnly,
+	}
+}
+
+// Open shift handler for /open-shifts
+func (app *App) openShiftHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		principal, ok := requirePermission(w, r, permShiftsRead)
+		if !ok {
+			return
+		}
+		app.openShiftGet(w, r, principal)
+	case http.MethodPost:
+		principal, ok := requirePermission(w, r, permShiftsWrite)
+		if !ok {
+			return
+		}
+		app.openShiftPost(w, r, principal)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Open shift handler for /open-shifts/{id} and /open-shifts/{id}/claim
+func (app *App) openShiftByIDHandler(w http.ResponseWriter, r *http.Request) {
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) < 2 || pathSegments[1] == "" {
+		writeMessage(w, http.StatusBadRequest, "Invalid shift ID")
+		return
+	}
+	shiftID := pathSegments[1]
+
+	principal, ok := requirePermission(w, r, permShiftsWrite)
+	if !ok {
+		return
+	}
+
+	switch {
+	case len(pathSegments) == 2 && r.Method == http.MethodDelete:
+		app.openShiftWithdraw(w, r, principal, shiftID)
+	case len(pathSegments) == 3 && r.Method == http.MethodPost && pathSegments[2] == "claim":
+		app.openShiftClaim(w, r, principal, shiftID)
+	case len(pathSegments) > 3:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// openShiftGet lists the open shifts of the principal's teams and those
+// without a team, admins see the whole pool
+func (app *App) openShiftGet(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	open, err := app.store(r).ListOpenShifts()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch open shifts")
+		return
+	}
+	teams, err := app.store(r).UserTeams(principal.Username)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get teams")
+		return
+	}
+	member := make(map[string]bool, len(teams))
+	for _, team := range teams {
+		member[team] = true
+	}
+
+	postings := []OpenShiftReceive{}
+	for _, posting := range open {
+		if posting.Shift.Team == "" || member[posting.Shift.Team] || posting.Shift.Username == principal.Username || principal.can(permShiftsManageAll) {
+			postings = append(postings, openShiftReceive(posting))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(postings)
+	if err != nil {
+		return
+	}
+}
+
+// openShiftPost releases a shift of the principal, or posts a new shift
+// without owner if no uid is given
+func (app *App) openShiftPost(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	var body OpenShiftReceive
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	open := OpenShift{ReleasedBy: principal.Username, Released: time.Now(), PickupOnly: body.PickupOnly}
+	if body.Uid == "" {
+		if !principal.can(permShiftsManage) {
+			writeMessage(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		types, err := app.Store.ShiftTypes()
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
+			return
+		}
+		input, errs := parseShift(ShiftReceive{Datum: body.Datum, Time: body.Time, Skills: body.Skills}, types, time.Now(), isPastAllowed(principal))
+		if errs != nil {
+			writeValidationErrors(w, errs)
+			return
+		}
+		input.Team, errs, err = app.resolveShiftTeam(r, principal, body.Team, false)
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to get team")
+			return
+		}
+		if errs != nil {
+			writeValidationErrors(w, errs)
+			return
+		}
+		if !principal.managesTeam(input.Team) {
+			writeMessage(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		open.Shift = input.shift(generateSessionID(), "")
+	}
+
+	message := "Failed to release shift"
+	var events []Event
+	err = app.store(r).Atomic(func(tx Store) error {
+		if body.Uid == "" {
+			message = "Failed to add shift"
+			if err := tx.CreateShift(open.Shift); err != nil {
+				return err
+			}
+			message = "Failed to release shift"
+			return tx.ReleaseShift(open)
+		}
+
+		stored, err := tx.GetShift(principal.shiftScope(), body.Uid)
+		if err != nil {
+			return err
+		}
+		if stored.NoGiveback && !principal.can(permShiftsManage) {
+			return errNoGiveback
+		}
+		if !stored.EndsAt.After(time.Now()) {
+			return errShiftEnded
+		}
+		open.Shift = *stored
+		if err := tx.ReleaseShift(open); err != nil {
+			return err
+		}
+		events = append(events, shiftEvent(requestTenant(r), "released", *stored))
+		if stored.Trade {
+			events = append(events, offersEvent(requestTenant(r), *stored))
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errShiftNotFound):
+		writeMessage(w, http.StatusNotFound, "Shift not found")
+		return
+	case errors.Is(err, errShiftReleased):
+		writeMessage(w, http.StatusConflict, "Shift is already released")
+		return
+	case errors.Is(err, errNoGiveback):
+		writeMessage(w, http.StatusConflict, "Shift was picked up without giveback")
+		return
+	case errors.Is(err, errShiftEnded):
+		writeMessage(w, http.StatusConflict, "Shift has already ended")
+		return
+	case err != nil:
+		writeMessage(w, http.StatusInternalServerError, message)
+		return
+	}
+
+	app.publish(append(events, openShiftEvent(requestTenant(r), "released", open))...)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(openShiftReceive(open))
+	if err != nil {
+		return
+	}
+}
+
+// openShiftWithdraw takes a shift out of the pool, shifts posted without
+// owner are deleted
+func (app *App) openShiftWithdraw(w http.ResponseWriter, r *http.Request, principal *Principal, shiftID string) {
+	var withdrawn *OpenShift
+	err := app.store(r).Atomic(func(tx Store) error {
+		open, err := tx.GetOpenShift(shiftID)
+		if err != nil {
+			return err
+		}
+		withdrawn = open
+		owned := open.Shift.Username != "" && open.Shift.Username == principal.Username
+		if !owned && open.ReleasedBy != principal.Username && !principal.shiftScope().includes(open.Shift) {
+			return errShiftNotOpen
+		}
+		if open.Shift.Username == "" {
+			return tx.DeleteShift(ShiftScope{All: true}, shiftID)
+		}
+		return tx.WithdrawShift(shiftID)
+	})
+	if errors.Is(err, errShiftNotOpen) {
+		writeMessage(w, http.StatusNotFound, "Open shift not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to withdraw shift")
+		return
+	}
+
+	app.publish(openShiftEvent(requestTenant(r), "withdrawn", *withdrawn))
+	writeMessage(w, http.StatusOK, "Shift withdrawn successfully")
+}
+
+// claimRefusal explains why a user may not claim an open shift
+type claimRefusal struct {
+	status     int
+	message    string
+	missing    []string
+	conflict   *Shift
+	violations []RuleViolation
+}
+
+// openShiftClaim hands an open shift to the principal. The posting stays
+// locked while eligibility is checked, so of several concurrent claims only
+// the first one succeeds.
+func (app *App) openShiftClaim(w http.ResponseWriter, r *http.Request, principal *Principal, shiftID string) {
+	username := principal.Username
+
+	var refusal *claimRefusal
+	var events []Event
+	err := app.store(r).Atomic(func(tx Store) error {
+		open, err := tx.GetOpenShift(shiftID)
+		if err != nil {
+			return err
+		}
+		refusal, err = app.checkClaim(tx, *open, username)
+		if err != nil || refusal != nil {
+			return err
+		}
+		if err := tx.ClaimShift(shiftID, username); err != nil {
+			return err
+		}
+
+		tenant := requestTenant(r)
+		events = append(events, openShiftEvent(tenant, "claimed", *open))
+		if open.Shift.Username != "" {
+			events = append(events, shiftEvent(tenant, "claimed", open.Shift))
+		}
+		claimed := open.Shift
+		claimed.Username = username
+		events = append(events, shiftEvent(tenant, "claimed", claimed))
+		return nil
+	})
+	switch {
+	case errors.Is(err, errShiftNotOpen):
+		writeMessage(w, http.StatusConflict, "Shift is no longer open")
+		return
+	case errors.Is(err, errShiftConflict):
+		writeMessage(w, http.StatusConflict, "User already works the slot on that date")
+		return
+	case err != nil:
+		writeMessage(w, http.StatusInternalServerError, "Failed to claim shift")
+		return
+	}
+
+	switch {
+	case refusal == nil:
+		app.publish(events...)
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]string{"message": "Shift claimed successfully", "uid": shiftID})
+		if err != nil {
+			return
+		}
+	case refusal.conflict != nil:
+		writeShiftConflict(w, refusal.conflict)
+	case refusal.violations != nil:
+		writeRuleViolations(w, refusal.violations)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(refusal.status)
+		err = json.NewEncoder(w).Encode(map[string]interface{}{"message": refusal.message, "missing": refusal.missing})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// checkClaim returns why username may not claim the open shift, or nil if
+// they may: the shift must not have ended or be their own, they must be a
+// member of its team, have the skills it requires, be free in its slot and
+// stay within the working time rules
+func (app *App) checkClaim(tx Store, open OpenShift, username string) (*claimRefusal, error) {
+	shift := open.Shift
+	if shift.Username == username {
+		return &claimRefusal{status: http.StatusConflict, message: "You cannot claim your own shift"}, nil
+	}
+	if !shift.EndsAt.After(time.Now()) {
+		return &claimRefusal{status: http.StatusConflict, message: "Shift has already ended"}, nil
+	}
+
+	if shift.Team != "" {
+		team, err := tx.GetTeam(shift.Team)
+		if err != nil {
+			return nil, err
+		}
+		if !team.hasMember(username) {
+			return &claimRefusal{status: http.StatusForbidden, message: fmt.Sprintf("Only members of team %s can claim the shift", shift.Team)}, nil
+		}
+	}
+
+	shiftType, err := tx.GetShiftType(shift.Time)
+	if err != nil {
+		return nil, err
+	}
+	skills, err := tx.UserSkills(username)
+	if err != nil {
+		return nil, err
+	}
+	if missing := missingSkills(*shiftType, shift, skillSet(skills)); missing != nil {
+		return &claimRefusal{status: http.StatusForbidden, message: "Missing skills required for the shift", missing: missing}, nil
+	}
+
+	schedule, err := tx.ListShifts(username)
+	if err != nil {
+		return nil, err
+	}
+	shift.Username = username
+	if conflict := slotConflict(shift, schedule); conflict != nil {
+		return &claimRefusal{conflict: conflict}, nil
+	}
+	rules, err := app.rules(tx)
+	if err != nil {
+		return nil, err
+	}
+	if violations := rules.check(shift, schedule); violations != nil {
+		return &claimRefusal{violations: violations}, nil
+	}
+	return nil, nil
+}
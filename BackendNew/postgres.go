@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// allTenants is the app.tenant setting of queries that are not limited to a
+// tenant, the row-level security policies show them every row
+const allTenants = "*"
+
+// setTenant is run before every Postgres query, the policies deny all rows
+// while app.tenant is unset
+const setTenant = "SELECT set_config('app.tenant', $1, false)"
+
+// tenantQueryer runs each statement on a connection of the shared pool whose
+// app.tenant setting limits it to the tenant. Transactions set the tenant
+// themselves in Atomic.
+type tenantQueryer struct {
+	db     *sql.DB
+	tenant string
+}
+
+// conn takes a connection from the pool and sets the tenant on it, a
+// connection keeps the setting of its last query until it is set again
+func (t tenantQueryer) conn(ctx context.Context) (*sql.Conn, error) {
+	conn, err := t.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, setTenant, t.tenant)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t tenantQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx := context.Background()
+	conn, err := t.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func(conn *sql.Conn) {
+		_ = conn.Close()
+	}(conn)
+	return conn.ExecContext(ctx, query, args...)
+}
+
+func (t tenantQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	ctx := context.Background()
+	conn, err := t.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	releaseAfter(conn)
+	return rows, nil
+}
+
+func (t tenantQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	ctx := context.Background()
+	conn, err := t.conn(ctx)
+	if err != nil {
+		// The query must not run without the tenant, the row reports that it
+		// was cancelled
+		log.Println("failed to set the tenant of a query:", err)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		return t.db.QueryRowContext(cancelled, query, args...)
+	}
+	row := conn.QueryRowContext(ctx, query, args...)
+	releaseAfter(conn)
+	return row
+}
+
+// releaseAfter returns the connection to the pool once the rows read from it
+// are closed, Close waits for them
+func releaseAfter(conn *sql.Conn) {
+	go func() {
+		_ = conn.Close()
+	}()
+}
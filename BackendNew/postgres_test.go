@@ -0,0 +1,186 @@
+//go:build postgres
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// The Postgres tests run with `go test -tags postgres` against the database
+// named by TEST_POSTGRES_DSN. They drop and recreate its public schema.
+
+// openPostgres connects to an emptied test database
+func openPostgres(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+	db, err := sql.Open(driverPostgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	_, err = db.Exec("DROP SCHEMA IF EXISTS public CASCADE; CREATE SCHEMA public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newPostgresStore migrates an emptied test database
+func newPostgresStore(t *testing.T) Store {
+	t.Helper()
+	db := openPostgres(t)
+	if err := migrateUp(context.Background(), db, driverPostgres, 0); err != nil {
+		t.Fatal(err)
+	}
+	return newSQLStore(db, driverPostgres)
+}
+
+// TestPostgresStore runs the handler tests against the Postgres backend
+func TestPostgresStore(t *testing.T) {
+	runBackendTests(t, newPostgresStore)
+}
+
+func TestPostgresMigrateDown(t *testing.T) {
+	db := openPostgres(t)
+	migrations, err := loadMigrations(driverPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := migrateUp(ctx, db, driverPostgres, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDown(ctx, db, driverPostgres, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	err = db.QueryRow("SELECT count(*) FROM pg_tables WHERE schemaname='public' AND tablename<>'schema_migrations'").Scan(&tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatalf("%d tables left after migrating down", tables)
+	}
+
+	// The schema comes back up after a full round trip
+	if err := migrateUp(ctx, db, driverPostgres, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPostgresRowLevelSecurity checks the policies themselves, the queries
+// carry no tenant condition of their own
+func TestPostgresRowLevelSecurity(t *testing.T) {
+	store := newPostgresStore(t).(*sqlStore)
+	if err := store.CreateTenant(Tenant{ID: "acme", Name: "Acme"}); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Now().AddDate(0, 0, 7)
+	for _, tenant := range []string{defaultTenant, "acme"} {
+		scoped := store.ForTenant(tenant)
+		username := "user-" + tenant
+		if err := scoped.CreateUser(username, "hash"); err != nil {
+			t.Fatal(err)
+		}
+		if err := scoped.CreateSession(Session{ID: "session-" + tenant, Tenant: tenant, Username: username, Expires: date}); err != nil {
+			t.Fatal(err)
+		}
+		if err := scoped.CreateTeam(Team{Name: "icu"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := scoped.AddTeamMember("icu", username); err != nil {
+			t.Fatal(err)
+		}
+		if err := scoped.CreateRotation(RotationTemplate{Name: "wechsel", Days: []string{"früh", ""}}); err != nil {
+			t.Fatal(err)
+		}
+		err := scoped.SetTeamRotation(TeamRotation{Team: "icu", Template: "wechsel", Start: date, Members: []RotationMember{{Username: username}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = scoped.CreateShift(Shift{ID: "shift-" + tenant, Username: username, Tenant: tenant, Date: date, Time: "früh", StartsAt: date, EndsAt: date.Add(8 * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Superusers and roles with BYPASSRLS skip the policies, the checks run
+	// as a plain role then
+	ctx := context.Background()
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var bypass bool
+	err = conn.QueryRowContext(ctx, "SELECT rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user").Scan(&bypass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bypass {
+		for _, statement := range []string{
+			"DROP ROLE IF EXISTS shifts_rls_probe",
+			"CREATE ROLE shifts_rls_probe NOLOGIN",
+			"GRANT USAGE ON SCHEMA public TO shifts_rls_probe",
+			"GRANT SELECT ON ALL TABLES IN SCHEMA public TO shifts_rls_probe",
+			"SET ROLE shifts_rls_probe",
+		} {
+			if _, err := conn.ExecContext(ctx, statement); err != nil {
+				t.Fatal(err)
+			}
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.Background(), "RESET ROLE")
+			_, _ = conn.ExecContext(context.Background(), "DROP OWNED BY shifts_rls_probe")
+			_, _ = conn.ExecContext(context.Background(), "DROP ROLE shifts_rls_probe")
+		}()
+	}
+
+	tables := []string{"user_base", "sessions", "shifts", "teams", "team_members", "team_rotations", "team_rotation_members", "rotation_templates", "rotation_days"}
+	count := func(table, condition string, args ...interface{}) int {
+		t.Helper()
+		var n int
+		if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM "+table+" WHERE "+condition, args...).Scan(&n); err != nil {
+			t.Fatalf("%s: %v", table, err)
+		}
+		return n
+	}
+
+	if _, err := conn.ExecContext(ctx, setTenant, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if n := count(table, "tenant = $1", "acme"); n == 0 {
+			t.Errorf("%s: acme does not see its own rows", table)
+		}
+		if n := count(table, "tenant <> $1", "acme"); n != 0 {
+			t.Errorf("%s: acme sees %d rows of other tenants", table, n)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, setTenant, allTenants); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if n := count(table, "tenant <> $1", "acme"); n == 0 {
+			t.Errorf("%s: the unlimited setting hides the rows of other tenants", table)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, "RESET app.tenant"); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if n := count(table, "true"); n != 0 {
+			t.Errorf("%s: %d rows visible without a tenant", table, n)
+		}
+	}
+}
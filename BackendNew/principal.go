@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Principal is the authenticated user of a request, resolved once from the
+// session cookie by authMiddleware
+type Principal struct {
+	Username string
+	Tenant   string
+	Roles    []string
+	Expires  time.Time
+	// Teams are the teams a supervisor manages, the ones they are a member of
+	Teams []string
+}
+
+// can reports whether any of the principal's roles grants the permission
+func (p *Principal) can(permission string) bool {
+	for _, role := range p.Roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasRole reports whether the principal has been granted the given role
+func (p *Principal) hasRole(role string) bool {
+	for _, granted := range p.Roles {
+		if granted == role {
+			return true
+		}
+	}
+	return false
+}
+
+// shiftScope returns the shifts the principal may access, supervisors may
+// access the shifts of their teams and admins those of everyone
+func (p *Principal) shiftScope() ShiftScope {
+	scope := ShiftScope{Username: p.Username, All: p.can(permShiftsManageAll)}
+	if p.can(permShiftsManage) {
+		scope.Teams = p.Teams
+	}
+	return scope
+}
+
+// managesTeam reports whether the principal may manage the shifts of the
+// team, shifts without a team are managed by admins only
+func (p *Principal) managesTeam(team string) bool {
+	if p.can(permShiftsManageAll) {
+		return true
+	}
+	if team == "" || !p.can(permShiftsManage) {
+		return false
+	}
+	for _, managed := range p.Teams {
+		if managed == team {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying the principal
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFromContext returns the principal attached by authMiddleware
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// resolvePrincipal looks up the session of the request's cookie together
+// with the roles of its user and the teams of supervisors
+func (app *App) resolvePrincipal(r *http.Request) (*Principal, error) {
+	cookie, err := r.Cookie("sessionID")
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := app.Store.GetSession(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	principal := Principal{Username: session.Username, Tenant: session.Tenant, Expires: session.Expires}
+	store := app.Store.ForTenant(principal.Tenant)
+	principal.Roles, err = store.UserRoles(principal.Username)
+	if err != nil {
+		return nil, err
+	}
+	if principal.can(permShiftsManage) && !principal.can(permShiftsManageAll) {
+		principal.Teams, err = store.UserTeams(principal.Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &principal, nil
+}
+
+// requestTenant returns the tenant of the request's principal
+func requestTenant(r *http.Request) string {
+	if principal, ok := principalFromContext(r.Context()); ok && principal.Tenant != "" {
+		return principal.Tenant
+	}
+	return defaultTenant
+}
+
+// store returns the store limited to the tenant of the request's principal
+func (app *App) store(r *http.Request) Store {
+	return app.Store.ForTenant(requestTenant(r))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+)
+
+// User roles
+const (
+	roleEmployee   = "employee"
+	roleSupervisor = "supervisor"
+	roleAdmin      = "admin"
+	roleOperator   = "operator"
+)
+
+// Permissions checked by the handlers
+const (
+	permShiftsRead       = "shifts:read"
+	permShiftsWrite      = "shifts:write"
+	permShiftsTrade      = "shifts:trade"
+	permShiftsManage     = "shifts:manage"
+	permShiftsManageAll  = "shifts:manage-all"
+	permShiftTypesManage = "shift-types:manage"
+	permTradesApprove    = "trades:approve"
+	permUsersManage      = "users:manage"
+	permTeamsManage      = "teams:manage"
+	permTenantsManage    = "tenants:manage"
+	permRulesManage      = "rules:manage"
+)
+
+var rolePermissions = map[string][]string{
+	roleEmployee:   {permShiftsRead, permShiftsWrite, permShiftsTrade},
+	roleSupervisor: {permShiftsRead, permShiftsWrite, permShiftsTrade, permShiftsManage, permTradesApprove},
+	roleAdmin:      {permShiftsRead, permShiftsWrite, permShiftsTrade, permShiftsManage, permShiftsManageAll, permTradesApprove, permUsersManage, permTeamsManage, permRulesManage},
+	roleOperator:   {permTenantsManage, permShiftTypesManage}, // shift types are shared by all tenants
+}
+
+// isKnownRole reports whether role is one of the defined roles
+func isKnownRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// requirePermission returns the request's principal if it holds the
+// permission, otherwise it writes an error response and returns false
+func requirePermission(w http.ResponseWriter, r *http.Request, permission string) (*Principal, bool) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+	if !principal.can(permission) {
+		writeMessage(w, http.StatusForbidden, "Forbidden")
+		return nil, false
+	}
+	return principal, true
+}
@@ -0,0 +1,950 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Supported roster file formats
+const (
+	rosterCSV = "csv"
+	rosterICS = "ics"
+)
+
+// Actions of the changes an import makes
+const (
+	rosterInsert    = "insert"
+	rosterUpdate    = "update"
+	rosterDelete    = "delete"
+	rosterUnchanged = "unchanged"
+	rosterKept      = "kept"
+)
+
+// maxRosterSize limits the size of uploaded roster files
+const maxRosterSize = 10 << 20
+
+// errRosterInvalid is returned when an import is applied while rows are
+// rejected
+var errRosterInvalid = errors.New("roster has rejected rows")
+
+// RosterEntry is a shift read from a roster file, Time holds a shift type
+// name or the HH:MM start of a slot
+type RosterEntry struct {
+	Row      int
+	Username string
+	Date     time.Time
+	Time     string
+	Team     string
+}
+
+// RosterError rejects a row of a roster file; rows are CSV lines or the
+// position of an ICS event, 0 refers to the whole file
+type RosterError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// RosterSlot is the previous slot of an updated shift
+type RosterSlot struct {
+	Time string `json:"time"`
+	Team string `json:"team,omitempty"`
+}
+
+// RosterChange is a change an import makes to a single shift
+type RosterChange struct {
+	Action   string      `json:"action"`
+	Row      int         `json:"row,omitempty"`
+	Uid      string      `json:"uid,omitempty"`
+	Username string      `json:"username"`
+	Datum    string      `json:"datum"`
+	Time     string      `json:"time"`
+	Team     string      `json:"team,omitempty"`
+	Previous *RosterSlot `json:"previous,omitempty"`
+	// Violations and Missing are the working time rules the new slot breaks
+	// and the skills it requires that the user lacks
+	Violations []RuleViolation `json:"violations,omitempty"`
+	Missing    []string        `json:"missing,omitempty"`
+
+	shift  Shift
+	stored *Shift
+}
+
+// RosterReport is the diff of a roster against the stored shifts
+type RosterReport struct {
+	DryRun    bool   `json:"dryRun"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	Inserted  int    `json:"inserted"`
+	Updated   int    `json:"updated"`
+	Deleted   int    `json:"deleted"`
+	Unchanged int    `json:"unchanged"`
+	// Kept counts the slots left to shifts that were traded or entered by
+	// hand when a rotation is generated
+	Kept    int            `json:"kept,omitempty"`
+	Changes []RosterChange `json:"changes"`
+	Errors  []RosterError  `json:"errors"`
+}
+
+// RosterOptions control how a roster file is read and which stored shifts
+// it replaces
+type RosterOptions struct {
+	Format string
+	CSV    ImportConfig
+	// Username owns the ICS events without a matching attendee
+	Username string
+	// From and To widen the replaced date range beyond the dates of the file
+	From, To time.Time
+	DryRun   bool
+	// Scope limits the shifts the roster may create and replace, shifts
+	// outside of it are kept
+	Scope ShiftScope
+}
+
+// validate checks the CSV settings
+func (c ImportConfig) validate() error {
+	var errs []error
+	if c.Columns.Username == "" || c.Columns.Date == "" || c.Columns.Time == "" {
+		errs = append(errs, errors.New("the username, date and time columns must be set"))
+	}
+	if _, err := c.delimiter(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.DateFormat == "" {
+		errs = append(errs, errors.New("date_format must be set"))
+	}
+	return errors.Join(errs...)
+}
+
+// delimiter returns the field separator of the CSV files
+func (c ImportConfig) delimiter() (rune, error) {
+	if c.Delimiter == `\t` {
+		return '\t', nil
+	}
+	delimiter, size := utf8.DecodeRuneInString(c.Delimiter)
+	if size == 0 || size != len(c.Delimiter) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError {
+		return 0, fmt.Errorf("invalid delimiter %q", c.Delimiter)
+	}
+	return delimiter, nil
+}
+
+// parseRoster reads the entries of a roster file in the given format
+func parseRoster(content []byte, options RosterOptions) ([]RosterEntry, []RosterError, error) {
+	switch options.Format {
+	case rosterCSV:
+		return parseRosterCSV(content, options.CSV)
+	case rosterICS:
+		entries, errs := parseRosterICS(content, options.Username)
+		return entries, errs, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown roster format %q, use csv or ics", options.Format)
+	}
+}
+
+// parseRosterCSV reads a CSV roster with a header line naming the columns
+func parseRosterCSV(content []byte, config ImportConfig) ([]RosterEntry, []RosterError, error) {
+	delimiter, err := config.delimiter()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(content), "\uFEFF")))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	column := func(name string) int {
+		if i, ok := columns[strings.ToLower(name)]; ok && name != "" {
+			return i
+		}
+		return -1
+	}
+	usernameColumn, dateColumn, timeColumn, teamColumn := column(config.Columns.Username), column(config.Columns.Date), column(config.Columns.Time), column(config.Columns.Team)
+	var missing []string
+	for name, i := range map[string]int{config.Columns.Username: usernameColumn, config.Columns.Date: dateColumn, config.Columns.Time: timeColumn} {
+		if i < 0 {
+			missing = append(missing, fmt.Sprintf("%q", name))
+		}
+	}
+	if missing != nil {
+		sort.Strings(missing)
+		return nil, nil, fmt.Errorf("missing CSV columns %s", strings.Join(missing, ", "))
+	}
+
+	var entries []RosterEntry
+	var errs []RosterError
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			errs = append(errs, RosterError{Row: parseErr.StartLine, Message: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		row, _ := reader.FieldPos(0)
+		field := func(i int) string {
+			if i < 0 || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		entry := RosterEntry{Row: row, Username: field(usernameColumn), Time: field(timeColumn), Team: field(teamColumn)}
+		if entry.Username == "" {
+			errs = append(errs, RosterError{Row: row, Field: "username", Message: "must not be empty"})
+			continue
+		}
+		entry.Date, err = time.ParseInLocation(config.DateFormat, field(dateColumn), time.Local)
+		if err != nil {
+			errs = append(errs, RosterError{Row: row, Field: "datum", Message: fmt.Sprintf("must be a date in the format %s", config.DateFormat)})
+			continue
+		}
+		entry.Date = time.Date(entry.Date.Year(), entry.Date.Month(), entry.Date.Day(), 0, 0, 0, 0, time.Local)
+		entries = append(entries, entry)
+	}
+	return entries, errs, nil
+}
+
+// icsProperty is a content line of an iCalendar file
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// parseICSLines unfolds an iCalendar file into its content lines
+func parseICSLines(content string) []icsProperty {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\n ", "")
+	content = strings.ReplaceAll(content, "\n\t", "")
+
+	var properties []icsProperty
+	for _, line := range strings.Split(content, "\n") {
+		// The value starts at the first colon outside of quoted parameters
+		quoted, split := false, -1
+		for i, c := range line {
+			if c == '"' {
+				quoted = !quoted
+			} else if c == ':' && !quoted {
+				split = i
+				break
+			}
+		}
+		if split < 0 {
+			continue
+		}
+		parts := strings.Split(line[:split], ";")
+		property := icsProperty{Name: strings.ToUpper(parts[0]), Params: map[string]string{}, Value: line[split+1:]}
+		for _, param := range parts[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			property.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+		}
+		properties = append(properties, property)
+	}
+	return properties
+}
+
+var icsUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// parseICSTime reads a DATE or DATE-TIME value in the local time zone
+func parseICSTime(property icsProperty) (time.Time, bool, error) {
+	if property.Params["VALUE"] == "DATE" || len(property.Value) == len("20060102") {
+		date, err := time.ParseInLocation("20060102", property.Value, time.Local)
+		return date, true, err
+	}
+	if strings.HasSuffix(property.Value, "Z") {
+		t, err := time.Parse("20060102T150405Z", property.Value)
+		return t.Local(), false, err
+	}
+	location := time.Local
+	if tzid := property.Params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(tzid); err == nil {
+			location = loaded
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", property.Value, location)
+	return t.Local(), false, err
+}
+
+// parseRosterICS reads the events of an iCalendar roster. Every attendee
+// of an event works the shift, events without attendees belong to
+// username. The SUMMARY names the shift type, otherwise the slot is found
+// by the start time.
+func parseRosterICS(content []byte, username string) ([]RosterEntry, []RosterError) {
+	var entries []RosterEntry
+	var errs []RosterError
+	var event []icsProperty
+	inEvent, number := false, 0
+	for _, property := range parseICSLines(string(content)) {
+		switch {
+		case property.Name == "BEGIN" && strings.EqualFold(property.Value, "VEVENT"):
+			inEvent, event = true, nil
+			number++
+		case property.Name == "END" && strings.EqualFold(property.Value, "VEVENT"):
+			inEvent = false
+			parsed, err := rosterEvent(number, event, username)
+			if err != nil {
+				errs = append(errs, *err)
+				continue
+			}
+			entries = append(entries, parsed...)
+		case inEvent:
+			event = append(event, property)
+		}
+	}
+	if number == 0 {
+		errs = append(errs, RosterError{Message: "the calendar contains no events"})
+	}
+	return entries, errs
+}
+
+// rosterEvent returns the entries of an ICS event, cancelled events have none
+func rosterEvent(number int, event []icsProperty, username string) ([]RosterEntry, *RosterError) {
+	var start *icsProperty
+	var summary string
+	var users []string
+	for i, property := range event {
+		switch property.Name {
+		case "DTSTART":
+			start = &event[i]
+		case "SUMMARY":
+			summary = icsUnescaper.Replace(property.Value)
+		case "STATUS":
+			if strings.EqualFold(property.Value, "CANCELLED") {
+				return nil, nil
+			}
+		case "ATTENDEE":
+			// The local part of the address is taken before the display name
+			user := property.Params["CN"]
+			if mail := property.Value; strings.HasPrefix(strings.ToLower(mail), "mailto:") {
+				if local, _, _ := strings.Cut(mail[len("mailto:"):], "@"); local != "" {
+					user = local
+				}
+			}
+			if user != "" {
+				users = append(users, user)
+			}
+		}
+	}
+	if start == nil {
+		return nil, &RosterError{Row: number, Field: "DTSTART", Message: "missing start"}
+	}
+	startsAt, allDay, err := parseICSTime(*start)
+	if err != nil {
+		return nil, &RosterError{Row: number, Field: "DTSTART", Message: "must be an iCalendar date or date-time"}
+	}
+	if len(users) == 0 {
+		if username == "" {
+			return nil, &RosterError{Row: number, Field: "ATTENDEE", Message: "missing attendee"}
+		}
+		users = []string{username}
+	}
+
+	timeV := summary
+	if !allDay {
+		timeV = summary + "\x00" + startsAt.Format("15:04")
+	}
+	date := time.Date(startsAt.Year(), startsAt.Month(), startsAt.Day(), 0, 0, 0, 0, time.Local)
+	var entries []RosterEntry
+	for _, user := range users {
+		entries = append(entries, RosterEntry{Row: number, Username: user, Date: date, Time: timeV})
+	}
+	return entries, nil
+}
+
+// rosterType resolves the slot of an entry: a shift type name, a summary
+// containing one or a start time. ICS entries separate summary and start
+// time with a NUL byte.
+func rosterType(types []ShiftType, value string) (ShiftType, bool) {
+	summary, start, _ := strings.Cut(value, "\x00")
+	summary = strings.ToLower(strings.TrimSpace(summary))
+	if summary != "" {
+		for _, t := range types {
+			if strings.ToLower(t.Name) == summary {
+				return t, true
+			}
+		}
+		// The longest name wins so that a type is not shadowed by one whose
+		// name it contains
+		var found *ShiftType
+		for i, t := range types {
+			if strings.Contains(summary, strings.ToLower(t.Name)) && (found == nil || len(t.Name) > len(found.Name)) {
+				found = &types[i]
+			}
+		}
+		if found != nil {
+			return *found, true
+		}
+	}
+	if start == "" {
+		start, _, _ = strings.Cut(summary, "-")
+	}
+	start = strings.TrimSpace(start)
+	for _, t := range types {
+		if start != "" && t.Start == start {
+			return t, true
+		}
+	}
+	return ShiftType{}, false
+}
+
+// planRoster resolves the entries and diffs them against the stored shifts.
+// Within the dates of the roster, or the wider range of the options, the
+// roster replaces the schedules of its users: shifts in the same slot are
+// kept, other shifts on the same date move to a remaining slot and the rest
+// are deleted. Rows whose shifts break the working time rules, need skills
+// their user lacks or name a team the user is not in are rejected.
+func planRoster(store Store, rules RuleSet, types []ShiftType, entries []RosterEntry, errs []RosterError, options RosterOptions) (*RosterReport, error) {
+	report := &RosterReport{DryRun: options.DryRun, Changes: []RosterChange{}, Errors: errs}
+	usernames, err := store.Usernames()
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string, len(usernames))
+	for _, username := range usernames {
+		users[strings.ToLower(username)] = username
+	}
+	teams := map[string]*Team{}
+	team := func(name string) (*Team, error) {
+		if resolved, ok := teams[strings.ToLower(name)]; ok {
+			return resolved, nil
+		}
+		stored, err := store.GetTeam(name)
+		if errors.Is(err, errTeamNotFound) {
+			teams[strings.ToLower(name)] = nil
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		teams[strings.ToLower(name)] = stored
+		return stored, nil
+	}
+	shiftTypes := make(map[string]ShiftType, len(types))
+	for _, t := range types {
+		shiftTypes[t.Name] = t
+	}
+
+	// Resolved shifts by user and date
+	planned := map[string]map[string][]RosterChange{}
+	seen := map[string]int{}
+	from, to := options.From, options.To
+	for _, entry := range entries {
+		username, ok := users[strings.ToLower(entry.Username)]
+		if !ok {
+			report.Errors = append(report.Errors, RosterError{Row: entry.Row, Field: "username", Message: fmt.Sprintf("unknown user %q", entry.Username)})
+			continue
+		}
+		shiftType, ok := rosterType(types, entry.Time)
+		if !ok {
+			value := strings.ReplaceAll(entry.Time, "\x00", " ")
+			report.Errors = append(report.Errors, RosterError{Row: entry.Row, Field: "time", Message: fmt.Sprintf("no shift type matches %q", strings.TrimSpace(value))})
+			continue
+		}
+		teamName := ""
+		if entry.Team != "" {
+			resolved, err := team(entry.Team)
+			if err != nil {
+				return nil, err
+			}
+			if resolved == nil {
+				report.Errors = append(report.Errors, RosterError{Row: entry.Row, Field: "team", Message: fmt.Sprintf("unknown team %q", entry.Team)})
+				continue
+			}
+			if !resolved.hasMember(username) {
+				report.Errors = append(report.Errors, RosterError{Row: entry.Row, Field: "team", Message: fmt.Sprintf("%s is not a member of team %q", username, resolved.Name)})
+				continue
+			}
+			teamName = resolved.Name
+		}
+		if !options.Scope.includes(Shift{Username: username, Team: teamName}) {
+			message := fmt.Sprintf("you do not manage team %q", teamName)
+			if teamName == "" {
+				message = "shifts without a team are managed by admins"
+			}
+			report.Errors = append(report.Errors, RosterError{Row: entry.Row, Field: "team", Message: message})
+			continue
+		}
+		datum := formatDate(entry.Date)
+		key := username + "\x00" + datum + "\x00" + shiftType.Name
+		if row, ok := seen[key]; ok {
+			report.Errors = append(report.Errors, RosterError{Row: entry.Row, Message: fmt.Sprintf("%s already works %s on %s in row %d", username, shiftType.Name, datum, row)})
+			continue
+		}
+		seen[key] = entry.Row
+
+		startsAt, endsAt := shiftTimes(entry.Date, shiftType)
+		if planned[username] == nil {
+			planned[username] = map[string][]RosterChange{}
+		}
+		planned[username][datum] = append(planned[username][datum], RosterChange{
+			Row:      entry.Row,
+			Username: username,
+			Datum:    datum,
+			Time:     shiftType.Name,
+			Team:     teamName,
+			shift:    Shift{Username: username, Team: teamName, Date: entry.Date, Time: shiftType.Name, StartsAt: startsAt, EndsAt: endsAt},
+		})
+		if from.IsZero() || entry.Date.Before(from) {
+			from = entry.Date
+		}
+		if to.IsZero() || entry.Date.After(to) {
+			to = entry.Date
+		}
+	}
+	if from.IsZero() {
+		report.sortErrors()
+		return report, nil
+	}
+	report.From, report.To = formatDate(from), formatDate(to)
+
+	names := make([]string, 0, len(planned))
+	for username := range planned {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	for _, username := range names {
+		stored, err := store.ListShifts(username)
+		if err != nil {
+			return nil, err
+		}
+		existing := map[string][]Shift{}
+		for _, shift := range stored {
+			datum := formatDate(shift.Date)
+			if datum >= report.From && datum <= report.To && options.Scope.includes(shift) {
+				existing[datum] = append(existing[datum], shift)
+			}
+		}
+		var userTeams []string
+		if userTeams, err = store.UserTeams(username); err != nil {
+			return nil, err
+		}
+		dates := map[string]bool{}
+		for datum := range existing {
+			dates[datum] = true
+		}
+		for datum := range planned[username] {
+			dates[datum] = true
+		}
+		sorted := make([]string, 0, len(dates))
+		for datum := range dates {
+			sorted = append(sorted, datum)
+		}
+		sort.Strings(sorted)
+		for _, datum := range sorted {
+			report.diff(planned[username][datum], existing[datum], userTeams)
+		}
+		if err := report.check(store, rules, shiftTypes, username, stored); err != nil {
+			return nil, err
+		}
+	}
+
+	report.rejectChecked()
+	return report, nil
+}
+
+// rejectChecked adds an error for every rule violation and missing skill the
+// checks found in the changes
+func (report *RosterReport) rejectChecked() {
+	for _, change := range report.Changes {
+		for _, violation := range change.Violations {
+			report.Errors = append(report.Errors, RosterError{Row: change.Row, Field: "time", Message: violation.Message})
+		}
+		if change.Missing != nil {
+			report.Errors = append(report.Errors, RosterError{Row: change.Row, Field: "time", Message: fmt.Sprintf("%s lacks the skills %s required for the %s shift", change.Username, strings.Join(change.Missing, ", "), change.Time)})
+		}
+	}
+	report.sortErrors()
+}
+
+// sortErrors orders the errors by row
+func (report *RosterReport) sortErrors() {
+	sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+}
+
+// check evaluates the inserted and updated shifts of a user against the
+// working time rules and the user's skills. schedule holds the stored shifts
+// of the user, the planned changes replace them for the check.
+func (report *RosterReport) check(store Store, rules RuleSet, types map[string]ShiftType, username string, schedule []Shift) error {
+	skills, err := store.UserSkills(username)
+	if err != nil {
+		return err
+	}
+	has := skillSet(skills)
+
+	replaced := map[string]bool{}
+	var changed []int
+	for i, change := range report.Changes {
+		if change.Username != username {
+			continue
+		}
+		if change.stored != nil {
+			replaced[change.stored.ID] = true
+		}
+		if change.Action == rosterInsert || change.Action == rosterUpdate || change.Action == rosterUnchanged {
+			changed = append(changed, i)
+		}
+	}
+	var result []Shift
+	for _, shift := range schedule {
+		if !replaced[shift.ID] {
+			result = append(result, shift)
+		}
+	}
+	planned := make([]Shift, len(changed))
+	for j, i := range changed {
+		shift := report.Changes[i].shift
+		// New shifts get IDs of their own so the rules tell them apart
+		shift.ID = fmt.Sprintf("planned-%d", i)
+		if stored := report.Changes[i].stored; stored != nil {
+			shift.ID, shift.Skills = stored.ID, stored.Skills
+		}
+		planned[j] = shift
+	}
+	result = append(result, planned...)
+
+	for j, i := range changed {
+		change := &report.Changes[i]
+		if change.Action == rosterUnchanged {
+			continue
+		}
+		change.Violations = rules.check(planned[j], result)
+		change.Missing = missingSkills(types[planned[j].Time], planned[j], has)
+	}
+	return nil
+}
+
+// diff adds the changes turning the stored shifts of a user on a date into
+// the planned ones
+func (report *RosterReport) diff(planned []RosterChange, existing []Shift, userTeams []string) {
+	var remaining []RosterChange
+	for _, change := range planned {
+		matched := -1
+		for i, shift := range existing {
+			if shift.Time == change.Time {
+				matched = i
+				break
+			}
+		}
+		if matched < 0 {
+			remaining = append(remaining, change)
+			continue
+		}
+		stored := existing[matched]
+		existing = append(existing[:matched:matched], existing[matched+1:]...)
+		report.change(change, &stored)
+	}
+	for _, change := range remaining {
+		if len(existing) > 0 {
+			stored := existing[0]
+			existing = existing[1:]
+			report.change(change, &stored)
+			continue
+		}
+		// New shifts of users in a single team belong to it, as when they
+		// are added through the API
+		if change.Team == "" && len(userTeams) == 1 {
+			change.Team, change.shift.Team = userTeams[0], userTeams[0]
+		}
+		change.Action = rosterInsert
+		report.Inserted++
+		report.Changes = append(report.Changes, change)
+	}
+	for _, shift := range existing {
+		stored := shift
+		report.Deleted++
+		report.Changes = append(report.Changes, RosterChange{
+			Action:   rosterDelete,
+			Uid:      shift.ID,
+			Username: shift.Username,
+			Datum:    formatDate(shift.Date),
+			Time:     shift.Time,
+			Team:     shift.Team,
+			stored:   &stored,
+		})
+	}
+}
+
+// change adds a planned shift taking over a stored one; a roster without
+// team keeps the stored team
+func (report *RosterReport) change(change RosterChange, stored *Shift) {
+	if change.Team == "" {
+		change.Team, change.shift.Team = stored.Team, stored.Team
+	}
+	change.Uid, change.stored = stored.ID, stored
+	if change.Time == stored.Time && change.Team == stored.Team {
+		change.Action = rosterUnchanged
+		report.Unchanged++
+	} else {
+		change.Action = rosterUpdate
+		change.Previous = &RosterSlot{Time: stored.Time, Team: stored.Team}
+		report.Updated++
+	}
+	report.Changes = append(report.Changes, change)
+}
+
+// importRoster diffs the roster against the shifts of the tenant and, unless
+// it is a dry run, applies the changes in one transaction. It returns
+// errRosterInvalid with the report if rows were rejected; nothing is
+// changed then.
+func (app *App) importRoster(store Store, tenant string, entries []RosterEntry, errs []RosterError, options RosterOptions) (*RosterReport, []Event, error) {
+	types, err := app.Store.ShiftTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var report *RosterReport
+	var events []Event
+	err = store.Atomic(func(tx Store) error {
+		rules, err := app.rules(tx)
+		if err != nil {
+			return err
+		}
+		report, err = planRoster(tx, rules, types, entries, errs, options)
+		if err != nil {
+			return err
+		}
+		if options.DryRun {
+			return nil
+		}
+		if len(report.Errors) > 0 {
+			return errRosterInvalid
+		}
+
+		events, err = report.apply(tx, tenant)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, errRosterInvalid) {
+			return report, nil, err
+		}
+		return nil, nil, err
+	}
+	return report, events, nil
+}
+
+// apply makes the changes of the report, it returns errRosterInvalid and
+// reports the row if a slot is taken in the meantime
+func (report *RosterReport) apply(tx Store, tenant string) ([]Event, error) {
+	var events []Event
+	var err error
+	// Deletes and updates free the slots the inserts take
+	for _, action := range []string{rosterDelete, rosterUpdate, rosterInsert} {
+		for i, change := range report.Changes {
+			if change.Action != action {
+				continue
+			}
+			switch action {
+			case rosterDelete:
+				err = tx.DeleteShift(ShiftScope{All: true}, change.Uid)
+				events = append(events, shiftEvent(tenant, "deleted", *change.stored))
+				if change.stored.Trade {
+					events = append(events, offersEvent(tenant, *change.stored))
+				}
+			case rosterUpdate:
+				updated := *change.stored
+				updated.Team, updated.Time = change.shift.Team, change.shift.Time
+				updated.StartsAt, updated.EndsAt = change.shift.StartsAt, change.shift.EndsAt
+				err = tx.UpdateShift(ShiftScope{All: true}, updated)
+				events = append(events, shiftChanged(tenant, *change.stored, updated)...)
+			case rosterInsert:
+				shift := change.shift
+				shift.ID = generateSessionID()
+				report.Changes[i].Uid = shift.ID
+				err = tx.CreateShift(shift)
+				events = append(events, shiftEvent(tenant, "created", shift))
+			}
+			if errors.Is(err, errShiftConflict) {
+				report.Errors = append(report.Errors, RosterError{Row: change.Row, Field: "time", Message: "the slot is already taken"})
+				return nil, errRosterInvalid
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s shift of %s on %s: %w", action, change.Username, change.Datum, err)
+			}
+		}
+	}
+	return events, nil
+}
+
+// rosterFormat returns the format of a roster from its name or content type
+func rosterFormat(requested, name, contentType string) string {
+	if requested != "" {
+		return strings.ToLower(requested)
+	}
+	switch {
+	case strings.EqualFold(filepath.Ext(name), ".ics"), strings.HasPrefix(contentType, "text/calendar"):
+		return rosterICS
+	default:
+		return rosterCSV
+	}
+}
+
+// Roster import handler for /roster/import. The body is a CSV or ICS file;
+// the query selects the format, overrides the configured column mapping
+// and turns the import into a dry run.
+func (app *App) rosterImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	principal, ok := requirePermission(w, r, permShiftsManage)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	options := RosterOptions{
+		Format:   rosterFormat(query.Get("format"), "", r.Header.Get("Content-Type")),
+		CSV:      app.Config.Import,
+		Username: query.Get("username"),
+		DryRun:   query.Get("dry_run") == "true" || query.Get("dry_run") == "1",
+		Scope:    principal.shiftScope(),
+	}
+	for name, target := range map[string]*string{
+		"username_column": &options.CSV.Columns.Username,
+		"date_column":     &options.CSV.Columns.Date,
+		"time_column":     &options.CSV.Columns.Time,
+		"team_column":     &options.CSV.Columns.Team,
+		"delimiter":       &options.CSV.Delimiter,
+		"date_format":     &options.CSV.DateFormat,
+	} {
+		if query.Has(name) {
+			*target = query.Get(name)
+		}
+	}
+	for name, target := range map[string]*time.Time{"from": &options.From, "to": &options.To} {
+		if value := query.Get(name); value != "" {
+			date, err := parseDate(value)
+			if err != nil {
+				writeMessage(w, http.StatusBadRequest, name+" must be an ISO 8601 date")
+				return
+			}
+			*target = date
+		}
+	}
+	if err := options.CSV.validate(); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRosterSize))
+	if err != nil {
+		writeMessage(w, http.StatusRequestEntityTooLarge, "Roster file is too large")
+		return
+	}
+	entries, errs, err := parseRoster(content, options)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report, events, err := app.importRoster(app.store(r), requestTenant(r), entries, errs, options)
+	status := http.StatusOK
+	if errors.Is(err, errRosterInvalid) {
+		status = http.StatusUnprocessableEntity
+	} else if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to import roster")
+		return
+	}
+	app.publish(events...)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		return
+	}
+}
+
+// runImportCommand imports a roster file from the command line and prints
+// the report, `-` reads the file from stdin
+func runImportCommand(app *App, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	tenant := flags.String("tenant", defaultTenant, "tenant whose shifts are replaced")
+	format := flags.String("format", "", "csv or ics, by default derived from the file name")
+	username := flags.String("username", "", "owner of ICS events without attendees")
+	from := flags.String("from", "", "first date of the replaced range")
+	to := flags.String("to", "", "last date of the replaced range")
+	dryRun := flags.Bool("dry-run", false, "only report the changes")
+	config := app.Config.Import
+	flags.StringVar(&config.Columns.Username, "username-column", config.Columns.Username, "CSV column of the username")
+	flags.StringVar(&config.Columns.Date, "date-column", config.Columns.Date, "CSV column of the date")
+	flags.StringVar(&config.Columns.Time, "time-column", config.Columns.Time, "CSV column of the shift type")
+	flags.StringVar(&config.Columns.Team, "team-column", config.Columns.Team, "CSV column of the team")
+	flags.StringVar(&config.Delimiter, "delimiter", config.Delimiter, "CSV field delimiter")
+	flags.StringVar(&config.DateFormat, "date-format", config.DateFormat, "Go time layout of the CSV dates")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [flags] file")
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	options := RosterOptions{Format: rosterFormat(*format, flags.Arg(0), ""), CSV: config, Username: *username, DryRun: *dryRun, Scope: ShiftScope{All: true}}
+	for _, value := range []string{*from, *to} {
+		if value == "" {
+			continue
+		}
+		date, err := parseDate(value)
+		if err != nil {
+			return fmt.Errorf("invalid date %q", value)
+		}
+		if value == *from {
+			options.From = date
+		}
+		if value == *to {
+			options.To = date
+		}
+	}
+
+	var content []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	entries, errs, err := parseRoster(content, options)
+	if err != nil {
+		return err
+	}
+
+	report, _, err := app.importRoster(app.Store.ForTenant(*tenant), *tenant, entries, errs, options)
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRotationDays limits the length of a rotation cycle
+const maxRotationDays = 366
+
+// monthLayout is the format of the month a rotation is generated for
+const monthLayout = "2006-01"
+
+// RotationTemplate is a named cycle of slots, e.g. two early, two late and
+// two night shifts followed by two days off; days off are empty
+type RotationTemplate struct {
+	Name string   `json:"name"`
+	Days []string `json:"days"`
+}
+
+// TeamRotation assigns a template to a team, its cycle starts at Start
+type TeamRotation struct {
+	Team     string
+	Template string
+	Start    time.Time
+	Members  []RotationMember
+}
+
+// RotationMember follows the rotation of a team Offset days ahead of the
+// cycle, so that members working the same template cover different slots
+type RotationMember struct {
+	Username string `json:"username"`
+	Offset   int    `json:"offset"`
+}
+
+// TeamRotationReceive is the rotation of a team as sent and received by
+// the API
+type TeamRotationReceive struct {
+	Team     string           `json:"team"`
+	Template string           `json:"template"`
+	Start    string           `json:"start"`
+	Members  []RotationMember `json:"members"`
+}
+
+// parseRotation validates a template against the shift type catalogue and
+// returns it with the canonical slot names
+func parseRotation(rotation RotationTemplate, types []ShiftType) (RotationTemplate, []ValidationError) {
+	var errs []ValidationError
+	rotation.Name = strings.TrimSpace(rotation.Name)
+	if rotation.Name == "" || strings.Contains(rotation.Name, "/") {
+		errs = append(errs, ValidationError{Field: "name", Message: "must not be empty or contain /"})
+	}
+	if len(rotation.Days) == 0 || len(rotation.Days) > maxRotationDays {
+		errs = append(errs, ValidationError{Field: "days", Message: fmt.Sprintf("must have between 1 and %d days", maxRotationDays)})
+	}
+
+	days := make([]string, len(rotation.Days))
+	working := false
+	for i, day := range rotation.Days {
+		if isDayOff(day) {
+			continue
+		}
+		found := false
+		for _, t := range types {
+			if strings.EqualFold(t.Name, strings.TrimSpace(day)) {
+				days[i], found, working = t.Name, true, true
+			}
+		}
+		if !found {
+			errs = append(errs, ValidationError{Field: fmt.Sprintf("days[%d]", i), Message: fmt.Sprintf("unknown shift type %q", day)})
+		}
+	}
+	if len(rotation.Days) > 0 && !working && errs == nil {
+		errs = append(errs, ValidationError{Field: "days", Message: "must contain at least one shift"})
+	}
+	rotation.Days = days
+	return rotation, errs
+}
+
+// Rotation handler for /rotations
+func (app *App) rotationHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permShiftsManage); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rotations, err := app.store(r).Rotations()
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to fetch rotations")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(rotations)
+		if err != nil {
+			return
+		}
+	case http.MethodPost:
+		app.rotationSave(w, r, "")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Rotation handler for /rotations/{name}
+func (app *App) rotationByNameHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permShiftsManage); !ok {
+		return
+	}
+
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := pathSegments[1]
+
+	switch r.Method {
+	case http.MethodGet:
+		app.writeRotation(w, r, http.StatusOK, name)
+	case http.MethodPut:
+		app.rotationSave(w, r, name)
+	case http.MethodDelete:
+		err := app.store(r).DeleteRotation(name)
+		if errors.Is(err, errRotationInUse) {
+			writeMessage(w, http.StatusConflict, "Rotation is still assigned to teams")
+			return
+		}
+		if errors.Is(err, errRotationNotFound) {
+			writeMessage(w, http.StatusNotFound, "Rotation not found")
+			return
+		}
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to delete rotation")
+			return
+		}
+		writeMessage(w, http.StatusOK, "Rotation deleted successfully")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// rotationSave creates a template, or replaces the template name if it is set
+func (app *App) rotationSave(w http.ResponseWriter, r *http.Request, name string) {
+	var rotation RotationTemplate
+	err := json.NewDecoder(r.Body).Decode(&rotation)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if rotation.Name == "" {
+		rotation.Name = name
+	}
+	types, err := app.Store.ShiftTypes()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
+		return
+	}
+	rotation, errs := parseRotation(rotation, types)
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	status := http.StatusCreated
+	if name == "" {
+		err = app.store(r).CreateRotation(rotation)
+	} else {
+		status = http.StatusOK
+		err = app.store(r).UpdateRotation(name, rotation)
+	}
+	if errors.Is(err, errRotationExists) {
+		writeMessage(w, http.StatusConflict, "Rotation already exists")
+		return
+	}
+	if errors.Is(err, errRotationNotFound) {
+		writeMessage(w, http.StatusNotFound, "Rotation not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to save rotation")
+		return
+	}
+
+	app.writeRotation(w, r, status, rotation.Name)
+}
+
+// writeRotation responds with the stored template
+func (app *App) writeRotation(w http.ResponseWriter, r *http.Request, status int, name string) {
+	rotation, err := app.store(r).GetRotation(name)
+	if errors.Is(err, errRotationNotFound) {
+		writeMessage(w, http.StatusNotFound, "Rotation not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get rotation")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(rotation)
+	if err != nil {
+		return
+	}
+}
+
+// Team rotation handler for /teams/{name}/rotation, its preview and its
+// generation; supervisors manage the rotations of their own teams
+func (app *App) teamRotationHandler(w http.ResponseWriter, r *http.Request, name string, action string) {
+	principal, ok := requirePermission(w, r, permShiftsManage)
+	if !ok {
+		return
+	}
+	if !principal.managesTeam(name) {
+		writeMessage(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		app.writeTeamRotation(w, r, http.StatusOK, name)
+	case action == "" && r.Method == http.MethodPut:
+		app.teamRotationPut(w, r, name)
+	case action == "" && r.Method == http.MethodDelete:
+		err := app.store(r).DeleteTeamRotation(name)
+		if errors.Is(err, errRotationNotFound) {
+			writeMessage(w, http.StatusNotFound, "Team follows no rotation")
+			return
+		}
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to remove rotation")
+			return
+		}
+		writeMessage(w, http.StatusOK, "Rotation removed, generated shifts are kept")
+	case action == "preview" && r.Method == http.MethodGet:
+		app.teamRotationGenerate(w, r, name, true)
+	case action == "generate" && r.Method == http.MethodPost:
+		app.teamRotationGenerate(w, r, name, false)
+	case action == "" || action == "preview" || action == "generate":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (app *App) teamRotationPut(w http.ResponseWriter, r *http.Request, name string) {
+	var receive TeamRotationReceive
+	err := json.NewDecoder(r.Body).Decode(&receive)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	team, err := app.store(r).GetTeam(name)
+	if errors.Is(err, errTeamNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get team")
+		return
+	}
+
+	var errs []ValidationError
+	rotation := TeamRotation{Team: team.Name, Template: receive.Template}
+	_, err = app.store(r).GetRotation(receive.Template)
+	if errors.Is(err, errRotationNotFound) {
+		errs = append(errs, ValidationError{Field: "template", Message: fmt.Sprintf("unknown rotation %q", receive.Template)})
+	} else if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get rotation")
+		return
+	}
+	rotation.Start, err = parseDate(receive.Start)
+	if err != nil {
+		errs = append(errs, ValidationError{Field: "start", Message: "must be an ISO 8601 date"})
+	}
+	seen := make(map[string]bool, len(receive.Members))
+	for i, member := range receive.Members {
+		field := fmt.Sprintf("members[%d].username", i)
+		switch {
+		case !team.hasMember(member.Username):
+			errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf("not a member of team %q", team.Name)})
+		case seen[member.Username]:
+			errs = append(errs, ValidationError{Field: field, Message: "must not be listed twice"})
+		default:
+			seen[member.Username] = true
+			rotation.Members = append(rotation.Members, member)
+		}
+	}
+	if errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	err = app.store(r).SetTeamRotation(rotation)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to assign rotation")
+		return
+	}
+	app.writeTeamRotation(w, r, http.StatusOK, team.Name)
+}
+
+// writeTeamRotation responds with the stored rotation of a team
+func (app *App) writeTeamRotation(w http.ResponseWriter, r *http.Request, status int, name string) {
+	rotation, err := app.store(r).TeamRotation(name)
+	if errors.Is(err, errRotationNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team follows no rotation")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get rotation")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(TeamRotationReceive{
+		Team:     rotation.Team,
+		Template: rotation.Template,
+		Start:    formatDate(rotation.Start),
+		Members:  rotation.Members,
+	})
+	if err != nil {
+		return
+	}
+}
+
+// teamRotationGenerate previews or generates the shifts of a team's
+// rotation for the month given by the query, e.g. ?month=2026-11
+func (app *App) teamRotationGenerate(w http.ResponseWriter, r *http.Request, name string, preview bool) {
+	first, err := time.ParseInLocation(monthLayout, r.URL.Query().Get("month"), time.Local)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "month must be given as YYYY-MM")
+		return
+	}
+	types, err := app.Store.ShiftTypes()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift types")
+		return
+	}
+
+	var report *RosterReport
+	var events []Event
+	rejected := false
+	message := "Failed to get team"
+	err = app.store(r).Atomic(func(tx Store) error {
+		team, err := tx.GetTeam(name)
+		if err != nil {
+			return err
+		}
+		message = "Failed to get rotation"
+		rotation, err := tx.TeamRotation(team.Name)
+		if err != nil {
+			return err
+		}
+		template, err := tx.GetRotation(rotation.Template)
+		if err != nil {
+			return err
+		}
+
+		message = "Failed to get rules"
+		rules, err := app.rules(tx)
+		if err != nil {
+			return err
+		}
+
+		message = "Failed to generate shifts"
+		report, err = planRotation(tx, rules, team, rotation, template, types, first, first.AddDate(0, 1, -1))
+		if err != nil || preview {
+			return err
+		}
+		if len(report.Errors) > 0 {
+			rejected = true
+			return errRosterInvalid
+		}
+		report.DryRun = false
+		events, err = report.apply(tx, requestTenant(r))
+		return err
+	})
+	if errors.Is(err, errTeamNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team not found")
+		return
+	}
+	if errors.Is(err, errRotationNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team follows no rotation")
+		return
+	}
+	status := http.StatusOK
+	if errors.Is(err, errRosterInvalid) && rejected {
+		status = http.StatusUnprocessableEntity
+	} else if errors.Is(err, errRosterInvalid) {
+		writeMessage(w, http.StatusConflict, "A slot of the rotation was taken in the meantime")
+		return
+	} else if err != nil {
+		writeMessage(w, http.StatusInternalServerError, message)
+		return
+	}
+	app.publish(events...)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		return
+	}
+}
+
+// planRotation diffs the shifts the rotation of a team yields between first
+// and last against the stored shifts. Generated shifts are kept, moved to
+// another slot or deleted as the rotation demands. Shifts that were traded,
+// offered, released or entered by hand are left alone and the member gets
+// no generated shift on their date. Generated shifts that break the working
+// time rules or need skills their member lacks are reported as errors.
+func planRotation(tx Store, rules RuleSet, team *Team, rotation *TeamRotation, template *RotationTemplate, types []ShiftType, first, last time.Time) (*RosterReport, error) {
+	report := &RosterReport{DryRun: true, From: formatDate(first), To: formatDate(last), Changes: []RosterChange{}, Errors: []RosterError{}}
+	shiftTypes := make(map[string]ShiftType, len(types))
+	for _, t := range types {
+		shiftTypes[t.Name] = t
+	}
+	offsets := make(map[string]int, len(rotation.Members))
+	for _, member := range rotation.Members {
+		if team.hasMember(member.Username) {
+			offsets[member.Username] = member.Offset
+		}
+	}
+	inMonth := func(shift Shift) bool {
+		datum := formatDate(shift.Date)
+		return datum >= report.From && datum <= report.To
+	}
+	// replaceable reports whether regenerating may change a shift
+	replaceable := func(shift Shift) bool {
+		return shift.Generated && shift.Team == team.Name && !shift.Trade && !shift.Released
+	}
+
+	// Generated shifts of former members are removed
+	teamShifts, err := tx.ListTeamShifts(team.Name)
+	if err != nil {
+		return nil, err
+	}
+	var former []Shift
+	for _, shift := range teamShifts {
+		if _, ok := offsets[shift.Username]; !ok && inMonth(shift) && replaceable(shift) {
+			former = append(former, shift)
+		}
+	}
+	report.diff(nil, former, nil)
+
+	usernames := make([]string, 0, len(offsets))
+	for username := range offsets {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		schedule, err := tx.ListShifts(username)
+		if err != nil {
+			return nil, err
+		}
+		byDate := make(map[string][]Shift)
+		for _, shift := range schedule {
+			if inMonth(shift) {
+				byDate[formatDate(shift.Date)] = append(byDate[formatDate(shift.Date)], shift)
+			}
+		}
+
+		for date := first; !date.After(last); date = date.AddDate(0, 0, 1) {
+			datum := formatDate(date)
+			var generated []Shift
+			kept := false
+			for _, shift := range byDate[datum] {
+				if replaceable(shift) {
+					generated = append(generated, shift)
+				} else {
+					kept = true
+				}
+			}
+
+			var planned []RosterChange
+			slot := ""
+			if !date.Before(rotation.Start) {
+				slot = rotationSlot(template.Days, rotation.Start, date, offsets[username])
+			}
+			shiftType, known := shiftTypes[slot]
+			switch {
+			case slot == "" || !known:
+			case kept:
+				report.Kept++
+				report.Changes = append(report.Changes, RosterChange{Action: rosterKept, Username: username, Datum: datum, Time: slot, Team: team.Name})
+			default:
+				startsAt, endsAt := shiftTimes(date, shiftType)
+				planned = append(planned, RosterChange{
+					Username: username,
+					Datum:    datum,
+					Time:     slot,
+					Team:     team.Name,
+					shift:    Shift{Username: username, Team: team.Name, Date: date, Time: slot, StartsAt: startsAt, EndsAt: endsAt, Generated: true},
+				})
+			}
+			report.diff(planned, generated, nil)
+		}
+		if err := report.check(tx, rules, shiftTypes, username, schedule); err != nil {
+			return nil, err
+		}
+	}
+	report.rejectChecked()
+	return report, nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Rule names reported with violations
+const (
+	ruleMinRest            = "min_rest"
+	ruleMaxConsecutiveDays = "max_consecutive_days"
+	ruleMaxWeeklyHours     = "max_weekly_hours"
+	ruleNoDoubleBooking    = "no_double_booking"
+	ruleUniqueSlot         = "unique_slot"
+)
+
+// RuleConfig sets the working time rules of a tenant, zero values disable
+// a rule
+type RuleConfig struct {
+	MinRestHours       float64 `yaml:"min_rest_hours" json:"minRestHours"`
+	MaxConsecutiveDays int     `yaml:"max_consecutive_days" json:"maxConsecutiveDays"`
+	MaxWeeklyHours     float64 `yaml:"max_weekly_hours" json:"maxWeeklyHours"`
+	NoDoubleBooking    bool    `yaml:"no_double_booking" json:"noDoubleBooking"`
+}
+
+// RuleViolation describes why a user may not work a shift
+type RuleViolation struct {
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+	Username string `json:"username"`
+	// Conflict is the ID of the shift the new one clashes with, if any
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// Rule checks whether a user may work shift in addition to the shifts of
+// their schedule
+type Rule interface {
+	Check(shift Shift, schedule []Shift) []RuleViolation
+}
+
+// RuleSet is the list of rules a tenant's shifts are checked against
+type RuleSet []Rule
+
+// validate rejects negative limits
+func (c RuleConfig) validate() error {
+	if c.MinRestHours < 0 || c.MaxConsecutiveDays < 0 || c.MaxWeeklyHours < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// ruleSet returns the built-in rules enabled by the configuration
+func (c RuleConfig) ruleSet() RuleSet {
+	var rules RuleSet
+	if c.NoDoubleBooking {
+		rules = append(rules, doubleBookingRule{})
+	}
+	if c.MinRestHours > 0 {
+		rules = append(rules, restRule{minRest: time.Duration(c.MinRestHours * float64(time.Hour))})
+	}
+	if c.MaxConsecutiveDays > 0 {
+		rules = append(rules, consecutiveDaysRule{maxDays: c.MaxConsecutiveDays})
+	}
+	if c.MaxWeeklyHours > 0 {
+		rules = append(rules, weeklyHoursRule{maxHours: c.MaxWeeklyHours})
+	}
+	return rules
+}
+
+// check returns the violations of all rules; the shift itself is left out of
+// the schedule so stored shifts can be checked as well
+func (rs RuleSet) check(shift Shift, schedule []Shift) []RuleViolation {
+	others := make([]Shift, 0, len(schedule))
+	for _, s := range schedule {
+		if s.ID != shift.ID {
+			others = append(others, s)
+		}
+	}
+
+	var violations []RuleViolation
+	for _, rule := range rs {
+		violations = append(violations, rule.Check(shift, others)...)
+	}
+	return violations
+}
+
+// slotConflict returns the shift of schedule on the date and slot of shift,
+// or nil if the slot is free. Unlike the rules this cannot be switched off.
+func slotConflict(shift Shift, schedule []Shift) *Shift {
+	for _, s := range schedule {
+		if s.ID != shift.ID && s.Time == shift.Time && formatDate(s.Date) == formatDate(shift.Date) {
+			return &s
+		}
+	}
+	return nil
+}
+
+// checkMove returns the shift the owner of stored works on the date and slot
+// it is moved to, or else the working time rules the move breaks. The stored
+// version is left out of the schedule; shifts that stay in place and shifts
+// without an owner are not checked against the rules.
+func (app *App) checkMove(tx Store, stored, shift Shift) (*Shift, []RuleViolation, error) {
+	schedule, err := tx.ListShifts(stored.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conflict := slotConflict(shift, schedule); conflict != nil {
+		return conflict, nil, nil
+	}
+	if stored.Username == "" || (shift.Time == stored.Time && formatDate(shift.Date) == formatDate(stored.Date)) {
+		return nil, nil, nil
+	}
+	rules, err := app.rules(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, rules.check(shift, schedule), nil
+}
+
+// writeShiftConflict writes a 409 response naming the shift that already
+// takes the slot
+func writeShiftConflict(w http.ResponseWriter, conflict *Shift) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	err := json.NewEncoder(w).Encode(map[string]string{
+		"message":  shiftConflictMessage(conflict),
+		"conflict": conflict.ID,
+	})
+	if err != nil {
+		return
+	}
+}
+
+// shiftConflictMessage names the owner and slot of a conflicting shift
+func shiftConflictMessage(conflict *Shift) string {
+	return fmt.Sprintf("%s already works the %s shift on %s", conflict.Username, conflict.Time, formatDate(conflict.Date))
+}
+
+// doubleBookingRule allows a single shift per user and date; the same slot
+// twice is refused by slotConflict even without the rule
+type doubleBookingRule struct{}
+
+func (doubleBookingRule) Check(shift Shift, schedule []Shift) []RuleViolation {
+	var violations []RuleViolation
+	for _, s := range schedule {
+		if formatDate(s.Date) == formatDate(shift.Date) && s.Time != shift.Time {
+			violations = append(violations, RuleViolation{
+				Rule:     ruleNoDoubleBooking,
+				Message:  fmt.Sprintf("%s already works the %s shift on %s", shift.Username, s.Time, formatDate(s.Date)),
+				Username: shift.Username,
+				Conflict: s.ID,
+			})
+		}
+	}
+	return violations
+}
+
+// restRule requires a minimum rest between the end of a shift and the start
+// of the next one
+type restRule struct {
+	minRest time.Duration
+}
+
+func (r restRule) Check(shift Shift, schedule []Shift) []RuleViolation {
+	var violations []RuleViolation
+	for _, s := range schedule {
+		rest := shift.StartsAt.Sub(s.EndsAt)
+		if s.StartsAt.After(shift.StartsAt) {
+			rest = s.StartsAt.Sub(shift.EndsAt)
+		}
+		if rest < r.minRest {
+			violations = append(violations, RuleViolation{
+				Rule:     ruleMinRest,
+				Message:  fmt.Sprintf("%s would rest %s between this and the %s shift on %s, at least %s are required", shift.Username, formatHours(rest), s.Time, formatDate(s.Date), formatHours(r.minRest)),
+				Username: shift.Username,
+				Conflict: s.ID,
+			})
+		}
+	}
+	return violations
+}
+
+// consecutiveDaysRule limits the number of days worked in a row
+type consecutiveDaysRule struct {
+	maxDays int
+}
+
+func (r consecutiveDaysRule) Check(shift Shift, schedule []Shift) []RuleViolation {
+	worked := make(map[string]bool)
+	for _, s := range schedule {
+		worked[formatDate(s.Date)] = true
+	}
+
+	days := 1
+	for day := shift.Date.AddDate(0, 0, -1); worked[formatDate(day)]; day = day.AddDate(0, 0, -1) {
+		days++
+	}
+	for day := shift.Date.AddDate(0, 0, 1); worked[formatDate(day)]; day = day.AddDate(0, 0, 1) {
+		days++
+	}
+	if days <= r.maxDays {
+		return nil
+	}
+	return []RuleViolation{{
+		Rule:     ruleMaxConsecutiveDays,
+		Message:  fmt.Sprintf("%s would work %d days in a row, at most %d are allowed", shift.Username, days, r.maxDays),
+		Username: shift.Username,
+	}}
+}
+
+// weeklyHoursRule limits the hours worked in a calendar week
+type weeklyHoursRule struct {
+	maxHours float64
+}
+
+func (r weeklyHoursRule) Check(shift Shift, schedule []Shift) []RuleViolation {
+	year, week := shift.Date.ISOWeek()
+	total := shift.EndsAt.Sub(shift.StartsAt)
+	for _, s := range schedule {
+		if y, w := s.Date.ISOWeek(); y == year && w == week {
+			total += s.EndsAt.Sub(s.StartsAt)
+		}
+	}
+	if total.Hours() <= r.maxHours {
+		return nil
+	}
+	return []RuleViolation{{
+		Rule:     ruleMaxWeeklyHours,
+		Message:  fmt.Sprintf("%s would work %s in week %d, at most %gh are allowed", shift.Username, formatHours(total), week, r.maxHours),
+		Username: shift.Username,
+	}}
+}
+
+// formatHours formats a duration as hours, e.g. 7.5h
+func formatHours(d time.Duration) string {
+	return fmt.Sprintf("%gh", float64(d.Round(time.Minute))/float64(time.Hour))
+}
+
+// rules returns the rules of the store's tenant, tenants without own rules
+// use the configured defaults
+func (app *App) rules(store Store) (RuleSet, error) {
+	config, err := store.Rules()
+	if errors.Is(err, errRulesNotFound) {
+		return app.Config.Rules.ruleSet(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config.ruleSet(), nil
+}
+
+// swapCheck evaluates the rules for the owners of trade nodes taking over
+// other shifts, loading every user's schedule once
+type swapCheck struct {
+	store     Store
+	rules     RuleSet
+	schedules map[string][]Shift
+	err       error // first error loading a schedule
+}
+
+func newSwapCheck(store Store, rules RuleSet) *swapCheck {
+	return &swapCheck{store: store, rules: rules, schedules: make(map[string][]Shift)}
+}
+
+// schedule returns the shifts of a user
+func (c *swapCheck) schedule(username string) []Shift {
+	if shifts, ok := c.schedules[username]; ok {
+		return shifts
+	}
+	shifts, err := c.store.ListShifts(username)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	c.schedules[username] = shifts
+	return shifts
+}
+
+// violations returns the rules the owner of n breaks by handing n over and
+// taking other's shift, including a slot the owner already works
+func (c *swapCheck) violations(n, other tradeNode) []RuleViolation {
+	var received Shift
+	for _, s := range c.schedule(other.Username) {
+		if s.ID == other.ShiftID {
+			received = s
+		}
+	}
+	if received.ID == "" {
+		return nil
+	}
+
+	var schedule []Shift
+	for _, s := range c.schedule(n.Username) {
+		if s.ID != n.ShiftID {
+			schedule = append(schedule, s)
+		}
+	}
+	received.Username = n.Username
+	var violations []RuleViolation
+	if conflict := slotConflict(received, schedule); conflict != nil {
+		violations = append(violations, RuleViolation{
+			Rule:     ruleUniqueSlot,
+			Message:  fmt.Sprintf("%s already works the %s shift on %s", n.Username, conflict.Time, formatDate(conflict.Date)),
+			Username: n.Username,
+			Conflict: conflict.ID,
+		})
+	}
+	return append(violations, c.rules.check(received, schedule)...)
+}
+
+// allows reports whether the owner of n may take other's shift
+func (c *swapCheck) allows(n, other tradeNode) bool {
+	return len(c.violations(n, other)) == 0
+}
+
+// cycleViolations returns the violations of all owners in a trade cycle
+func (c *swapCheck) cycleViolations(cycle []tradeNode) []RuleViolation {
+	var violations []RuleViolation
+	for i, node := range cycle {
+		violations = append(violations, c.violations(node, cycle[(i+1)%len(cycle)])...)
+	}
+	return violations
+}
+
+// writeRuleViolations writes a 422 response listing the broken rules
+func writeRuleViolations(w http.ResponseWriter, violations []RuleViolation) {
+	sort.SliceStable(violations, func(i, j int) bool { return violations[i].Rule < violations[j].Rule })
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Working time rules violated",
+		"violations": violations,
+	})
+	if err != nil {
+		return
+	}
+}
+
+// Admin handler for /admin/rules
+func (app *App) adminRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permRulesManage); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.writeRules(w, r)
+	case http.MethodPut:
+		app.adminRulesPut(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) adminRulesPut(w http.ResponseWriter, r *http.Request) {
+	var config RuleConfig
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := config.validate(); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid rules: "+err.Error())
+		return
+	}
+
+	err = app.store(r).SetRules(config)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to update rules")
+		return
+	}
+
+	app.writeRules(w, r)
+}
+
+// writeRules responds with the rules in effect for the principal's tenant
+func (app *App) writeRules(w http.ResponseWriter, r *http.Request) {
+	config, err := app.store(r).Rules()
+	if errors.Is(err, errRulesNotFound) {
+		config, err = &app.Config.Rules, nil
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get rules")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(config)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ShiftType is a slot of the shift type catalogue, e.g. früh from 06:00 to 14:00
+type ShiftType struct {
+	Name     string   `json:"name"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Color    string   `json:"color"`
+	Position int      `json:"position"`
+	Skills   []string `json:"skills"` // required to work a shift of the type
+}
+
+// validate checks the times are HH:MM and the color is a hex color
+func (t ShiftType) validate() error {
+	if strings.TrimSpace(t.Name) == "" || strings.Contains(t.Name, "/") {
+		return errors.New("invalid name")
+	}
+	if _, err := time.Parse("15:04", t.Start); err != nil {
+		return errors.New("invalid start time")
+	}
+	if _, err := time.Parse("15:04", t.End); err != nil {
+		return errors.New("invalid end time")
+	}
+	if len(t.Color) != 7 || t.Color[0] != '#' || strings.Trim(strings.ToLower(t.Color[1:]), "0123456789abcdef") != "" {
+		return errors.New("invalid color")
+	}
+	return validateSkills(t.Skills)
+}
+
+// searchedSet turns a list of searched shift types into a lookup set
+func searchedSet(searched []string) map[string]bool {
+	set := make(map[string]bool, len(searched))
+	for _, name := range searched {
+		set[name] = true
+	}
+	return set
+}
+
+// isShiftType reports whether name is in the catalogue
+func isShiftType(types []ShiftType, name string) bool {
+	for _, t := range types {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// searchList builds the search payload with one entry per catalogue slot
+func searchList(types []ShiftType, selected map[string]bool, offers map[string]int) []map[string]interface{} {
+	search := make([]map[string]interface{}, 0, len(types))
+	for _, t := range types {
+		entry := map[string]interface{}{"name": t.Name, "selected": selected[t.Name]}
+		if offers != nil {
+			entry["offers"] = offers[t.Name]
+		}
+		search = append(search, entry)
+	}
+	return search
+}
+
+// Shift type handler for /shift-types
+func (app *App) shiftTypeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := requirePermission(w, r, permShiftsRead); !ok {
+			return
+		}
+		app.shiftTypeGet(w, r)
+	case http.MethodPost:
+		if _, ok := requirePermission(w, r, permShiftTypesManage); !ok {
+			return
+		}
+		app.shiftTypePost(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) shiftTypeGet(w http.ResponseWriter, r *http.Request) {
+	types, err := app.Store.ShiftTypes()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch shift types")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(types)
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) shiftTypePost(w http.ResponseWriter, r *http.Request) {
+	var shiftType ShiftType
+	err := json.NewDecoder(r.Body).Decode(&shiftType)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := shiftType.validate(); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid shift type: "+err.Error())
+		return
+	}
+	shiftType.Skills = mergeSkills(shiftType.Skills)
+
+	err = app.Store.CreateShiftType(shiftType)
+	if errors.Is(err, errShiftTypeExists) {
+		writeMessage(w, http.StatusConflict, "Shift type already exists")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to add shift type")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(shiftType)
+	if err != nil {
+		return
+	}
+}
+
+// Shift type handler for /shift-types/{name}
+func (app *App) shiftTypeByNameHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/shift-types/")
+	if name == "" || strings.Contains(name, "/") {
+		writeMessage(w, http.StatusBadRequest, "Invalid shift type")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := requirePermission(w, r, permShiftsRead); !ok {
+			return
+		}
+		app.shiftTypeByNameGet(w, r, name)
+	case http.MethodPut:
+		if _, ok := requirePermission(w, r, permShiftTypesManage); !ok {
+			return
+		}
+		app.shiftTypeByNamePut(w, r, name)
+	case http.MethodDelete:
+		if _, ok := requirePermission(w, r, permShiftTypesManage); !ok {
+			return
+		}
+		app.shiftTypeByNameDelete(w, r, name)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) shiftTypeByNameGet(w http.ResponseWriter, r *http.Request, name string) {
+	shiftType, err := app.Store.GetShiftType(name)
+	if errors.Is(err, errShiftTypeNotFound) {
+		writeMessage(w, http.StatusNotFound, "Shift type not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get shift type")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(shiftType)
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) shiftTypeByNamePut(w http.ResponseWriter, r *http.Request, name string) {
+	var shiftType ShiftType
+	err := json.NewDecoder(r.Body).Decode(&shiftType)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if shiftType.Name == "" {
+		shiftType.Name = name
+	}
+	if err := shiftType.validate(); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid shift type: "+err.Error())
+		return
+	}
+	shiftType.Skills = mergeSkills(shiftType.Skills)
+
+	err = app.Store.UpdateShiftType(name, shiftType)
+	if errors.Is(err, errShiftTypeNotFound) {
+		writeMessage(w, http.StatusNotFound, "Shift type not found")
+		return
+	}
+	if errors.Is(err, errShiftTypeExists) {
+		writeMessage(w, http.StatusConflict, "Shift type already exists")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to update shift type")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(shiftType)
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) shiftTypeByNameDelete(w http.ResponseWriter, r *http.Request, name string) {
+	err := app.Store.DeleteShiftType(name)
+	if errors.Is(err, errShiftTypeInUse) {
+		writeMessage(w, http.StatusConflict, "Shift type is still in use")
+		return
+	}
+	if errors.Is(err, errShiftTypeNotFound) {
+		writeMessage(w, http.StatusNotFound, "Shift type not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to delete shift type")
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "Shift type deleted successfully")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// UserSkills lists the qualifications of a user, e.g. a nursing certificate
+type UserSkills struct {
+	Username string   `json:"username"`
+	Skills   []string `json:"skills"`
+}
+
+// TradeExclusion explains why a shift matching a trade offer was left out
+// of the trade search
+type TradeExclusion struct {
+	Uid        string          `json:"uid"`
+	Username   string          `json:"username"`
+	Datum      string          `json:"datum"`
+	Time       string          `json:"time"`
+	Reason     string          `json:"reason"`
+	Missing    []string        `json:"missing,omitempty"`
+	Violations []RuleViolation `json:"violations,omitempty"`
+}
+
+// validateSkills checks that no skill name is blank
+func validateSkills(skills []string) error {
+	for _, skill := range skills {
+		if strings.TrimSpace(skill) == "" {
+			return errors.New("invalid skill")
+		}
+	}
+	return nil
+}
+
+// mergeSkills returns the sorted union of the given skill lists
+func mergeSkills(lists ...[]string) []string {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, skill := range list {
+			set[strings.TrimSpace(skill)] = true
+		}
+	}
+	skills := make([]string, 0, len(set))
+	for skill := range set {
+		skills = append(skills, skill)
+	}
+	sort.Strings(skills)
+	return skills
+}
+
+// missingSkills returns the skills a shift of the type requires that are not
+// in has
+func missingSkills(shiftType ShiftType, shift Shift, has map[string]bool) []string {
+	var missing []string
+	for _, skill := range mergeSkills(shiftType.Skills, shift.Skills) {
+		if !has[skill] {
+			missing = append(missing, skill)
+		}
+	}
+	return missing
+}
+
+// skillSet turns a list of skills into a lookup set
+func skillSet(skills []string) map[string]bool {
+	set := make(map[string]bool, len(skills))
+	for _, skill := range skills {
+		set[skill] = true
+	}
+	return set
+}
+
+// tradeExclusions lists the shifts that match the trade offer of the shift
+// with the given ID, or whose offer it matches, but cannot be traded with it
+// because one of the owners lacks a required skill or would break a rule
+// reported by check
+func tradeExclusions(nodes []tradeNode, startID string, check func(n, other tradeNode) []RuleViolation) []TradeExclusion {
+	var start *tradeNode
+	for i := range nodes {
+		if nodes[i].ShiftID == startID {
+			start = &nodes[i]
+		}
+	}
+	if start == nil {
+		return nil
+	}
+
+	var exclusions []TradeExclusion
+	for _, node := range nodes {
+		if node.ShiftID == startID {
+			continue
+		}
+		exclusion := TradeExclusion{Uid: node.ShiftID, Username: node.Username, Datum: node.Date, Time: node.Time}
+		switch {
+		case start.prefers(node) && len(start.missingSkills(node)) > 0:
+			exclusion.Reason = fmt.Sprintf("%s lacks skills required for the shift", start.Username)
+			exclusion.Missing = start.missingSkills(node)
+		case node.prefers(*start) && len(node.missingSkills(*start)) > 0:
+			exclusion.Reason = fmt.Sprintf("%s lacks skills required for your shift", node.Username)
+			exclusion.Missing = node.missingSkills(*start)
+		case start.wants(node) && len(check(*start, node)) > 0:
+			exclusion.Reason = fmt.Sprintf("%s would break working time rules with the shift", start.Username)
+			exclusion.Violations = check(*start, node)
+		case node.wants(*start) && len(check(node, *start)) > 0:
+			exclusion.Reason = fmt.Sprintf("%s would break working time rules with your shift", node.Username)
+			exclusion.Violations = check(node, *start)
+		default:
+			continue
+		}
+		exclusions = append(exclusions, exclusion)
+	}
+	return exclusions
+}
+
+func (app *App) adminUserSkillsGet(w http.ResponseWriter, r *http.Request, username string) {
+	skills, err := app.store(r).UserSkills(username)
+	if errors.Is(err, errUserNotFound) {
+		writeMessage(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get user skills")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(UserSkills{Username: username, Skills: skills})
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) adminUserSkillsPut(w http.ResponseWriter, r *http.Request, username string) {
+	var body UserSkills
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := validateSkills(body.Skills); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid skills: "+err.Error())
+		return
+	}
+
+	err = app.store(r).SetUserSkills(username, mergeSkills(body.Skills))
+	if errors.Is(err, errUserNotFound) {
+		writeMessage(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to update user skills")
+		return
+	}
+
+	app.adminUserSkillsGet(w, r, username)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteTimeLayout stores timestamps in UTC with a fixed width so that they
+// compare correctly as text
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000000"
+
+// sqliteQueryer runs the Postgres queries of sqlStore on SQLite. Row locks
+// are dropped since SQLite locks the whole database for a write transaction.
+type sqliteQueryer struct {
+	q queryer
+}
+
+func (s sqliteQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.q.Exec(sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (s sqliteQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.q.Query(sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func (s sqliteQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.q.QueryRow(sqliteQuery(query), sqliteArgs(args)...)
+}
+
+func sqliteQuery(query string) string {
+	return strings.ReplaceAll(query, " FOR UPDATE", "")
+}
+
+func sqliteArgs(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			arg = t.UTC().Format(sqliteTimeLayout)
+		}
+		converted[i] = arg
+	}
+	return converted
+}
+
+// sqliteDSN opens the database file with foreign keys enforced and waits for
+// locks instead of failing right away
+func sqliteDSN(path string) string {
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	return "file:" + path + "?" + params.Encode()
+}
+
+// isSQLiteUniqueViolation reports whether err is a failed UNIQUE or PRIMARY
+// KEY constraint, SQLite reports them with different codes
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
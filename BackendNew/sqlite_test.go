@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// newSQLiteStore migrates a fresh database file in the test's temp directory
+func newSQLiteStore(t *testing.T) Store {
+	t.Helper()
+	config := defaultConfig().Database
+	config.Driver = driverSQLite
+	config.Path = filepath.Join(t.TempDir(), "shifts.db")
+
+	db, err := sql.Open(config.Driver, config.connectionString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	if err := migrateUp(context.Background(), db, config.Driver, 0); err != nil {
+		t.Fatal(err)
+	}
+	return newSQLStore(db, config.Driver)
+}
+
+// TestSQLiteStore runs the handler tests against the SQLite backend
+func TestSQLiteStore(t *testing.T) {
+	runBackendTests(t, newSQLiteStore)
+}
+
+// backendTests are the handler tests every storage backend must pass
+var backendTests = []struct {
+	name string
+	run  func(t *testing.T)
+}{
+	{"RegistrationAndLogin", TestRegistrationAndLogin},
+	{"ExpiredSession", TestExpiredSession},
+	{"ShiftCRUD", TestShiftCRUD},
+	{"ShiftByIDPatchSwap", TestShiftByIDPatchSwap},
+	{"ShiftByIDPatchThreeWaySwap", TestShiftByIDPatchThreeWaySwap},
+	{"ShiftByIDPatchDecline", TestShiftByIDPatchDecline},
+	{"ShiftByIDPatchApproval", TestShiftByIDPatchApproval},
+	{"AtomicRollsBack", TestAtomicRollsBack},
+	{"TeamScopedTrades", TestTeamScopedTrades},
+	{"SupervisorScope", TestSupervisorScope},
+	{"TenantIsolation", TestTenantIsolation},
+	{"ShiftTypeRename", TestShiftTypeRename},
+	{"SkillRequirements", TestSkillRequirements},
+	{"WorkingTimeRules", TestWorkingTimeRules},
+	{"DoubleBooking", TestDoubleBooking},
+	{"OpenShifts", TestOpenShifts},
+	{"OpenShiftClaimRace", TestOpenShiftClaimRace},
+	{"EventStream", TestEventStream},
+	{"DashboardSocket", TestDashboardSocket},
+	{"CalendarFeed", TestCalendarFeed},
+	{"RosterImport", TestRosterImport},
+	{"ShiftBulk", TestShiftBulk},
+	{"ShiftBulkRace", TestShiftBulkRace},
+	{"TradeSwapRace", TestTradeSwapRace},
+	{"TradeApprovalExpiry", TestTradeApprovalExpiry},
+	{"TeamRotation", TestTeamRotation},
+}
+
+// runBackendTests runs the backend tests on stores returned by newStore
+func runBackendTests(t *testing.T, newStore func(t *testing.T) Store) {
+	previous := newTestStore
+	newTestStore = newStore
+	t.Cleanup(func() { newTestStore = previous })
+
+	for _, test := range backendTests {
+		t.Run(test.name, test.run)
+	}
+}
+
+func TestSQLiteMigrateDown(t *testing.T) {
+	db, err := sql.Open(driverSQLite, sqliteDSN(filepath.Join(t.TempDir(), "shifts.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations, err := loadMigrations(driverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := migrateUp(ctx, db, driverSQLite, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDown(ctx, db, driverSQLite, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	var tables int
+	err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name<>'schema_migrations'").Scan(&tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Fatalf("%d tables left after migrating down", tables)
+	}
+}
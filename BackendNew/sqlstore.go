@@ -0,0 +1,1763 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlStore implements Store on a SQL database, the queries are written for
+// Postgres and adapted to SQLite by sqliteQueryer
+type sqlStore struct {
+	db     *sql.DB // nil inside Atomic
+	q      queryer
+	driver string
+	tenant string // empty unless limited by ForTenant
+}
+
+var _ Store = (*sqlStore)(nil)
+
+func newSQLStore(db *sql.DB, driver string) *sqlStore {
+	s := &sqlStore{db: db, driver: driver}
+	s.q = s.pooled()
+	return s
+}
+
+// pooled returns the queryer of statements outside a transaction, Postgres
+// connections are limited to the store's tenant first
+func (s *sqlStore) pooled() queryer {
+	if s.driver == driverPostgres {
+		return tenantQueryer{db: s.db, tenant: s.rowTenant()}
+	}
+	return s.adapt(s.db)
+}
+
+// rowTenant returns the app.tenant setting that lets row-level security show
+// the rows of the store's tenant
+func (s *sqlStore) rowTenant() string {
+	if s.tenant == "" {
+		return allTenants
+	}
+	return s.tenant
+}
+
+// adapt wraps q for the dialect of the database
+func (s *sqlStore) adapt(q queryer) queryer {
+	if s.driver == driverSQLite {
+		return sqliteQueryer{q}
+	}
+	return q
+}
+
+func (s *sqlStore) Atomic(fn func(tx Store) error) error {
+	if s.db == nil {
+		return s.savepoint(fn)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil {
+
+		}
+	}(tx)
+
+	// Row-level security hides the rows of other tenants for the rest of
+	// the transaction
+	if s.driver == driverPostgres {
+		_, err = tx.Exec("SELECT set_config('app.tenant', $1, true)", s.rowTenant())
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := fn(&sqlStore{q: s.adapt(tx), driver: s.driver, tenant: s.tenant}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// savepoint runs fn inside the current transaction and rolls back its
+// changes only if it fails, Postgres aborts the whole transaction otherwise
+func (s *sqlStore) savepoint(fn func(tx Store) error) error {
+	if _, err := s.q.Exec("SAVEPOINT atomic"); err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		if _, rollbackErr := s.q.Exec("ROLLBACK TO SAVEPOINT atomic"); rollbackErr != nil {
+			return rollbackErr
+		}
+		_, _ = s.q.Exec("RELEASE SAVEPOINT atomic")
+		return err
+	}
+	_, err := s.q.Exec("RELEASE SAVEPOINT atomic")
+	return err
+}
+
+func (s *sqlStore) ForTenant(tenantID string) Store {
+	scoped := *s
+	scoped.tenant = tenantID
+	if s.db != nil {
+		scoped.q = scoped.pooled()
+	}
+	return &scoped
+}
+
+// tenantIs returns the condition limiting column to the store's tenant and
+// adds its argument to args, the condition holds for any tenant if the store
+// is not limited
+func (s *sqlStore) tenantIs(column string, args *[]interface{}) string {
+	if s.tenant == "" {
+		return "true"
+	}
+	*args = append(*args, s.tenant)
+	return fmt.Sprintf("%s=$%d", column, len(*args))
+}
+
+// tenantFor returns the tenant new rows are created in
+func (s *sqlStore) tenantFor(tenantID string) string {
+	if s.tenant != "" {
+		return s.tenant
+	}
+	if tenantID != "" {
+		return tenantID
+	}
+	return defaultTenant
+}
+
+// scopeIs returns the condition limiting shifts to the scope and adds its
+// arguments to args
+func scopeIs(scope ShiftScope, args *[]interface{}) string {
+	if scope.All {
+		return "true"
+	}
+	*args = append(*args, scope.Username)
+	condition := fmt.Sprintf("(username=$%d", len(*args))
+	for _, team := range scope.Teams {
+		*args = append(*args, team)
+		condition += fmt.Sprintf(" OR team=$%d", len(*args))
+	}
+	return condition + ")"
+}
+
+// nullString stores empty strings as NULL
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// teamMemberCondition limits a shift query to shifts without a team and
+// shifts whose owner is a member of their team
+const teamMemberCondition = "(shifts.team IS NULL OR EXISTS (SELECT 1 FROM team_members m WHERE m.tenant = shifts.tenant AND m.team = shifts.team AND m.username = shifts.username))"
+
+// uniqueViolation returns errConflict if err reports a violated unique
+// constraint and err otherwise
+func uniqueViolation(err error, errConflict error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return errConflict
+	}
+	if isSQLiteUniqueViolation(err) {
+		return errConflict
+	}
+	return err
+}
+
+// notReleasedCondition leaves out the shifts in the pool of open shifts
+const notReleasedCondition = "shiftID NOT IN (SELECT shiftID FROM open_shifts)"
+
+// affected returns errNotFound if the statement did not change any row
+func affected(result sql.Result, err error, errNotFound error) error {
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) Tenants() ([]Tenant, error) {
+	rows, err := s.q.Query("SELECT tenantID, name FROM tenants ORDER BY tenantID")
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		var tenant Tenant
+		if err := rows.Scan(&tenant.ID, &tenant.Name); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+func (s *sqlStore) GetTenant(tenantID string) (*Tenant, error) {
+	var tenant Tenant
+	err := s.q.QueryRow("SELECT tenantID, name FROM tenants WHERE tenantID=$1", tenantID).Scan(&tenant.ID, &tenant.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errTenantNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tenant, nil
+}
+
+func (s *sqlStore) CreateTenant(tenant Tenant) error {
+	result, err := s.q.Exec("INSERT INTO tenants (tenantID, name) VALUES ($1, $2) ON CONFLICT DO NOTHING", tenant.ID, tenant.Name)
+	return affected(result, err, errTenantExists)
+}
+
+func (s *sqlStore) CreateUser(username, passwordHash string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		q := ts.q
+		result, err := q.Exec("INSERT INTO user_base (username, password, tenant) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", username, passwordHash, ts.tenantFor(""))
+		if err := affected(result, err, errUserExists); err != nil {
+			return err
+		}
+
+		// New users start out as employees
+		_, err = q.Exec("INSERT INTO user_roles (username, role) VALUES ($1, $2)", username, roleEmployee)
+		return err
+	})
+}
+
+func (s *sqlStore) UserTenant(username string) (string, error) {
+	args := []interface{}{username}
+	query := "SELECT tenant FROM user_base WHERE username=$1 AND " + s.tenantIs("tenant", &args)
+	var tenantID string
+	err := s.q.QueryRow(query, args...).Scan(&tenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errUserNotFound
+	}
+	return tenantID, err
+}
+
+func (s *sqlStore) PasswordHash(username string) (string, error) {
+	args := []interface{}{username}
+	query := "SELECT password FROM user_base WHERE username=$1 AND " + s.tenantIs("tenant", &args)
+	var passwordHash string
+	err := s.q.QueryRow(query, args...).Scan(&passwordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errUserNotFound
+	}
+	return passwordHash, err
+}
+
+func (s *sqlStore) Usernames() ([]string, error) {
+	var args []interface{}
+	rows, err := s.q.Query("SELECT username FROM user_base WHERE "+s.tenantIs("tenant", &args)+" ORDER BY username", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+func (s *sqlStore) UserRoles(username string) ([]string, error) {
+	args := []interface{}{username}
+	query := `
+		SELECT r.role FROM user_base u LEFT JOIN user_roles r ON r.username = u.username
+		WHERE u.username=$1 AND ` + s.tenantIs("u.tenant", &args) + ` ORDER BY r.role
+	`
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	found := false
+	var roles []string
+	for rows.Next() {
+		var role sql.NullString
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		found = true
+		if role.Valid {
+			roles = append(roles, role.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errUserNotFound
+	}
+	if len(roles) == 0 {
+		roles = []string{roleEmployee}
+	}
+	return roles, nil
+}
+
+func (s *sqlStore) SetUserRoles(username string, roles []string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		q := ts.q
+		args := []interface{}{username}
+		query := "SELECT username FROM user_base WHERE username=$1 AND " + ts.tenantIs("tenant", &args) + " FOR UPDATE"
+		err := q.QueryRow(query, args...).Scan(&username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Exec("DELETE FROM user_roles WHERE username=$1", username)
+		if err != nil {
+			return err
+		}
+		for _, role := range roles {
+			_, err = q.Exec("INSERT INTO user_roles (username, role) VALUES ($1, $2) ON CONFLICT DO NOTHING", username, role)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) GrantRole(username, role string) error {
+	args := []interface{}{username, role}
+	query := "INSERT INTO user_roles (username, role) SELECT username, $2 FROM user_base WHERE username=$1 AND " + s.tenantIs("tenant", &args) + " ON CONFLICT DO NOTHING"
+	_, err := s.q.Exec(query, args...)
+	return err
+}
+
+func (s *sqlStore) UserSkills(username string) ([]string, error) {
+	if _, err := s.UserTenant(username); err != nil {
+		return nil, err
+	}
+	skills, err := s.loadSkills("SELECT username, skill FROM user_skills WHERE username=$1", username)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSkills(skills[username]), nil
+}
+
+func (s *sqlStore) SetUserSkills(username string, skills []string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		args := []interface{}{username}
+		query := "SELECT username FROM user_base WHERE username=$1 AND " + ts.tenantIs("tenant", &args) + " FOR UPDATE"
+		err := ts.q.QueryRow(query, args...).Scan(&username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = ts.q.Exec("DELETE FROM user_skills WHERE username=$1", username)
+		if err != nil {
+			return err
+		}
+		for _, skill := range skills {
+			_, err = ts.q.Exec("INSERT INTO user_skills (username, skill) VALUES ($1, $2) ON CONFLICT DO NOTHING", username, skill)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadSkills returns the skills selected by a query of key and skill pairs,
+// keyed by the first column
+func (s *sqlStore) loadSkills(query string, args ...interface{}) (map[string][]string, error) {
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	skills := make(map[string][]string)
+	for rows.Next() {
+		var key, skill string
+		if err := rows.Scan(&key, &skill); err != nil {
+			return nil, err
+		}
+		skills[key] = append(skills[key], skill)
+	}
+	return skills, rows.Err()
+}
+
+func (s *sqlStore) CreateSession(session Session) error {
+	_, err := s.q.Exec("INSERT INTO sessions (sessionID, tenant, username, timeout) VALUES ($1, $2, $3, $4)", session.ID, s.tenantFor(session.Tenant), session.Username, session.Expires)
+	return err
+}
+
+func (s *sqlStore) GetSession(sessionID string) (*Session, error) {
+	args := []interface{}{sessionID, time.Now()}
+	query := "SELECT sessionID, tenant, username, timeout FROM sessions WHERE sessionID=$1 AND timeout > $2 AND " + s.tenantIs("tenant", &args)
+	var session Session
+	err := s.q.QueryRow(query, args...).Scan(&session.ID, &session.Tenant, &session.Username, &session.Expires)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *sqlStore) DeleteSession(sessionID string) error {
+	args := []interface{}{sessionID}
+	_, err := s.q.Exec("DELETE FROM sessions WHERE sessionID=$1 AND "+s.tenantIs("tenant", &args), args...)
+	return err
+}
+
+// loadShifts loads the shifts matching the given condition with their
+// searches and trade targets; suffix is appended to the shift query
+func (s *sqlStore) loadShifts(condition, suffix string, args ...interface{}) ([]Shift, error) {
+	condition = "(" + condition + ") AND " + s.tenantIs("shifts.tenant", &args)
+	query := "SELECT shiftID, tenant, username, team, date, time, starts_at, ends_at, TRADE, no_giveback, sequence, generated, shiftID IN (SELECT shiftID FROM open_shifts) FROM shifts WHERE " + condition + " " + suffix
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	shifts := []Shift{}
+	for rows.Next() {
+		var shift Shift
+		var username, team sql.NullString
+		var startsAt, endsAt sql.NullTime
+		err := rows.Scan(&shift.ID, &shift.Tenant, &username, &team, &shift.Date, &shift.Time, &startsAt, &endsAt, &shift.Trade, &shift.NoGiveback, &shift.Sequence, &shift.Generated, &shift.Released)
+		if err != nil {
+			return nil, err
+		}
+		shift.Username, shift.Team = username.String, team.String
+		shift.StartsAt, shift.EndsAt = startsAt.Time, endsAt.Time
+		shifts = append(shifts, shift)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	searches, err := s.loadSearches("SELECT shiftID FROM shifts WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := s.loadTradeTargets("SELECT shiftID FROM shifts WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	skills, err := s.loadSkills("SELECT shiftID, skill FROM shift_skills WHERE shiftID IN (SELECT shiftID FROM shifts WHERE "+condition+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range shifts {
+		shifts[i].Search = searches[shifts[i].ID]
+		shifts[i].Targets = targets[shifts[i].ID]
+		shifts[i].Skills = mergeSkills(skills[shifts[i].ID])
+	}
+	return shifts, nil
+}
+
+func (s *sqlStore) ListShifts(username string) ([]Shift, error) {
+	return s.loadShifts("username=$1", "ORDER BY date, starts_at", username)
+}
+
+func (s *sqlStore) GetShift(scope ShiftScope, shiftID string) (*Shift, error) {
+	args := []interface{}{shiftID}
+	shifts, err := s.loadShifts("shiftID=$1 AND "+scopeIs(scope, &args), "", args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(shifts) == 0 {
+		return nil, errShiftNotFound
+	}
+	return &shifts[0], nil
+}
+
+func (s *sqlStore) CreateShift(shift Shift) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		// A taken slot skips the insert instead of failing it, so that the
+		// surrounding transaction stays usable on Postgres
+		result, err := ts.q.Exec("INSERT INTO shifts (shiftID, tenant, username, team, date, time, starts_at, ends_at, TRADE, generated) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT DO NOTHING",
+			shift.ID, ts.tenantFor(shift.Tenant), nullString(shift.Username), nullString(shift.Team), formatDate(shift.Date), shift.Time, shift.StartsAt, shift.EndsAt, shift.Trade, shift.Generated)
+		if err := affected(result, err, errShiftConflict); err != nil {
+			return err
+		}
+		if err := ts.saveShiftSkills(shift); err != nil {
+			return err
+		}
+		return ts.saveOffer(shift)
+	})
+}
+
+func (s *sqlStore) UpdateShift(scope ShiftScope, shift Shift) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		args := []interface{}{formatDate(shift.Date), shift.Time, shift.StartsAt, shift.EndsAt, shift.Trade, nullString(shift.Team), shift.ID}
+		query := "UPDATE shifts SET date=$1, time=$2, starts_at=$3, ends_at=$4, TRADE=$5, team=COALESCE($6, team), sequence=sequence+1 WHERE shiftID=$7 AND " + scopeIs(scope, &args) + " AND " + ts.tenantIs("tenant", &args)
+		result, err := ts.q.Exec(query, args...)
+		if err := affected(result, uniqueViolation(err, errShiftConflict), errShiftNotFound); err != nil {
+			return err
+		}
+		if shift.Skills != nil {
+			if err := ts.saveShiftSkills(shift); err != nil {
+				return err
+			}
+		}
+		return ts.saveOffer(shift)
+	})
+}
+
+func (s *sqlStore) ListOpenShifts() ([]OpenShift, error) {
+	return s.loadOpenShifts("", "")
+}
+
+func (s *sqlStore) GetOpenShift(shiftID string) (*OpenShift, error) {
+	open, err := s.loadOpenShifts("WHERE shiftID=$1", "FOR UPDATE", shiftID)
+	if err != nil {
+		return nil, err
+	}
+	if len(open) == 0 {
+		return nil, errShiftNotOpen
+	}
+	return &open[0], nil
+}
+
+// loadOpenShifts loads the postings matching the given condition together
+// with their shifts, suffix is appended to the posting query
+func (s *sqlStore) loadOpenShifts(condition, suffix string, args ...interface{}) ([]OpenShift, error) {
+	rows, err := s.q.Query("SELECT shiftID, released_by, released, pickup_only FROM open_shifts "+condition+" "+suffix, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	postings := make(map[string]OpenShift)
+	for rows.Next() {
+		var open OpenShift
+		var shiftID string
+		var releasedBy sql.NullString
+		if err := rows.Scan(&shiftID, &releasedBy, &open.Released, &open.PickupOnly); err != nil {
+			return nil, err
+		}
+		open.ReleasedBy = releasedBy.String
+		postings[shiftID] = open
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	shifts, err := s.loadShifts("shiftID IN (SELECT shiftID FROM open_shifts "+condition+")", "ORDER BY date, starts_at, shiftID", args...)
+	if err != nil {
+		return nil, err
+	}
+	open := []OpenShift{}
+	for _, shift := range shifts {
+		posting := postings[shift.ID]
+		posting.Shift = shift
+		open = append(open, posting)
+	}
+	return open, nil
+}
+
+func (s *sqlStore) ReleaseShift(open OpenShift) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		args := []interface{}{open.Shift.ID}
+		query := "UPDATE shifts SET TRADE=false WHERE shiftID=$1 AND " + ts.tenantIs("tenant", &args)
+		result, err := ts.q.Exec(query, args...)
+		if err := affected(result, err, errShiftNotFound); err != nil {
+			return err
+		}
+		if err := ts.saveOffer(Shift{ID: open.Shift.ID}); err != nil {
+			return err
+		}
+		result, err = ts.q.Exec("INSERT INTO open_shifts (shiftID, released_by, released, pickup_only) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			open.Shift.ID, nullString(open.ReleasedBy), open.Released, open.PickupOnly)
+		return affected(result, err, errShiftReleased)
+	})
+}
+
+func (s *sqlStore) WithdrawShift(shiftID string) error {
+	args := []interface{}{shiftID}
+	query := "DELETE FROM open_shifts WHERE shiftID=$1 AND shiftID IN (SELECT shiftID FROM shifts WHERE " + s.tenantIs("tenant", &args) + ")"
+	result, err := s.q.Exec(query, args...)
+	return affected(result, err, errShiftNotOpen)
+}
+
+func (s *sqlStore) ClaimShift(shiftID, username string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		open, err := ts.GetOpenShift(shiftID)
+		if err != nil {
+			return err
+		}
+		if err := ts.cancelCalendarEvents("shiftID=$1", shiftID); err != nil {
+			return err
+		}
+		_, err = ts.q.Exec("UPDATE shifts SET username=$1, TRADE=false, no_giveback=$2, generated=false, sequence=sequence+1 WHERE shiftID=$3", username, open.PickupOnly, shiftID)
+		if err != nil {
+			return uniqueViolation(err, errShiftConflict)
+		}
+		if err := ts.saveOffer(Shift{ID: shiftID}); err != nil {
+			return err
+		}
+		_, err = ts.q.Exec("DELETE FROM open_shifts WHERE shiftID=$1", shiftID)
+		return err
+	})
+}
+
+func (s *sqlStore) ListTeamShifts(team string) ([]Shift, error) {
+	args := []interface{}{team}
+	return s.loadShifts("team=$1 AND "+s.tenantIs("tenant", &args), "ORDER BY date, starts_at, username", args...)
+}
+
+// saveShiftSkills replaces the skills required by a shift
+func (s *sqlStore) saveShiftSkills(shift Shift) error {
+	_, err := s.q.Exec("DELETE FROM shift_skills WHERE shiftID=$1", shift.ID)
+	if err != nil {
+		return err
+	}
+	for _, skill := range shift.Skills {
+		_, err = s.q.Exec("INSERT INTO shift_skills (shiftID, skill) VALUES ($1, $2) ON CONFLICT DO NOTHING", shift.ID, skill)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveOffer replaces the searches and trade targets of a shift
+func (s *sqlStore) saveOffer(shift Shift) error {
+	_, err := s.q.Exec("DELETE FROM shift_searches WHERE shiftID=$1", shift.ID)
+	if err != nil {
+		return err
+	}
+	for shiftType, selected := range shift.Search {
+		if !selected {
+			continue
+		}
+		_, err = s.q.Exec("INSERT INTO shift_searches (shiftID, shift_type) VALUES ($1, $2) ON CONFLICT DO NOTHING", shift.ID, shiftType)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.q.Exec("DELETE FROM shift_trade_targets WHERE shiftID=$1", shift.ID)
+	if err != nil {
+		return err
+	}
+	for _, target := range shift.Targets {
+		to := target.To
+		if to == "" {
+			to = target.From
+		}
+		if len(target.Times) == 0 {
+			_, err = s.q.Exec("INSERT INTO shift_trade_targets (shiftID, date_from, date_to, time) VALUES ($1, $2, $3, NULL)", shift.ID, target.From, to)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, timeV := range target.Times {
+			_, err = s.q.Exec("INSERT INTO shift_trade_targets (shiftID, date_from, date_to, time) VALUES ($1, $2, $3, $4)", shift.ID, target.From, to, timeV)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteShift(scope ShiftScope, shiftID string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		args := []interface{}{shiftID}
+		condition := "shiftID=$1 AND " + scopeIs(scope, &args) + " AND " + ts.tenantIs("tenant", &args)
+		if err := ts.cancelCalendarEvents(condition, args...); err != nil {
+			return err
+		}
+		result, err := ts.q.Exec("DELETE FROM shifts WHERE "+condition, args...)
+		return affected(result, err, errShiftNotFound)
+	})
+}
+
+// cancelCalendarEvents records the owned shifts matching condition as
+// cancelled in their owners' calendars, one change after their current one
+func (s *sqlStore) cancelCalendarEvents(condition string, args ...interface{}) error {
+	args = append(args[:len(args):len(args)], time.Now())
+	query := fmt.Sprintf(`INSERT INTO calendar_cancellations (shiftID, username, date, time, starts_at, ends_at, sequence, cancelled)
+		SELECT shiftID, username, date, time, starts_at, ends_at, sequence+1, $%d FROM shifts WHERE username IS NOT NULL AND (%s)
+		ON CONFLICT (shiftID, username) DO UPDATE SET date=excluded.date, time=excluded.time, starts_at=excluded.starts_at, ends_at=excluded.ends_at, sequence=excluded.sequence, cancelled=excluded.cancelled`,
+		len(args), condition)
+	_, err := s.q.Exec(query, args...)
+	return err
+}
+
+func (s *sqlStore) CountOffers(date, team string) (map[string]int, error) {
+	args := []interface{}{date, team}
+	query := "SELECT time, count(*) FROM shifts WHERE date=$1 AND trade=true AND COALESCE(team, '')=$2 AND " + teamMemberCondition + " AND " + s.tenantIs("tenant", &args) + " GROUP BY time"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	offers := make(map[string]int)
+	for rows.Next() {
+		var timeV string
+		var count int
+		if err := rows.Scan(&timeV, &count); err != nil {
+			return nil, err
+		}
+		offers[timeV] = count
+	}
+	return offers, rows.Err()
+}
+
+// loadSearches returns the searched shift types of all shifts selected by the
+// given subquery, keyed by shift ID
+func (s *sqlStore) loadSearches(shiftQuery string, args ...interface{}) (map[string]map[string]bool, error) {
+	rows, err := s.q.Query("SELECT shiftID, shift_type FROM shift_searches WHERE shiftID IN ("+shiftQuery+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	searches := make(map[string]map[string]bool)
+	for rows.Next() {
+		var shiftID, shiftType string
+		if err := rows.Scan(&shiftID, &shiftType); err != nil {
+			return nil, err
+		}
+		if searches[shiftID] == nil {
+			searches[shiftID] = make(map[string]bool)
+		}
+		searches[shiftID][shiftType] = true
+	}
+	return searches, rows.Err()
+}
+
+// loadTradeTargets returns the trade targets of all shifts selected by the
+// given subquery, keyed by shift ID
+func (s *sqlStore) loadTradeTargets(shiftQuery string, args ...interface{}) (map[string][]TradeTarget, error) {
+	rows, err := s.q.Query("SELECT shiftID, date_from, date_to, time FROM shift_trade_targets WHERE shiftID IN ("+shiftQuery+") ORDER BY shiftID, date_from, date_to", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	targets := make(map[string][]TradeTarget)
+	for rows.Next() {
+		var shiftID string
+		var fromDate, toDate time.Time
+		var timeV sql.NullString
+		err := rows.Scan(&shiftID, &fromDate, &toDate, &timeV)
+		if err != nil {
+			return nil, err
+		}
+		from, to := formatDate(fromDate), formatDate(toDate)
+
+		// Rows of the same range are folded back into one target
+		list := targets[shiftID]
+		if n := len(list); n > 0 && list[n-1].From == from && list[n-1].To == to && timeV.Valid && len(list[n-1].Times) > 0 {
+			list[n-1].Times = append(list[n-1].Times, timeV.String)
+		} else {
+			target := TradeTarget{From: from, To: to}
+			if timeV.Valid {
+				target.Times = []string{timeV.String}
+			}
+			list = append(list, target)
+		}
+		targets[shiftID] = list
+	}
+	return targets, rows.Err()
+}
+
+func (s *sqlStore) ShiftTypes() ([]ShiftType, error) {
+	rows, err := s.q.Query("SELECT name, start_time, end_time, color, position FROM shift_types ORDER BY position, name")
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	types := []ShiftType{}
+	for rows.Next() {
+		var t ShiftType
+		if err := rows.Scan(&t.Name, &t.Start, &t.End, &t.Color, &t.Position); err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	skills, err := s.loadSkills("SELECT shift_type, skill FROM shift_type_skills")
+	if err != nil {
+		return nil, err
+	}
+	for i := range types {
+		types[i].Skills = mergeSkills(skills[types[i].Name])
+	}
+	return types, nil
+}
+
+func (s *sqlStore) GetShiftType(name string) (*ShiftType, error) {
+	var shiftType ShiftType
+	err := s.q.QueryRow("SELECT name, start_time, end_time, color, position FROM shift_types WHERE name=$1", name).
+		Scan(&shiftType.Name, &shiftType.Start, &shiftType.End, &shiftType.Color, &shiftType.Position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errShiftTypeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	skills, err := s.loadSkills("SELECT shift_type, skill FROM shift_type_skills WHERE shift_type=$1", name)
+	if err != nil {
+		return nil, err
+	}
+	shiftType.Skills = mergeSkills(skills[name])
+	return &shiftType, nil
+}
+
+func (s *sqlStore) CreateShiftType(shiftType ShiftType) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		result, err := ts.q.Exec("INSERT INTO shift_types (name, start_time, end_time, color, position) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING",
+			shiftType.Name, shiftType.Start, shiftType.End, shiftType.Color, shiftType.Position)
+		if err := affected(result, err, errShiftTypeExists); err != nil {
+			return err
+		}
+		return ts.saveShiftTypeSkills(shiftType)
+	})
+}
+
+// saveShiftTypeSkills replaces the skills required by a shift type
+func (s *sqlStore) saveShiftTypeSkills(shiftType ShiftType) error {
+	_, err := s.q.Exec("DELETE FROM shift_type_skills WHERE shift_type=$1", shiftType.Name)
+	if err != nil {
+		return err
+	}
+	for _, skill := range shiftType.Skills {
+		_, err = s.q.Exec("INSERT INTO shift_type_skills (shift_type, skill) VALUES ($1, $2) ON CONFLICT DO NOTHING", shiftType.Name, skill)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdateShiftType(name string, shiftType ShiftType) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+
+		// Searches follow a rename through the foreign key, shifts, trade
+		// targets and rotations refer to the slot by name and are renamed here
+		result, err := ts.q.Exec("UPDATE shift_types SET name=$1, start_time=$2, end_time=$3, color=$4, position=$5 WHERE name=$6",
+			shiftType.Name, shiftType.Start, shiftType.End, shiftType.Color, shiftType.Position, name)
+		if err := affected(result, uniqueViolation(err, errShiftTypeExists), errShiftTypeNotFound); err != nil {
+			return err
+		}
+		if shiftType.Name != name {
+			_, err = ts.q.Exec("UPDATE shifts SET time=$1 WHERE time=$2", shiftType.Name, name)
+			if err != nil {
+				return err
+			}
+			_, err = ts.q.Exec("UPDATE shift_trade_targets SET time=$1 WHERE time=$2", shiftType.Name, name)
+			if err != nil {
+				return err
+			}
+			_, err = ts.q.Exec("UPDATE rotation_days SET time=$1 WHERE time=$2", shiftType.Name, name)
+			if err != nil {
+				return err
+			}
+		}
+		if err := ts.saveShiftTypeSkills(shiftType); err != nil {
+			return err
+		}
+		return ts.recomputeShiftTimes(shiftType)
+	})
+}
+
+// recomputeShiftTimes updates start and end of all shifts of the given type
+func (s *sqlStore) recomputeShiftTimes(shiftType ShiftType) error {
+	rows, err := s.q.Query("SELECT shiftID, date FROM shifts WHERE time=$1", shiftType.Name)
+	if err != nil {
+		return err
+	}
+	dates := make(map[string]time.Time)
+	for rows.Next() {
+		var shiftID string
+		var date time.Time
+		if err := rows.Scan(&shiftID, &date); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		dates[shiftID] = date
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for shiftID, date := range dates {
+		day, err := parseDate(formatDate(date))
+		if err != nil {
+			return err
+		}
+		startsAt, endsAt := shiftTimes(day, shiftType)
+		_, err = s.q.Exec("UPDATE shifts SET starts_at=$1, ends_at=$2, sequence=sequence+1 WHERE shiftID=$3", startsAt, endsAt, shiftID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteShiftType(name string) error {
+	return s.Atomic(func(tx Store) error {
+		q := tx.(*sqlStore).q
+		var inUse int
+		err := q.QueryRow("SELECT (SELECT count(*) FROM shifts WHERE time=$1) + (SELECT count(*) FROM rotation_days WHERE time=$1)", name).Scan(&inUse)
+		if err != nil {
+			return err
+		}
+		if inUse > 0 {
+			return errShiftTypeInUse
+		}
+
+		result, err := q.Exec("DELETE FROM shift_types WHERE name=$1", name)
+		return affected(result, err, errShiftTypeNotFound)
+	})
+}
+
+func (s *sqlStore) Teams() ([]Team, error) {
+	var args []interface{}
+	query := "SELECT name, department FROM teams WHERE " + s.tenantIs("tenant", &args) + " ORDER BY department, name"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	teams := []Team{}
+	for rows.Next() {
+		var team Team
+		if err := rows.Scan(&team.Name, &team.Department); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := s.teamMembers("true")
+	if err != nil {
+		return nil, err
+	}
+	for i := range teams {
+		teams[i].Members = append([]string{}, members[teams[i].Name]...)
+	}
+	return teams, nil
+}
+
+func (s *sqlStore) GetTeam(name string) (*Team, error) {
+	var team Team
+	args := []interface{}{name}
+	query := "SELECT name, department FROM teams WHERE name=$1 AND " + s.tenantIs("tenant", &args)
+	err := s.q.QueryRow(query, args...).Scan(&team.Name, &team.Department)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errTeamNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.teamMembers("m.team=$1", name)
+	if err != nil {
+		return nil, err
+	}
+	team.Members = append([]string{}, members[team.Name]...)
+	return &team, nil
+}
+
+// teamMembers returns the usernames of the members of the store's teams
+// matching condition, keyed by team name
+func (s *sqlStore) teamMembers(condition string, args ...interface{}) (map[string][]string, error) {
+	query := "SELECT m.team, m.username FROM team_members m WHERE " + condition + " AND " + s.tenantIs("m.tenant", &args) + " ORDER BY m.team, m.username"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	members := make(map[string][]string)
+	for rows.Next() {
+		var team, username string
+		if err := rows.Scan(&team, &username); err != nil {
+			return nil, err
+		}
+		members[team] = append(members[team], username)
+	}
+	return members, rows.Err()
+}
+
+func (s *sqlStore) UserTeams(username string) ([]string, error) {
+	args := []interface{}{username}
+	query := "SELECT team FROM team_members WHERE username=$1 AND " + s.tenantIs("tenant", &args) + " ORDER BY team"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	teams := []string{}
+	for rows.Next() {
+		var team string
+		if err := rows.Scan(&team); err != nil {
+			return nil, err
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+func (s *sqlStore) CreateTeam(team Team) error {
+	result, err := s.q.Exec("INSERT INTO teams (tenant, name, department) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", s.tenantFor(""), team.Name, team.Department)
+	return affected(result, err, errTeamExists)
+}
+
+func (s *sqlStore) UpdateTeam(name string, team Team) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		if team.Name != name {
+			var exists int
+			args := []interface{}{team.Name}
+			query := "SELECT count(*) FROM teams WHERE name=$1 AND " + ts.tenantIs("tenant", &args)
+			err := ts.q.QueryRow(query, args...).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists > 0 {
+				return errTeamExists
+			}
+		}
+
+		// Members and rotations follow a rename through their foreign keys
+		args := []interface{}{team.Name, team.Department, name}
+		query := "UPDATE teams SET name=$1, department=$2 WHERE name=$3 AND " + ts.tenantIs("tenant", &args)
+		result, err := ts.q.Exec(query, args...)
+		if err := affected(result, err, errTeamNotFound); err != nil {
+			return err
+		}
+		// The team of a shift is only a foreign key on Postgres
+		args = []interface{}{team.Name, name}
+		_, err = ts.q.Exec("UPDATE shifts SET team=$1 WHERE team=$2 AND "+ts.tenantIs("tenant", &args), args...)
+		return err
+	})
+}
+
+func (s *sqlStore) DeleteTeam(name string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		var inUse int
+		args := []interface{}{name}
+		err := ts.q.QueryRow("SELECT count(*) FROM shifts WHERE team=$1 AND "+ts.tenantIs("tenant", &args), args...).Scan(&inUse)
+		if err != nil {
+			return err
+		}
+		if inUse > 0 {
+			return errTeamInUse
+		}
+
+		args = []interface{}{name}
+		result, err := ts.q.Exec("DELETE FROM teams WHERE name=$1 AND "+ts.tenantIs("tenant", &args), args...)
+		return affected(result, err, errTeamNotFound)
+	})
+}
+
+func (s *sqlStore) AddTeamMember(team, username string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		var tenant string
+		args := []interface{}{team}
+		query := "SELECT tenant FROM teams WHERE name=$1 AND " + ts.tenantIs("tenant", &args)
+		err := ts.q.QueryRow(query, args...).Scan(&tenant)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errTeamNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// Members come from the tenant of their team
+		err = ts.q.QueryRow("SELECT username FROM user_base WHERE username=$1 AND tenant=$2", username, tenant).Scan(&username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = ts.q.Exec("INSERT INTO team_members (tenant, team, username) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", tenant, team, username)
+		return err
+	})
+}
+
+func (s *sqlStore) RemoveTeamMember(team, username string) error {
+	args := []interface{}{team, username}
+	query := "DELETE FROM team_members WHERE team=$1 AND username=$2 AND " + s.tenantIs("tenant", &args)
+	result, err := s.q.Exec(query, args...)
+	return affected(result, err, errNotTeamMember)
+}
+
+func (s *sqlStore) Rules() (*RuleConfig, error) {
+	var config RuleConfig
+	err := s.q.QueryRow("SELECT min_rest_hours, max_consecutive_days, max_weekly_hours, no_double_booking FROM tenant_rules WHERE tenant=$1", s.tenantFor("")).
+		Scan(&config.MinRestHours, &config.MaxConsecutiveDays, &config.MaxWeeklyHours, &config.NoDoubleBooking)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errRulesNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (s *sqlStore) SetRules(config RuleConfig) error {
+	_, err := s.q.Exec(`
+		INSERT INTO tenant_rules (tenant, min_rest_hours, max_consecutive_days, max_weekly_hours, no_double_booking) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant) DO UPDATE SET min_rest_hours=excluded.min_rest_hours, max_consecutive_days=excluded.max_consecutive_days,
+			max_weekly_hours=excluded.max_weekly_hours, no_double_booking=excluded.no_double_booking
+	`, s.tenantFor(""), config.MinRestHours, config.MaxConsecutiveDays, config.MaxWeeklyHours, config.NoDoubleBooking)
+	return err
+}
+
+func (s *sqlStore) ExpireTrades() error {
+	_, err := s.q.Exec("UPDATE trades SET status=$1 WHERE status IN ($2, $3) AND expires <= $4", tradeExpired, tradePending, tradeAwaitingApproval, time.Now())
+	return err
+}
+
+func (s *sqlStore) TradeGraph() ([]tradeNode, error) {
+	return s.loadTradeNodes(`TRADE=true AND `+teamMemberCondition+` AND `+notReleasedCondition+` AND shiftID NOT IN (
+		SELECT p.shiftID FROM trade_participants p JOIN trades t ON t.tradeID = p.tradeID
+		WHERE t.status IN ('pending', 'awaiting_approval') AND t.expires > $1
+	)`, time.Now())
+}
+
+func (s *sqlStore) TradeNodes(tradeID string) ([]tradeNode, error) {
+	return s.loadTradeNodes("TRADE=true AND "+teamMemberCondition+" AND "+notReleasedCondition+" AND shiftID IN (SELECT shiftID FROM trade_participants WHERE tradeID=$1)", tradeID)
+}
+
+// loadTradeNodes loads and locks the shifts matching the given condition
+func (s *sqlStore) loadTradeNodes(condition string, args ...interface{}) ([]tradeNode, error) {
+	shifts, err := s.loadShifts(condition, "ORDER BY shiftID FOR UPDATE", args...)
+	if err != nil {
+		return nil, err
+	}
+	typeSkills, err := s.loadSkills("SELECT shift_type, skill FROM shift_type_skills")
+	if err != nil {
+		return nil, err
+	}
+	userSkills, err := s.loadSkills("SELECT username, skill FROM user_skills WHERE username IN (SELECT username FROM shifts WHERE TRADE=true)")
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]tradeNode, len(shifts))
+	for i, shift := range shifts {
+		nodes[i] = newTradeNode(shift, typeSkills[shift.Time], skillSet(userSkills[shift.Username]))
+	}
+	return nodes, nil
+}
+
+func (s *sqlStore) CreateTrade(cycle []tradeNode, ttl time.Duration) (string, error) {
+	tradeID := generateSessionID()
+	err := s.Atomic(func(tx Store) error {
+		q := tx.(*sqlStore).q
+		now := time.Now()
+		_, err := q.Exec("INSERT INTO trades (tradeID, status, created, expires) VALUES ($1, $2, $3, $4)", tradeID, tradePending, now, now.Add(ttl))
+		if err != nil {
+			return err
+		}
+
+		for i, node := range cycle {
+			next := cycle[(i+1)%len(cycle)]
+			_, err = q.Exec("INSERT INTO trade_participants (tradeID, position, shiftID, username, receives, decision) VALUES ($1, $2, $3, $4, $5, $6)",
+				tradeID, i, node.ShiftID, node.Username, next.ShiftID, decisionPending)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return tradeID, nil
+}
+
+// GetTrade loads a trade with its participants, ordered along the cycle
+func (s *sqlStore) GetTrade(tradeID string) (*Trade, error) {
+	args := []interface{}{tradeID}
+	query := `
+		SELECT t.tradeID, t.status, t.created, t.expires, t.reviewer, p.username, p.decision,
+			g.shiftID, g.date, g.time, r.shiftID, r.date, r.time
+		FROM trades t
+		JOIN trade_participants p ON p.tradeID = t.tradeID
+		JOIN shifts g ON g.shiftID = p.shiftID
+		JOIN shifts r ON r.shiftID = p.receives
+		WHERE t.tradeID=$1 AND ` + s.tenantIs("g.tenant", &args) + `
+		ORDER BY p.position
+	`
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	var trade *Trade
+	for rows.Next() {
+		var t Trade
+		var p TradeParticipant
+		var reviewer sql.NullString
+		var givesDate, receivesDate time.Time
+		err := rows.Scan(&t.Uid, &t.Status, &t.Created, &t.Expires, &reviewer, &p.Username, &p.Decision,
+			&p.Gives.Uid, &givesDate, &p.Gives.Time,
+			&p.Receives.Uid, &receivesDate, &p.Receives.Time)
+		if err != nil {
+			return nil, err
+		}
+		p.Gives.Datum, p.Gives.Day = formatDate(givesDate), weekdayName(givesDate)
+		p.Receives.Datum, p.Receives.Day = formatDate(receivesDate), weekdayName(receivesDate)
+		if trade == nil {
+			t.Reviewer = reviewer.String
+			trade = &t
+		}
+		trade.Participants = append(trade.Participants, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if trade == nil {
+		return nil, errTradeNotFound
+	}
+	return trade, nil
+}
+
+func (s *sqlStore) ListTrades(username string) ([]*Trade, error) {
+	return s.loadTrades("SELECT tradeID FROM trade_participants WHERE username=$1", username)
+}
+
+func (s *sqlStore) ListTradesByStatus(status string) ([]*Trade, error) {
+	return s.loadTrades("SELECT tradeID FROM trades WHERE status=$1", status)
+}
+
+// loadTrades loads all trades selected by the given subquery, newest first
+func (s *sqlStore) loadTrades(tradeQuery string, args ...interface{}) ([]*Trade, error) {
+	rows, err := s.q.Query("SELECT tradeID FROM trades WHERE tradeID IN ("+tradeQuery+") ORDER BY created DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	var tradeIDs []string
+	for rows.Next() {
+		var tradeID string
+		if err := rows.Scan(&tradeID); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		tradeIDs = append(tradeIDs, tradeID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	trades := []*Trade{}
+	for _, tradeID := range tradeIDs {
+		trade, err := s.GetTrade(tradeID)
+		if errors.Is(err, errTradeNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+	return trades, nil
+}
+
+func (s *sqlStore) TradeStatus(tradeID string) (string, error) {
+	args := []interface{}{tradeID}
+	query := `SELECT status FROM trades WHERE tradeID=$1 AND tradeID IN (
+		SELECT p.tradeID FROM trade_participants p JOIN shifts s ON s.shiftID = p.shiftID WHERE ` + s.tenantIs("s.tenant", &args) + `
+	) FOR UPDATE`
+	var status string
+	err := s.q.QueryRow(query, args...).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errTradeNotFound
+	}
+	return status, err
+}
+
+func (s *sqlStore) SetTradeStatus(tradeID, status string) error {
+	_, err := s.q.Exec("UPDATE trades SET status=$1 WHERE tradeID=$2", status, tradeID)
+	return err
+}
+
+func (s *sqlStore) RequestTradeApproval(tradeID string, expires time.Time) error {
+	_, err := s.q.Exec("UPDATE trades SET status=$1, expires=$2 WHERE tradeID=$3", tradeAwaitingApproval, expires, tradeID)
+	return err
+}
+
+func (s *sqlStore) SetTradeReviewer(tradeID, reviewer string) error {
+	result, err := s.q.Exec("UPDATE trades SET reviewer=$1 WHERE tradeID=$2 AND NOT EXISTS (SELECT 1 FROM trade_participants WHERE tradeID=$2 AND username=$1)", reviewer, tradeID)
+	return affected(result, err, errTradeParticipant)
+}
+
+func (s *sqlStore) SetTradeDecision(tradeID, username, decision string) error {
+	_, err := s.q.Exec("UPDATE trade_participants SET decision=$1 WHERE tradeID=$2 AND username=$3", decision, tradeID, username)
+	return err
+}
+
+func (s *sqlStore) OpenDecisions(tradeID string) (int, error) {
+	var open int
+	err := s.q.QueryRow("SELECT count(*) FROM trade_participants WHERE tradeID=$1 AND decision<>$2", tradeID, decisionAccepted).Scan(&open)
+	return open, err
+}
+
+func (s *sqlStore) SwapShifts(cycle []tradeNode) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+
+		// The shifts are released first so that the unique slot index only
+		// sees the owners after the swap, they leave their owners' calendars
+		for _, node := range cycle {
+			if err := ts.cancelCalendarEvents("shiftID=$1", node.ShiftID); err != nil {
+				return err
+			}
+			_, err := ts.q.Exec("UPDATE shifts SET username=NULL, sequence=sequence+1 WHERE shiftID=$1", node.ShiftID)
+			if err != nil {
+				return err
+			}
+		}
+		for i, node := range cycle {
+			next := cycle[(i+1)%len(cycle)]
+			_, err := ts.q.Exec("UPDATE shifts SET username=$1, trade=false, generated=false WHERE shiftID=$2", node.Username, next.ShiftID)
+			if err != nil {
+				return uniqueViolation(err, errShiftConflict)
+			}
+			err = ts.saveOffer(Shift{ID: next.ShiftID})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) CalendarFeed(username string) (*CalendarFeed, error) {
+	args := []interface{}{username}
+	return s.loadCalendarFeed("username=$1 AND username IN (SELECT username FROM user_base WHERE "+s.tenantIs("tenant", &args)+")", args...)
+}
+
+func (s *sqlStore) CalendarFeedByToken(token string) (*CalendarFeed, error) {
+	args := []interface{}{token}
+	return s.loadCalendarFeed("token=$1 AND username IN (SELECT username FROM user_base WHERE "+s.tenantIs("tenant", &args)+")", args...)
+}
+
+// loadCalendarFeed loads the feed matching the given condition
+func (s *sqlStore) loadCalendarFeed(condition string, args ...interface{}) (*CalendarFeed, error) {
+	var feed CalendarFeed
+	err := s.q.QueryRow("SELECT token, username, created FROM calendar_feeds WHERE "+condition, args...).Scan(&feed.Token, &feed.Username, &feed.Created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errCalendarNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+func (s *sqlStore) SetCalendarFeed(feed CalendarFeed) error {
+	args := []interface{}{feed.Username}
+	var exists bool
+	err := s.q.QueryRow("SELECT EXISTS (SELECT 1 FROM user_base WHERE username=$1 AND "+s.tenantIs("tenant", &args)+")", args...).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errUserNotFound
+	}
+	_, err = s.q.Exec("INSERT INTO calendar_feeds (username, token, created) VALUES ($1, $2, $3) ON CONFLICT (username) DO UPDATE SET token=excluded.token, created=excluded.created",
+		feed.Username, feed.Token, feed.Created)
+	return err
+}
+
+func (s *sqlStore) DeleteCalendarFeed(username string) error {
+	args := []interface{}{username}
+	result, err := s.q.Exec("DELETE FROM calendar_feeds WHERE username=$1 AND username IN (SELECT username FROM user_base WHERE "+s.tenantIs("tenant", &args)+")", args...)
+	return affected(result, err, errCalendarNotFound)
+}
+
+func (s *sqlStore) CalendarCancellations(username string, since time.Time) ([]CalendarCancellation, error) {
+	args := []interface{}{username, since}
+	query := "SELECT shiftID, username, date, time, starts_at, ends_at, sequence, cancelled FROM calendar_cancellations WHERE username=$1 AND cancelled > $2 AND username IN (SELECT username FROM user_base WHERE " +
+		s.tenantIs("tenant", &args) + ") ORDER BY date, starts_at, shiftID"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	cancellations := []CalendarCancellation{}
+	for rows.Next() {
+		var c CalendarCancellation
+		var startsAt, endsAt sql.NullTime
+		if err := rows.Scan(&c.ShiftID, &c.Username, &c.Date, &c.Time, &startsAt, &endsAt, &c.Sequence, &c.Cancelled); err != nil {
+			return nil, err
+		}
+		c.StartsAt, c.EndsAt = startsAt.Time, endsAt.Time
+		cancellations = append(cancellations, c)
+	}
+	return cancellations, rows.Err()
+}
+
+func (s *sqlStore) Rotations() ([]RotationTemplate, error) {
+	args := []interface{}{}
+	condition := s.tenantIs("tenant", &args)
+	rows, err := s.q.Query("SELECT tenant, name FROM rotation_templates WHERE "+condition+" ORDER BY name, tenant", args...)
+	if err != nil {
+		return nil, err
+	}
+	rotations := []RotationTemplate{}
+	tenants := []string{}
+	for rows.Next() {
+		var rotation RotationTemplate
+		var tenant string
+		if err := rows.Scan(&tenant, &rotation.Name); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		rotations = append(rotations, rotation)
+		tenants = append(tenants, tenant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	days, err := s.rotationDays(condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rotations {
+		rotations[i].Days = days[rotationKey{tenants[i], rotations[i].Name}]
+	}
+	return rotations, nil
+}
+
+func (s *sqlStore) GetRotation(name string) (*RotationTemplate, error) {
+	rotation := RotationTemplate{}
+	var tenant string
+	args := []interface{}{name}
+	condition := "name=$1 AND " + s.tenantIs("tenant", &args)
+	err := s.q.QueryRow("SELECT tenant, name FROM rotation_templates WHERE "+condition, args...).Scan(&tenant, &rotation.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errRotationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	days, err := s.rotationDays("tenant=$1 AND name=$2", tenant, rotation.Name)
+	if err != nil {
+		return nil, err
+	}
+	rotation.Days = days[rotationKey{tenant, rotation.Name}]
+	return &rotation, nil
+}
+
+// rotationKey identifies a template, template names are unique per tenant
+type rotationKey struct {
+	tenant string
+	name   string
+}
+
+// rotationDays returns the days of the templates matching condition, days
+// off are empty
+func (s *sqlStore) rotationDays(condition string, args ...interface{}) (map[rotationKey][]string, error) {
+	rows, err := s.q.Query(`
+		SELECT d.tenant, d.template, d.time FROM rotation_days d
+		JOIN (SELECT tenant, name FROM rotation_templates WHERE `+condition+`) t ON t.tenant = d.tenant AND t.name = d.template
+		ORDER BY d.tenant, d.template, d.position
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	days := make(map[rotationKey][]string)
+	for rows.Next() {
+		var key rotationKey
+		var timeV sql.NullString
+		if err := rows.Scan(&key.tenant, &key.name, &timeV); err != nil {
+			return nil, err
+		}
+		days[key] = append(days[key], timeV.String)
+	}
+	return days, rows.Err()
+}
+
+// saveRotationDays replaces the days of a template of the tenant
+func (s *sqlStore) saveRotationDays(tenant string, rotation RotationTemplate) error {
+	_, err := s.q.Exec("DELETE FROM rotation_days WHERE tenant=$1 AND template=$2", tenant, rotation.Name)
+	if err != nil {
+		return err
+	}
+	for i, timeV := range rotation.Days {
+		_, err = s.q.Exec("INSERT INTO rotation_days (tenant, template, position, time) VALUES ($1, $2, $3, $4)", tenant, rotation.Name, i, nullString(timeV))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) CreateRotation(rotation RotationTemplate) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		tenant := ts.tenantFor("")
+		result, err := ts.q.Exec("INSERT INTO rotation_templates (tenant, name) VALUES ($1, $2) ON CONFLICT DO NOTHING", tenant, rotation.Name)
+		if err := affected(result, err, errRotationExists); err != nil {
+			return err
+		}
+		return ts.saveRotationDays(tenant, rotation)
+	})
+}
+
+func (s *sqlStore) UpdateRotation(name string, rotation RotationTemplate) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		var tenant string
+		args := []interface{}{name}
+		err := ts.q.QueryRow("SELECT tenant FROM rotation_templates WHERE name=$1 AND "+ts.tenantIs("tenant", &args), args...).Scan(&tenant)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errRotationNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if rotation.Name != name {
+			var exists int
+			err := ts.q.QueryRow("SELECT count(*) FROM rotation_templates WHERE tenant=$1 AND name=$2", tenant, rotation.Name).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists > 0 {
+				return errRotationExists
+			}
+		}
+
+		// Days and teams follow a rename through their foreign keys
+		result, err := ts.q.Exec("UPDATE rotation_templates SET name=$1 WHERE tenant=$2 AND name=$3", rotation.Name, tenant, name)
+		if err := affected(result, err, errRotationNotFound); err != nil {
+			return err
+		}
+		return ts.saveRotationDays(tenant, rotation)
+	})
+}
+
+func (s *sqlStore) DeleteRotation(name string) error {
+	return s.Atomic(func(tx Store) error {
+		ts := tx.(*sqlStore)
+		var tenant string
+		args := []interface{}{name}
+		err := ts.q.QueryRow("SELECT tenant FROM rotation_templates WHERE name=$1 AND "+ts.tenantIs("tenant", &args), args...).Scan(&tenant)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errRotationNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var inUse int
+		err = ts.q.QueryRow("SELECT count(*) FROM team_rotations WHERE tenant=$1 AND template=$2", tenant, name).Scan(&inUse)
+		if err != nil {
+			return err
+		}
+		if inUse > 0 {
+			return errRotationInUse
+		}
+
+		result, err := ts.q.Exec("DELETE FROM rotation_templates WHERE tenant=$1 AND name=$2", tenant, name)
+		return affected(result, err, errRotationNotFound)
+	})
+}
+
+func (s *sqlStore) TeamRotation(team string) (*TeamRotation, error) {
+	rotation := TeamRotation{Members: []RotationMember{}}
+	args := []interface{}{team}
+	query := "SELECT team, template, start_date FROM team_rotations WHERE team=$1 AND " + s.tenantIs("tenant", &args)
+	err := s.q.QueryRow(query, args...).Scan(&rotation.Team, &rotation.Template, &rotation.Start)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errRotationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	args = []interface{}{team}
+	query = "SELECT username, day_offset FROM team_rotation_members WHERE team=$1 AND " + s.tenantIs("tenant", &args) + " ORDER BY username"
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+	for rows.Next() {
+		var member RotationMember
+		if err := rows.Scan(&member.Username, &member.Offset); err != nil {
+			return nil, err
+		}
+		rotation.Members = append(rotation.Members, member)
+	}
+	return &rotation, rows.Err()
+}
+
+func (s *sqlStore) SetTeamRotation(rotation TeamRotation) error {
+	return s.Atomic(func(tx Store) error {
+		q := tx.(*sqlStore).q
+		tenant := tx.(*sqlStore).tenantFor("")
+		_, err := q.Exec(`
+			INSERT INTO team_rotations (tenant, team, template, start_date) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (tenant, team) DO UPDATE SET template=excluded.template, start_date=excluded.start_date
+		`, tenant, rotation.Team, rotation.Template, formatDate(rotation.Start))
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec("DELETE FROM team_rotation_members WHERE tenant=$1 AND team=$2", tenant, rotation.Team)
+		if err != nil {
+			return err
+		}
+		for _, member := range rotation.Members {
+			_, err = q.Exec("INSERT INTO team_rotation_members (tenant, team, username, day_offset) VALUES ($1, $2, $3, $4)", tenant, rotation.Team, member.Username, member.Offset)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) DeleteTeamRotation(team string) error {
+	args := []interface{}{team}
+	result, err := s.q.Exec("DELETE FROM team_rotations WHERE team=$1 AND "+s.tenantIs("tenant", &args), args...)
+	return affected(result, err, errRotationNotFound)
+}
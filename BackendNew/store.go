@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errUserNotFound      = errors.New("user not found")
+	errUserExists        = errors.New("user already exists")
+	errSessionNotFound   = errors.New("session not found")
+	errShiftNotFound     = errors.New("shift not found")
+	errShiftConflict     = errors.New("user already works the slot on that date")
+	errShiftNotOpen      = errors.New("shift is not released")
+	errShiftReleased     = errors.New("shift is already released")
+	errShiftTypeNotFound = errors.New("shift type not found")
+	errShiftTypeExists   = errors.New("shift type already exists")
+	errShiftTypeInUse    = errors.New("shift type is still in use")
+	errTeamNotFound      = errors.New("team not found")
+	errTeamExists        = errors.New("team already exists")
+	errTeamInUse         = errors.New("team still has shifts")
+	errNotTeamMember     = errors.New("user is not a member of the team")
+	errTenantNotFound    = errors.New("tenant not found")
+	errTenantExists      = errors.New("tenant already exists")
+	errRulesNotFound     = errors.New("tenant has no rules of its own")
+	errCalendarNotFound  = errors.New("calendar feed not found")
+	errRotationNotFound  = errors.New("rotation not found")
+	errRotationExists    = errors.New("rotation already exists")
+	errRotationInUse     = errors.New("rotation is still assigned to teams")
+)
+
+// defaultTenant holds all data created before tenants existed and is used
+// when no tenant is given
+const defaultTenant = "default"
+
+// Shift is a stored shift together with its trade offer
+type Shift struct {
+	ID       string
+	Tenant   string
+	Username string
+	// Team is empty for shifts that do not belong to a team
+	Team     string
+	Date     time.Time
+	Time     string
+	StartsAt time.Time
+	EndsAt   time.Time
+	Trade    bool
+	Search   map[string]bool
+	Targets  []TradeTarget
+	// Skills are required in addition to those of the shift type, nil keeps
+	// the stored ones on update
+	Skills []string
+	// Released is set while the shift is in the pool of open shifts
+	Released bool
+	// NoGiveback is set on shifts claimed from a pickup-only posting
+	NoGiveback bool
+	// Sequence counts the changes published to calendar feeds
+	Sequence int
+	// Generated marks shifts created from the rotation of their team, trades
+	// and claims clear it
+	Generated bool
+}
+
+// OpenShift is a shift released to the pool, eligible colleagues claim it
+// first come, first served
+type OpenShift struct {
+	// Shift has no Username if it was posted without an owner
+	Shift      Shift
+	ReleasedBy string
+	Released   time.Time
+	// PickupOnly keeps the shift with whoever claims it, they cannot release
+	// or trade it again
+	PickupOnly bool
+}
+
+// ShiftScope limits shift lookups and changes to the shifts of Username and
+// the shifts of Teams, unless All is set
+type ShiftScope struct {
+	Username string
+	Teams    []string
+	All      bool
+}
+
+// includes reports whether the shift is within the scope
+func (s ShiftScope) includes(shift Shift) bool {
+	if s.All || s.Username == shift.Username {
+		return true
+	}
+	for _, team := range s.Teams {
+		if team == shift.Team {
+			return true
+		}
+	}
+	return false
+}
+
+// Session is a login session of a user
+type Session struct {
+	ID       string
+	Tenant   string
+	Username string
+	Expires  time.Time
+}
+
+// CalendarFeed publishes the shifts of a user as an iCalendar feed to
+// whoever knows its token
+type CalendarFeed struct {
+	Token    string
+	Username string
+	Created  time.Time
+}
+
+// CalendarCancellation is a shift that left a user's calendar because it
+// was deleted or handed to someone else
+type CalendarCancellation struct {
+	ShiftID   string
+	Username  string
+	Date      time.Time
+	Time      string
+	StartsAt  time.Time
+	EndsAt    time.Time
+	Sequence  int
+	Cancelled time.Time
+}
+
+// Tenant is an organisation whose users, sessions and shifts are kept apart
+// from those of all other tenants
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// TenantStore keeps the tenants, it is not limited by ForTenant
+type TenantStore interface {
+	Tenants() ([]Tenant, error)
+	GetTenant(tenantID string) (*Tenant, error)
+	CreateTenant(tenant Tenant) error
+}
+
+// UserStore keeps the accounts with their roles and skills
+type UserStore interface {
+	// CreateUser stores a new account with the employee role
+	CreateUser(username, passwordHash string) error
+	// UserTenant returns the tenant an account belongs to; usernames are
+	// unique across tenants
+	UserTenant(username string) (string, error)
+	PasswordHash(username string) (string, error)
+	Usernames() ([]string, error)
+	// UserRoles returns the roles of a user, users without any role are employees
+	UserRoles(username string) ([]string, error)
+	SetUserRoles(username string, roles []string) error
+	// GrantRole adds a role to an existing user, unknown users are ignored
+	GrantRole(username, role string) error
+	// UserSkills returns the sorted qualifications of a user
+	UserSkills(username string) ([]string, error)
+	SetUserSkills(username string, skills []string) error
+}
+
+// SessionStore keeps the login sessions
+type SessionStore interface {
+	CreateSession(session Session) error
+	// GetSession returns the session unless it does not exist or has expired
+	GetSession(sessionID string) (*Session, error)
+	DeleteSession(sessionID string) error
+}
+
+// ShiftStore keeps the shifts with their searched slots and trade targets
+type ShiftStore interface {
+	// ListShifts returns the shifts of a user ordered by start
+	ListShifts(username string) ([]Shift, error)
+	GetShift(scope ShiftScope, shiftID string) (*Shift, error)
+	// CreateShift returns errShiftConflict if the user already works the
+	// slot on that date
+	CreateShift(shift Shift) error
+	// UpdateShift replaces date, slot and trade offer of a shift, the owner is
+	// kept and so are team and skills unless new ones are given. Like
+	// CreateShift it returns errShiftConflict for a double booked slot.
+	UpdateShift(scope ShiftScope, shift Shift) error
+	DeleteShift(scope ShiftScope, shiftID string) error
+	// CountOffers returns the number of trade-enabled shifts per slot on a
+	// date within a team whose owners are members of it
+	CountOffers(date, team string) (map[string]int, error)
+	// ListTeamShifts returns the shifts of a team ordered by start
+	ListTeamShifts(team string) ([]Shift, error)
+}
+
+// OpenShiftStore keeps the pool of released shifts
+type OpenShiftStore interface {
+	// ListOpenShifts returns the released shifts ordered by start
+	ListOpenShifts() ([]OpenShift, error)
+	// GetOpenShift returns a released shift and locks it for the rest of the
+	// surrounding Atomic call
+	GetOpenShift(shiftID string) (*OpenShift, error)
+	// ReleaseShift puts a stored shift into the pool and withdraws its trade
+	// offer, pending trades with the shift fail on completion
+	ReleaseShift(open OpenShift) error
+	// WithdrawShift takes a shift out of the pool, its owner keeps it
+	WithdrawShift(shiftID string) error
+	// ClaimShift hands a released shift to username and removes it from the
+	// pool; it returns errShiftConflict if the user already works the slot
+	ClaimShift(shiftID, username string) error
+}
+
+// ShiftTypeStore keeps the shift type catalogue
+type ShiftTypeStore interface {
+	// ShiftTypes returns the catalogue in display order
+	ShiftTypes() ([]ShiftType, error)
+	GetShiftType(name string) (*ShiftType, error)
+	CreateShiftType(shiftType ShiftType) error
+	// UpdateShiftType changes a slot, renames it on all shifts and trade
+	// targets and recomputes the times of its shifts
+	UpdateShiftType(name string, shiftType ShiftType) error
+	DeleteShiftType(name string) error
+}
+
+// TeamStore keeps the teams and their members
+type TeamStore interface {
+	// Teams returns all teams ordered by department and name
+	Teams() ([]Team, error)
+	GetTeam(name string) (*Team, error)
+	// UserTeams returns the names of the teams a user is a member of
+	UserTeams(username string) ([]string, error)
+	CreateTeam(team Team) error
+	// UpdateTeam changes a team, a rename carries over to its members and shifts
+	UpdateTeam(name string, team Team) error
+	DeleteTeam(name string) error
+	AddTeamMember(team, username string) error
+	RemoveTeamMember(team, username string) error
+}
+
+// TradeStore keeps the trade proposals and performs the swaps
+type TradeStore interface {
+	// ExpireTrades marks all pending proposals and trades awaiting approval
+	// past their expiry as expired
+	ExpireTrades() error
+	// TradeGraph returns all trade-enabled shifts that are not already part
+	// of a pending or unapproved proposal, leaving out released shifts and
+	// shifts whose owner is no member of the shift's team
+	TradeGraph() ([]tradeNode, error)
+	// TradeNodes returns the trade-enabled shifts of the given trade, with
+	// the same rules for released shifts and membership as TradeGraph
+	TradeNodes(tradeID string) ([]tradeNode, error)
+	// CreateTrade stores a pending proposal for the cycle and returns its ID
+	CreateTrade(cycle []tradeNode, ttl time.Duration) (string, error)
+	GetTrade(tradeID string) (*Trade, error)
+	// ListTrades returns the trades a user takes part in, newest first
+	ListTrades(username string) ([]*Trade, error)
+	// ListTradesByStatus returns the trades in the given state, newest first
+	ListTradesByStatus(status string) ([]*Trade, error)
+	// TradeStatus returns the state of a trade and locks it for the rest of
+	// the surrounding Atomic call
+	TradeStatus(tradeID string) (string, error)
+	SetTradeStatus(tradeID, status string) error
+	// RequestTradeApproval hands an accepted trade to the supervisors, who
+	// have until expires to review it
+	RequestTradeApproval(tradeID string, expires time.Time) error
+	// SetTradeReviewer returns errTradeParticipant if the reviewer takes
+	// part in the trade
+	SetTradeReviewer(tradeID, reviewer string) error
+	SetTradeDecision(tradeID, username, decision string) error
+	// OpenDecisions returns the number of participants yet to accept
+	OpenDecisions(tradeID string) (int, error)
+	// SwapShifts hands every shift in the cycle to the owner of the preceding
+	// shift and clears the trade offers of all involved shifts; it returns
+	// errShiftConflict if an owner would work a slot twice on a date
+	SwapShifts(cycle []tradeNode) error
+}
+
+// CalendarStore keeps the calendar feeds and the shifts that left them;
+// deleting, swapping and claiming shifts records the cancellations
+type CalendarStore interface {
+	// CalendarFeed returns errCalendarNotFound if the user has no feed
+	CalendarFeed(username string) (*CalendarFeed, error)
+	CalendarFeedByToken(token string) (*CalendarFeed, error)
+	// SetCalendarFeed replaces the feed of a user, the previous token stops
+	// working
+	SetCalendarFeed(feed CalendarFeed) error
+	DeleteCalendarFeed(username string) error
+	// CalendarCancellations returns the shifts that left the user's calendar
+	// after since, ordered by start
+	CalendarCancellations(username string, since time.Time) ([]CalendarCancellation, error)
+}
+
+// RotationStore keeps the rotation templates and the teams following them
+type RotationStore interface {
+	// Rotations returns all templates ordered by name
+	Rotations() ([]RotationTemplate, error)
+	GetRotation(name string) (*RotationTemplate, error)
+	CreateRotation(rotation RotationTemplate) error
+	// UpdateRotation replaces the days of a template, a rename carries over
+	// to the teams following it
+	UpdateRotation(name string, rotation RotationTemplate) error
+	// DeleteRotation returns errRotationInUse while teams follow the template
+	DeleteRotation(name string) error
+	// TeamRotation returns errRotationNotFound if the team follows no template
+	TeamRotation(team string) (*TeamRotation, error)
+	// SetTeamRotation replaces the template and members of a team's rotation
+	SetTeamRotation(rotation TeamRotation) error
+	DeleteTeamRotation(team string) error
+}
+
+// RuleStore keeps the working time rules of the store's tenant
+type RuleStore interface {
+	// Rules returns errRulesNotFound if the tenant uses the default rules
+	Rules() (*RuleConfig, error)
+	SetRules(config RuleConfig) error
+}
+
+// Store is the storage backend of the application. Users, sessions, shifts,
+// teams and rotation templates of all tenants are visible unless the store is
+// limited with ForTenant; new rows are created in the store's tenant, or the
+// one given or the default tenant if the store is not limited. Shift types
+// are shared by all tenants, team and template names are unique per tenant.
+type Store interface {
+	TenantStore
+	UserStore
+	SessionStore
+	ShiftStore
+	OpenShiftStore
+	ShiftTypeStore
+	TeamStore
+	RuleStore
+	TradeStore
+	CalendarStore
+	RotationStore
+
+	// Atomic runs fn against a view of the store whose changes are applied
+	// together if fn returns nil and discarded otherwise. Inside another
+	// Atomic call only the changes of fn are discarded, the caller may
+	// recover from the error.
+	Atomic(fn func(tx Store) error) error
+	// ForTenant returns a view of the store limited to the given tenant
+	ForTenant(tenantID string) Store
+}
+
+// defaultShiftTypes is the catalogue a new database starts with
+var defaultShiftTypes = []ShiftType{
+	{Name: "früh", Start: "06:00", End: "14:00", Color: "#f6c945", Position: 1},
+	{Name: "spät", Start: "14:00", End: "22:00", Color: "#e8833a", Position: 2},
+	{Name: "nacht", Start: "22:00", End: "06:00", Color: "#3a5ba0", Position: 3},
+}
@@ -0,0 +1,29 @@
+package main
+
+// TradeTarget describes a date or date range a shift may be traded into.
+// If Times is empty, the slots selected in the shift's search apply.
+type TradeTarget struct {
+	From  string   `json:"from"`
+	To    string   `json:"to,omitempty"`
+	Times []string `json:"times,omitempty"`
+}
+
+// covers reports whether a shift on date in slot timeV falls into the target
+func (t TradeTarget) covers(date, timeV string, search map[string]bool) bool {
+	to := t.To
+	if to == "" {
+		to = t.From
+	}
+	if date < t.From || date > to {
+		return false
+	}
+	if len(t.Times) == 0 {
+		return search[timeV]
+	}
+	for _, candidate := range t.Times {
+		if candidate == timeV {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Team is a group of users within a department, shifts of a team are only
+// traded between its members
+type Team struct {
+	Name       string   `json:"name"`
+	Department string   `json:"department"`
+	Members    []string `json:"members"`
+}
+
+// TeamShift is a row of a team's roster
+type TeamShift struct {
+	Uid      string `json:"uid"`
+	Username string `json:"username"`
+	Datum    string `json:"datum"`
+	Day      string `json:"day"`
+	Time     string `json:"time"`
+	Trade    bool   `json:"trade"`
+}
+
+// validate checks the name can be used in a URL path
+func (t Team) validate() error {
+	if strings.TrimSpace(t.Name) == "" || strings.Contains(t.Name, "/") {
+		return errors.New("invalid name")
+	}
+	return nil
+}
+
+// hasMember reports whether username is among the team's members
+func (t *Team) hasMember(username string) bool {
+	for _, member := range t.Members {
+		if member == username {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveShiftTeam checks the team requested for a shift of the principal.
+// Without a request the shift keeps its team, new shifts go to the
+// principal's team if there is exactly one.
+func (app *App) resolveShiftTeam(r *http.Request, principal *Principal, requested string, isNew bool) (string, []ValidationError, error) {
+	if requested == "" {
+		if !isNew {
+			return "", nil, nil
+		}
+		teams, err := app.store(r).UserTeams(principal.Username)
+		if err != nil || len(teams) != 1 {
+			return "", nil, err
+		}
+		return teams[0], nil, nil
+	}
+
+	team, err := app.store(r).GetTeam(requested)
+	if errors.Is(err, errTeamNotFound) {
+		return "", []ValidationError{{Field: "team", Message: fmt.Sprintf("unknown team %q", requested)}}, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !team.hasMember(principal.Username) && !principal.managesTeam(team.Name) {
+		return "", []ValidationError{{Field: "team", Message: fmt.Sprintf("not a member of team %q", requested)}}, nil
+	}
+	return team.Name, nil, nil
+}
+
+// Team handler for /teams
+func (app *App) teamHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePermission(w, r, permShiftsRead)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.teamGet(w, r, principal)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// teamGet lists the principal's teams, admins see all teams
+func (app *App) teamGet(w http.ResponseWriter, r *http.Request, principal *Principal) {
+	all, err := app.store(r).Teams()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch teams")
+		return
+	}
+
+	teams := []Team{}
+	for _, team := range all {
+		if team.hasMember(principal.Username) || principal.managesTeam(team.Name) {
+			teams = append(teams, team)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(teams)
+	if err != nil {
+		return
+	}
+}
+
+// Team handler for /teams/{name}/shifts and /teams/{name}/rotation
+func (app *App) teamByNameHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePermission(w, r, permShiftsRead)
+	if !ok {
+		return
+	}
+
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) >= 3 && len(pathSegments) <= 4 && pathSegments[2] == "rotation" {
+		action := ""
+		if len(pathSegments) == 4 {
+			action = pathSegments[3]
+		}
+		app.teamRotationHandler(w, r, pathSegments[1], action)
+		return
+	}
+	if len(pathSegments) != 3 || pathSegments[2] != "shifts" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.teamShiftsGet(w, r, principal, pathSegments[1])
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// teamShiftsGet lists the roster of a team to its members and supervisors
+func (app *App) teamShiftsGet(w http.ResponseWriter, r *http.Request, principal *Principal, name string) {
+	team, err := app.store(r).GetTeam(name)
+	if errors.Is(err, errTeamNotFound) || (err == nil && !team.hasMember(principal.Username) && !principal.managesTeam(team.Name)) {
+		writeMessage(w, http.StatusNotFound, "Team not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get team")
+		return
+	}
+
+	stored, err := app.store(r).ListTeamShifts(team.Name)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch shifts")
+		return
+	}
+
+	shifts := []TeamShift{}
+	for _, s := range stored {
+		shifts = append(shifts, TeamShift{
+			Uid:      s.ID,
+			Username: s.Username,
+			Datum:    formatDate(s.Date),
+			Day:      weekdayName(s.Date),
+			Time:     s.Time,
+			Trade:    s.Trade,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(shifts)
+	if err != nil {
+		return
+	}
+}
+
+// Admin handler for /admin/teams
+func (app *App) adminTeamHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permTeamsManage); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.adminTeamGet(w, r)
+	case http.MethodPost:
+		app.adminTeamPost(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) adminTeamGet(w http.ResponseWriter, r *http.Request) {
+	teams, err := app.store(r).Teams()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch teams")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(teams)
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) adminTeamPost(w http.ResponseWriter, r *http.Request) {
+	var team Team
+	err := json.NewDecoder(r.Body).Decode(&team)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if err := team.validate(); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid team: "+err.Error())
+		return
+	}
+
+	err = app.store(r).CreateTeam(team)
+	if errors.Is(err, errTeamExists) {
+		writeMessage(w, http.StatusConflict, "Team already exists")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to add team")
+		return
+	}
+
+	app.writeTeam(w, r, http.StatusCreated, team.Name)
+}
+
+// Admin handler for /admin/teams/{name} and /admin/teams/{name}/members/{username}
+func (app *App) adminTeamByNameHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permTeamsManage); !ok {
+		return
+	}
+
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(pathSegments) == 3:
+		name := pathSegments[2]
+		switch r.Method {
+		case http.MethodGet:
+			app.writeTeam(w, r, http.StatusOK, name)
+		case http.MethodPut:
+			app.adminTeamByNamePut(w, r, name)
+		case http.MethodDelete:
+			app.adminTeamByNameDelete(w, r, name)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case len(pathSegments) == 5 && pathSegments[3] == "members":
+		name, username := pathSegments[2], pathSegments[4]
+		switch r.Method {
+		case http.MethodPut:
+			app.adminTeamMemberPut(w, r, name, username)
+		case http.MethodDelete:
+			app.adminTeamMemberDelete(w, r, name, username)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (app *App) adminTeamByNamePut(w http.ResponseWriter, r *http.Request, name string) {
+	var team Team
+	err := json.NewDecoder(r.Body).Decode(&team)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if team.Name == "" {
+		team.Name = name
+	}
+	if err := team.validate(); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid team: "+err.Error())
+		return
+	}
+
+	err = app.store(r).UpdateTeam(name, team)
+	if errors.Is(err, errTeamNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team not found")
+		return
+	}
+	if errors.Is(err, errTeamExists) {
+		writeMessage(w, http.StatusConflict, "Team already exists")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to update team")
+		return
+	}
+
+	app.writeTeam(w, r, http.StatusOK, team.Name)
+}
+
+func (app *App) adminTeamByNameDelete(w http.ResponseWriter, r *http.Request, name string) {
+	err := app.store(r).DeleteTeam(name)
+	if errors.Is(err, errTeamInUse) {
+		writeMessage(w, http.StatusConflict, "Team still has shifts")
+		return
+	}
+	if errors.Is(err, errTeamNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to delete team")
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "Team deleted successfully")
+}
+
+func (app *App) adminTeamMemberPut(w http.ResponseWriter, r *http.Request, name, username string) {
+	err := app.store(r).AddTeamMember(name, username)
+	if errors.Is(err, errTeamNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team not found")
+		return
+	}
+	if errors.Is(err, errUserNotFound) {
+		writeMessage(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to add team member")
+		return
+	}
+
+	app.writeTeam(w, r, http.StatusOK, name)
+}
+
+func (app *App) adminTeamMemberDelete(w http.ResponseWriter, r *http.Request, name, username string) {
+	err := app.store(r).RemoveTeamMember(name, username)
+	if errors.Is(err, errNotTeamMember) {
+		writeMessage(w, http.StatusNotFound, "Team member not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to remove team member")
+		return
+	}
+
+	app.writeTeam(w, r, http.StatusOK, name)
+}
+
+// writeTeam responds with the stored team and its members
+func (app *App) writeTeam(w http.ResponseWriter, r *http.Request, status int, name string) {
+	team, err := app.store(r).GetTeam(name)
+	if errors.Is(err, errTeamNotFound) {
+		writeMessage(w, http.StatusNotFound, "Team not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get team")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(team)
+	if err != nil {
+		return
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TenantReceive creates a tenant, optionally together with its first admin
+type TenantReceive struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Admin *User  `json:"admin,omitempty"`
+}
+
+// validate checks the ID can be used in a URL path and a name is given
+func (t Tenant) validate() error {
+	if strings.TrimSpace(t.ID) == "" || strings.Contains(t.ID, "/") {
+		return errors.New("invalid id")
+	}
+	if strings.TrimSpace(t.Name) == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+// Admin handler for /admin/tenants
+func (app *App) adminTenantHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requirePermission(w, r, permTenantsManage); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		app.adminTenantGet(w, r)
+	case http.MethodPost:
+		app.adminTenantPost(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) adminTenantGet(w http.ResponseWriter, r *http.Request) {
+	tenants, err := app.Store.Tenants()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch tenants")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(tenants)
+	if err != nil {
+		return
+	}
+}
+
+// adminTenantPost creates a tenant and, if given, its first admin account
+func (app *App) adminTenantPost(w http.ResponseWriter, r *http.Request) {
+	var body TenantReceive
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	tenant := Tenant{ID: body.ID, Name: body.Name}
+	if err := tenant.validate(); err != nil {
+		writeMessage(w, http.StatusBadRequest, "Invalid tenant: "+err.Error())
+		return
+	}
+	if body.Admin != nil && (body.Admin.Username == "" || body.Admin.Password == "") {
+		writeMessage(w, http.StatusBadRequest, "Invalid tenant: admin needs a username and password")
+		return
+	}
+
+	var hashedPassword []byte
+	if body.Admin != nil {
+		hashedPassword, err = bcrypt.GenerateFromPassword([]byte(body.Admin.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to hash password")
+			return
+		}
+	}
+
+	err = app.Store.Atomic(func(tx Store) error {
+		if err := tx.CreateTenant(tenant); err != nil {
+			return err
+		}
+		if body.Admin == nil {
+			return nil
+		}
+		scoped := tx.ForTenant(tenant.ID)
+		if err := scoped.CreateUser(body.Admin.Username, string(hashedPassword)); err != nil {
+			return err
+		}
+		return scoped.GrantRole(body.Admin.Username, roleAdmin)
+	})
+	if errors.Is(err, errTenantExists) {
+		writeMessage(w, http.StatusConflict, "Tenant already exists")
+		return
+	}
+	if errors.Is(err, errUserExists) {
+		writeMessage(w, http.StatusConflict, "User already exists")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to add tenant")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(tenant)
+	if err != nil {
+		return
+	}
+}
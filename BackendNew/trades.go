@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Trade proposal states
+const (
+	tradePending          = "pending"
+	tradeAwaitingApproval = "awaiting_approval"
+	tradeCompleted        = "completed"
+	tradeDeclined         = "declined"
+	tradeRejected         = "rejected"
+	tradeExpired          = "expired"
+	tradeFailed           = "failed"
+)
+
+// Participant decisions
+const (
+	decisionPending  = "pending"
+	decisionAccepted = "accepted"
+	decisionDeclined = "declined"
+)
+
+type TradeShift struct {
+	Uid   string `json:"uid"`
+	Datum string `json:"datum"`
+	Time  string `json:"time"`
+	Day   string `json:"day"`
+}
+
+type TradeParticipant struct {
+	Username string     `json:"username"`
+	Gives    TradeShift `json:"gives"`
+	Receives TradeShift `json:"receives"`
+	Decision string     `json:"decision"`
+}
+
+type Trade struct {
+	Uid          string             `json:"uid"`
+	Status       string             `json:"status"`
+	Created      time.Time          `json:"created"`
+	Expires      time.Time          `json:"expires"`
+	Reviewer     string             `json:"reviewer,omitempty"`
+	Participants []TradeParticipant `json:"participants"`
+}
+
+var (
+	errTradeNotFound    = errors.New("trade not found")
+	errTradeState       = errors.New("trade is in the wrong state")
+	errTradeParticipant = errors.New("reviewer takes part in the trade")
+)
+
+// hasParticipant reports whether username takes part in the trade
+func (t *Trade) hasParticipant(username string) bool {
+	for _, p := range t.Participants {
+		if p.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// cycle rebuilds the trade cycle in the form expected by SwapShifts
+func (t *Trade) cycle() []tradeNode {
+	cycle := make([]tradeNode, len(t.Participants))
+	for i, p := range t.Participants {
+		cycle[i] = tradeNode{ShiftID: p.Gives.Uid, Username: p.Username}
+	}
+	return cycle
+}
+
+// isStillValid checks against the trade's current nodes that every
+// participant still owns the shift they give and still wants the shift they
+// receive
+func isStillValid(trade *Trade, nodes []tradeNode) bool {
+	byID := make(map[string]tradeNode, len(nodes))
+	for _, node := range nodes {
+		byID[node.ShiftID] = node
+	}
+	for _, p := range trade.Participants {
+		gives, ok := byID[p.Gives.Uid]
+		if !ok || gives.Username != p.Username {
+			return false
+		}
+		receives, ok := byID[p.Receives.Uid]
+		if !ok || !gives.wants(receives) {
+			return false
+		}
+	}
+	return true
+}
+
+// completeTrade swaps the shifts of a fully accepted trade and returns its
+// new status; the trade fails if it is no longer valid, breaks the rules or
+// a slot was taken in the meantime
+func completeTrade(tx Store, trade *Trade, rules RuleSet) (string, error) {
+	nodes, err := tx.TradeNodes(trade.Uid)
+	if err != nil {
+		return "", err
+	}
+
+	check := newSwapCheck(tx, rules)
+	valid := isStillValid(trade, nodes) && len(check.cycleViolations(trade.cycle())) == 0
+	if check.err != nil {
+		return "", check.err
+	}
+
+	status := tradeCompleted
+	if !valid {
+		status = tradeFailed
+	} else if err := tx.SwapShifts(trade.cycle()); errors.Is(err, errShiftConflict) {
+		status = tradeFailed
+	} else if err != nil {
+		return "", err
+	}
+
+	err = tx.SetTradeStatus(trade.Uid, status)
+	if err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// Trades handler
+func (app *App) tradeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		app.tradeHandlerGet(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) tradeHandlerGet(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	username := principal.Username
+
+	err := app.store(r).ExpireTrades()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to expire trades")
+		return
+	}
+
+	trades, err := app.store(r).ListTrades(username)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch trades")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(trades)
+	if err != nil {
+		return
+	}
+}
+
+// Handler for /trades/{id} and /trades/{id}/{action}
+func (app *App) tradeByIDHandler(w http.ResponseWriter, r *http.Request) {
+	pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pathSegments) < 2 || pathSegments[1] == "" {
+		writeMessage(w, http.StatusBadRequest, "Invalid trade ID")
+		return
+	}
+	tradeID := pathSegments[1]
+
+	switch {
+	case len(pathSegments) == 2 && tradeID == "approvals" && r.Method == http.MethodGet:
+		app.tradeApprovalsGet(w, r)
+	case len(pathSegments) == 2 && r.Method == http.MethodGet:
+		app.tradeByIDGet(w, r, tradeID)
+	case len(pathSegments) == 3 && r.Method == http.MethodPost && pathSegments[2] == "accept":
+		app.tradeByIDDecide(w, r, tradeID, decisionAccepted)
+	case len(pathSegments) == 3 && r.Method == http.MethodPost && pathSegments[2] == "decline":
+		app.tradeByIDDecide(w, r, tradeID, decisionDeclined)
+	case len(pathSegments) == 3 && r.Method == http.MethodPost && pathSegments[2] == "approve":
+		app.tradeByIDReview(w, r, tradeID, true)
+	case len(pathSegments) == 3 && r.Method == http.MethodPost && pathSegments[2] == "reject":
+		app.tradeByIDReview(w, r, tradeID, false)
+	case len(pathSegments) > 3:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) tradeByIDGet(w http.ResponseWriter, r *http.Request, tradeID string) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	username := principal.Username
+
+	err := app.store(r).ExpireTrades()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to expire trades")
+		return
+	}
+
+	trade, err := app.store(r).GetTrade(tradeID)
+	if errors.Is(err, errTradeNotFound) || (err == nil && !trade.hasParticipant(username)) {
+		writeMessage(w, http.StatusNotFound, "Trade not found")
+		return
+	}
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get trade")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(trade)
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) tradeByIDDecide(w http.ResponseWriter, r *http.Request, tradeID string, decision string) {
+	principal, ok := principalFromContext(r.Context())
+	if !ok {
+		writeMessage(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	username := principal.Username
+
+	err := app.store(r).ExpireTrades()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to expire trades")
+		return
+	}
+
+	var status string
+	message := "Failed to get trade"
+	err = app.store(r).Atomic(func(tx Store) error {
+		var err error
+		status, err = tx.TradeStatus(tradeID)
+		if err != nil {
+			return err
+		}
+		trade, err := tx.GetTrade(tradeID)
+		if err != nil {
+			return err
+		}
+		if !trade.hasParticipant(username) {
+			return errTradeNotFound
+		}
+		if status != tradePending {
+			return errTradeState
+		}
+
+		message = "Failed to record decision"
+		err = tx.SetTradeDecision(tradeID, username, decision)
+		if err != nil {
+			return err
+		}
+
+		if decision == decisionDeclined {
+			message = "Failed to decline trade"
+			status = tradeDeclined
+			return tx.SetTradeStatus(tradeID, tradeDeclined)
+		}
+
+		message = "Failed to check decisions"
+		open, err := tx.OpenDecisions(tradeID)
+		if err != nil || open > 0 {
+			return err
+		}
+		if app.Config.Trade.RequireApproval {
+			message = "Failed to request approval"
+			status = tradeAwaitingApproval
+			return tx.RequestTradeApproval(tradeID, time.Now().Add(app.Config.Trade.ApprovalTTL))
+		}
+
+		// A failure is recorded as well, so the proposal does not block the shifts any longer
+		message = "Failed to get rules"
+		rules, err := app.rules(tx)
+		if err != nil {
+			return err
+		}
+		message = "Failed to swap shifts"
+		status, err = completeTrade(tx, trade, rules)
+		return err
+	})
+	if err == nil {
+		app.publishTrade(r, tradeID)
+	}
+	app.writeTradeUpdate(w, r, tradeID, status, message, err)
+}
+
+// isReviewer reports whether the principal manages the teams of every shift
+// in the trade, supervisors review the trades of their own teams
+func isReviewer(store Store, principal *Principal, trade *Trade) (bool, error) {
+	for _, participant := range trade.Participants {
+		shift, err := store.GetShift(ShiftScope{All: true}, participant.Gives.Uid)
+		if errors.Is(err, errShiftNotFound) {
+			shift, err = &Shift{}, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !principal.managesTeam(shift.Team) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (app *App) tradeApprovalsGet(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePermission(w, r, permTradesApprove)
+	if !ok {
+		return
+	}
+
+	err := app.store(r).ExpireTrades()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to expire trades")
+		return
+	}
+	awaiting, err := app.store(r).ListTradesByStatus(tradeAwaitingApproval)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to fetch trades")
+		return
+	}
+	trades := []*Trade{}
+	for _, trade := range awaiting {
+		reviewer, err := isReviewer(app.store(r), principal, trade)
+		if err != nil {
+			writeMessage(w, http.StatusInternalServerError, "Failed to fetch trades")
+			return
+		}
+		if reviewer {
+			trades = append(trades, trade)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(trades)
+	if err != nil {
+		return
+	}
+}
+
+func (app *App) tradeByIDReview(w http.ResponseWriter, r *http.Request, tradeID string, approve bool) {
+	principal, ok := requirePermission(w, r, permTradesApprove)
+	if !ok {
+		return
+	}
+	username := principal.Username
+
+	err := app.store(r).ExpireTrades()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to expire trades")
+		return
+	}
+
+	var status string
+	message := "Failed to get trade"
+	err = app.store(r).Atomic(func(tx Store) error {
+		var err error
+		status, err = tx.TradeStatus(tradeID)
+		if err != nil {
+			return err
+		}
+		trade, err := tx.GetTrade(tradeID)
+		if err != nil {
+			return err
+		}
+		reviewer, err := isReviewer(tx, principal, trade)
+		if err != nil {
+			return err
+		}
+		if !reviewer {
+			return errTradeNotFound
+		}
+		if status != tradeAwaitingApproval {
+			return errTradeState
+		}
+
+		message = "Failed to record review"
+		err = tx.SetTradeReviewer(tradeID, username)
+		if err != nil {
+			return err
+		}
+
+		if !approve {
+			message = "Failed to reject trade"
+			status = tradeRejected
+			return tx.SetTradeStatus(tradeID, tradeRejected)
+		}
+
+		message = "Failed to get rules"
+		rules, err := app.rules(tx)
+		if err != nil {
+			return err
+		}
+		message = "Failed to swap shifts"
+		status, err = completeTrade(tx, trade, rules)
+		return err
+	})
+	if err == nil {
+		app.publishTrade(r, tradeID)
+	}
+	app.writeTradeUpdate(w, r, tradeID, status, message, err)
+}
+
+// publishTrade tells the participants of a trade about its new state, after
+// a swap they learn about the shifts they received and the offer counts of
+// the swapped shifts' dates change
+func (app *App) publishTrade(r *http.Request, tradeID string) {
+	trade, err := app.store(r).GetTrade(tradeID)
+	if err != nil {
+		return
+	}
+	tenant := requestTenant(r)
+	events := []Event{tradeEvent(tenant, trade)}
+	if trade.Status == tradeCompleted {
+		dates := make(map[string]bool)
+		for _, p := range trade.Participants {
+			shift, err := app.store(r).GetShift(ShiftScope{All: true}, p.Receives.Uid)
+			if err != nil {
+				continue
+			}
+			events = append(events, shiftEvent(tenant, "swapped", *shift))
+			if key := shift.Team + "/" + formatDate(shift.Date); !dates[key] {
+				dates[key] = true
+				events = append(events, offersEvent(tenant, *shift))
+			}
+		}
+	}
+	app.publish(events...)
+}
+
+// writeTradeUpdate writes the response to a decision or review: the error of
+// the transaction if there is one, otherwise the updated trade
+func (app *App) writeTradeUpdate(w http.ResponseWriter, r *http.Request, tradeID, status, message string, err error) {
+	switch {
+	case errors.Is(err, errTradeNotFound):
+		writeMessage(w, http.StatusNotFound, "Trade not found")
+		return
+	case errors.Is(err, errTradeState):
+		writeMessage(w, http.StatusConflict, "Trade is "+status)
+		return
+	case errors.Is(err, errTradeParticipant):
+		writeMessage(w, http.StatusForbidden, "Trades cannot be reviewed by their participants")
+		return
+	case err != nil:
+		writeMessage(w, http.StatusInternalServerError, message)
+		return
+	case status == tradeFailed:
+		writeMessage(w, http.StatusConflict, "Trade is no longer possible")
+		return
+	}
+
+	trade, err := app.store(r).GetTrade(tradeID)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get trade")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(trade)
+	if err != nil {
+		return
+	}
+}
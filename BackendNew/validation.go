@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// dateLayout is the ISO 8601 calendar date format used for shift dates
+const dateLayout = "2006-01-02"
+
+var weekdayNames = [...]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"}
+
+// ValidationError describes why a single field of a request was rejected
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ShiftInput is a validated ShiftReceive payload
+type ShiftInput struct {
+	Team     string
+	Skills   []string // nil keeps the stored skills
+	Date     time.Time
+	Type     ShiftType
+	StartsAt time.Time
+	EndsAt   time.Time
+	Trade    bool
+	Searched []string
+	Targets  []TradeTarget
+}
+
+// Datum returns the shift date in ISO 8601 format
+func (s *ShiftInput) Datum() string {
+	return s.Date.Format(dateLayout)
+}
+
+// shift returns the input as the stored shift with the given ID and owner
+func (s *ShiftInput) shift(shiftID, username string) Shift {
+	return Shift{
+		ID:       shiftID,
+		Username: username,
+		Team:     s.Team,
+		Skills:   s.Skills,
+		Date:     s.Date,
+		Time:     s.Type.Name,
+		StartsAt: s.StartsAt,
+		EndsAt:   s.EndsAt,
+		Trade:    s.Trade,
+		Search:   searchedSet(s.Searched),
+		Targets:  s.Targets,
+	}
+}
+
+// parseDate accepts a plain ISO 8601 date or a full ISO 8601 timestamp
+func parseDate(value string) (time.Time, error) {
+	if date, err := time.ParseInLocation(dateLayout, value, time.Local); err == nil {
+		return date, nil
+	}
+	timestamp, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(timestamp.Year(), timestamp.Month(), timestamp.Day(), 0, 0, 0, 0, time.Local), nil
+}
+
+// formatDate formats a date scanned from the database as ISO 8601
+func formatDate(date time.Time) string {
+	return date.Format(dateLayout)
+}
+
+// weekdayName returns the German name of the date's weekday
+func weekdayName(date time.Time) string {
+	return weekdayNames[date.Weekday()]
+}
+
+// shiftTimes returns when a shift of the given type starts and ends on date;
+// shifts ending at or before their start time end on the following day
+func shiftTimes(date time.Time, shiftType ShiftType) (time.Time, time.Time) {
+	start, _ := time.Parse("15:04", shiftType.Start)
+	end, _ := time.Parse("15:04", shiftType.End)
+
+	startsAt := time.Date(date.Year(), date.Month(), date.Day(), start.Hour(), start.Minute(), 0, 0, time.Local)
+	endsAt := time.Date(date.Year(), date.Month(), date.Day(), end.Hour(), end.Minute(), 0, 0, time.Local)
+	if !endsAt.After(startsAt) {
+		endsAt = endsAt.AddDate(0, 0, 1)
+	}
+	return startsAt, endsAt
+}
+
+// parseShift validates a shift payload against the shift type catalogue.
+// Dates before today are rejected unless allowPast is set.
+func parseShift(shift ShiftReceive, types []ShiftType, now time.Time, allowPast bool) (*ShiftInput, []ValidationError) {
+	var errs []ValidationError
+	input := &ShiftInput{Trade: shift.Trade, Targets: shift.Targets}
+
+	date, err := parseDate(shift.Datum)
+	if err != nil {
+		errs = append(errs, ValidationError{Field: "datum", Message: "must be an ISO 8601 date"})
+	} else {
+		input.Date = date
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		if date.Before(today) && !allowPast {
+			errs = append(errs, ValidationError{Field: "datum", Message: "must not be in the past"})
+		}
+	}
+
+	found := false
+	for _, t := range types {
+		if t.Name == shift.Time {
+			input.Type = t
+			found = true
+		}
+	}
+	if !found {
+		errs = append(errs, ValidationError{Field: "time", Message: fmt.Sprintf("unknown shift type %q", shift.Time)})
+	}
+
+	if err := validateSkills(shift.Skills); err != nil {
+		errs = append(errs, ValidationError{Field: "skills", Message: "must not contain blank skills"})
+	} else if shift.Skills != nil {
+		input.Skills = mergeSkills(shift.Skills)
+	}
+
+	for i, item := range shift.Search {
+		if selected, _ := item["selected"].(bool); !selected {
+			continue
+		}
+		name, _ := item["name"].(string)
+		if !isShiftType(types, name) {
+			errs = append(errs, ValidationError{Field: fmt.Sprintf("search[%d].name", i), Message: fmt.Sprintf("unknown shift type %q", name)})
+			continue
+		}
+		input.Searched = append(input.Searched, name)
+	}
+
+	for i, target := range shift.Targets {
+		field := fmt.Sprintf("targets[%d]", i)
+		from, err := time.Parse(dateLayout, target.From)
+		if err != nil {
+			errs = append(errs, ValidationError{Field: field + ".from", Message: "must be an ISO 8601 date"})
+			continue
+		}
+		if target.To != "" {
+			to, err := time.Parse(dateLayout, target.To)
+			if err != nil {
+				errs = append(errs, ValidationError{Field: field + ".to", Message: "must be an ISO 8601 date"})
+			} else if to.Before(from) {
+				errs = append(errs, ValidationError{Field: field + ".to", Message: "must not be before from"})
+			}
+		}
+		for j, name := range target.Times {
+			if !isShiftType(types, name) {
+				errs = append(errs, ValidationError{Field: fmt.Sprintf("%s.times[%d]", field, j), Message: fmt.Sprintf("unknown shift type %q", name)})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	input.StartsAt, input.EndsAt = shiftTimes(input.Date, input.Type)
+	return input, nil
+}
+
+// writeValidationErrors writes a 422 response listing all rejected fields
+func writeValidationErrors(w http.ResponseWriter, errs []ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Validation failed",
+		"errors":  errs,
+	})
+	if err != nil {
+		return
+	}
+}
+
+// isPastAllowed reports whether the principal may create or edit shifts
+// dated before today
+func isPastAllowed(principal *Principal) bool {
+	return principal.can(permShiftsManage)
+}
+
+// keepSkills drops the skills of a shift update unless the principal manages
+// shifts, the stored requirements are kept then so an employee cannot lift
+// them before trading the shift away
+func keepSkills(principal *Principal, input *ShiftInput) {
+	if !principal.can(permShiftsManage) {
+		input.Skills = nil
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages exchanged with dashboards over /shifts/ws; the events of the hub
+// are forwarded with their own type
+const (
+	socketSubscribe   = "subscribe"   // client: watch dates or shift types
+	socketUnsubscribe = "unsubscribe" // client: stop watching dates or shift types
+	socketTrade       = "trade"       // client: offer a shift for trade or withdraw the offer
+	socketSubscribed  = "subscribed"  // server: the dates and shift types watched
+	socketResult      = "result"      // server: the shift updated by a trade intent
+	socketError       = "error"       // server: a request failed
+)
+
+const (
+	// socketMessageLimit is the size of the largest message a client may send
+	socketMessageLimit = 64 << 10
+	// socketWriteTimeout bounds the time a slow client may block a write
+	socketWriteTimeout = 10 * time.Second
+)
+
+// socketUpgrader keeps gorilla's origin check, handshakes from other sites
+// would otherwise ride on the session cookie
+var socketUpgrader = websocket.Upgrader{}
+
+// SocketRequest is a message sent by a dashboard
+type SocketRequest struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref,omitempty"` // echoed in the reply
+	// subscribe and unsubscribe
+	Dates      []string `json:"dates,omitempty"`
+	ShiftTypes []string `json:"shiftTypes,omitempty"`
+	// trade
+	Uid     string        `json:"uid,omitempty"`
+	Trade   *bool         `json:"trade,omitempty"` // defaults to offering the shift
+	Search  []string      `json:"search,omitempty"`
+	Targets []TradeTarget `json:"targets,omitempty"`
+}
+
+// SocketMessage is a message sent to a dashboard
+type SocketMessage struct {
+	Type string      `json:"type"`
+	Ref  string      `json:"ref,omitempty"`
+	Data interface{} `json:"data"`
+}
+
+// socketFailure is the data of an error message
+type socketFailure struct {
+	Status     int               `json:"status"`
+	Message    string            `json:"message"`
+	Conflict   string            `json:"conflict,omitempty"`
+	Errors     []ValidationError `json:"errors,omitempty"`
+	Violations []RuleViolation   `json:"violations,omitempty"`
+}
+
+// dashboardSocket is the connection of a dashboard and what it watches
+type dashboardSocket struct {
+	app       *App
+	r         *http.Request
+	principal *Principal
+	conn      *websocket.Conn
+	teams     []string // the teams whose offers are counted
+	dates     map[string]bool
+	types     map[string]bool
+	// sent holds the offer counts last sent per team and date, counts are
+	// only sent again once they change
+	sent map[string]map[string]int
+}
+
+// Dashboard socket handler for /shifts/ws. Dashboards subscribe to dates or
+// shift types, receive their offer counts as they change together with the
+// events of their shifts and trades, and send trade intents.
+func (app *App) socketHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := requirePermission(w, r, permShiftsRead)
+	if !ok {
+		return
+	}
+	if app.Events == nil {
+		writeMessage(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	subscriber, err := app.newEventSubscriber(r, principal)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, "Failed to get teams")
+		return
+	}
+
+	// Upgrade replies to failed handshakes itself
+	conn, err := socketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	unsubscribe := app.Events.subscribe(subscriber)
+	defer unsubscribe()
+
+	socket := &dashboardSocket{
+		app:       app,
+		r:         r,
+		principal: principal,
+		conn:      conn,
+		teams:     []string{""},
+		dates:     make(map[string]bool),
+		types:     make(map[string]bool),
+		sent:      make(map[string]map[string]int),
+	}
+	for team := range subscriber.teams {
+		socket.teams = append(socket.teams, team)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	requests := socket.readRequests(done)
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	expired := time.NewTimer(time.Until(principal.Expires))
+	defer expired.Stop()
+	for {
+		select {
+		case request, ok := <-requests:
+			if !ok {
+				return
+			}
+			err = socket.handle(request)
+		case event := <-subscriber.events:
+			err = socket.forward(event)
+		case <-keepAlive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteTimeout))
+		case <-expired.C:
+			closing := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired")
+			_ = conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(socketWriteTimeout))
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readRequests reads the client's messages until the connection fails; a
+// client that answers no ping within two keep-alive intervals is dropped
+func (s *dashboardSocket) readRequests(done <-chan struct{}) <-chan []byte {
+	requests := make(chan []byte)
+	s.conn.SetReadLimit(socketMessageLimit)
+	_ = s.conn.SetReadDeadline(time.Now().Add(2 * eventKeepAlive))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(2 * eventKeepAlive))
+	})
+	go func() {
+		defer close(requests)
+		for {
+			_, message, err := s.conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case requests <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return requests
+}
+
+// send writes a message to the client
+func (s *dashboardSocket) send(message SocketMessage) error {
+	err := s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteJSON(message)
+}
+
+// fail answers a request with an error
+func (s *dashboardSocket) fail(ref string, failure socketFailure) error {
+	return s.send(SocketMessage{Type: socketError, Ref: ref, Data: failure})
+}
+
+// handle answers a client message; only failures to write end the connection
+func (s *dashboardSocket) handle(message []byte) error {
+	var request SocketRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		return s.fail("", socketFailure{Status: http.StatusBadRequest, Message: "Invalid request payload"})
+	}
+	switch request.Type {
+	case socketSubscribe, socketUnsubscribe:
+		return s.subscribe(request)
+	case socketTrade:
+		return s.trade(request)
+	default:
+		return s.fail(request.Ref, socketFailure{Status: http.StatusBadRequest, Message: fmt.Sprintf("Unknown message type %q", request.Type)})
+	}
+}
+
+// subscribe adds or removes watched dates and shift types and sends the
+// current offer counts of newly watched dates
+func (s *dashboardSocket) subscribe(request SocketRequest) error {
+	types, err := s.app.Store.ShiftTypes()
+	if err != nil {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusInternalServerError, Message: "Failed to get shift types"})
+	}
+
+	var errs []ValidationError
+	dates := make([]string, 0, len(request.Dates))
+	for i, value := range request.Dates {
+		date, err := parseDate(value)
+		if err != nil {
+			errs = append(errs, ValidationError{Field: fmt.Sprintf("dates[%d]", i), Message: "must be an ISO 8601 date"})
+			continue
+		}
+		dates = append(dates, formatDate(date))
+	}
+	for i, name := range request.ShiftTypes {
+		if !isShiftType(types, name) {
+			errs = append(errs, ValidationError{Field: fmt.Sprintf("shiftTypes[%d]", i), Message: fmt.Sprintf("unknown shift type %q", name)})
+		}
+	}
+	if errs != nil {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusUnprocessableEntity, Message: "Validation failed", Errors: errs})
+	}
+
+	watch := request.Type == socketSubscribe
+	for _, date := range dates {
+		if watch {
+			s.dates[date] = true
+			continue
+		}
+		delete(s.dates, date)
+		for _, team := range s.teams {
+			delete(s.sent, team+"/"+date)
+		}
+	}
+	for _, name := range request.ShiftTypes {
+		if watch {
+			s.types[name] = true
+		} else {
+			delete(s.types, name)
+		}
+	}
+
+	subscribed := map[string][]string{"dates": {}, "shiftTypes": {}}
+	for date := range s.dates {
+		subscribed["dates"] = append(subscribed["dates"], date)
+	}
+	for name := range s.types {
+		subscribed["shiftTypes"] = append(subscribed["shiftTypes"], name)
+	}
+	sort.Strings(subscribed["dates"])
+	sort.Strings(subscribed["shiftTypes"])
+	err = s.send(SocketMessage{Type: socketSubscribed, Ref: request.Ref, Data: subscribed})
+	if err != nil || !watch {
+		return err
+	}
+
+	// Watching other shift types changes the counts of every watched date
+	if len(request.ShiftTypes) > 0 {
+		dates = dates[:0]
+		for date := range s.dates {
+			dates = append(dates, date)
+		}
+	}
+	for _, date := range dates {
+		for _, team := range s.teams {
+			err := s.sendOffers(date, team, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// watches reports whether the client subscribed to the slot; an empty
+// shift type matches every watched type
+func (s *dashboardSocket) watches(date, shiftType string) bool {
+	if len(s.dates) == 0 && len(s.types) == 0 {
+		return false
+	}
+	if len(s.dates) > 0 && !s.dates[date] {
+		return false
+	}
+	return shiftType == "" || len(s.types) == 0 || s.types[shiftType]
+}
+
+// sendOffers sends the offer counts of the watched shift types on a date,
+// unless they are unchanged since they were last sent
+func (s *dashboardSocket) sendOffers(date, team string, always bool) error {
+	counts, err := s.app.store(s.r).CountOffers(date, team)
+	if err != nil {
+		return s.fail("", socketFailure{Status: http.StatusInternalServerError, Message: "Failed to count offers"})
+	}
+	offers := make(map[string]int, len(counts))
+	for name, count := range counts {
+		if len(s.types) == 0 || s.types[name] {
+			offers[name] = count
+		}
+	}
+
+	key := team + "/" + date
+	if sent, ok := s.sent[key]; ok && !always && sameCounts(sent, offers) {
+		return nil
+	}
+	s.sent[key] = offers
+	return s.send(SocketMessage{Type: eventOffers, Data: map[string]interface{}{
+		"datum":  date,
+		"team":   team,
+		"offers": offers,
+	}})
+}
+
+// sameCounts reports whether two offer counts are equal
+func sameCounts(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, count := range a {
+		if b[name] != count {
+			return false
+		}
+	}
+	return true
+}
+
+// eventSlot is the part of an event's data that locates it
+type eventSlot struct {
+	Datum string     `json:"datum"`
+	Time  string     `json:"time"`
+	Team  string     `json:"team"`
+	Shift *eventSlot `json:"shift"`
+}
+
+// forward passes a hub event on if it concerns a watched slot; offer events
+// are replaced by the recounted offers, trade events are always passed on
+func (s *dashboardSocket) forward(event Event) error {
+	var slot eventSlot
+	if err := json.Unmarshal(event.Data, &slot); err != nil {
+		return nil
+	}
+	if slot.Shift != nil {
+		slot = *slot.Shift
+	}
+
+	if event.Type == eventOffers {
+		if !s.watches(slot.Datum, "") {
+			return nil
+		}
+		return s.sendOffers(slot.Datum, slot.Team, false)
+	}
+	if event.Type != eventTrade && !s.watches(slot.Datum, slot.Time) {
+		return nil
+	}
+	return s.send(SocketMessage{Type: event.Type, Data: event.Data})
+}
+
+// trade applies a trade intent like PATCH /shifts/{id} with the shift's
+// date, time and team left as stored
+func (s *dashboardSocket) trade(request SocketRequest) error {
+	if !s.principal.can(permShiftsTrade) {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusForbidden, Message: "Forbidden"})
+	}
+	stored, err := s.app.store(s.r).GetShift(s.principal.shiftScope(), request.Uid)
+	if err != nil {
+		status, message := patchFailure(&shiftPatch{message: "Failed to get shift"}, err)
+		return s.fail(request.Ref, socketFailure{Status: status, Message: message})
+	}
+	types, err := s.app.Store.ShiftTypes()
+	if err != nil {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusInternalServerError, Message: "Failed to get shift types"})
+	}
+
+	shift := ShiftReceive{
+		Datum:   formatDate(stored.Date),
+		Time:    stored.Time,
+		Trade:   request.Trade == nil || *request.Trade,
+		Team:    stored.Team,
+		Targets: request.Targets,
+	}
+	for _, name := range request.Search {
+		shift.Search = append(shift.Search, map[string]interface{}{"name": name, "selected": true})
+	}
+	input, errs := parseShift(shift, types, time.Now(), isPastAllowed(s.principal))
+	if errs == nil {
+		input.Team, errs, err = s.app.resolveShiftTeam(s.r, s.principal, shift.Team, false)
+	}
+	if err != nil {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusInternalServerError, Message: "Failed to get team"})
+	}
+	if errs != nil {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusUnprocessableEntity, Message: "Validation failed", Errors: errs})
+	}
+
+	patch, err := s.app.patchShift(s.r, s.principal, stored.ID, input)
+	if patch.conflict != nil {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusConflict, Message: shiftConflictMessage(patch.conflict), Conflict: patch.conflict.ID})
+	}
+	if patch.violations != nil {
+		return s.fail(request.Ref, socketFailure{Status: http.StatusUnprocessableEntity, Message: "Working time rules violated", Violations: patch.violations})
+	}
+	if err != nil {
+		status, message := patchFailure(patch, err)
+		return s.fail(request.Ref, socketFailure{Status: status, Message: message})
+	}
+	return s.send(SocketMessage{Type: socketResult, Ref: request.Ref, Data: patch.shift(stored.ID, input, types)})
+}